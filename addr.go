@@ -0,0 +1,178 @@
+package curvecp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// The base32 alphabet used by DJB's tools, notably for keys in DNS
+// names.
+const base32Alphabet = "0123456789bcdfghjklmnpqrstuvwxyz"
+
+// ErrNoHostnameKey is returned when a host name doesn't embed a
+// server key, see KeyFromHostname.
+var ErrNoHostnameKey = errors.New("no server key in host name")
+
+// A Listener is a net.Listener for CurveCP connections.
+type Listener interface {
+	net.Listener
+	// PublicKey returns the server's long-term public key, which
+	// clients need to connect.
+	PublicKey() []byte
+	// Fingerprint returns a short printable digest of PublicKey, for
+	// people to compare.
+	Fingerprint() string
+	// AcceptCurveCP is like Accept, without hiding the connection's
+	// type.
+	AcceptCurveCP() (*Conn, error)
+	// SetDeadline sets the time after which pending and future
+	// Accepts fail with an error wrapping os.ErrDeadlineExceeded, like
+	// net.TCPListener.SetDeadline. The zero time means no deadline.
+	SetDeadline(t time.Time) error
+	// Shutdown closes the listener gracefully: it stops accepting new
+	// connections, waits for the established ones to close, then
+	// releases the socket. If ctx is done first, the remaining
+	// connections are aborted, and Shutdown returns ctx.Err().
+	Shutdown(ctx context.Context) error
+	// Handle returns a listener for the connections whose clients
+	// request domain, ignoring case and any protocol, see
+	// SplitProtocolDomain. They're no longer returned by Accept. The
+	// listener has a backlog of its own, of Config.AcceptBacklog,
+	// and closing it hands domain back to Accept. Handle panics if
+	// domain already has a listener.
+	Handle(domain string) net.Listener
+}
+
+// Addr is the address of a CurveCP server: where it listens, and its
+// long-term public key. UDP is nil for servers on other transports,
+// see ListenPacketConn.
+type Addr struct {
+	UDP *net.UDPAddr
+	Key []byte
+}
+
+func (a *Addr) Network() string {
+	return "curvecp"
+}
+
+// String returns the address in the form
+// curvecp://<key>@<host>:<port>, with the key in DJB's base32.
+func (a *Addr) String() string {
+	return "curvecp://" + encodeKey(a.Key) + "@" + a.UDP.String()
+}
+
+// ResolveAddr returns the address of the CurveCP server at raddr, a
+// host name and port, taking the server's key from the host name, see
+// KeyFromHostname.
+func ResolveAddr(raddr string) (*Addr, error) {
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	key, err := KeyFromHostname(host)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Addr{udp, key}, nil
+}
+
+// KeyFromHostname extracts a server's public key from its host name,
+// following DJB's convention of naming servers like
+// uz5<key>.example.com, with the key in 51 characters of base32. The
+// first label of that form, in any case, is used.
+func KeyFromHostname(host string) ([]byte, error) {
+	for _, label := range strings.Split(host, ".") {
+		if len(label) != 54 || !strings.EqualFold(label[:3], "uz5") {
+			continue
+		}
+		if key := decodeKey(strings.ToLower(label[3:])); key != nil {
+			return key, nil
+		}
+	}
+	return nil, ErrNoHostnameKey
+}
+
+// KeyLabel returns the DNS label embedding a server's public key, for
+// naming the server like <label>.example.com, see KeyFromHostname.
+func KeyLabel(key []byte) string {
+	return "uz5" + encodeKey(key)
+}
+
+// Fingerprint returns a short printable digest of a public key, in
+// the style of OpenSSH.
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// encodeKey returns the 51 character base32 form of a public key, the
+// one that follows "uz5" in DNS names. Curve25519 public keys are
+// less than 2^255, the last bit isn't encoded.
+func encodeKey(key []byte) string {
+	s := encodeBase32(key)
+	return s[:51]
+}
+
+// encodeBase32 encodes b in DJB's base32: 5 bits at a time, least
+// significant first.
+func encodeBase32(b []byte) string {
+	out := make([]byte, 0, (len(b)*8+4)/5)
+	v, bits := 0, 0
+	for _, c := range b {
+		v |= int(c) << bits
+		bits += 8
+		for bits >= 5 {
+			out = append(out, base32Alphabet[v&31])
+			v >>= 5
+			bits -= 5
+		}
+	}
+	if bits > 0 {
+		out = append(out, base32Alphabet[v&31])
+	}
+	return string(out)
+}
+
+// decodeKey decodes the 51 character base32 form of a public key.
+// Returns nil if s isn't one.
+func decodeKey(s string) []byte {
+	if len(s) != 51 {
+		return nil
+	}
+	// Put back the last bit, see encodeKey.
+	return decodeBase32(s + "0")
+}
+
+// decodeBase32 decodes s from DJB's base32. Returns nil if it has
+// characters outside the alphabet, or bits set past the last full
+// byte.
+func decodeBase32(s string) []byte {
+	out := make([]byte, 0, len(s)*5/8)
+	v, bits := 0, 0
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base32Alphabet, s[i])
+		if d < 0 {
+			return nil
+		}
+		v |= d << bits
+		bits += 5
+		if bits >= 8 {
+			out = append(out, byte(v))
+			v >>= 8
+			bits -= 8
+		}
+	}
+	if v != 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestEncodeBase32(t *testing.T) {
+	for _, tc := range []struct {
+		in   []byte
+		want string
+	}{
+		{nil, ""},
+		{[]byte{0}, "00"},
+		{[]byte{0xff}, "z7"},
+		{[]byte{0x01, 0x02}, "1j00"},
+	} {
+		if got := encodeBase32(tc.in); got != tc.want {
+			t.Errorf("encodeBase32(%x) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestKeyFromHostname(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	pub[31] &= 0x7f
+	enc := encodeKey(pub[:])
+	for _, host := range []string{
+		"uz5" + enc + ".example.com",
+		"www.UZ5" + strings.ToUpper(enc) + ".example.com",
+		KeyLabel(pub[:]) + ".example.com",
+	} {
+		if key, err := KeyFromHostname(host); err != nil || !bytes.Equal(key, pub[:]) {
+			t.Errorf("KeyFromHostname(%q) = %x, %v, want %x", host, key, err, pub[:])
+		}
+	}
+	for _, host := range []string{
+		"example.com",
+		"uz5" + enc[1:] + ".example.com",
+		"uz5" + enc[:50] + "a.example.com",
+	} {
+		if _, err := KeyFromHostname(host); err != ErrNoHostnameKey {
+			t.Errorf("KeyFromHostname(%q) = %v, want ErrNoHostnameKey", host, err)
+		}
+	}
+}
+
+func TestDialHostnameKey(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	if pub[31]&0x80 != 0 {
+		t.Skip("public key too large for a host name")
+	}
+	l := serveEcho(t, "127.0.0.1:0", priv[:], nil)
+	// Resolvers don't look up IP addresses, this only needs to
+	// look like a name.
+	raddr := net.JoinHostPort("uz5"+encodeKey(pub[:])+".localhost", fmt.Sprint(l.Addr().(*Addr).UDP.Port))
+	addr, err := ResolveAddr(raddr)
+	if err != nil {
+		t.Skip("can't resolve localhost names:", err)
+	}
+	if !bytes.Equal(addr.Key, pub[:]) {
+		t.Errorf("ResolveAddr(%q) key = %x, want %x", raddr, addr.Key, pub[:])
+	}
+	c, err := Dial(raddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, c, c, 5000)
+}
+
+func TestListenerIdentity(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(l.PublicKey(), pub[:]) {
+		t.Errorf("PublicKey() = %x, want %x", l.PublicKey(), pub[:])
+	}
+	if l.Fingerprint() != Fingerprint(pub[:]) || !strings.HasPrefix(l.Fingerprint(), "SHA256:") {
+		t.Errorf("Fingerprint() = %q", l.Fingerprint())
+	}
+	addr := l.Addr().(*Addr)
+	want := "curvecp://" + encodeKey(pub[:]) + "@" + addr.UDP.String()
+	if addr.String() != want || addr.Network() != "curvecp" {
+		t.Errorf("Addr() = %s %q, want curvecp %q", addr.Network(), addr, want)
+	}
+	if full := encodeBase32(pub[:]); len(encodeKey(pub[:])) != 51 || full[51:] != "0" {
+		t.Errorf("public key %x encodes to %q, last bit not clear", pub[:], full)
+	}
+}
@@ -0,0 +1,49 @@
+package curvecp
+
+import (
+	"net"
+	"time"
+)
+
+// LatencyAlarm watches a connection's smoothed RTT and
+// retransmission rate, and calls Func when either goes over its
+// limit. It fires again only after the connection has gone back
+// under the limits.
+type LatencyAlarm struct {
+	// RTT, if nonzero, is the highest acceptable smoothed RTT.
+	RTT time.Duration
+	// RetransmitRate, if nonzero, is the highest acceptable fraction
+	// of data transmissions that are retransmissions, averaged over
+	// recent transmissions.
+	RetransmitRate float64
+	// Func is called in its own goroutine with the connection and
+	// its current RTT and retransmission rate.
+	Func func(c net.Conn, rtt time.Duration, retransmitRate float64)
+}
+
+type alarmState struct {
+	LatencyAlarm
+	raised bool
+}
+
+// AddLatencyAlarm starts watching the connection with a. Alarms for
+// every connection can be set in Config.LatencyAlarms.
+func (c *Conn) AddLatencyAlarm(a LatencyAlarm) {
+	select {
+	case c.alarmRequest <- a:
+	case <-c.done:
+	}
+}
+
+// checkAlarms fires alarms whose limits have just been crossed.
+func (c *Conn) checkAlarms() {
+	rtt := c.sched.RTT()
+	for i := range c.alarms {
+		a := &c.alarms[i]
+		over := (a.RTT > 0 && rtt > a.RTT) || (a.RetransmitRate > 0 && c.retransmitRate > a.RetransmitRate)
+		if over && !a.raised {
+			go a.Func(c, rtt, c.retransmitRate)
+		}
+		a.raised = over
+	}
+}
@@ -0,0 +1,68 @@
+package curvecp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLatencyAlarm(t *testing.T) {
+	fired := make(chan time.Duration, 10)
+	server, _ := newConnPair(t, &Config{
+		LatencyAlarms: []LatencyAlarm{{
+			RTT:  100 * time.Millisecond,
+			Func: func(c net.Conn, rtt time.Duration, rate float64) { fired <- rtt },
+		}},
+	})
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case <-fired:
+			if !want {
+				t.Errorf("alarm fired unexpectedly")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Errorf("alarm didn't fire")
+			}
+		}
+	}
+
+	chicago(server).rttAverage = 50 * time.Millisecond
+	server.checkAlarms()
+	expect(false)
+
+	chicago(server).rttAverage = 200 * time.Millisecond
+	server.checkAlarms()
+	expect(true)
+	// Still over, no new alarm.
+	server.checkAlarms()
+	expect(false)
+
+	// Under, then over again.
+	chicago(server).rttAverage = 50 * time.Millisecond
+	server.checkAlarms()
+	chicago(server).rttAverage = 200 * time.Millisecond
+	server.checkAlarms()
+	expect(true)
+}
+
+func TestRetransmitRateAlarm(t *testing.T) {
+	fired := make(chan float64, 10)
+	server, _ := newConnPair(t, nil)
+	server.alarms = append(server.alarms, alarmState{LatencyAlarm: LatencyAlarm{
+		RetransmitRate: 0.5,
+		Func:           func(c net.Conn, rtt time.Duration, rate float64) { fired <- rate },
+	}})
+
+	server.retransmitRate = 0.6
+	server.checkAlarms()
+	select {
+	case rate := <-fired:
+		if rate != 0.6 {
+			t.Errorf("alarm fired with rate %f, want 0.6", rate)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("alarm didn't fire")
+	}
+}
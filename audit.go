@@ -0,0 +1,61 @@
+package curvecp
+
+import (
+	"net"
+	"strconv"
+)
+
+// A HandshakeFailure is a reason a server rejects a packet from a
+// client it isn't connected to yet, see Config.OnHandshakeFailure.
+type HandshakeFailure int
+
+const (
+	// HandshakeMalformed is a packet of no known type, or of the
+	// wrong length for its type.
+	HandshakeMalformed HandshakeFailure = iota
+	// HandshakeBadHello is a Hello not boxed to any of the server's
+	// long-term keys, or with a nonzero plaintext.
+	HandshakeBadHello
+	// HandshakeBadCookie is an Initiate whose Cookie isn't sealed
+	// under either of the server's minute keys, usually because it
+	// expired, or isn't the client's.
+	HandshakeBadCookie
+	// HandshakeBadInitiate is an Initiate whose box doesn't open
+	// with the short-term keys.
+	HandshakeBadInitiate
+	// HandshakeBadVouch is an Initiate whose vouch doesn't prove the
+	// client holds the secret of its long-term key.
+	HandshakeBadVouch
+	// HandshakeBadDomain is an Initiate requesting no domain, a
+	// protocol the server doesn't accept, see Config.Protocols, or a
+	// domain the key it was vouched under doesn't serve, see
+	// Config.VirtualHosts.
+	HandshakeBadDomain
+
+	numHandshakeFailures = iota
+)
+
+var handshakeFailureNames = [...]string{
+	HandshakeMalformed:   "malformed packet",
+	HandshakeBadHello:    "bad Hello box",
+	HandshakeBadCookie:   "bad or expired Cookie",
+	HandshakeBadInitiate: "bad Initiate box",
+	HandshakeBadVouch:    "bad vouch",
+	HandshakeBadDomain:   "bad domain",
+}
+
+func (f HandshakeFailure) String() string {
+	if f >= 0 && int(f) < len(handshakeFailureNames) {
+		return handshakeFailureNames[f]
+	}
+	return "HandshakeFailure(" + strconv.Itoa(int(f)) + ")"
+}
+
+// handshakeFailed counts a packet from addr rejected for failure, and
+// reports it to Config.OnHandshakeFailure.
+func (s *server) handshakeFailed(failure HandshakeFailure, addr net.Addr) {
+	s.handshakeFailures[failure]++
+	if f := s.config.onHandshakeFailure(); f != nil {
+		f(failure, addr)
+	}
+}
@@ -0,0 +1,71 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestHandshakeFailures(t *testing.T) {
+	failures := make(chan HandshakeFailure, 100)
+	addr, key := listenEcho(t, &Config{
+		Protocols: []string{"echo"},
+		OnHandshakeFailure: func(failure HandshakeFailure, addr net.Addr) {
+			failures <- failure
+		},
+	})
+	expect := func(want HandshakeFailure) {
+		t.Helper()
+		select {
+		case got := <-failures:
+			if got != want {
+				t.Errorf("handshake failure %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no handshake failure, want %q", want)
+		}
+		// Retransmissions fail the same way.
+		for len(failures) > 0 {
+			if got := <-failures; got != want {
+				t.Errorf("handshake failure %q, want %q", got, want)
+			}
+		}
+	}
+
+	sock, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	sock.Write(make([]byte, 100))
+	expect(HandshakeMalformed)
+
+	otherKey, _, _ := box.GenerateKey(rand.Reader)
+	d := Dialer{Config: &Config{HelloAttempts: 1, HandshakeTimeout: 200 * time.Millisecond}}
+	if c, err := d.Dial(addr, otherKey[:]); err == nil {
+		c.Abort()
+		t.Fatal("Dial with the wrong server key succeeded")
+	}
+	expect(HandshakeBadHello)
+
+	d = Dialer{Domain: ProtocolDomain("example.com", "other")}
+	c, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	c.Write([]byte("hi"))
+	expect(HandshakeBadDomain)
+}
+
+func TestHandshakeFailureString(t *testing.T) {
+	if s := HandshakeBadVouch.String(); s != "bad vouch" {
+		t.Errorf("HandshakeBadVouch.String() = %q", s)
+	}
+	if s := HandshakeFailure(-1).String(); s != "HandshakeFailure(-1)" {
+		t.Errorf("unknown failure's String() = %q", s)
+	}
+}
@@ -0,0 +1,256 @@
+package curvecp
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+var (
+	// ErrUnauthorized is returned by authorizers for keys they don't
+	// let in.
+	ErrUnauthorized = errors.New("client key not authorized")
+	// errLookupPending is returned by a CachedAuthorizer while it
+	// looks up a key it doesn't know yet.
+	errLookupPending = errors.New("client key lookup in progress")
+	// errLookupsBusy is returned by a CachedAuthorizer for a key it
+	// doesn't know while maxAuthLookups lookups are in progress.
+	errLookupsBusy = errors.New("too many client key lookups in progress")
+)
+
+// maxAuthLookups is the most lookups a CachedAuthorizer runs at once.
+const maxAuthLookups = 64
+
+// An Authorizer decides which client keys a server lets in. Its
+// Authorize method is meant for Config.VerifyPeer.
+type Authorizer interface {
+	Authorize(key [32]byte, domain string, addr net.Addr) error
+}
+
+// A KeySet is an Authorizer letting in the client keys it holds. Keys
+// may be added and removed while it is in use. The zero value is an
+// empty set.
+type KeySet struct {
+	mu   sync.RWMutex
+	keys map[[32]byte]bool
+}
+
+// NewKeySet returns a set holding keys.
+func NewKeySet(keys ...[32]byte) *KeySet {
+	s := &KeySet{}
+	for _, k := range keys {
+		s.Add(k)
+	}
+	return s
+}
+
+// LoadKeyDir returns a set of the client keys in dir, one per entry,
+// the way servers are commonly given their clients' keys: a file of
+// 32 bytes, like a copy of a client's publickey, or of 64 hexadecimal
+// digits, or a key directory as made by curvecpmakekey, see package
+// keys. Hidden entries are skipped.
+func LoadKeyDir(dir string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &KeySet{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		var key []byte
+		if e.IsDir() {
+			key, err = keys.ReadPublic(name)
+		} else {
+			key, err = readKeyFile(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var k [32]byte
+		copy(k[:], key)
+		s.Add(k)
+	}
+	return s, nil
+}
+
+// readKeyFile reads a public key, raw or in hexadecimal.
+func readKeyFile(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	if key, err := hex.DecodeString(string(bytes.TrimSpace(b))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("not a public key")}
+}
+
+// Add lets key in.
+func (s *KeySet) Add(key [32]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[[32]byte]bool)
+	}
+	s.keys[key] = true
+}
+
+// Remove stops letting key in. Connections already established with
+// it are not affected.
+func (s *KeySet) Remove(key [32]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
+
+// Contains returns true if key is in the set.
+func (s *KeySet) Contains(key [32]byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[key]
+}
+
+// Len returns the number of keys in the set.
+func (s *KeySet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Authorize returns ErrUnauthorized if key isn't in the set.
+func (s *KeySet) Authorize(key [32]byte, domain string, addr net.Addr) error {
+	if !s.Contains(key) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// A KeyLookup asks an external service, like a database or a
+// directory server, whether a client key may connect.
+type KeyLookup interface {
+	LookupKey(key [32]byte) (allowed bool, err error)
+}
+
+// A CachedAuthorizer is an Authorizer asking a KeyLookup about the
+// keys it doesn't know, and remembering the answers in a bounded LRU
+// cache for a while.
+//
+// Servers authorize clients from their packet loop, which can't wait
+// for a lookup. An unknown client is turned away while its key is
+// looked up in the background, and let in when it sends its Initiate
+// again, which clients keep doing until they hear from the server.
+// Up to 64 keys are looked up at once, clients with other unknown keys
+// are turned away without a lookup until one finishes.
+type CachedAuthorizer struct {
+	// Clock, if not nil, replaces the system clock for expiring
+	// answers. It must be set before the authorizer is used.
+	Clock Clock
+
+	lookup KeyLookup
+	max    int
+	ttl    time.Duration
+
+	mu sync.Mutex
+	// Most recently used first.
+	lru     *list.List // of *authEntry
+	entries map[[32]byte]*list.Element
+	// Keys being looked up, at most maxAuthLookups.
+	pending map[[32]byte]bool
+}
+
+type authEntry struct {
+	key     [32]byte
+	allowed bool
+	expires time.Time
+}
+
+// NewCachedAuthorizer returns an authorizer asking lookup, and caching
+// up to max answers, at least 1, for ttl each. Failed lookups aren't
+// cached.
+func NewCachedAuthorizer(lookup KeyLookup, max int, ttl time.Duration) *CachedAuthorizer {
+	if max < 1 {
+		max = 1
+	}
+	return &CachedAuthorizer{
+		lookup:  lookup,
+		max:     max,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+		pending: make(map[[32]byte]bool),
+	}
+}
+
+// Authorize returns nil if the cached answer for key allows it, and
+// ErrUnauthorized if it doesn't. Without an answer, it starts a
+// lookup if there's room for one, and returns an error.
+func (a *CachedAuthorizer) Authorize(key [32]byte, domain string, addr net.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.entries[key]; ok {
+		entry := e.Value.(*authEntry)
+		if a.clock().Now().Before(entry.expires) {
+			a.lru.MoveToFront(e)
+			if !entry.allowed {
+				return ErrUnauthorized
+			}
+			return nil
+		}
+		delete(a.entries, key)
+		a.lru.Remove(e)
+	}
+	if a.pending[key] {
+		return errLookupPending
+	}
+	if len(a.pending) >= maxAuthLookups {
+		return errLookupsBusy
+	}
+	a.pending[key] = true
+	go a.fetch(key)
+	return errLookupPending
+}
+
+// fetch looks key up, and caches the answer.
+func (a *CachedAuthorizer) fetch(key [32]byte) {
+	allowed, err := a.lookup.LookupKey(key)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, key)
+	if err != nil {
+		return
+	}
+	var entry *authEntry
+	if a.lru.Len() >= a.max {
+		// Recycle the least recently used entry.
+		e := a.lru.Back()
+		entry = e.Value.(*authEntry)
+		delete(a.entries, entry.key)
+		a.lru.Remove(e)
+	} else {
+		entry = new(authEntry)
+	}
+	entry.key, entry.allowed, entry.expires = key, allowed, a.clock().Now().Add(a.ttl)
+	a.entries[key] = a.lru.PushFront(entry)
+}
+
+func (a *CachedAuthorizer) clock() Clock {
+	if a.Clock == nil {
+		return systemClock{}
+	}
+	return a.Clock
+}
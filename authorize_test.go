@@ -0,0 +1,196 @@
+package curvecp
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+func TestKeySet(t *testing.T) {
+	a, b := [32]byte{1}, [32]byte{2}
+	s := NewKeySet(a)
+	if s.Authorize(a, "", nil) != nil || s.Authorize(b, "", nil) != ErrUnauthorized {
+		t.Errorf("set of a doesn't let in exactly a")
+	}
+	s.Add(b)
+	s.Remove(a)
+	if s.Authorize(a, "", nil) != ErrUnauthorized || s.Authorize(b, "", nil) != nil || s.Len() != 1 {
+		t.Errorf("after swapping a for b, the set doesn't let in exactly b")
+	}
+	var zero KeySet
+	if zero.Authorize(a, "", nil) != ErrUnauthorized {
+		t.Errorf("empty set lets a in")
+	}
+}
+
+func TestLoadKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	raw, hexKey := [32]byte{1}, [32]byte{2}
+	os.WriteFile(filepath.Join(dir, "alice"), raw[:], 0644)
+	os.WriteFile(filepath.Join(dir, "bob"), []byte(hex.EncodeToString(hexKey[:])+"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, ".hidden"), []byte("not a key"), 0644)
+	kp, err := keys.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Write(filepath.Join(dir, "carol"), kp); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadKeyDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 || !s.Contains(raw) || !s.Contains(hexKey) || !s.Contains(kp.Public) {
+		t.Errorf("loaded %d keys, want the raw, hex and keypair ones", s.Len())
+	}
+
+	os.WriteFile(filepath.Join(dir, "dave"), []byte("short"), 0644)
+	if _, err := LoadKeyDir(dir); err == nil {
+		t.Errorf("LoadKeyDir with a bad key file succeeded")
+	}
+}
+
+// mapLookup is a KeyLookup answering from a map, counting lookups.
+type mapLookup struct {
+	mu      sync.Mutex
+	allowed map[[32]byte]bool
+	lookups int
+	err     error
+}
+
+func (m *mapLookup) LookupKey(key [32]byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups++
+	return m.allowed[key], m.err
+}
+
+// authorizeEventually retries Authorize like a client resending its
+// Initiate, until the lookup is done.
+func authorizeEventually(a Authorizer, key [32]byte) error {
+	for i := 0; i < 100; i++ {
+		if err := a.Authorize(key, "", nil); err != errLookupPending {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return errLookupPending
+}
+
+func TestCachedAuthorizer(t *testing.T) {
+	a, b, c := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	lookup := &mapLookup{allowed: map[[32]byte]bool{a: true, c: true}}
+	auth := NewCachedAuthorizer(lookup, 2, time.Hour)
+
+	if err := auth.Authorize(a, "", nil); err != errLookupPending {
+		t.Errorf("unknown key authorized right away: %v", err)
+	}
+	if err := authorizeEventually(auth, a); err != nil {
+		t.Errorf("allowed key: %v", err)
+	}
+	if err := authorizeEventually(auth, b); err != ErrUnauthorized {
+		t.Errorf("denied key: %v, want ErrUnauthorized", err)
+	}
+	if lookup.lookups != 2 {
+		t.Errorf("%d lookups for 2 keys", lookup.lookups)
+	}
+
+	// c evicts a, the least recently used.
+	authorizeEventually(auth, c)
+	auth.Authorize(b, "", nil)
+	if err := authorizeEventually(auth, a); err != nil || lookup.lookups != 4 {
+		t.Errorf("evicted key: %v after %d lookups, want nil after 4", err, lookup.lookups)
+	}
+
+	// Failures aren't cached.
+	lookup.err = errors.New("unreachable")
+	auth = NewCachedAuthorizer(lookup, 2, time.Hour)
+	if err := authorizeEventually(auth, a); err != errLookupPending {
+		t.Errorf("key with failing lookups: %v", err)
+	}
+}
+
+func TestCachedAuthorizerExpiry(t *testing.T) {
+	a := [32]byte{1}
+	lookup := &mapLookup{allowed: map[[32]byte]bool{a: true}}
+	auth := NewCachedAuthorizer(lookup, 2, time.Minute)
+	clock := newFakeClock()
+	auth.Clock = clock
+	if err := authorizeEventually(auth, a); err != nil {
+		t.Fatalf("allowed key: %v", err)
+	}
+
+	clock.Advance(time.Minute - 1)
+	if err := auth.Authorize(a, "", nil); err != nil || lookup.lookups != 1 {
+		t.Errorf("key before its answer expired: %v after %d lookups, want nil after 1", err, lookup.lookups)
+	}
+	clock.Advance(1)
+	if err := auth.Authorize(a, "", nil); err != errLookupPending {
+		t.Errorf("key once its answer expired: %v, want errLookupPending", err)
+	}
+	if err := authorizeEventually(auth, a); err != nil || lookup.lookups != 2 {
+		t.Errorf("key looked up again: %v after %d lookups, want nil after 2", err, lookup.lookups)
+	}
+}
+
+// blockingLookup is a KeyLookup that doesn't answer until release is
+// closed, except about the keys in free.
+type blockingLookup struct {
+	release chan struct{}
+	free    map[[32]byte]bool
+}
+
+func (b *blockingLookup) LookupKey(key [32]byte) (bool, error) {
+	if !b.free[key] {
+		<-b.release
+	}
+	return true, nil
+}
+
+func TestCachedAuthorizerBusy(t *testing.T) {
+	known := [32]byte{2, 2}
+	lookup := &blockingLookup{release: make(chan struct{}), free: map[[32]byte]bool{known: true}}
+	auth := NewCachedAuthorizer(lookup, 1000, time.Hour)
+	clock := newFakeClock()
+	auth.Clock = clock
+	if err := authorizeEventually(auth, known); err != nil {
+		t.Fatalf("known key: %v", err)
+	}
+	for i := 0; i < maxAuthLookups; i++ {
+		if err := auth.Authorize([32]byte{byte(i)}, "", nil); err != errLookupPending {
+			t.Fatalf("key %d: %v, want errLookupPending", i, err)
+		}
+	}
+	// No more lookups until one finishes, for new keys or again for
+	// pending ones.
+	busy := [32]byte{1, 1}
+	if err := auth.Authorize(busy, "", nil); err != errLookupsBusy {
+		t.Errorf("key past the limit: %v, want errLookupsBusy", err)
+	}
+	if err := auth.Authorize([32]byte{0}, "", nil); err != errLookupPending {
+		t.Errorf("pending key: %v, want errLookupPending", err)
+	}
+	// Cached answers still count, until they expire.
+	if err := auth.Authorize(known, "", nil); err != nil {
+		t.Errorf("cached key: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if err := auth.Authorize(known, "", nil); err != errLookupsBusy {
+		t.Errorf("key whose answer expired: %v, want errLookupsBusy", err)
+	}
+
+	close(lookup.release)
+	if err := authorizeEventually(auth, [32]byte{0}); err != nil {
+		t.Errorf("key looked up: %v", err)
+	}
+	if err := authorizeEventually(auth, busy); err != nil {
+		t.Errorf("key turned away before: %v", err)
+	}
+}
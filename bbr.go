@@ -0,0 +1,207 @@
+package curvecp
+
+import "time"
+
+const (
+	// Pacing gain while looking for the bottleneck bandwidth, 2/ln 2:
+	// the highest that still lets the bandwidth estimate keep up.
+	bbrStartupGain = 2.89
+	// Bandwidth samples the max filter remembers, one per round
+	// trip.
+	bbrBandwidthWindow = 10
+	// How long a min RTT sample stays valid.
+	bbrMinRTTWindow = 10 * time.Second
+	// Pacing before the first RTT sample.
+	bbrInitialInterval = 10 * time.Millisecond
+	// Blocks per RTT between the first RTT sample and the first
+	// bandwidth sample.
+	bbrInitialBlocks = 10
+	// Least retransmission timeout. Over short paths, scheduling
+	// delays at the peer would otherwise look like losses, and soon
+	// like a dead peer.
+	bbrMinRTO = 200 * time.Millisecond
+	// Least time spent in ProbeRTT, and its pacing gain.
+	bbrProbeRTTTime = 200 * time.Millisecond
+	bbrProbeRTTGain = 0.5
+)
+
+// Pacing gains of the ProbeBW cycle, one phase per min RTT: probe for
+// more bandwidth, drain the queue that made, then cruise.
+var bbrProbeGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// Phases of a bbr controller.
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbr is a model-based congestion controller in the style of BBR: it
+// estimates the bottleneck bandwidth and the round trip time of the
+// empty path, and paces at the bandwidth, periodically probing for
+// more. Without a congestion window, it tells how much is queued from
+// the RTT: Drain lasts until the RTT is back near the minimum, and
+// ProbeRTT slows down every bbrMinRTTWindow to measure it afresh.
+//
+// Unlike Chicago, it neither backs off when the RTT cycles nor reacts
+// to losses, which suits bulk transfers over long fat networks, at
+// the cost of some queueing on shared ones.
+type bbr struct {
+	phase int
+	// Current pacing gain, and where the ProbeBW cycle is.
+	gain       float64
+	cycle      int
+	cycleStart time.Time
+
+	// Bandwidth samples, in bytes per second, of the last
+	// bbrBandwidthWindow rounds, and the max filter over them.
+	samples [bbrBandwidthWindow]float64
+	next    int
+	bw      float64
+	// Bytes acknowledged in the current round, and when it started.
+	roundBytes int
+	roundStart time.Time
+	// Startup ends once the bandwidth stops growing by 25% for 3
+	// rounds.
+	fullBW       float64
+	fullBWRounds int
+
+	// Lowest RTT seen recently, and when. The last sample.
+	minRTT     time.Duration
+	minRTTTime time.Time
+	lastRTT    time.Duration
+	// When ProbeRTT ends.
+	probeRTTEnd time.Time
+	// Smoothed RTT and mean deviation, for the retransmission
+	// timeout.
+	srtt, rttVar time.Duration
+}
+
+// NewBBR returns a controller that paces at the measured bottleneck
+// bandwidth, in the style of BBR. Use it, through
+// Config.CongestionControl, for bulk transfers on paths where
+// Chicago is too conservative.
+func NewBBR() CongestionController {
+	return &bbr{phase: bbrStartup, gain: bbrStartupGain}
+}
+
+func (b *bbr) OnRTT(now time.Time, rtt time.Duration) {
+	if b.srtt == 0 {
+		b.srtt, b.rttVar = rtt, rtt/2
+	} else {
+		delta := rtt - b.srtt
+		b.srtt += delta / 8
+		b.rttVar += (abs(delta) - b.rttVar) / 4
+	}
+	b.lastRTT = rtt
+	if b.minRTT == 0 || rtt <= b.minRTT {
+		b.minRTT, b.minRTTTime = rtt, now
+	}
+	switch {
+	case b.phase == bbrProbeRTT && !now.Before(b.probeRTTEnd):
+		b.phase, b.cycle, b.cycleStart = bbrProbeBW, 0, now
+		b.gain = bbrProbeGains[0]
+	case b.phase == bbrProbeBW && now.Sub(b.minRTTTime) > bbrMinRTTWindow:
+		// Let the queue drain, and take whatever the RTT then is
+		// as the new minimum.
+		b.phase, b.gain = bbrProbeRTT, bbrProbeRTTGain
+		b.probeRTTEnd = now.Add(bbrProbeRTTTime + b.minRTT)
+		b.minRTT, b.minRTTTime = 0, now
+	}
+}
+
+func (b *bbr) OnAck(now time.Time, n int) {
+	if b.roundStart.IsZero() {
+		b.roundStart = now
+	}
+	b.roundBytes += n
+	// A round lasts one min RTT, the time for the bandwidth to show
+	// in acknowledgments.
+	elapsed := now.Sub(b.roundStart)
+	if b.minRTT == 0 || elapsed < b.minRTT {
+		return
+	}
+	b.addSample(float64(b.roundBytes) / elapsed.Seconds())
+	b.roundBytes, b.roundStart = 0, now
+	b.advance(now)
+}
+
+// addSample records a round's bandwidth sample, and updates the max
+// filter.
+func (b *bbr) addSample(bw float64) {
+	b.samples[b.next] = bw
+	b.next = (b.next + 1) % len(b.samples)
+	b.bw = 0
+	for _, s := range b.samples {
+		if s > b.bw {
+			b.bw = s
+		}
+	}
+}
+
+// advance moves through the phases, once per round.
+func (b *bbr) advance(now time.Time) {
+	switch b.phase {
+	case bbrStartup:
+		if b.bw >= b.fullBW*1.25 {
+			b.fullBW, b.fullBWRounds = b.bw, 0
+			return
+		}
+		if b.fullBWRounds++; b.fullBWRounds >= 3 {
+			b.phase, b.gain = bbrDrain, 1/bbrStartupGain
+		}
+	case bbrDrain:
+		// Until the queue Startup built is gone.
+		if b.lastRTT > b.minRTT*5/4 {
+			return
+		}
+		b.phase = bbrProbeBW
+		b.cycle, b.cycleStart = 0, now
+		b.gain = bbrProbeGains[0]
+	case bbrProbeBW:
+		if now.Sub(b.cycleStart) >= b.minRTT {
+			b.cycle = (b.cycle + 1) % len(bbrProbeGains)
+			b.cycleStart = now
+			b.gain = bbrProbeGains[b.cycle]
+		}
+	}
+}
+
+// OnLoss does nothing, losses don't say much about the bandwidth.
+func (b *bbr) OnLoss(now time.Time) {}
+
+func (b *bbr) NextSendTime(last time.Time) time.Time {
+	return last.Add(b.interval())
+}
+
+// interval returns the time between blocks at the current pacing
+// rate.
+func (b *bbr) interval() time.Duration {
+	switch {
+	case b.bw > 0:
+		return time.Duration(float64(maxMessageData) / (b.gain * b.bw) * float64(time.Second))
+	case b.minRTT > 0:
+		return b.minRTT / bbrInitialBlocks
+	}
+	return bbrInitialInterval
+}
+
+func (b *bbr) RTO() time.Duration {
+	if b.srtt == 0 {
+		return time.Second
+	}
+	rto := b.srtt + 4*b.rttVar + 8*b.interval()
+	if rto < bbrMinRTO {
+		rto = bbrMinRTO
+	}
+	return rto
+}
+
+func (b *bbr) RTT() time.Duration {
+	return b.srtt
+}
+
+func (b *bbr) RTTVar() time.Duration {
+	return b.rttVar
+}
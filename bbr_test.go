@@ -0,0 +1,68 @@
+package curvecp
+
+import (
+	"testing"
+	"time"
+)
+
+// simulateBottleneck runs cc over a simulated path with the given
+// bottleneck bandwidth, in bytes per second, and RTT, with the sender
+// always having data, for d of simulated time.
+func simulateBottleneck(cc CongestionController, bandwidth float64, rtt, d time.Duration) {
+	type inflight struct{ sent, acked time.Time }
+	start := time.Unix(0, 0)
+	perBlock := time.Duration(float64(maxMessageData) / bandwidth * float64(time.Second))
+	var acks []inflight
+	var lastSend, linkFree time.Time
+	for now := start; now.Sub(start) < d; {
+		send := cc.NextSendTime(lastSend)
+		if send.Before(now) {
+			send = now
+		}
+		if len(acks) > 0 && !acks[0].acked.After(send) {
+			a := acks[0]
+			acks = acks[1:]
+			now = a.acked
+			cc.OnRTT(now, now.Sub(a.sent))
+			cc.OnAck(now, maxMessageData)
+			continue
+		}
+		now, lastSend = send, send
+		// Queued behind earlier blocks at the bottleneck.
+		arrive := now.Add(rtt / 2)
+		if arrive.Before(linkFree) {
+			arrive = linkFree
+		}
+		linkFree = arrive.Add(perBlock)
+		acks = append(acks, inflight{now, linkFree.Add(rtt / 2)})
+	}
+}
+
+func TestBBRFindsBandwidth(t *testing.T) {
+	const bandwidth = 2e6
+	rtt := 100 * time.Millisecond
+	cc := NewBBR().(*bbr)
+	simulateBottleneck(cc, bandwidth, rtt, 30*time.Second)
+
+	if cc.phase != bbrProbeBW {
+		t.Errorf("still in phase %d after 30s", cc.phase)
+	}
+	if cc.bw < 0.8*bandwidth || cc.bw > 1.3*bandwidth {
+		t.Errorf("estimated bandwidth %.0f, want about %.0f", cc.bw, float64(bandwidth))
+	}
+	if cc.minRTT < rtt || cc.minRTT > rtt+10*time.Millisecond {
+		t.Errorf("min RTT %s, want about %s", cc.minRTT, rtt)
+	}
+	// Pacing at the bandwidth keeps the queue short.
+	if cc.srtt > 2*rtt {
+		t.Errorf("smoothed RTT %s, the queue keeps growing", cc.srtt)
+	}
+}
+
+func TestBBRTransfer(t *testing.T) {
+	server, client := newConnPair(t, &Config{CongestionControl: NewBBR})
+	startConnPair(server, client)
+
+	testTransfer(t, client, server, 300*1024)
+	testTransfer(t, server, client, 300*1024)
+}
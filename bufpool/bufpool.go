@@ -0,0 +1,64 @@
+// Package bufpool recycles byte buffers of a fixed size, such as those
+// packets are read into and built in, on top of sync.Pool.
+//
+// A buffer from Get belongs to the caller until it hands it back with
+// Put or PutZeroed, or hands it on to another owner along with the
+// duty to do so. Once a buffer is back, neither it nor any slice of it
+// may be used anymore, by anyone. Any buffer of the Pool's size may be
+// put back, wherever it comes from, and buffers of other capacities
+// are dropped.
+//
+// Buffers aren't cleared on the way in or out: Get returns buffers
+// holding whatever their last owner left in them. Those that held
+// secrets, keys or plaintext, go back with PutZeroed, which clears them
+// first, so that the secrets don't outlive their owner.
+package bufpool
+
+import "sync"
+
+// A Pool is a pool of buffers of a given size. It is safe for
+// concurrent use.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// New returns a pool of buffers of size bytes.
+func New(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Size returns the size of p's buffers.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer of p's size, and capacity, with unspecified
+// contents.
+func (p *Pool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put hands buf back to p, if its capacity is p's size.
+func (p *Pool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// PutZeroed clears buf, all of its capacity, and hands it back to p
+// like Put.
+func (p *Pool) PutZeroed(buf []byte) {
+	buf = buf[:cap(buf)]
+	for i := range buf {
+		buf[i] = 0
+	}
+	p.Put(buf)
+}
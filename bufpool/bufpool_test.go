@@ -0,0 +1,59 @@
+package bufpool
+
+import (
+	"testing"
+)
+
+func checkLen(t *testing.T, p []byte) {
+	if len(p) != 10 {
+		t.Errorf("len(p) = %d, want 10", len(p))
+	}
+	if cap(p) != 10 {
+		t.Errorf("cap(p) = %d, want 10", cap(p))
+	}
+}
+
+func TestPool(t *testing.T) {
+	p := New(10)
+	if p.Size() != 10 {
+		t.Errorf("Size() = %d, want 10", p.Size())
+	}
+
+	// Are the buffers well formed, even truncated ones put back?
+	b := p.Get()
+	checkLen(t, b)
+	p.Put(b[:5])
+	checkLen(t, p.Get())
+
+	// Slices of the wrong capacity are dropped, not handed out.
+	p.Put(make([]byte, 20))
+	p.Put(make([]byte, 10)[5:])
+	for i := 0; i < 10; i++ {
+		checkLen(t, p.Get())
+	}
+}
+
+func TestPutZeroed(t *testing.T) {
+	p := New(10)
+	b := p.Get()
+	for i := range b {
+		b[i] = 42
+	}
+	// All of the capacity is cleared, beyond the length.
+	p.PutZeroed(b[:5])
+	for i, x := range b {
+		if x != 0 {
+			t.Fatalf("b[%d] = %d after PutZeroed, want 0", i, x)
+		}
+	}
+}
+
+func BenchmarkPool(b *testing.B) {
+	p := New(1280)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Put(p.Get())
+		}
+	})
+}
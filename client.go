@@ -0,0 +1,638 @@
+package curvecp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/bufpool"
+	"github.com/johnwchadwick/curvecp/handshake"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Hello packets are retransmitted Config.HelloAttempts times before
+// giving up, starting with this timeout, which grows per
+// Config.HandshakeBackoff.
+const helloTimeout = time.Second
+
+var (
+	// ErrHandshakeTimeout is returned by Dial when the server never
+	// answered the Hello packets.
+	ErrHandshakeTimeout net.Error = &timeoutError{"handshake timed out"}
+
+	errInvalidDomain = errors.New("domain name can't be encoded in an Initiate")
+)
+
+// A Dialer contains options for connecting to CurveCP servers. The
+// zero value is usable: it dials with a fresh random identity and the
+// default configuration, from a new UDP socket for every connection.
+type Dialer struct {
+	// Key is the client's long-term secret key, i.e. its identity as
+	// seen by servers. If nil, every connection uses a new random
+	// key.
+	Key []byte
+
+	// Domain is the domain name requested from the server. If empty,
+	// the host part of the dialed address is used.
+	Domain string
+
+	// Config tunes the connections. May be nil.
+	Config *Config
+
+	// ShareSocket makes all the connections from this Dialer, to any
+	// number of servers, use a single local UDP socket, instead of
+	// one socket each. The socket is closed along with the last
+	// connection using it, and the next Dial opens a new one.
+	//
+	// Packets are routed to connections by client extension alone,
+	// which the Dialer picks at random for each connection, not by
+	// server address and extension as the reference client does: a
+	// packet carrying a connection's extension reaches it from any
+	// address, and only failing to authenticate gets it dropped.
+	ShareSocket bool
+
+	// ServerExtension is put in every packet to the server, for
+	// whatever sits in front of it to route them by, see Dispatcher.
+	ServerExtension [16]byte
+
+	// ClientExtension is put in every packet to the server, which
+	// echoes it back, for applications to carry an identifier in,
+	// see Conn.Extensions. Under ShareSocket, the Dialer picks the
+	// client extension itself, and ClientExtension is ignored.
+	ClientExtension [16]byte
+
+	// Relay, if not empty, is the address of a UDP relay through
+	// which all packets are sent, for networks from which servers
+	// can't be reached directly. See relayConn for what the relay
+	// must do.
+	Relay string
+
+	// The shared socket, while any connection uses it.
+	mu     sync.Mutex
+	shared *clientMux
+}
+
+// Dial connects to the CurveCP server at raddr, whose long-term public
+// key is serverKey, with a fresh random identity and the default
+// configuration. It is the client counterpart of Listen.
+func Dial(raddr string, serverKey []byte) (*Conn, error) {
+	var d Dialer
+	return d.Dial(raddr, serverKey)
+}
+
+// DialTimeout is like Dial, but gives up if the handshake doesn't
+// complete within timeout.
+func DialTimeout(raddr string, serverKey []byte, timeout time.Duration) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var d Dialer
+	return d.DialContext(ctx, raddr, serverKey)
+}
+
+// Dial connects to the CurveCP server at raddr, whose long-term public
+// key is serverKey. If serverKey is nil, it's taken from the host name
+// in raddr, see KeyFromHostname.
+//
+// Dial returns once the server has answered the client's Hello. Until
+// the server answers again, written data travels in Initiate packets
+// alongside the rest of the handshake, up to 592 bytes at a time, so a
+// request written right away costs no extra round trip.
+func (d *Dialer) Dial(raddr string, serverKey []byte) (*Conn, error) {
+	return d.DialContext(context.Background(), raddr, serverKey)
+}
+
+// DialContext is like Dial, but gives up on the handshake when ctx is
+// done, returning an error that wraps ctx.Err(). Once the connection
+// is established, ctx has no effect on it.
+func (d *Dialer) DialContext(ctx context.Context, raddr string, serverKey []byte) (*Conn, error) {
+	return d.dial(ctx, raddr, "", serverKey, d.Key)
+}
+
+// DialUDPConn is similar to Dial, but talks to the server at raddr
+// over an already existing net.UDPConn, which the connection then
+// owns. sock is closed if the handshake fails.
+//
+// It is the counterpart of ListenUDPConn: the main use is to first
+// execute a NAT-busting protocol on the UDPConn, and then use CurveCP
+// to communicate with the peer.
+func DialUDPConn(sock *net.UDPConn, raddr net.Addr, serverKey []byte) (*Conn, error) {
+	var d Dialer
+	return d.DialUDPConn(sock, raddr, serverKey)
+}
+
+// DialUDPConn is like the DialUDPConn function, but with the Dialer's
+// key, domain and configuration. ShareSocket and Relay don't apply.
+func (d *Dialer) DialUDPConn(sock *net.UDPConn, raddr net.Addr, serverKey []byte) (*Conn, error) {
+	return d.DialPacketConn(sock, raddr, serverKey)
+}
+
+// DialPacketConn is like DialUDPConn, but over any net.PacketConn, for
+// transports other than UDP, see ListenPacketConn.
+func DialPacketConn(sock net.PacketConn, raddr net.Addr, serverKey []byte) (*Conn, error) {
+	var d Dialer
+	return d.DialPacketConn(sock, raddr, serverKey)
+}
+
+// DialPacketConn is like the DialPacketConn function, but with the
+// Dialer's key, domain and configuration. Without a Domain, the host
+// part of raddr is requested, or all of it if it has no port.
+func (d *Dialer) DialPacketConn(sock net.PacketConn, raddr net.Addr, serverKey []byte) (*Conn, error) {
+	if len(serverKey) != 32 {
+		panic("Wrong key length")
+	}
+	domain := d.Domain
+	if domain == "" {
+		domain = raddr.String()
+		if host, _, err := net.SplitHostPort(domain); err == nil {
+			domain = host
+		}
+	}
+	sock.SetDeadline(time.Time{})
+	c, err := d.dialMux(context.Background(), newClientMux(sock), []net.Addr{raddr}, serverKey, d.Key, domain)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial is DialContext with the given client long-term secret key, or
+// a random one if nil, requesting domain if not empty instead of the
+// Dialer's.
+func (d *Dialer) dial(ctx context.Context, raddr, domain string, serverKey, clientKey []byte) (*Conn, error) {
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	if serverKey == nil {
+		if serverKey, err = KeyFromHostname(host); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "curvecp", Err: err}
+		}
+	}
+	if len(serverKey) != 32 {
+		panic("Wrong key length")
+	}
+	addrs, err := resolveAll(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if domain == "" {
+		domain = d.Domain
+	}
+	if domain == "" {
+		domain = host
+	}
+	mux, err := d.mux()
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.dialMux(ctx, mux, addrs, serverKey, clientKey, domain)
+	if err != nil {
+		d.release(mux)
+	}
+	return c, err
+}
+
+// resolveAll returns all the UDP addresses of raddr, a host and port.
+func resolveAll(ctx context.Context, raddr string) ([]net.Addr, error) {
+	host, service, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return []net.Addr{&net.UDPAddr{Port: port}}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.Addr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+	}
+	return addrs, nil
+}
+
+// dialMux connects over mux to the server, reachable at any of addrs,
+// and starts the resulting conn. Closing the conn releases the
+// caller's reference to mux.
+func (d *Dialer) dialMux(ctx context.Context, mux *clientMux, addrs []net.Addr, serverKey, clientKey []byte, domain string) (*Conn, error) {
+	encodedDomain := handshake.EncodeDomain(domain)
+	if encodedDomain == nil {
+		return nil, &net.OpError{Op: "dial", Net: "curvecp", Addr: addrs[0], Err: errInvalidDomain}
+	}
+	if timeout := d.Config.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	c, err := d.handshake(ctx, mux, addrs, serverKey, clientKey, domain, encodedDomain)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "curvecp", Addr: addrs[0], Err: err}
+	}
+	c.onClose = func() {
+		mux.unroute(c.client.ext)
+		d.release(mux)
+	}
+	go c.pump()
+	return c, nil
+}
+
+// mux returns the socket to dial from: the shared one, or a new one.
+// The caller must release it when done.
+func (d *Dialer) mux() (*clientMux, error) {
+	if !d.ShareSocket {
+		return d.listen()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.shared != nil {
+		d.shared.refs++
+		return d.shared, nil
+	}
+	var err error
+	if d.shared, err = d.listen(); err != nil {
+		return nil, err
+	}
+	return d.shared, nil
+}
+
+// release drops a reference to mux, closing its socket, which stops
+// its goroutines, with the last one.
+func (d *Dialer) release(mux *clientMux) {
+	d.mu.Lock()
+	mux.refs--
+	last := mux.refs == 0
+	if last && d.shared == mux {
+		d.shared = nil
+	}
+	d.mu.Unlock()
+	if last {
+		mux.sock.Close()
+	}
+}
+
+// clientState is what a client conn keeps to be able to handshake
+// again with the same identity, see Config.RehandshakeThreshold.
+type clientState struct {
+	serverKey                        [32]byte
+	longTermKey, longTermSecretKey   [32]byte
+	shortTermKey, shortTermSecretKey [32]byte
+	ext                              [16]byte
+	serverExt                        [16]byte
+	// The requested domain, encoded for the Initiate.
+	domain []byte
+
+	// While probing the server with Hellos: the short-term key pair
+	// they carry, how many have been sent, and when to send the next
+	// one. helloAt is zero when not probing.
+	probeKey, probeSecretKey [32]byte
+	hellos                   int
+	helloAt                  time.Time
+	// When probing started.
+	probeStart time.Time
+	// Whether the server answered a probe while data was in flight,
+	// see handleCookie.
+	answered bool
+}
+
+// handshake exchanges Hello and Cookie packets with the server, and
+// returns a conn ready to send its first messages in Initiate
+// packets. The caller must start the conn's pump. It gives up with
+// ctx.Err() when ctx is done.
+//
+// Hellos go to each of addrs in turn, a round of them taking about as
+// long as a single Hello's timeout, and the conn talks to the address
+// that answered first.
+func (d *Dialer) handshake(ctx context.Context, mux *clientMux, addrs []net.Addr, serverKey, clientKey []byte, domain string, encodedDomain []byte) (*Conn, error) {
+	cs := &clientState{domain: encodedDomain, ext: d.ClientExtension, serverExt: d.ServerExtension}
+	copy(cs.serverKey[:], serverKey)
+	if clientKey != nil {
+		if len(clientKey) != 32 {
+			panic("Wrong key length")
+		}
+		copy(cs.longTermSecretKey[:], clientKey)
+		curve25519.ScalarBaseMult(&cs.longTermKey, &cs.longTermSecretKey)
+	} else {
+		cs.longTermKey, cs.longTermSecretKey = generateKey()
+	}
+	cs.shortTermKey, cs.shortTermSecretKey = generateKey()
+	start := d.Config.clock().Now()
+	var cookie [128]byte
+	addr, cookies, nonce, err := d.hello(ctx, mux, addrs, cs, cookie[:])
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Config.verifyPeer(serverKey, domain, addr); err != nil {
+		abandonCookies(mux, cs.ext, cookies)
+		return nil, err
+	}
+
+	c := newConn(mux.sock, addr, nil, true, cs.serverKey[:], cookie[:32], cs.shortTermSecretKey[:], domain, d.Config)
+	c.client = cs
+	c.bufs = mux.bufs
+	// The mux drops what doesn't fit, allow for as much as the
+	// server queues for a conn.
+	c.packetIn = make(chan packet, maxConnBacklog)
+	c.handshakeStart = start
+	c.initiate(cookie[:])
+	// One nonce counter for all packets under our short-term key.
+	c.nonce = nonce
+	mux.route(cs.ext, c.packetIn)
+	return c, nil
+}
+
+// hello sends Hellos from cs's short-term key to each of addrs in turn
+// until one of them answers with a Cookie, and puts its plaintext in
+// cookie. It returns the address that answered, the channel its
+// packets are routed to on mux, and the last nonce used.
+func (d *Dialer) hello(ctx context.Context, mux *clientMux, addrs []net.Addr, cs *clientState, cookie []byte) (net.Addr, chan packet, uint64, error) {
+	clock := d.Config.clock()
+	if d.ShareSocket {
+		randBytes(cs.ext[:])
+	}
+	cookies := make(chan packet, 4)
+	mux.route(cs.ext, cookies)
+
+	hello := make([]byte, 224)
+	var nonce uint64
+	backoff := d.Config.handshakeBackoff()
+	rng := mrand.New(mrand.NewSource(clock.Now().UnixNano()))
+	attempts := d.Config.helloAttempts() * len(addrs)
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			abandonCookies(mux, cs.ext, cookies)
+			return nil, nil, 0, err
+		}
+		if attempt == attempts {
+			abandonCookies(mux, cs.ext, cookies)
+			return nil, nil, 0, ErrHandshakeTimeout
+		}
+		nonce++
+		cs.sealHello(hello, &cs.shortTermKey, &cs.shortTermSecretKey, nonce)
+		mux.sock.WriteTo(hello, addrs[attempt%len(addrs)])
+
+		timeout := backoff.timeout(helloTimeout, attempt/len(addrs), rng) / time.Duration(len(addrs))
+		timer := clock.NewTimer(timeout)
+		addr := waitCookie(ctx, cookies, timer.C(), cs, cookie)
+		timer.Stop()
+		if addr != nil {
+			return addr, cookies, nonce, nil
+		}
+	}
+}
+
+// waitCookie waits for a valid Cookie packet on cookies until timeout
+// or ctx is done, and puts its plaintext in out. Returns the address
+// the Cookie came from, or nil if none came.
+func waitCookie(ctx context.Context, cookies <-chan packet, timeout <-chan time.Time, cs *clientState, out []byte) net.Addr {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case p := <-cookies:
+			ok := cs.openCookie(p.buf, out, &cs.shortTermSecretKey)
+			p.release()
+			if ok {
+				return p.Addr
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// abandonCookies stops routing packets to a handshake that gave up,
+// and releases the packets it didn't look at.
+func abandonCookies(mux *clientMux, clientExt [16]byte, cookies chan packet) {
+	mux.unroute(clientExt)
+	for {
+		select {
+		case p := <-cookies:
+			p.release()
+		default:
+			return
+		}
+	}
+}
+
+// sealHello fills hello, 224 bytes, with a Hello packet from the given
+// short-term key pair.
+func (cs *clientState) sealHello(hello []byte, shortTermKey, shortTermSecretKey *[32]byte, n uint64) {
+	handshake.SealHello(hello[:0], cs.serverExt, cs.ext, &cs.serverKey, shortTermKey, shortTermSecretKey, n)
+}
+
+// openCookie puts the plaintext of pb in out, 128 bytes, the server
+// short-term key and the cookie, if pb is a Cookie packet for the
+// given short-term key. Returns false if it isn't.
+func (cs *clientState) openCookie(pb, out []byte, shortTermSecretKey *[32]byte) bool {
+	if len(pb) != handshake.CookieLen || !bytes.Equal(pb[8:24], cs.ext[:]) {
+		return false
+	}
+	serverShortTermKey, cookie, err := handshake.OpenCookie(pb, &cs.serverKey, shortTermSecretKey)
+	if err != nil {
+		return false
+	}
+	copy(out, serverShortTermKey[:])
+	copy(out[32:], cookie[:])
+	return true
+}
+
+// initiate starts a session with the server short-term key and cookie
+// from the plaintext of a Cookie packet. Messages go in Initiate
+// packets until the server answers, see sendMessage. Everything but
+// the message is the same in all of them.
+func (c *Conn) initiate(cookie []byte) {
+	cs := c.client
+	c.header = make([]byte, 72)
+	copy(c.header, clientMessageMagic)
+	copy(c.header[8:], cs.serverExt[:])
+	copy(c.header[24:], cs.ext[:])
+	copy(c.header[40:], cs.shortTermKey[:])
+
+	var sealed handshake.Cookie
+	copy(sealed[:], cookie[32:])
+	c.initiateHeader = handshake.InitiateHeader(cs.serverExt, cs.ext, &cs.shortTermKey, &sealed)
+
+	var nonce [16]byte
+	c.config.longTermNonce(nonce[:])
+	c.initiatePrefix = handshake.InitiatePrefix(&cs.serverKey, &cs.longTermKey, &cs.longTermSecretKey, &cs.shortTermKey, &nonce, cs.domain)
+
+	var serverShortTermKey [32]byte
+	copy(serverShortTermKey[:], cookie[:32])
+	box.Precompute(&c.sharedKey, &serverShortTermKey, &cs.shortTermSecretKey)
+	c.localShortTermKey, c.peerShortTermKey = cs.shortTermKey, serverShortTermKey
+	c.handshakeEnd = time.Time{}
+	c.initiating = true
+}
+
+// probe sends Hellos while the server isn't answering, to find out
+// whether it is still up but has forgotten about us, e.g. because it
+// restarted. A Cookie in response means it has, see handleCookie.
+// Returns when to call probe again, or the zero time if the server
+// doesn't need probing.
+func (c *Conn) probe(now time.Time) time.Time {
+	cs := c.client
+	if max := c.config.rehandshakeThreshold(); max <= 0 || c.unanswered < max {
+		cs.helloAt, cs.hellos, cs.answered = time.Time{}, 0, false
+		return time.Time{}
+	}
+	if cs.answered {
+		return time.Time{}
+	}
+	if cs.helloAt.IsZero() {
+		cs.probeKey, cs.probeSecretKey = generateKey()
+		cs.helloAt, cs.probeStart = now, now
+	}
+	if !cs.helloAt.After(now) {
+		hello := c.bufs.Get()[:224]
+		c.nonce++
+		cs.sealHello(hello, &cs.probeKey, &cs.probeSecretKey, c.nonce)
+		c.sock.WriteTo(hello, c.addr)
+		c.bufs.Put(hello)
+		cs.helloAt = now.Add(c.config.handshakeBackoff().timeout(helloTimeout, cs.hellos, c.rand))
+		cs.hellos++
+	}
+	return cs.helloAt
+}
+
+// handleCookie processes a Cookie packet answering a probe: the
+// server is up, but lost the session, or is only slow to answer it.
+// If nothing is in flight either way, the conn starts a new session
+// under the probe's short-term key, with new streams picking up where
+// the old ones left off. Otherwise, a new session would lose data if
+// the server did lose the old one, and only spares the conn a wait if
+// not: the conn keeps waiting on the old session, and fails with
+// ErrSessionLost instead of ErrPeerDead if it never answers.
+func (c *Conn) handleCookie(pb []byte) {
+	cs := c.client
+	var cookie [128]byte
+	if cs.helloAt.IsZero() || !cs.openCookie(pb, cookie[:], &cs.probeSecretKey) {
+		return
+	}
+	cs.helloAt, cs.hellos = time.Time{}, 0
+	if c.toSend.Len() != 0 || len(c.recvRanges) != 0 || c.sendEOF != 0 || c.recvEOF != 0 {
+		cs.answered = true
+		return
+	}
+	cs.shortTermKey, cs.shortTermSecretKey = cs.probeKey, cs.probeSecretKey
+	c.handshakeStart = cs.probeStart
+	c.initiate(cookie[:])
+
+	c.sendPos, c.recvPos = 0, 0
+	c.recvNonce, c.recvWindow = 0, 0
+	c.ackNeeded, c.ackID = false, 0
+	c.keepaliveID = 0
+	c.unanswered = 0
+	// Introduce ourselves with a keepalive right away.
+	c.lastSend = time.Time{}
+}
+
+func generateKey() (publicKey, privateKey [32]byte) {
+	randBytes(privateKey[:])
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+	return publicKey, privateKey
+}
+
+// clientMux reads packets from a client socket, and routes them to the
+// handshakes and conns using the socket, by client extension.
+type clientMux struct {
+	sock net.PacketConn
+	// The buffers of the packets read from sock, and of those the
+	// conns send.
+	bufs *bufpool.Pool
+
+	mu sync.Mutex
+	// Neither handshakes, which can give up at any moment, nor conns
+	// behind on their packets are waited on: packets that don't fit
+	// in their channels are dropped.
+	routes map[[16]byte]chan packet
+
+	// The number of handshakes and conns using sock, guarded by the
+	// Dialer's mu.
+	refs int
+}
+
+// listen creates a new socket to dial from.
+func (d *Dialer) listen() (*clientMux, error) {
+	var relay *net.UDPAddr
+	if d.Relay != "" {
+		var err error
+		if relay, err = net.ResolveUDPAddr("udp", d.Relay); err != nil {
+			return nil, err
+		}
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.Config.setupSocket(udp); err != nil {
+		udp.Close()
+		return nil, err
+	}
+	var sock net.PacketConn = udp
+	if relay != nil {
+		sock = &relayConn{udp, relay, bufpool.New(packetSize)}
+	}
+	return newClientMux(sock), nil
+}
+
+// newClientMux starts routing the packets arriving on sock, with one
+// reference held by the caller.
+func newClientMux(sock net.PacketConn) *clientMux {
+	m := &clientMux{
+		sock:   sock,
+		bufs:   bufpool.New(packetSize),
+		routes: make(map[[16]byte]chan packet),
+		refs:   1,
+	}
+	packetIn := make(chan packet)
+	go func() {
+		readLoop(sock, m.bufs, packetIn, nil, nil, nil)
+		close(packetIn)
+	}()
+	go m.pump(packetIn)
+	return m
+}
+
+func (m *clientMux) route(clientExt [16]byte, ch chan packet) {
+	m.mu.Lock()
+	m.routes[clientExt] = ch
+	m.mu.Unlock()
+}
+
+func (m *clientMux) unroute(clientExt [16]byte) {
+	m.mu.Lock()
+	delete(m.routes, clientExt)
+	m.mu.Unlock()
+}
+
+func (m *clientMux) pump(packetIn <-chan packet) {
+	for p := range packetIn {
+		// Cookie and Message packets both carry the client extension
+		// right after the magic.
+		var clientExt [16]byte
+		copy(clientExt[:], p.buf[8:24])
+		m.mu.Lock()
+		ch, ok := m.routes[clientExt]
+		m.mu.Unlock()
+		if !ok {
+			p.release()
+			continue
+		}
+		select {
+		case ch <- p:
+		default:
+			p.release()
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package curvecp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/bufpool"
+	"github.com/johnwchadwick/curvecp/handshake"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// listenEcho starts a listener on loopback that echoes everything
+// back on every connection, and returns its address and public key.
+func listenEcho(t *testing.T, config *Config) (addr string, key []byte) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l := serveEcho(t, "127.0.0.1:0", priv[:], config)
+	return l.Addr().(*Addr).UDP.String(), pub[:]
+}
+
+// serveEcho listens on laddr with the secret key, and echoes
+// everything back on every connection.
+func serveEcho(t *testing.T, laddr string, key []byte, config *Config) Listener {
+	l, err := ListenWithConfig(laddr, key, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go echoAll(l)
+	return l
+}
+
+func TestDial(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	c, err := Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, c, c, 20*1024)
+
+	// Closing the connection releases its socket, once the server has
+	// closed too.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still running after both sides closed")
+	}
+	if err := c.sock.SetReadDeadline(time.Time{}); err == nil {
+		t.Errorf("the connection's socket is still open")
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", spriv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := l.AcceptCurveCP()
+		accepted <- c
+	}()
+
+	start := time.Now()
+	d := Dialer{Key: cpriv[:]}
+	c, err := d.Dial(l.Addr().(*Addr).UDP.String(), spub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("Accept failed")
+	}
+	defer s.Close()
+	if _, err := io.ReadFull(s, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// Once the server echoes, the client has heard from it.
+	s.Write([]byte("hi"))
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	cst := c.ConnectionState()
+	sst := s.ConnectionState()
+	if string(cst.PeerKey) != string(spub[:]) || string(sst.PeerKey) != string(cpub[:]) {
+		t.Errorf("peer keys aren't the other side's long-term keys")
+	}
+	if string(c.PeerKey()) != string(spub[:]) || string(s.PeerKey()) != string(cpub[:]) {
+		t.Errorf("PeerKey() isn't the other side's long-term key")
+	}
+	if cst.LocalShortTermKey != sst.PeerShortTermKey || cst.PeerShortTermKey != sst.LocalShortTermKey || cst.LocalShortTermKey == cst.PeerShortTermKey {
+		t.Errorf("short-term keys don't match: client %s and %s, server %s and %s", cst.LocalShortTermKey, cst.PeerShortTermKey, sst.LocalShortTermKey, sst.PeerShortTermKey)
+	}
+	if cst.HandshakeStart.Before(start) || cst.HandshakeEnd.Before(sst.HandshakeStart) || sst.HandshakeEnd.Before(cst.HandshakeStart) {
+		t.Errorf("handshake times: client %v to %v, server %v to %v", cst.HandshakeStart, cst.HandshakeEnd, sst.HandshakeStart, sst.HandshakeEnd)
+	}
+	if cst.RTT <= 0 {
+		t.Errorf("client RTT %s after an exchange", cst.RTT)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", spriv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := l.AcceptCurveCP()
+		accepted <- c
+	}()
+
+	d := Dialer{ClientExtension: [16]byte{1, 2, 3}, ServerExtension: [16]byte{4, 5, 6}}
+	c, err := d.Dial(l.Addr().(*Addr).UDP.String(), spub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("Accept failed")
+	}
+	defer s.Abort()
+	for side, conn := range map[string]*Conn{"client": c, "server": s} {
+		if ce, se := conn.Extensions(); ce != d.ClientExtension || se != d.ServerExtension {
+			t.Errorf("%s extensions %x and %x, want %x and %x", side, ce, se, d.ClientExtension, d.ServerExtension)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// A server that never answers.
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	key := make([]byte, 32)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var d Dialer
+	if _, err := d.DialContext(ctx, sock.LocalAddr().String(), key); !errors.Is(err, context.Canceled) {
+		t.Errorf("DialContext with a cancelled context = %v, want context.Canceled", err)
+	}
+
+	start := time.Now()
+	_, err = DialTimeout(sock.LocalAddr().String(), key, 100*time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialTimeout = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("DialTimeout took %s", d)
+	}
+
+	start = time.Now()
+	d = Dialer{Config: &Config{HandshakeTimeout: 100 * time.Millisecond}}
+	if _, err = d.Dial(sock.LocalAddr().String(), key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Dial with a HandshakeTimeout = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("HandshakeTimeout took %s", d)
+	}
+}
+
+func TestDialUDPConn(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialUDPConn(sock, raddr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LocalAddr().String() != sock.LocalAddr().String() {
+		t.Errorf("connection is on %s, not the given socket %s", c.LocalAddr(), sock.LocalAddr())
+	}
+	testTransfer(t, c, c, 20*1024)
+}
+
+func TestPacketConn(t *testing.T) {
+	mn := &memNet{socks: make(map[memAddr]*memSock)}
+	ssock := mn.listen("server")
+	defer ssock.Close()
+	csock := mn.listen("client")
+	defer csock.Close()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenPacketConn(ssock, priv[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	domains := make(chan string, 1)
+	go func() {
+		c, err := l.AcceptCurveCP()
+		if err != nil {
+			return
+		}
+		domains <- c.Domain()
+		io.Copy(c, c)
+		c.Close()
+	}()
+	if a := l.Addr().(*Addr); a.UDP != nil || string(a.Key) != string(pub[:]) {
+		t.Errorf("listener address %v", a)
+	}
+
+	c, err := DialPacketConn(csock, ssock.LocalAddr(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 20*1024)
+	if domain := <-domains; domain != "server" {
+		t.Errorf("client requested %q, want the whole address", domain)
+	}
+}
+
+func TestUDPConnWithConfig(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+	ssock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := make(chan string, 1)
+	l, err := ListenUDPConnWithConfig(ssock, spriv[:], &Config{
+		VerifyPeer: func(key [32]byte, domain string, addr net.Addr) error {
+			if key != *cpub {
+				return ErrUnauthorized
+			}
+			verified <- domain
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	csock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dialer{Key: cpriv[:], Domain: "example.com"}
+	c, err := d.DialUDPConn(csock, ssock.LocalAddr(), spub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, c, c, 5000)
+	if domain := <-verified; domain != "example.com" {
+		t.Errorf("server saw domain %q, want the Dialer's, example.com", domain)
+	}
+}
+
+func TestDialMultipleAddresses(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	live, _ := net.ResolveUDPAddr("udp", addr)
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	var d Dialer
+	mux, err := d.mux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.sock.Close()
+	c, err := d.dialMux(context.Background(), mux, []net.Addr{dead.LocalAddr(), live}, key, nil, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.addr.String() != live.String() {
+		t.Errorf("connection talks to %s, want the address that answered, %s", c.addr, live)
+	}
+	testTransfer(t, c, c, 5000)
+}
+
+func TestDialHelloAttempts(t *testing.T) {
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	hellos := make(chan int)
+	go func() {
+		n := 0
+		b := make([]byte, 1500)
+		dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := dead.ReadFrom(b); err != nil {
+				hellos <- n
+				return
+			}
+			n++
+			dead.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		}
+	}()
+
+	d := Dialer{Config: &Config{
+		HelloAttempts:    3,
+		HandshakeBackoff: Backoff{Max: 10 * time.Millisecond},
+	}}
+	if _, err := d.Dial(dead.LocalAddr().String(), make([]byte, 32)); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("Dial = %v, want ErrHandshakeTimeout", err)
+	}
+	if n := <-hellos; n != 3 {
+		t.Errorf("server got %d Hellos, want 3", n)
+	}
+}
+
+func TestDialZeroRTT(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	// Write before the pump starts, so that the very first Initiate
+	// carries data.
+	var d Dialer
+	mux, err := d.mux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.sock.Close()
+	addrs := []net.Addr{l.Addr().(*Addr).UDP}
+	c, err := d.handshake(context.Background(), mux, addrs, pub[:], nil, "example.com", handshake.EncodeDomain("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := c.write([]byte("GET /")); res.n != 5 {
+		t.Fatalf("write = %+v", res)
+	}
+	go c.pump()
+
+	s := (<-accepted).(*Conn)
+	if got := s.InitialData(); string(got) != "GET /" {
+		t.Errorf("InitialData = %q, want %q", got, "GET /")
+	}
+	// Without waiting for a retransmission.
+	s.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	b := make([]byte, 10)
+	if n, err := s.Read(b); string(b[:n]) != "GET /" || err != nil {
+		t.Errorf("first Read = %q, %v, want %q", b[:n], err, "GET /")
+	}
+}
+
+func TestDialSharedSocket(t *testing.T) {
+	addr1, key1 := listenEcho(t, nil)
+	addr2, key2 := listenEcho(t, nil)
+	d := Dialer{ShareSocket: true}
+
+	var wg sync.WaitGroup
+	locals := make([]net.Addr, 20)
+	for i := range locals {
+		addr, key := addr1, key1
+		if i%2 == 1 {
+			addr, key = addr2, key2
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := d.Dial(addr, key)
+			if err != nil {
+				t.Errorf("Dial: %s", err)
+				return
+			}
+			locals[i] = c.LocalAddr()
+			testTransfer(t, c, c, 5000)
+		}(i)
+	}
+	wg.Wait()
+	for _, a := range locals[1:] {
+		if a != nil && a.String() != locals[0].String() {
+			t.Errorf("connections use different sockets, %s and %s", a, locals[0])
+		}
+	}
+}
+
+func TestDialSharedSocketClose(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	d := Dialer{ShareSocket: true}
+	c1, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := c1.sock
+
+	// The socket outlives the first connection closed...
+	c1.Close()
+	testTransfer(t, c2, c2, 5000)
+
+	// ...and goes with the last one.
+	c2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		shared := d.shared
+		d.mu.Unlock()
+		if shared == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := sock.WriteTo([]byte("x"), c2.addr); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo on the shared socket after the last conn closed = %v, want net.ErrClosed", err)
+	}
+
+	c3, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	if c3.sock == sock {
+		t.Error("Dial after the last conn closed reused the closed socket")
+	}
+	testTransfer(t, c3, c3, 5000)
+}
+
+func TestClientMuxDrops(t *testing.T) {
+	m := &clientMux{bufs: bufpool.New(packetSize), routes: make(map[[16]byte]chan packet)}
+	stalled, live := make(chan packet, 1), make(chan packet, 1)
+	m.route([16]byte{1}, stalled)
+	m.route([16]byte{2}, live)
+	packetIn := make(chan packet)
+	go m.pump(packetIn)
+	defer close(packetIn)
+
+	// A conn that stopped reading doesn't hold up the others.
+	for _, ext := range []byte{1, 1, 1, 2} {
+		buf := m.bufs.Get()[:64]
+		copy(buf[8:], []byte{ext})
+		packetIn <- packet{nil, buf, m.bufs}
+	}
+	select {
+	case p := <-live:
+		p.release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not routed past a full conn")
+	}
+	if len(stalled) != 1 {
+		t.Errorf("%d packets queued for the stalled conn, want 1", len(stalled))
+	}
+}
+
+func TestSessionLost(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l := serveEcho(t, "127.0.0.1:0", priv[:], nil)
+	var d Dialer
+	c, err := d.Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testTransfer(t, c, c, 5000)
+
+	// Restart the server, and write before the client notices. The
+	// new server can't tell whether the old one had the data, the
+	// connection can't carry on.
+	l.(*server).sock.Close()
+	serveEcho(t, l.Addr().(*Addr).UDP.String(), priv[:], nil)
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 5)); err != ErrSessionLost {
+		t.Errorf("Read after the server restarted: %v, want ErrSessionLost", err)
+	}
+	if _, err := c.Write([]byte("hello")); err != ErrSessionLost {
+		t.Errorf("Write after the server restarted: %v, want ErrSessionLost", err)
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	allowed, allowedSecret, _ := box.GenerateKey(rand.Reader)
+	_, otherSecret, _ := box.GenerateKey(rand.Reader)
+	verified := make(chan string, 10)
+	addr, key := listenEcho(t, &Config{
+		VerifyPeer: func(key [32]byte, domain string, addr net.Addr) error {
+			if key != *allowed {
+				return errors.New("not allowed")
+			}
+			verified <- domain
+			return nil
+		},
+	})
+
+	// The server ignores clients it rejects.
+	d := Dialer{Key: otherSecret[:], Domain: "example.com"}
+	c, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody would acknowledge the end of the stream.
+	defer c.Abort()
+	c.Write([]byte("hi"))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 2)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rejected client's Read = %v, want no answer", err)
+	}
+
+	d = Dialer{Key: allowedSecret[:], Domain: "example.com"}
+	c, err = d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testTransfer(t, c, c, 5000)
+	if domain := <-verified; domain != "example.com" {
+		t.Errorf("VerifyPeer called with domain %q, want example.com", domain)
+	}
+
+	// Clients check servers too.
+	errPinned := errors.New("not the pinned server")
+	d = Dialer{Config: &Config{
+		VerifyPeer: func(k [32]byte, domain string, addr net.Addr) error {
+			if string(k[:]) != string(key) {
+				t.Errorf("VerifyPeer called with another key")
+			}
+			return errPinned
+		},
+	}}
+	if _, err := d.Dial(addr, key); !errors.Is(err, errPinned) {
+		t.Errorf("Dial with a failing VerifyPeer = %v, want its error", err)
+	}
+}
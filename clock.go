@@ -0,0 +1,66 @@
+package curvecp
+
+import "time"
+
+// A Clock is where connections and servers get the time from, and
+// their timers, see Config.Clock. The default is the system clock;
+// tests can substitute one they advance by hand, to check
+// retransmission timeouts, idle timeouts and key rotation without
+// waiting for them.
+//
+// Deadlines set with SetDeadline and friends, and Dial's handshake
+// timeouts given as a context, always follow the system clock.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer sending the time on its channel once d
+	// has passed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a ticker sending the time on its channel
+	// every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Timer is a time.Timer from a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop and Reset are like those of time.Timer.
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// A Ticker is a time.Ticker from a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
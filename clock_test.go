@@ -0,0 +1,196 @@
+package curvecp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1e9, 0)}
+}
+
+// fakeTimer is a Timer, or with a period a Ticker, of a fakeClock.
+// With a func, it calls it instead of sending on its channel.
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	f      func()
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), period: period}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, t)
+	t.arm(d)
+	return t
+}
+
+// afterFunc calls f once d has passed, from Advance.
+func (c *fakeClock) afterFunc(d time.Duration, f func()) {
+	t := &fakeTimer{clock: c, f: f}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, t)
+	t.when = c.now.Add(d)
+	t.active = true
+}
+
+// Advance moves the time forward by d, firing the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var funcs []func()
+	live := c.timers[:0]
+	for _, t := range c.timers {
+		if t.f != nil {
+			if t.when.After(c.now) {
+				live = append(live, t)
+			} else {
+				funcs = append(funcs, t.f)
+			}
+			continue
+		}
+		t.fire()
+		live = append(live, t)
+	}
+	c.timers = live
+	c.mu.Unlock()
+	for _, f := range funcs {
+		f()
+	}
+}
+
+// next returns when the earliest timer is due, if any is active.
+func (c *fakeClock) next() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next time.Time
+	for _, t := range c.timers {
+		if t.active && (next.IsZero() || t.when.Before(next)) {
+			next = t.when
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// arm sets t to fire d from now, under clock.mu.
+func (t *fakeTimer) arm(d time.Duration) {
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	t.fire()
+}
+
+// fire sends on t's channel if it's due, under clock.mu. Like those of
+// the time package, timers don't block, and tickers drop ticks.
+func (t *fakeTimer) fire() {
+	now := t.clock.now
+	if !t.active || t.when.After(now) {
+		return
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+	if t.period <= 0 {
+		t.active = false
+		return
+	}
+	for !t.when.After(now) {
+		t.when = t.when.Add(t.period)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.arm(d)
+	return wasActive
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	timer := c.NewTimer(time.Minute)
+	ticker := c.NewTicker(time.Minute)
+	c.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	case <-ticker.C():
+		t.Fatal("ticker ticked early")
+	default:
+	}
+	c.Advance(time.Second)
+	<-timer.C()
+	<-ticker.C()
+	c.Advance(time.Minute)
+	<-ticker.C()
+	if timer.Stop() {
+		t.Errorf("Stop on a fired timer returned true")
+	}
+}
+
+func TestClockIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	server, client := newConnPair(t, &Config{Clock: clock, IdleTimeout: time.Hour})
+	startConnPair(server, client)
+	testTransfer(t, client, server, 1000)
+
+	// The peer falls silent for longer than the idle timeout, which
+	// takes no time at all on the fake clock.
+	client.sock.Close()
+	start := time.Now()
+	clock.Advance(2 * time.Hour)
+	if _, err := server.Read(make([]byte, 10)); err != ErrIdleTimeout {
+		t.Errorf("Read = %v, want ErrIdleTimeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("idle timeout took %s", d)
+	}
+}
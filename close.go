@@ -0,0 +1,189 @@
+package curvecp
+
+import (
+	"net"
+	"time"
+)
+
+// After Close, once the peer has acknowledged everything, the pump
+// keeps answering the peer for this long, or until the peer ends its
+// own stream, so that it can finish sending and close in turn.
+var closeLinger = 10 * time.Second
+
+// Kinds of close request.
+const (
+	closeBoth = iota
+	closeAbort
+	closeWrite
+	closeRead
+)
+
+// Close ends the stream after the data already written, unless
+// CloseWrite already did, waits until the peer has acknowledged all of
+// it, then closes the connection. Reads and writes fail with
+// net.ErrClosed from the moment Close is called.
+//
+// If the connection fails before everything is acknowledged, e.g.
+// because the peer is dead, Close returns the failure.
+func (c *Conn) Close() error {
+	if err := c.requestClose(closeBoth); err != nil {
+		return err
+	}
+	<-c.flushed
+	return c.flushErr
+}
+
+// Abort ends the stream with the failure flag, telling the peer that
+// the data it got is incomplete, and closes the connection without
+// waiting for anything to be acknowledged. After CloseWrite, the
+// stream has already ended, and Abort only closes the connection.
+func (c *Conn) Abort() error {
+	if err := c.requestClose(closeAbort); err != nil {
+		return err
+	}
+	<-c.done
+	return nil
+}
+
+// CloseWrite ends the stream after the data already written, like
+// Close, but returns at once and keeps the connection open for
+// reading, so that the peer can see the end of a request and answer
+// it. Writes fail with net.ErrClosed from then on. Close must still
+// be called to release the connection.
+func (c *Conn) CloseWrite() error {
+	return c.requestClose(closeWrite)
+}
+
+// CloseRead stops reading: pending and future reads fail with
+// net.ErrClosed, and data that arrives from then on is acknowledged
+// to the peer and dropped. Writing is unaffected.
+func (c *Conn) CloseRead() error {
+	return c.requestClose(closeRead)
+}
+
+func (c *Conn) requestClose(kind int) error {
+	select {
+	case c.closeRequest <- kind:
+		return <-c.closeResult
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
+
+// handleClose answers a close request, from the pump.
+func (c *Conn) handleClose(kind int) error {
+	if c.closing != 0 {
+		return net.ErrClosed
+	}
+	switch kind {
+	case closeWrite:
+		return c.endStream(eofSuccess)
+	case closeRead:
+		if c.readClosed {
+			return net.ErrClosed
+		}
+		c.closeReading()
+		return nil
+	}
+
+	c.closing = eofSuccess
+	if kind == closeAbort {
+		c.closing = eofFailure
+	}
+	c.closeReading()
+	if c.sendEOF == 0 {
+		c.endStream(c.closing)
+	}
+	return nil
+}
+
+// closeReading drops what is left to read, and wakes up pending
+// reads.
+func (c *Conn) closeReading() {
+	c.readClosed = true
+	c.releaseHeld()
+	c.received.Discard(c.received.Size())
+	signal(c.readable)
+}
+
+// endStream ends the stream we send with flag, from the pump. A
+// successful end goes out after the data, reliably. A failure goes
+// out at once, and only once.
+func (c *Conn) endStream(flag uint16) error {
+	if c.sendEOF != 0 {
+		return net.ErrClosed
+	}
+	c.sendEOF = flag
+	signal(c.writable)
+	if flag == eofFailure {
+		c.sendMessage(c.clock.Now(), &message{pos: c.sendPos, eof: eofFailure})
+		return nil
+	}
+
+	// Mark the last block if it hasn't been sent yet, otherwise the
+	// end of the stream gets a block of its own.
+	if e := c.toSend.Back(); e != nil {
+		if blk := e.Value.(*block); blk.transmissions == 0 {
+			blk.eof = flag
+			return nil
+		}
+	}
+	var blk *block
+	if c.sendFree.Len() > 0 {
+		blk = c.sendFree.Remove(c.sendFree.Front()).(*block)
+	} else {
+		blk = new(block)
+		c.sendBlocks++
+	}
+	*blk = block{pos: c.sendPos, eof: flag}
+	blk.buf = blk.arr[:0]
+	c.toSend.PushBack(blk)
+	return nil
+}
+
+// finished returns true when the pump can exit, after the user closed
+// the connection. Before that, the connection may be dead but the
+// user can still see why.
+func (c *Conn) finished(now time.Time) bool {
+	switch c.closing {
+	case 0:
+		// Except when idle, see Config.IdleTimeout, or revoked.
+		return c.err == ErrIdleTimeout || c.err == ErrRevoked
+	case eofFailure:
+		return true
+	}
+	if c.lingerUntil.IsZero() {
+		if c.err == nil && c.toSend.Len() > 0 {
+			return false
+		}
+		c.flushErr = c.err
+		close(c.flushed)
+		c.lingerUntil = now.Add(closeLinger)
+	}
+	peerDone := c.recvEOF != 0 && c.recvPos == c.recvEOFPos && !c.ackNeeded
+	return c.err != nil || peerDone || !now.Before(c.lingerUntil)
+}
+
+// teardown releases the connection's resources as the pump exits.
+func (c *Conn) teardown() {
+	if c.lingerUntil.IsZero() {
+		c.flushErr = net.ErrClosed
+		close(c.flushed)
+	}
+	c.finalStats = c.stats()
+	c.finalState = c.connectionState()
+	close(c.done)
+	// Stop the packets first, then drop those already queued.
+	if c.onClose != nil {
+		c.onClose()
+	}
+	for {
+		select {
+		case p := <-c.packetIn:
+			p.release()
+		default:
+			c.toSend, c.sendFree = nil, nil
+			return
+		}
+	}
+}
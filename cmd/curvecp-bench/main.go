@@ -0,0 +1,359 @@
+// Command curvecp-bench measures CurveCP throughput and latency between
+// two hosts, in the manner of iperf, to validate congestion control on
+// real networks.
+//
+// Usage:
+//
+//	curvecp-bench -s [-keys dir] [-listen host:port]
+//	curvecp-bench [flags] curvecp://key@host:port
+//	curvecp-bench [flags] key host:port
+//
+// The server prints its key if it made up one. The client sends to the
+// server for -t, or with -R has the server send to it, and prints the
+// goodput every -i and at the end, with the round trip times and the
+// share of retransmitted data packets as seen by the sending side. The
+// congestion controller of the sending side is picked with -cc on that
+// side.
+//
+// The client starts with a request, a line of JSON. When uploading,
+// the data follows, and once the client is done the server answers
+// with a report, another line of JSON. When downloading, the server
+// sends the data in chunks with a 4-byte big-endian length, then an
+// empty chunk and the report.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+// Size of the writes, and the chunks when downloading.
+const chunkSize = 32 * 1024
+
+var (
+	serverMode = flag.Bool("s", false, "run the server")
+	keyDir     = flag.String("keys", "", "server: long-term key `directory`, instead of a new key")
+	listen     = flag.String("listen", ":4040", "server: UDP `address` to listen on")
+	duration   = flag.Duration("t", 10*time.Second, "client: send for `duration`")
+	reverse    = flag.Bool("R", false, "client: have the server send")
+	interval   = flag.Duration("i", time.Second, "client: report every `duration`, or only at the end if 0")
+	cc         = flag.String("cc", "chicago", "congestion controller when sending: chicago or bbr")
+)
+
+// A request is what the client asks of the server.
+type request struct {
+	// Reverse has the server send for Duration.
+	Reverse  bool          `json:"reverse"`
+	Duration time.Duration `json:"duration"`
+}
+
+// A report is what one side tells the other at the end.
+type report struct {
+	// Bytes of data received, when uploading.
+	Bytes int64 `json:"bytes"`
+	// The sender's view, when downloading.
+	Stats *senderStats `json:"stats,omitempty"`
+}
+
+// senderStats are the statistics of the sending side.
+type senderStats struct {
+	RTT             time.Duration `json:"rtt"`
+	RTTMin          time.Duration `json:"rtt_min"`
+	RTTP50          time.Duration `json:"rtt_p50"`
+	RTTP99          time.Duration `json:"rtt_p99"`
+	RTTMax          time.Duration `json:"rtt_max"`
+	BlocksSent      int           `json:"blocks_sent"`
+	Retransmissions int           `json:"retransmissions"`
+}
+
+func newSenderStats(s curvecp.Stats) *senderStats {
+	h := &s.RTTHistogram
+	return &senderStats{
+		RTT:             s.RTT,
+		RTTMin:          h.Min(),
+		RTTP50:          h.Quantile(0.5),
+		RTTP99:          h.Quantile(0.99),
+		RTTMax:          h.Max(),
+		BlocksSent:      s.BlocksSent,
+		Retransmissions: s.Retransmissions,
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s -s [-keys dir] [-listen host:port]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [flags] curvecp://key@host:port\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [flags] key host:port\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-bench: ")
+	flag.Usage = usage
+	flag.Parse()
+	config := &curvecp.Config{}
+	switch *cc {
+	case "chicago":
+		config.CongestionControl = curvecp.NewChicago
+	case "bbr":
+		config.CongestionControl = curvecp.NewBBR
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if *serverMode {
+		if flag.NArg() != 0 {
+			usage()
+			os.Exit(2)
+		}
+		serve(config)
+		return
+	}
+	var key []byte
+	var addr string
+	switch args := flag.Args(); len(args) {
+	case 1:
+		u, err := curvecp.ParseURL(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, addr = u.Key, u.Host
+	case 2:
+		var err error
+		if key, err = hex.DecodeString(args[0]); err != nil || len(key) != 32 {
+			log.Fatal("server key must be 64 hex digits")
+		}
+		addr = args[1]
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err := run(config, addr, key); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the server, forever.
+func serve(config *curvecp.Config) {
+	var kp *keys.KeyPair
+	var err error
+	if *keyDir != "" {
+		if kp, err = keys.Read(*keyDir); err == nil {
+			config.NonceSource, err = keys.OpenNonceCounter(*keyDir)
+		}
+	} else {
+		kp, err = keys.Generate()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := curvecp.ListenWithConfig(*listen, kp.Secret[:], config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s, key %x", l.Addr(), kp.Public)
+	for {
+		c, err := l.AcceptCurveCP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := handle(c); err != nil {
+				c.Abort()
+				log.Printf("%s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handle answers a client's request.
+func handle(c *curvecp.Conn) error {
+	r := bufio.NewReaderSize(c, chunkSize)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return err
+	}
+
+	var rep report
+	if !req.Reverse {
+		if rep.Bytes, err = io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		log.Printf("%s: received %d bytes", c.RemoteAddr(), rep.Bytes)
+	} else {
+		buf := make([]byte, 4+chunkSize)
+		binary.BigEndian.PutUint32(buf, chunkSize)
+		var sent int64
+		for end := time.Now().Add(req.Duration); time.Now().Before(end); {
+			if _, err := c.Write(buf); err != nil {
+				return err
+			}
+			sent += chunkSize
+		}
+		if _, err := c.Write(make([]byte, 4)); err != nil {
+			return err
+		}
+		rep.Stats = newSenderStats(c.Stats())
+		log.Printf("%s: sent %d bytes", c.RemoteAddr(), sent)
+	}
+	if err := json.NewEncoder(c).Encode(&rep); err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// run benchmarks against the server at addr.
+func run(config *curvecp.Config, addr string, key []byte) error {
+	d := curvecp.Dialer{Config: config}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	c, err := d.DialContext(ctx, addr, key)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer c.Abort()
+	req := request{Reverse: *reverse, Duration: *duration}
+	if err := json.NewEncoder(c).Encode(&req); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	meter := newMeter(start)
+	r := bufio.NewReaderSize(c, 4+chunkSize)
+	var rep report
+	if !*reverse {
+		// Count what the server acknowledged, not what's still queued.
+		var written int64
+		acked := func() int64 {
+			s := c.Stats()
+			return written - int64(s.BytesInFlight+s.BytesQueued)
+		}
+		buf := make([]byte, chunkSize)
+		for end := start.Add(*duration); time.Now().Before(end); {
+			n, err := c.Write(buf)
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+			meter.tick(acked())
+		}
+		if err := c.CloseWrite(); err != nil {
+			return err
+		}
+		if err := readReport(r, &rep); err != nil {
+			return err
+		}
+		rep.Stats = newSenderStats(c.Stats())
+	} else {
+		c.CloseWrite()
+		var received int64
+		var header [4]byte
+		for {
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				return err
+			}
+			n := int64(binary.BigEndian.Uint32(header[:]))
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return err
+			}
+			received += n
+			meter.tick(received)
+		}
+		if err := readReport(r, &rep); err != nil {
+			return err
+		}
+		rep.Bytes = received
+	}
+	elapsed := time.Since(start)
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	s := rep.Stats
+	fmt.Printf("%s  %s  %s\n", span(0, elapsed), size(rep.Bytes), rate(rep.Bytes, elapsed))
+	fmt.Printf("rtt min/p50/p99/max = %s/%s/%s/%s\n", round(s.RTTMin), round(s.RTTP50), round(s.RTTP99), round(s.RTTMax))
+	retransmitted := 0.0
+	if s.BlocksSent > 0 {
+		retransmitted = 100 * float64(s.Retransmissions) / float64(s.BlocksSent)
+	}
+	fmt.Printf("%d data packets sent, %d retransmitted (%.2f%%)\n", s.BlocksSent, s.Retransmissions, retransmitted)
+	return nil
+}
+
+// readReport reads the server's report from r, and the end of the
+// stream after it, so that closing doesn't leave the server waiting
+// for its end to be acknowledged.
+func readReport(r *bufio.Reader, rep *report) error {
+	line, err := r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, rep)
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		return fmt.Errorf("reading the report: %w", err)
+	}
+	return nil
+}
+
+// A meter prints the goodput of every -i.
+type meter struct {
+	start, last time.Time
+	lastBytes   int64
+}
+
+func newMeter(start time.Time) *meter {
+	return &meter{start: start, last: start}
+}
+
+// tick reports the progress to total bytes, if an interval is over.
+func (m *meter) tick(total int64) {
+	if *interval <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(m.last) < *interval {
+		return
+	}
+	n := total - m.lastBytes
+	fmt.Printf("%s  %s  %s\n", span(m.last.Sub(m.start), now.Sub(m.start)), size(n), rate(n, now.Sub(m.last)))
+	m.last, m.lastBytes = now, total
+}
+
+func span(from, to time.Duration) string {
+	return fmt.Sprintf("%6.2f-%6.2f s", from.Seconds(), to.Seconds())
+}
+
+func size(n int64) string {
+	return fmt.Sprintf("%8.2f MB", float64(n)/1e6)
+}
+
+func rate(n int64, d time.Duration) string {
+	return fmt.Sprintf("%8.2f Mbit/s", float64(n)*8/1e6/d.Seconds())
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,159 @@
+// Command curvecp-cat connects its standard input and output to a
+// CurveCP stream, like netcat, either listening for a single
+// connection or dialing one:
+//
+//	curvecp-cat -l [-keys dir] host:port
+//	curvecp-cat [-keys dir] curvecp://key@host:port/domain
+//	curvecp-cat [-keys dir] key host:port
+//
+// The server's key is in DJB's base32 in URLs, see curvecp.ParseURL,
+// and in hex otherwise. Without -keys, the listening side makes up a
+// key and prints it, and the dialing side has a new identity each
+// time.
+//
+// The end of the standard input ends the stream to the peer, and the
+// command exits once the peer has ended its stream too, so that, say,
+//
+//	curvecp-cat -l :4000 > file
+//	curvecp-cat $key host:4000 < file
+//
+// copies a file.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+var (
+	listen  = flag.Bool("l", false, "listen for a connection instead of dialing")
+	keyDir  = flag.String("keys", "", "use the long-term key in `directory`, instead of a new one")
+	timeout = flag.Duration("T", 60*time.Second, "when dialing, give up on the handshake after `duration`")
+	verbose = flag.Bool("v", false, "print connection details")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s -l [-keys dir] host:port\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [-keys dir] curvecp://key@host:port/domain\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [-keys dir] key host:port\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-cat: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	var kp *keys.KeyPair
+	config := &curvecp.Config{}
+	if *keyDir != "" {
+		var err error
+		if kp, err = keys.Read(*keyDir); err != nil {
+			log.Fatal(err)
+		}
+		if config.NonceSource, err = keys.OpenNonceCounter(*keyDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var c *curvecp.Conn
+	var err error
+	switch args := flag.Args(); {
+	case *listen && len(args) == 1:
+		c, err = accept(args[0], kp, config)
+	case !*listen && len(args) == 1:
+		var u *curvecp.URL
+		if u, err = curvecp.ParseURL(args[0]); err == nil {
+			c, err = dial(u.Host, u.Key, u.Domain, kp, config)
+		}
+	case !*listen && len(args) == 2:
+		key, decodeErr := hex.DecodeString(args[0])
+		if decodeErr != nil || len(key) != 32 {
+			log.Fatal("server key must be 64 hex digits")
+		}
+		c, err = dial(args[1], key, "", kp, config)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		log.Printf("connected to %s, %s", c.RemoteAddr(), curvecp.Fingerprint(c.PeerKey()))
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, os.Stdin)
+		if err == nil {
+			err = c.CloseWrite()
+		}
+		sent <- err
+	}()
+	if _, err := io.Copy(os.Stdout, c); err != nil {
+		c.Abort()
+		log.Fatal(err)
+	}
+	// The peer may be done first, and still reading.
+	if err := <-sent; err != nil {
+		c.Abort()
+		log.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// accept listens on addr and returns the first connection.
+func accept(addr string, kp *keys.KeyPair, config *curvecp.Config) (*curvecp.Conn, error) {
+	if kp == nil {
+		var err error
+		if kp, err = keys.Generate(); err != nil {
+			return nil, err
+		}
+	}
+	l, err := curvecp.ListenWithConfig(addr, kp.Secret[:], config)
+	if err != nil {
+		return nil, err
+	}
+	if *keyDir == "" || *verbose {
+		log.Printf("listening on %s, key %x", l.Addr(), kp.Public)
+	}
+	c, err := l.AcceptCurveCP()
+	if err != nil {
+		return nil, err
+	}
+	// Take no more connections, c carries on.
+	l.Close()
+	return c, nil
+}
+
+// dial connects to the server at addr, with the long-term key kp if
+// not nil.
+func dial(addr string, key []byte, domain string, kp *keys.KeyPair, config *curvecp.Config) (*curvecp.Conn, error) {
+	d := curvecp.Dialer{Domain: domain}
+	if kp != nil {
+		d.Key = kp.Secret[:]
+		d.Config = config
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	c, err := d.DialContext(ctx, addr, key)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%s: no answer", addr)
+	}
+	return c, err
+}
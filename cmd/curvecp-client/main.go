@@ -0,0 +1,162 @@
+// Command curvecp-client connects to a CurveCP server, and either
+// connects its standard input and output to the stream, or runs a
+// program talking to the server, like the reference curvecpclient.
+//
+// Usage:
+//
+//	curvecp-client [flags] curvecp://key@host:port/domain [prog [args...]]
+//	curvecp-client [flags] key host:port [prog [args...]]
+//
+// The server's key is in DJB's base32 in URLs, see curvecp.ParseURL,
+// and in hex otherwise. A program reads the server's stream from file
+// descriptor 6 and writes to file descriptor 7, see curvecp.RunCommand.
+// Without one, the stream goes to the standard output, until the
+// server ends it.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+var (
+	quiet   = flag.Bool("q", false, "don't print error messages")
+	verbose = flag.Bool("v", false, "print connection details")
+	keyDir  = flag.String("c", "", "use the long-term key in `directory`, instead of a new one")
+	timeout = flag.Duration("T", 60*time.Second, "give up on the handshake after `duration`")
+	name    = flag.String("name", "", "request `domain` from the server, instead of the host")
+	ext     = flag.String("ext", "", "server extension, in `hex`")
+	relay   = flag.String("relay", "", "send packets through the UDP relay at `address`")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] curvecp://key@host:port/domain [prog [args...]]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [flags] key host:port [prog [args...]]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-client: ")
+	flag.Usage = usage
+	flag.Parse()
+	os.Exit(run())
+}
+
+// run does the work of main, and returns the exit status.
+func run() int {
+	args := flag.Args()
+	d := curvecp.Dialer{Domain: *name, Relay: *relay}
+	var key []byte
+	var addr string
+	switch {
+	case len(args) >= 1 && strings.HasPrefix(args[0], "curvecp://"):
+		u, err := curvecp.ParseURL(args[0])
+		if err != nil {
+			return fail(err)
+		}
+		key, addr = u.Key, u.Host
+		if u.Domain != "" && d.Domain == "" {
+			d.Domain = u.Domain
+		}
+		args = args[1:]
+	case len(args) >= 2:
+		var err error
+		if key, err = hex.DecodeString(args[0]); err != nil || len(key) != 32 {
+			return fail(errors.New("server key must be 64 hex digits"))
+		}
+		addr = args[1]
+		args = args[2:]
+	default:
+		usage()
+		return 2
+	}
+	if *ext != "" {
+		b, err := hex.DecodeString(*ext)
+		if err != nil || len(b) != len(d.ServerExtension) {
+			return fail(errors.New("server extension must be 32 hex digits"))
+		}
+		copy(d.ServerExtension[:], b)
+	}
+	if *keyDir != "" {
+		kp, err := keys.Read(*keyDir)
+		if err != nil {
+			return fail(err)
+		}
+		nonces, err := keys.OpenNonceCounter(*keyDir)
+		if err != nil {
+			return fail(err)
+		}
+		d.Key = kp.Secret[:]
+		d.Config = &curvecp.Config{NonceSource: nonces}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	start := time.Now()
+	c, err := d.DialContext(ctx, addr, key)
+	if err != nil {
+		return fail(err)
+	}
+	if *verbose {
+		log.Printf("connected to %s, %s, in %s", c.RemoteAddr(), curvecp.Fingerprint(key), time.Since(start).Round(time.Millisecond))
+	}
+
+	if len(args) > 0 {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := curvecp.RunCommand(c, cmd)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, os.Stdin)
+		if err == nil {
+			err = c.CloseWrite()
+		}
+		sent <- err
+	}()
+	if _, err := io.Copy(os.Stdout, c); err != nil {
+		c.Abort()
+		return fail(err)
+	}
+	// The server may be done first, and still reading.
+	if err := <-sent; err != nil {
+		c.Abort()
+		return fail(err)
+	}
+	if err := c.Close(); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+// fail reports err, unless -q, and returns the exit status for
+// failures.
+func fail(err error) int {
+	if !*quiet {
+		log.Print(err)
+	}
+	return 1
+}
@@ -0,0 +1,370 @@
+// Command curvecp-dissect decodes captured CurveCP packets, and
+// decrypts what the keys it's given allow, to debug interoperability
+// problems, see curvecp.Dissector.
+//
+// Usage:
+//
+//	curvecp-dissect [flags] capture.pcap
+//	curvecp-dissect [flags] -hex dump.txt
+//
+// Captures are in the classic libpcap format, as written by tcpdump
+// -w; convert pcapng files with editcap -F pcap first. UDP packets
+// over IPv4 and IPv6 are decoded, fragments aren't reassembled. With
+// -hex, the input has a packet per line instead, a UDP payload in hex,
+// with blank lines and lines starting with # ignored.
+//
+// Secret keys are given in hex with -key, or as the key directories
+// of servers and clients with -keys, and minute keys in hex with
+// -minutekey; all can be repeated.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+// hexKeys is a repeatable flag of 32-byte keys in hex.
+type hexKeys [][]byte
+
+func (k *hexKeys) String() string { return "" }
+
+func (k *hexKeys) Set(s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return errors.New("must be 64 hex digits")
+	}
+	*k = append(*k, b)
+	return nil
+}
+
+// dirs is a repeatable flag of directories.
+type dirs []string
+
+func (d *dirs) String() string { return "" }
+
+func (d *dirs) Set(s string) error {
+	*d = append(*d, s)
+	return nil
+}
+
+var (
+	hexInput = flag.Bool("hex", false, "read packets in hex, one per line, instead of a pcap file")
+	port     = flag.Int("port", 0, "only decode UDP packets from or to `port`")
+	dataLen  = flag.Int("data", 64, "print at most `n` bytes of each message's data")
+
+	secretKeys hexKeys
+	minuteKeys hexKeys
+	keyDirs    dirs
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] capture.pcap\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [flags] -hex dump.txt\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-dissect: ")
+	flag.Var(&secretKeys, "key", "secret `key` in hex, long-term or short-term")
+	flag.Var(&keyDirs, "keys", "key `directory` of a server or client")
+	flag.Var(&minuteKeys, "minutekey", "server minute `key` in hex")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	d := curvecp.NewDissector()
+	for _, k := range secretKeys {
+		d.AddKey(k)
+	}
+	for _, dir := range keyDirs {
+		kp, err := keys.Read(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.AddKey(kp.Secret[:])
+		if prev, err := keys.ReadPrevious(dir); err == nil {
+			d.AddKey(prev.Secret[:])
+		}
+	}
+	for _, k := range minuteKeys {
+		d.AddMinuteKey(k)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	emit := func(header string, payload []byte) {
+		p, err := d.Dissect(payload)
+		if p == nil && errors.Is(err, curvecp.ErrNotCurveCP) {
+			return
+		}
+		fmt.Fprintf(out, "%s", header)
+		if p != nil {
+			printPacket(out, p)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "  error: %v\n", err)
+		}
+	}
+	if *hexInput {
+		err = readHex(f, emit)
+	} else {
+		err = readPcap(f, emit)
+	}
+	if err != nil {
+		out.Flush()
+		log.Fatal(err)
+	}
+}
+
+// readHex reads a packet per line from r, and hands them to emit.
+func readHex(r io.Reader, emit func(header string, payload []byte)) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		text := strings.Join(strings.Fields(s.Text()), "")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		emit("line "+strconv.Itoa(line)+": ", b)
+	}
+	return s.Err()
+}
+
+// Link-layer header types of pcap files, see
+// https://www.tcpdump.org/linktypes.html.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkLinuxSLL = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkLinuxSL2 = 276
+)
+
+// readPcap reads the UDP packets of the pcap file in r, and hands
+// them to emit.
+func readPcap(r io.Reader, emit func(header string, payload []byte)) error {
+	br := bufio.NewReader(r)
+	var fh [24]byte
+	if _, err := io.ReadFull(br, fh[:]); err != nil {
+		return fmt.Errorf("reading the pcap header: %w", err)
+	}
+	var order binary.ByteOrder
+	nano := false
+	switch magic := binary.LittleEndian.Uint32(fh[:]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+		nano = magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+		nano = magic == 0x4d3cb2a1
+	case 0x0a0d0d0a:
+		return errors.New("pcapng isn't supported, convert with editcap -F pcap")
+	default:
+		return errors.New("not a pcap file")
+	}
+	link := order.Uint32(fh[20:]) & 0xffff
+
+	var ph [16]byte
+	for n := 1; ; n++ {
+		if _, err := io.ReadFull(br, ph[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("packet %d: %w", n, err)
+		}
+		capLen := order.Uint32(ph[8:])
+		if capLen > 1<<18 {
+			return fmt.Errorf("packet %d: invalid length %d", n, capLen)
+		}
+		frame := make([]byte, capLen)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return fmt.Errorf("packet %d: %w", n, err)
+		}
+		sec, frac := int64(order.Uint32(ph[0:])), int64(order.Uint32(ph[4:]))
+		if !nano {
+			frac *= 1000
+		}
+		ts := time.Unix(sec, frac).UTC()
+
+		ip := linkPayload(link, frame)
+		src, dst, payload, ok := udpPayload(ip)
+		if !ok || (*port != 0 && src.Port != *port && dst.Port != *port) {
+			continue
+		}
+		emit(fmt.Sprintf("%s %s > %s: ", ts.Format("15:04:05.000000"), src, dst), payload)
+	}
+}
+
+// linkPayload returns the IP packet in frame, or nil.
+func linkPayload(link uint32, frame []byte) []byte {
+	var etherType uint16
+	switch link {
+	case linkRaw, linkIPv4, linkIPv6:
+		return frame
+	case linkNull, linkLoop:
+		// The address family, in the byte order of the capturing
+		// host, or big-endian for linkLoop; the IP version tells
+		// anyway.
+		if len(frame) < 4 {
+			return nil
+		}
+		return frame[4:]
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(frame) < 4 {
+				return nil
+			}
+			etherType, frame = binary.BigEndian.Uint16(frame[2:]), frame[4:]
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[14:]), frame[16:]
+	case linkLinuxSL2:
+		if len(frame) < 20 {
+			return nil
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[0:]), frame[20:]
+	default:
+		return nil
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return nil
+	}
+	return frame
+}
+
+// udpPayload returns the addresses and payload of ip, if it's an
+// unfragmented UDP packet.
+func udpPayload(ip []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	if len(ip) < 1 {
+		return
+	}
+	var srcIP, dstIP net.IP
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0xf) * 4
+		if len(ip) < 20 || ihl < 20 || len(ip) < ihl || ip[9] != 17 {
+			return
+		}
+		// More fragments, or not the first.
+		if flags := binary.BigEndian.Uint16(ip[6:]); flags&0x2000 != 0 || flags&0x1fff != 0 {
+			return
+		}
+		srcIP, dstIP = net.IP(ip[12:16]), net.IP(ip[16:20])
+		end := int(binary.BigEndian.Uint16(ip[2:]))
+		if end < ihl || end > len(ip) {
+			end = len(ip)
+		}
+		udp = ip[ihl:end]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 {
+			return
+		}
+		srcIP, dstIP = net.IP(ip[8:24]), net.IP(ip[24:40])
+		udp = ip[40:]
+	default:
+		return
+	}
+	if len(udp) < 8 {
+		return
+	}
+	end := int(binary.BigEndian.Uint16(udp[4:]))
+	if end < 8 || end > len(udp) {
+		end = len(udp)
+	}
+	src = &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(udp[0:]))}
+	dst = &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(udp[2:]))}
+	return src, dst, udp[8:end], true
+}
+
+// printPacket prints p, indented, after its header line.
+func printPacket(w io.Writer, p *curvecp.DissectedPacket) {
+	fmt.Fprintf(w, "%s\n", p.Type)
+	fmt.Fprintf(w, "  client extension %x, server extension %x\n", p.ClientExtension, p.ServerExtension)
+	if p.ClientShortTermKey != nil {
+		fmt.Fprintf(w, "  client short-term key %x\n", p.ClientShortTermKey)
+	}
+	fmt.Fprintf(w, "  nonce %x\n", p.Nonce)
+	if !p.Opened {
+		fmt.Fprintf(w, "  box not opened\n")
+		return
+	}
+	fmt.Fprintf(w, "  box opened\n")
+	if p.ServerShortTermKey != nil {
+		fmt.Fprintf(w, "  server short-term key %x\n", p.ServerShortTermKey)
+	}
+	if p.ClientLongTermKey != nil {
+		vouch := "not verified"
+		if p.Vouched {
+			vouch = "good"
+		}
+		fmt.Fprintf(w, "  client long-term key %x, vouch %s\n", p.ClientLongTermKey, vouch)
+		fmt.Fprintf(w, "  domain %q\n", p.Domain)
+	}
+	if m := p.Message; m != nil {
+		fmt.Fprintf(w, "  message ID %d, acknowledged message ID %d\n", m.ID, m.AckID)
+		fmt.Fprintf(w, "  acknowledged data")
+		if len(p.AckRanges) == 0 {
+			fmt.Fprintf(w, " none")
+		}
+		for _, r := range p.AckRanges {
+			fmt.Fprintf(w, " [%d, %d)", r[0], r[1])
+		}
+		fmt.Fprintf(w, "\n  %d bytes of data at %d", len(m.Data), m.Pos)
+		switch {
+		case m.Failed:
+			fmt.Fprintf(w, ", end of stream, failed")
+		case m.EOF:
+			fmt.Fprintf(w, ", end of stream")
+		}
+		fmt.Fprintf(w, "\n")
+		if len(m.Data) > 0 && *dataLen > 0 {
+			data := m.Data
+			if len(data) > *dataLen {
+				data = data[:*dataLen]
+			}
+			fmt.Fprintf(w, "  %q", data)
+			if len(data) < len(m.Data) {
+				fmt.Fprintf(w, "...")
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Command curvecp-keygen creates long-term CurveCP keypairs, and prints
+// the public key in the forms clients need.
+//
+// Usage:
+//
+//	curvecp-keygen dir
+//	curvecp-keygen -hex file
+//	curvecp-keygen -rotate dir
+//	curvecp-keygen -show dir|file
+//
+// A directory has DJB's layout, as written by curvecpmakekey, and can
+// be used by curvecp-server and the reference tools alike, see package
+// keys. A hex file holds the secret key as 64 hex digits, with the
+// public key next to it in file.pub.
+//
+// Rotating a directory replaces its keypair, and keeps the old secret
+// key for curvecp-server to go on honoring for a while, see
+// keys.Rotate.
+//
+// Each command prints the public key in hex, as the DNS label to name
+// the server by, like <label>.example.com, and as its fingerprint.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+var (
+	hexFile = flag.Bool("hex", false, "write a hex key file instead of a directory")
+	rotate  = flag.Bool("rotate", false, "replace the keypair in an existing directory")
+	show    = flag.Bool("show", false, "print the public key of an existing directory or hex file")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s dir\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -hex file\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -rotate dir\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -show dir|file\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-keygen: ")
+	flag.Usage = usage
+	flag.Parse()
+	modes := 0
+	for _, m := range []bool{*hexFile, *rotate, *show} {
+		if m {
+			modes++
+		}
+	}
+	if flag.NArg() != 1 || modes > 1 {
+		usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	var public []byte
+	var err error
+	switch {
+	case *show:
+		public, err = readPublic(path)
+	case *rotate:
+		var kp *keys.KeyPair
+		if kp, err = keys.Rotate(path); err == nil {
+			public = kp.Public[:]
+		}
+	case *hexFile:
+		public, err = writeHex(path)
+	default:
+		var kp *keys.KeyPair
+		if kp, err = keys.Generate(); err == nil {
+			err = keys.Write(path, kp)
+			public = kp.Public[:]
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("public key:  %x\n", public)
+	fmt.Printf("DNS label:   %s\n", curvecp.KeyLabel(public))
+	fmt.Printf("fingerprint: %s\n", curvecp.Fingerprint(public))
+}
+
+// writeHex writes a new keypair to the hex file name and name.pub, and
+// returns the public key.
+func writeHex(name string) ([]byte, error) {
+	kp, err := keys.Generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(name, hex.EncodeToString(kp.Secret[:])+"\n", 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(name+".pub", hex.EncodeToString(kp.Public[:])+"\n", 0644); err != nil {
+		return nil, err
+	}
+	return kp.Public[:], nil
+}
+
+// writeFile creates name with data, refusing to overwrite a key.
+func writeFile(name, data string, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readPublic returns the public key of the key directory or hex file
+// at path.
+func readPublic(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return keys.ReadPublic(path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New(path + ": secret key must be 64 hex digits")
+	}
+	return curve25519.X25519(secret, curve25519.Basepoint)
+}
@@ -0,0 +1,192 @@
+// Command curvecp-ping checks that a CurveCP server is up and holds the
+// expected key, for monitoring, and reports how long it takes to
+// answer.
+//
+// Usage:
+//
+//	curvecp-ping [flags] curvecp://key@host:port/domain
+//	curvecp-ping [flags] key host:port
+//
+// The server's key is in DJB's base32 in URLs, see curvecp.ParseURL,
+// and in hex otherwise. Each probe exchanges a Hello and a Cookie
+// packet with the server, see curvecp.Dialer.Ping, which the server's
+// application never sees. With -initiate, each probe instead makes a
+// connection, waits for the server to answer its Initiate, and aborts
+// it, which checks the server's accept path too.
+//
+// A server with another key ignores the probes, so a wrong key shows
+// as a timeout. The exit status is 0 if any probe was answered, 1
+// otherwise, and 2 for usage errors.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+var (
+	count    = flag.Int("c", 4, "send `n` probes, or keep going until interrupted if 0")
+	interval = flag.Duration("i", time.Second, "wait `duration` between probes")
+	timeout  = flag.Duration("T", 5*time.Second, "give up on a probe after `duration`")
+	initiate = flag.Bool("initiate", false, "complete the handshake with an Initiate")
+	keyDir   = flag.String("keys", "", "with -initiate, connect with the long-term key in `directory`")
+	name     = flag.String("name", "", "with -initiate, request `domain` from the server, instead of the host")
+	ext      = flag.String("ext", "", "server extension, in `hex`")
+	quiet    = flag.Bool("q", false, "only print the summary")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] curvecp://key@host:port/domain\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [flags] key host:port\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-ping: ")
+	flag.Usage = usage
+	flag.Parse()
+
+	var key []byte
+	var addr string
+	var d curvecp.Dialer
+	switch args := flag.Args(); {
+	case len(args) == 1:
+		u, err := curvecp.ParseURL(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, addr, d.Domain = u.Key, u.Host, u.Domain
+	case len(args) == 2:
+		var err error
+		if key, err = hex.DecodeString(args[0]); err != nil || len(key) != 32 {
+			log.Fatal("server key must be 64 hex digits")
+		}
+		addr = args[1]
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if *name != "" {
+		d.Domain = *name
+	}
+	if *ext != "" {
+		b, err := hex.DecodeString(*ext)
+		if err != nil || len(b) != len(d.ServerExtension) {
+			log.Fatal("server extension must be 32 hex digits")
+		}
+		copy(d.ServerExtension[:], b)
+	}
+	if *keyDir != "" {
+		kp, err := keys.Read(*keyDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nonces, err := keys.OpenNonceCounter(*keyDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.Key = kp.Secret[:]
+		d.Config = &curvecp.Config{NonceSource: nonces}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var sent, answered int
+	var min, max, total time.Duration
+	for sent = 0; *count == 0 || sent < *count; sent++ {
+		if sent > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		rtt, err := probe(ctx, &d, addr, key)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if !*quiet {
+				fmt.Printf("%s: probe %d: %v\n", addr, sent+1, err)
+			}
+			continue
+		}
+		if !*quiet {
+			fmt.Printf("%s: probe %d: time=%s\n", addr, sent+1, round(rtt))
+		}
+		if answered == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		total += rtt
+		answered++
+	}
+
+	fmt.Printf("%d probes, %d answered\n", sent, answered)
+	if answered == 0 {
+		os.Exit(1)
+	}
+	avg := total / time.Duration(answered)
+	fmt.Printf("min/avg/max = %s/%s/%s\n", round(min), round(avg), round(max))
+}
+
+// round rounds d for printing.
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// probe pings the server once, with a Hello or an Initiate, and
+// returns how long it took to answer.
+func probe(ctx context.Context, d *curvecp.Dialer, addr string, key []byte) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	if !*initiate {
+		rtt, err := d.Ping(ctx, addr, key)
+		return rtt, unwrapTimeout(err)
+	}
+
+	c, err := d.DialContext(ctx, addr, key)
+	if err != nil {
+		return 0, unwrapTimeout(err)
+	}
+	defer c.Abort()
+	// The client sends its Initiate right away, and the handshake ends
+	// with the server's first Message.
+	tick := time.NewTicker(time.Millisecond)
+	defer tick.Stop()
+	for {
+		if s := c.ConnectionState(); !s.HandshakeEnd.IsZero() {
+			return s.HandshakeEnd.Sub(s.HandshakeStart), nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, errors.New("Initiate not answered")
+		case <-tick.C:
+		}
+	}
+}
+
+// unwrapTimeout shortens the errors of probes that weren't answered.
+func unwrapTimeout(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, curvecp.ErrHandshakeTimeout) {
+		return errors.New("no answer")
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+// Command curvecp-proxy bridges TCP and CurveCP, so that services and
+// clients that only speak TCP can talk over CurveCP unchanged. It
+// either accepts CurveCP connections and forwards each to a TCP
+// backend, or accepts TCP connections and forwards each to a CurveCP
+// server:
+//
+//	curvecp-proxy -keys dir -listen host:port -to host:port
+//	curvecp-proxy -tcp host:port -to curvecp://key@host:port/domain
+//
+// Running one of each, a TCP client reaches a TCP service across the
+// network with the traffic in between encrypted. The end of each
+// direction of a stream is passed on, see curvecp.Proxy.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+// How long connections have to finish once asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+var (
+	keyDir  = flag.String("keys", "", "long-term key `directory`; required with -listen, optional with -tcp")
+	listen  = flag.String("listen", "", "accept CurveCP connections on the UDP `address`")
+	tcp     = flag.String("tcp", "", "accept TCP connections on `address`")
+	to      = flag.String("to", "", "forward to the TCP `address`, or the CurveCP server `URL`")
+	timeout = flag.Duration("T", 60*time.Second, "give up on CurveCP handshakes after `duration`")
+	quiet   = flag.Bool("q", false, "don't log connections")
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s -keys dir -listen host:port -to host:port\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [-keys dir] -tcp host:port -to curvecp://key@host:port/domain\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-proxy: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 || *to == "" || (*listen == "") == (*tcp == "") || (*listen != "" && *keyDir == "") {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *listen != "" {
+		inbound(ctx)
+	} else {
+		outbound(ctx)
+	}
+}
+
+// config returns the configuration with the nonce state of -keys.
+func config() *curvecp.Config {
+	nonces, err := keys.OpenNonceCounter(*keyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &curvecp.Config{NonceSource: nonces}
+}
+
+// inbound accepts CurveCP connections and forwards them to the TCP
+// backend, until ctx is done.
+func inbound(ctx context.Context) {
+	kp, err := keys.Read(*keyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := curvecp.ListenWithConfig(*listen, kp.Secret[:], config())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s, forwarding to %s", l.Addr(), *to)
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		l.Shutdown(ctx)
+	}()
+
+	for {
+		c, err := l.AcceptCurveCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatal(err)
+		}
+		go func() {
+			peer := fmt.Sprintf("%s %s", c.RemoteAddr(), curvecp.Fingerprint(c.PeerKey()))
+			backend, err := net.Dial("tcp", *to)
+			if err != nil {
+				c.Abort()
+				log.Printf("%s: %v", peer, err)
+				return
+			}
+			forward(peer, c, backend)
+		}()
+	}
+}
+
+// outbound accepts TCP connections and forwards them to the CurveCP
+// server, until ctx is done.
+func outbound(ctx context.Context) {
+	u, err := curvecp.ParseURL(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d := curvecp.Dialer{Domain: u.Domain}
+	if *keyDir != "" {
+		kp, err := keys.Read(*keyDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.Key = kp.Secret[:]
+		d.Config = config()
+	}
+	l, err := net.Listen("tcp", *tcp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s, forwarding to %s", l.Addr(), u.Host)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatal(err)
+		}
+		go func() {
+			peer := client.RemoteAddr().String()
+			ctx, cancel := context.WithTimeout(ctx, *timeout)
+			c, err := d.DialContext(ctx, u.Host, u.Key)
+			cancel()
+			if err != nil {
+				client.Close()
+				log.Printf("%s: %v", peer, err)
+				return
+			}
+			forward(peer, c, client)
+		}()
+	}
+}
+
+// forward proxies between c and the TCP connection, and logs the
+// outcome under peer.
+func forward(peer string, c *curvecp.Conn, tcp net.Conn) {
+	start := time.Now()
+	if !*quiet {
+		log.Printf("%s: connected", peer)
+	}
+	if err := curvecp.Proxy(c, tcp); err != nil {
+		log.Printf("%s: %v", peer, err)
+	} else if !*quiet {
+		log.Printf("%s: done after %s", peer, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,146 @@
+// Command curvecp-server serves CurveCP connections, with a long-term
+// key from a key directory like the ones of curvecpmakekey and
+// curvecp-keygen. Each connection is either handed to a program, like
+// the reference curvecpserver does through curvecpmessage, or
+// forwarded to a TCP backend.
+//
+// Usage:
+//
+//	curvecp-server -keys dir -listen host:port prog [args...]
+//	curvecp-server -keys dir -listen host:port -proxy host:port
+//
+// A program reads the client's stream on its standard input and
+// writes the answer to its standard output, and finds out about the
+// client in its environment:
+//
+//	PROTO=CURVECP
+//	CURVECPREMOTEADDR  the client's address
+//	CURVECPREMOTEKEY   the client's long-term public key, in hex
+//
+// After curvecp-keygen -rotate, the server goes on honoring the
+// previous key for the time given by -previous, so that clients can
+// learn the new one.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/johnwchadwick/curvecp"
+	"github.com/johnwchadwick/curvecp/keys"
+)
+
+// How long connections have to finish once asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+var (
+	keyDir = flag.String("keys", "", "key `directory`")
+	listen = flag.String("listen", "", "UDP `address` to listen on")
+	proxy  = flag.String("proxy", "", "forward connections to the TCP `address`")
+	quiet  = flag.Bool("q", false, "don't log connections")
+
+	previous = flag.Duration("previous", 24*time.Hour, "honor the key from before the last rotation for `duration`")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -keys dir -listen host:port (-proxy host:port | prog [args...])\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("curvecp-server: ")
+	flag.Usage = usage
+	flag.Parse()
+	if *keyDir == "" || *listen == "" || (*proxy == "") == (flag.NArg() == 0) {
+		usage()
+		os.Exit(2)
+	}
+
+	kp, err := keys.Read(*keyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nonces, err := keys.OpenNonceCounter(*keyDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &curvecp.Config{NonceSource: nonces}
+	if *previous > 0 {
+		prev, err := keys.ReadPrevious(*keyDir)
+		switch {
+		case err == nil:
+			config.KeyRing = []curvecp.RingKey{{SecretKey: prev.Secret[:], Until: time.Now().Add(*previous)}}
+		case !errors.Is(err, fs.ErrNotExist):
+			log.Fatal(err)
+		}
+	}
+	l, err := curvecp.ListenWithConfig(*listen, kp.Secret[:], config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", l.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		l.Shutdown(ctx)
+	}()
+
+	for {
+		c, err := l.AcceptCurveCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatal(err)
+		}
+		go serve(c)
+	}
+}
+
+// serve hands c to the program, or the backend.
+func serve(c *curvecp.Conn) {
+	start := time.Now()
+	peer := fmt.Sprintf("%s %s", c.RemoteAddr(), curvecp.Fingerprint(c.PeerKey()))
+	if !*quiet {
+		log.Printf("%s: connected", peer)
+	}
+	var err error
+	if *proxy != "" {
+		var backend net.Conn
+		if backend, err = net.Dial("tcp", *proxy); err != nil {
+			c.Abort()
+		} else {
+			err = curvecp.Proxy(c, backend)
+		}
+	} else {
+		cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
+		cmd.Env = append(os.Environ(),
+			"PROTO=CURVECP",
+			"CURVECPREMOTEADDR="+c.RemoteAddr().String(),
+			"CURVECPREMOTEKEY="+hex.EncodeToString(c.PeerKey()),
+		)
+		cmd.Stderr = os.Stderr
+		err = curvecp.RunCommand(c, cmd)
+	}
+	if err != nil {
+		log.Printf("%s: %v", peer, err)
+	} else if !*quiet {
+		log.Printf("%s: done after %s", peer, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,70 @@
+package curvecp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// RunCommand runs cmd with the stream of c as its input and output,
+// the way curvecpmessage runs the programs of the reference
+// implementation's curvecpserver and curvecpclient, so that they can
+// be served, or served by, this package. It returns when cmd has
+// exited and c is closed.
+//
+// If c is a server connection, cmd reads the stream from its standard
+// input and writes to its standard output. If c is a client
+// connection, it reads from file descriptor 6 and writes to file
+// descriptor 7, and its standard input and output are left to cmd,
+// as UCSPI clients expect.
+//
+// The end of the peer's stream is the end of cmd's input, and cmd
+// closing its output, usually by exiting, ends c's stream, whether cmd
+// succeeded or not. Once cmd has exited, c is closed, and the error
+// from running cmd is returned, or the one from closing c.
+func RunCommand(c *Conn, cmd *exec.Cmd) error {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return err
+	}
+	if bytes.Equal(c.recvMagic, serverMessageMagic) {
+		// File descriptors 3 to 7, the first three closed.
+		cmd.ExtraFiles = []*os.File{nil, nil, nil, inR, outW}
+	} else {
+		cmd.Stdin, cmd.Stdout = inR, outW
+	}
+	err = cmd.Start()
+	// cmd has its own copies.
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return err
+	}
+
+	input := make(chan struct{})
+	go func() {
+		defer close(input)
+		io.Copy(inW, c)
+		inW.Close()
+	}()
+	if _, err := io.Copy(c, outR); err == nil {
+		c.CloseWrite()
+	}
+	outR.Close()
+
+	err = cmd.Wait()
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	<-input
+	return err
+}
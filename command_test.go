@@ -0,0 +1,86 @@
+package curvecp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRunCommandServer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs tr")
+	}
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	defer client.Abort()
+
+	done := make(chan error, 1)
+	go func() { done <- RunCommand(server, exec.Command("tr", "a-z", "A-Z")) }()
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil || string(got) != "HELLO" {
+		t.Errorf("read %q, %v, want %q", got, err, "HELLO")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("RunCommand: %v", err)
+	}
+}
+
+func TestRunCommandClient(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	defer server.Abort()
+
+	// Clients talk on file descriptors 6 and 7, and keep their
+	// standard output.
+	cmd := exec.Command("sh", "-c", "echo request >&7 && exec 7>&- && cat <&6")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	done := make(chan error, 1)
+	go func() { done <- RunCommand(client, cmd) }()
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "request\n" {
+		t.Errorf("read %q, %v, want %q", got, err, "request\n")
+	}
+	server.Write([]byte("response"))
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("RunCommand: %v", err)
+	}
+	if stdout.String() != "response" {
+		t.Errorf("command wrote %q, want %q", stdout.String(), "response")
+	}
+}
+
+func TestRunCommandFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	defer client.Abort()
+
+	// The stream ends with the command's output, the exit status is
+	// for the caller.
+	done := make(chan error, 1)
+	go func() { done <- RunCommand(server, exec.Command("sh", "-c", "echo partial; exit 3")) }()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if got, err := io.ReadAll(client); err != nil || string(got) != "partial\n" {
+		t.Errorf("read %q, %v, want %q", got, err, "partial\n")
+	}
+	var exitErr *exec.ExitError
+	if err := <-done; !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("RunCommand = %v, want exit status 3", err)
+	}
+}
@@ -0,0 +1,787 @@
+package curvecp
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	defaultDeadPeerThreshold    = 10
+	defaultHelloAttempts        = 8
+	defaultRehandshakeThreshold = 3
+	defaultMaxSendBuffer        = 1024 * 1024
+	defaultSharedKeyCacheSize   = 1024
+	defaultAverageGain          = 1. / 8
+	defaultDeviationGain        = 1. / 4
+	defaultDelayedAckFactor     = 8
+	defaultMinuteKeyInterval    = 30 * time.Second
+	defaultAcceptBacklog        = 128
+	defaultHalfOpenTimeout      = time.Minute
+	defaultSilentTimeout        = 2 * time.Minute
+)
+
+var (
+	defaultHandshakeBackoff = Backoff{Multiplier: 2, Max: 10 * time.Second}
+)
+
+// Backoff describes how retransmission timeouts grow when the same
+// packet has to be retransmitted repeatedly.
+type Backoff struct {
+	// Multiplier is applied to the timeout for every retransmission
+	// of the same packet. Values below 1 mean 1, i.e. no backoff.
+	Multiplier float64
+	// Max caps the timeout. Zero means no cap.
+	Max time.Duration
+	// Jitter is the fraction of the timeout, between 0 and 1, that
+	// is randomly added to or removed from it.
+	Jitter float64
+}
+
+// timeout returns how long to wait after sending a packet for the
+// retries-th time (0 for the first transmission), given the base
+// timeout.
+func (b *Backoff) timeout(base time.Duration, retries int, rand *rand.Rand) time.Duration {
+	d := float64(base)
+	for i := 0; i < retries && b.Multiplier > 1; i++ {
+		d *= b.Multiplier
+		if b.Max > 0 && d >= float64(b.Max) {
+			break
+		}
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// RTTEstimator tunes the Jacobson/Karels estimator Chicago derives
+// its retransmission timeout from. The defaults are those of the
+// reference implementation, and of the paper, which suit paths whose
+// RTT varies little. On paths where it swings widely, like satellite
+// links, lower gains smooth out the swings, and a larger deviation
+// gain follows them faster.
+type RTTEstimator struct {
+	// AverageGain is the weight of each sample in the smoothed RTT,
+	// between 0 and 1. Zero means the default of 1/8.
+	AverageGain float64
+	// DeviationGain is the weight of each sample's deviation in the
+	// mean deviation, between 0 and 1. Zero means the default of
+	// 1/4.
+	DeviationGain float64
+	// DelayedAckFactor is how many intervals between packets are
+	// added to the retransmission timeout, to allow for peers that
+	// delay their acknowledgments. Zero means the default of 8,
+	// negative means none.
+	DelayedAckFactor float64
+}
+
+func (e *RTTEstimator) averageGain() float64 {
+	if e.AverageGain == 0 {
+		return defaultAverageGain
+	}
+	return e.AverageGain
+}
+
+func (e *RTTEstimator) deviationGain() float64 {
+	if e.DeviationGain == 0 {
+		return defaultDeviationGain
+	}
+	return e.DeviationGain
+}
+
+func (e *RTTEstimator) delayedAckFactor() float64 {
+	switch {
+	case e.DelayedAckFactor == 0:
+		return defaultDelayedAckFactor
+	case e.DelayedAckFactor < 0:
+		return 0
+	}
+	return e.DelayedAckFactor
+}
+
+// A NonceSource makes the nonces of boxes under a long-term key,
+// which must never repeat for the same key. Nonce fills b, 16 bytes.
+// keys.NonceCounter is one.
+type NonceSource interface {
+	Nonce(b []byte) error
+}
+
+// RetransmitOrder selects what a connection sends first when it has
+// both data to retransmit and new data to send.
+type RetransmitOrder int
+
+const (
+	// RetransmitOldestFirst retransmits the oldest overdue data
+	// before sending anything new. This is the default, and what
+	// the reference implementation does.
+	RetransmitOldestFirst RetransmitOrder = iota
+	// RetransmitNewDataFirst sends newly written data before
+	// retransmitting, for latency sensitive protocols that care more
+	// about fresh data than about delivering stale data promptly.
+	RetransmitNewDataFirst
+)
+
+// BacklogPolicy selects what a server does with Initiates from new
+// clients while its accept backlog is full.
+type BacklogPolicy int
+
+const (
+	// BacklogDrop ignores the Initiates. The clients retransmit them,
+	// and get in once Accept has caught up. This is the default.
+	BacklogDrop BacklogPolicy = iota
+	// BacklogDefer holds on to up to a backlog's worth of Initiates,
+	// and starts their connections as soon as Accept makes room, so
+	// the clients don't wait for a retransmission.
+	BacklogDefer
+)
+
+// Config tunes the behavior of CurveCP connections, on both sides:
+// clients take it from Dialer.Config, servers from ListenWithConfig
+// and ListenUDPConnWithConfig. Options that only make sense on one
+// side say so, and are ignored on the other. A nil *Config is valid,
+// and uses the defaults for everything.
+type Config struct {
+	// DeadPeerThreshold is the number of consecutive unanswered
+	// keepalives or retransmissions after which the peer is
+	// considered dead, provided nothing was heard from it for a
+	// second either, and the connection fails with ErrPeerDead. Zero
+	// means the default of 10, negative disables dead peer detection.
+	DeadPeerThreshold int
+
+	// OnPeerDead, if not nil, is called in its own goroutine when a
+	// connection's peer is considered dead.
+	OnPeerDead func(c net.Conn)
+
+	// RehandshakeThreshold is the number of consecutive unanswered
+	// keepalives or retransmissions after which a client starts
+	// sending Hellos to the server. If it answers them, it's up but
+	// lost the connection, typically by restarting, or is only slow
+	// to answer it. If nothing is in flight either way, the client
+	// handshakes again with the same long-term key and carries on
+	// with new streams in the same connection. Otherwise data would
+	// be lost: the client keeps waiting on the old session, and if
+	// the peer would be considered dead, see DeadPeerThreshold, the
+	// connection fails with ErrSessionLost instead of ErrPeerDead.
+	// Zero means the default of 3, negative disables rehandshakes.
+	RehandshakeThreshold int
+
+	// UserTimeout, if nonzero, is how long written data may remain
+	// unacknowledged before the connection fails with
+	// ErrUserTimeout.
+	UserTimeout time.Duration
+	// MaxRetransmissions, if nonzero, is how many times a block of
+	// data may be retransmitted before the connection fails with
+	// ErrUserTimeout.
+	MaxRetransmissions int
+
+	// DataBackoff controls the retransmission timeout of stream data
+	// and keepalives. The zero value doesn't back off, leaving the
+	// timeout entirely to the congestion scheduler.
+	DataBackoff Backoff
+	// HandshakeBackoff controls the retransmission timeout of Hello
+	// and Initiate packets. The zero value means doubling up to 10
+	// seconds.
+	HandshakeBackoff Backoff
+	// HelloAttempts is how many Hellos a client sends to each of the
+	// server's addresses before giving up on the handshake. Zero
+	// means the default of 8.
+	HelloAttempts int
+
+	// IdleTimeout, if nonzero, is how long a connection may go
+	// without receiving anything from the peer before it is torn
+	// down, and Read and Write fail with ErrIdleTimeout. Keepalives
+	// keep a responsive peer's connection open, so this bounds how
+	// long a vanished peer's connection lingers. A server forgets
+	// the connection, a client releases its socket.
+	IdleTimeout time.Duration
+
+	// CongestionControl, if not nil, returns a new controller for
+	// each connection. The default is NewChicago.
+	CongestionControl func() CongestionController
+	// RTTEstimator tunes the RTT estimator of the default
+	// controller, Chicago.
+	RTTEstimator RTTEstimator
+
+	// MaxPacketRate, if nonzero, caps the rate at which a connection
+	// sends data, in packets per second, whatever its congestion
+	// controller allows. Each packet carries up to 1024 bytes.
+	MaxPacketRate int
+	// MaxSendInterval, if nonzero, is the longest a connection with
+	// data to send waits between packets, however slow its
+	// congestion controller would have it go. Acknowledgments and
+	// keepalives are not paced, and not affected.
+	MaxSendInterval time.Duration
+
+	// RetransmitOrder selects whether retransmissions or new data
+	// go first.
+	RetransmitOrder RetransmitOrder
+
+	// MaxSendBuffer is the most memory, in bytes, a connection's
+	// send buffer may grow to. The buffer starts small and grows
+	// with the measured bandwidth-delay product of the path. Zero
+	// means the default of 1MiB.
+	MaxSendBuffer int
+
+	// ReadBuffer and WriteBuffer, if nonzero, set the size of the
+	// operating system's receive and send buffers of the UDP sockets
+	// Listen and Dial use, see net.UDPConn.SetReadBuffer. Busy
+	// servers may need a larger receive buffer than the system's
+	// default to not drop bursts of packets.
+	ReadBuffer, WriteBuffer int
+
+	// AutoFlowLabel makes outgoing IPv6 packets carry a flow label
+	// derived from each connection's addresses and ports, so that
+	// multipath routers keep a connection on a single path. Linux
+	// only, and has no effect on IPv4.
+	AutoFlowLabel bool
+
+	// PinSourceAddress forbids roaming: packets for a connection are
+	// only accepted from the address that initiated it. Authenticated
+	// packets from elsewhere are dropped and reported to
+	// OnPinViolation.
+	PinSourceAddress bool
+	// OnPinViolation, if not nil, is called in its own goroutine
+	// with the source address of every packet dropped because of
+	// PinSourceAddress.
+	OnPinViolation func(c net.Conn, from net.Addr)
+
+	// PacketFilter, if not nil, is called by servers with the
+	// source address and the 8-byte magic of every packet they
+	// receive, before anything else is done with it. Packets for
+	// which it returns false are dropped, so operators can shed
+	// traffic from banned sources, or of unexpected types, before
+	// it costs any cryptography. It's called from the server's
+	// packet loop, and must be fast.
+	PacketFilter func(addr net.Addr, magic []byte) bool
+
+	// Clock, if not nil, replaces the system clock for timing the
+	// protocol: retransmissions, keepalives, idle timeouts, Hello
+	// retries and key rotation, see Clock.
+	Clock Clock
+
+	// OnForeignPacket, if not nil, is handed the packets a server
+	// receives that don't start with the magic of a packet from a
+	// CurveCP client, instead of dropping them, so that other
+	// protocols, like STUN keepalives, can share the socket given
+	// to ListenUDPConn. b is only valid during the call. It's
+	// called from the loop reading the socket, and must not block.
+	OnForeignPacket func(b []byte, addr net.Addr)
+
+	// OnHandshakeFailure, if not nil, is called by servers with
+	// the reason and source address of every packet they reject
+	// from clients they aren't connected to yet, for diagnosing
+	// clients that can't connect. It's called from the server's
+	// packet loop, and must not block.
+	OnHandshakeFailure func(failure HandshakeFailure, addr net.Addr)
+
+	// VerifyPeer, if not nil, enforces an identity policy, like
+	// pinning or an allowlist. It is called with the peer's
+	// long-term public key once the peer has proven it holds the
+	// secret key, the domain the client requested, and the peer's
+	// address: by servers for every new client, before Accept
+	// returns it, and by clients before Dial returns. If it returns
+	// an error, servers ignore the client's Initiate, and Dial fails
+	// with the error. Servers call it from their packet loop, it
+	// must not block. The Authorize method of an Authorizer, like
+	// KeySet or CachedAuthorizer, fits.
+	VerifyPeer func(key [32]byte, domain string, addr net.Addr) error
+
+	// Revoked, if not nil, reports client keys a server no longer
+	// lets in: their Initiates are ignored. KeySet.Contains and
+	// RevocationFile.Revoked fit.
+	Revoked func(key [32]byte) bool
+	// RevocationCheckInterval, if nonzero, is how often servers ask
+	// Revoked about their established connections' clients again,
+	// tearing down those whose keys were revoked since, and failing
+	// Read and Write with ErrRevoked.
+	RevocationCheckInterval time.Duration
+
+	// AcceptBacklog is how many new connections a server queues up
+	// for Accept. Zero means the default of 128.
+	AcceptBacklog int
+	// BacklogPolicy is what a server does with new clients while
+	// the accept backlog is full.
+	BacklogPolicy BacklogPolicy
+	// MaxConns, if nonzero, caps the number of connections a server
+	// handles at once. Initiates from new clients beyond it are
+	// ignored, and the clients retry.
+	MaxConns int
+	// MaxConnsPerHost and MaxHalfOpenPerHost, if nonzero, cap the
+	// connections a server handles from a single host, and those of
+	// them whose client hasn't got past the Initiate yet, so that one
+	// misbehaving host can't take up all of MaxConns or the accept
+	// backlog. Initiates from new clients beyond them are ignored.
+	MaxConnsPerHost, MaxHalfOpenPerHost int
+	// HostPrefixV4 and HostPrefixV6 are how many leading bits of
+	// their address clients share to count as one host. Zero means
+	// the defaults of 32 and 64: an IPv4 address, or an IPv6 /64.
+	HostPrefixV4, HostPrefixV6 int
+	// CookieRate, if nonzero, caps how many Hellos per second a
+	// server answers with a Cookie, allowing bursts of CookieBurst.
+	// Every answer costs a key generation and public-key
+	// cryptography, so this bounds what a flood of Hellos, which
+	// need not come from the addresses they claim, costs the server.
+	// Hellos beyond it are dropped before any cryptography, and the
+	// clients retry.
+	CookieRate  float64
+	CookieBurst int
+	// CookieRatePerHost and CookieBurstPerHost are the same, per
+	// host, see HostPrefixV4.
+	CookieRatePerHost  float64
+	CookieBurstPerHost int
+	// HalfOpenTimeout is how long a server keeps a connection whose
+	// client has sent nothing but Initiates, never answering the
+	// server. Zero means the default of a minute, negative disables
+	// it.
+	HalfOpenTimeout time.Duration
+	// SilentTimeout is how long a server keeps an established
+	// connection it has heard nothing from. Live peers send
+	// keepalives every 10 seconds. Zero means the default of 2
+	// minutes, negative disables it.
+	SilentTimeout time.Duration
+	// SingleUseCookies makes a server remember the Cookies that
+	// started connections for as long as they are good, and ignore
+	// Initiates reusing them. Otherwise, an attacker who captured an
+	// Initiate can replay it, and the data it carries, to start a
+	// second connection once the first has ended.
+	SingleUseCookies bool
+	// KeyProvider, if not nil, supplies a server's long-term secret
+	// key in place of the one passed to Listen, which may then be
+	// nil, and lets it change while the server runs. New clients
+	// need the new public key, established connections carry on.
+	KeyProvider KeyProvider
+	// KeyRing lists long-term keys a server honors besides its own,
+	// until their time is up, so that clients that know it by an old
+	// key can still connect while the new one spreads. Clients are
+	// answered under the key they used. The server advertises its
+	// own key only.
+	KeyRing []RingKey
+	// VirtualHosts maps domains to the long-term secret keys of
+	// further identities a server hosts on the same socket. Clients
+	// requesting one of these domains must connect to its key, and
+	// only to its key; Conn.Domain tells accepted connections apart.
+	// Each virtual host costs every Hello the server answers another
+	// public-key operation.
+	VirtualHosts map[string][]byte
+	// MinuteKeys, if not nil, supplies the minute keys a server seals
+	// its Cookies under, for instance to share them with other
+	// servers. MinuteKeyInterval then has no effect on them.
+	MinuteKeys MinuteKeys
+	// MinuteKeyFile, if not empty, is where a server saves its minute
+	// keys whenever it rotates them, and restores them from on
+	// startup if they're still good, so that a restart doesn't break
+	// handshakes in progress. The file is sealed under
+	// MinuteKeyFileKey, 32 bytes, or if that's nil under a key derived
+	// from the server's long-term secret key.
+	MinuteKeyFile    string
+	MinuteKeyFileKey []byte
+	// MinuteKeyInterval is how often a server replaces the minute
+	// key its Cookies are sealed under. A Cookie stays good for
+	// between one and two intervals, so this also bounds how long a
+	// client may take between Hello and Initiate. Zero means the
+	// default of 30 seconds.
+	MinuteKeyInterval time.Duration
+	// HandshakeTimeout, if nonzero, bounds how long Dial waits for
+	// the handshake to complete, like DialTimeout. Client only.
+	HandshakeTimeout time.Duration
+
+	// Protocols lists the application protocols a server accepts,
+	// see ProtocolDomain. Initiates requesting any other protocol are
+	// ignored. If empty, any protocol (or none) is accepted.
+	Protocols []string
+
+	// SharedKeyCacheSize is how many clients' long-term keys a
+	// server remembers the shared key of, to save verifying repeat
+	// clients' Initiates the cost of computing it. Zero means the
+	// default of 1024, negative disables the cache.
+	SharedKeyCacheSize int
+
+	// NonceSource, if not nil, makes the nonces of boxes under the
+	// long-term key: the vouches in a client's Initiates and a
+	// server's Cookies. Otherwise, and if it fails, they are
+	// random, which makes a repeat unlikely enough in practice, but
+	// the reference implementation keeps a counter.
+	NonceSource NonceSource
+
+	// LatencyAlarms are set on every connection, see LatencyAlarm.
+	LatencyAlarms []LatencyAlarm
+
+	// InsecureTap, if not nil, receives a plaintext copy of every
+	// message sent and received on the connection. This defeats the
+	// point of encrypting the traffic, and should only be used for
+	// debugging.
+	InsecureTap Tap
+}
+
+func (c *Config) deadPeerThreshold() int {
+	if c == nil || c.DeadPeerThreshold == 0 {
+		return defaultDeadPeerThreshold
+	}
+	return c.DeadPeerThreshold
+}
+
+func (c *Config) rehandshakeThreshold() int {
+	if c == nil || c.RehandshakeThreshold == 0 {
+		return defaultRehandshakeThreshold
+	}
+	return c.RehandshakeThreshold
+}
+
+func (c *Config) userTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.UserTimeout
+}
+
+func (c *Config) maxRetransmissions() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxRetransmissions
+}
+
+func (c *Config) dataBackoff() *Backoff {
+	if c == nil {
+		return &Backoff{}
+	}
+	return &c.DataBackoff
+}
+
+func (c *Config) handshakeBackoff() *Backoff {
+	if c == nil || c.HandshakeBackoff == (Backoff{}) {
+		return &defaultHandshakeBackoff
+	}
+	return &c.HandshakeBackoff
+}
+
+func (c *Config) helloAttempts() int {
+	if c == nil || c.HelloAttempts == 0 {
+		return defaultHelloAttempts
+	}
+	return c.HelloAttempts
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.IdleTimeout
+}
+
+func (c *Config) congestionController() CongestionController {
+	if c == nil || c.CongestionControl == nil {
+		s := newScheduler()
+		if c != nil {
+			s.estimator = c.RTTEstimator
+		}
+		return s
+	}
+	return c.CongestionControl()
+}
+
+// minSendInterval returns the shortest time between data packets, or
+// zero for no limit.
+func (c *Config) minSendInterval() time.Duration {
+	if c == nil || c.MaxPacketRate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(c.MaxPacketRate)
+}
+
+func (c *Config) maxSendInterval() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.MaxSendInterval
+}
+
+func (c *Config) retransmitOrder() RetransmitOrder {
+	if c == nil {
+		return RetransmitOldestFirst
+	}
+	return c.RetransmitOrder
+}
+
+func (c *Config) maxSendBuffer() int {
+	if c == nil || c.MaxSendBuffer == 0 {
+		return defaultMaxSendBuffer
+	}
+	return c.MaxSendBuffer
+}
+
+func (c *Config) acceptBacklog() int {
+	if c == nil || c.AcceptBacklog == 0 {
+		return defaultAcceptBacklog
+	}
+	return c.AcceptBacklog
+}
+
+func (c *Config) backlogPolicy() BacklogPolicy {
+	if c == nil {
+		return BacklogDrop
+	}
+	return c.BacklogPolicy
+}
+
+func (c *Config) maxConns() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxConns
+}
+
+func (c *Config) maxConnsPerHost() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxConnsPerHost
+}
+
+func (c *Config) maxHalfOpenPerHost() int {
+	if c == nil {
+		return 0
+	}
+	return c.MaxHalfOpenPerHost
+}
+
+func (c *Config) hostPrefixV4() int {
+	if c == nil || c.HostPrefixV4 == 0 {
+		return defaultHostPrefixV4
+	}
+	return c.HostPrefixV4
+}
+
+func (c *Config) hostPrefixV6() int {
+	if c == nil || c.HostPrefixV6 == 0 {
+		return defaultHostPrefixV6
+	}
+	return c.HostPrefixV6
+}
+
+func (c *Config) cookieRate() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.CookieRate
+}
+
+func (c *Config) cookieRatePerHost() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.CookieRatePerHost
+}
+
+func (c *Config) halfOpenTimeout() time.Duration {
+	if c == nil || c.HalfOpenTimeout == 0 {
+		return defaultHalfOpenTimeout
+	}
+	if c.HalfOpenTimeout < 0 {
+		return 0
+	}
+	return c.HalfOpenTimeout
+}
+
+func (c *Config) silentTimeout() time.Duration {
+	if c == nil || c.SilentTimeout == 0 {
+		return defaultSilentTimeout
+	}
+	if c.SilentTimeout < 0 {
+		return 0
+	}
+	return c.SilentTimeout
+}
+
+func (c *Config) singleUseCookies() bool {
+	return c != nil && c.SingleUseCookies
+}
+
+func (c *Config) keyProvider() KeyProvider {
+	if c == nil {
+		return nil
+	}
+	return c.KeyProvider
+}
+
+func (c *Config) keyRing() []RingKey {
+	if c == nil {
+		return nil
+	}
+	return c.KeyRing
+}
+
+func (c *Config) virtualHosts() map[string][]byte {
+	if c == nil {
+		return nil
+	}
+	return c.VirtualHosts
+}
+
+func (c *Config) minuteKeys() MinuteKeys {
+	if c == nil {
+		return nil
+	}
+	return c.MinuteKeys
+}
+
+func (c *Config) minuteKeyFile() string {
+	if c == nil {
+		return ""
+	}
+	return c.MinuteKeyFile
+}
+
+func (c *Config) minuteKeyInterval() time.Duration {
+	if c == nil || c.MinuteKeyInterval == 0 {
+		return defaultMinuteKeyInterval
+	}
+	return c.MinuteKeyInterval
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.HandshakeTimeout
+}
+
+// setupSocket applies the socket options of c to sock.
+func (c *Config) setupSocket(sock *net.UDPConn) error {
+	if c == nil {
+		return nil
+	}
+	if c.ReadBuffer != 0 {
+		if err := sock.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c.WriteBuffer != 0 {
+		if err := sock.SetWriteBuffer(c.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if c.AutoFlowLabel {
+		return setAutoFlowLabel(sock)
+	}
+	return nil
+}
+
+func (c *Config) pinSourceAddress() bool {
+	return c != nil && c.PinSourceAddress
+}
+
+func (c *Config) onPinViolation() func(net.Conn, net.Addr) {
+	if c == nil {
+		return nil
+	}
+	return c.OnPinViolation
+}
+
+func (c *Config) filterPacket(addr net.Addr, pb []byte) bool {
+	if c == nil || c.PacketFilter == nil {
+		return true
+	}
+	return c.PacketFilter(addr, pb[:8])
+}
+
+func (c *Config) clock() Clock {
+	if c == nil || c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
+}
+
+func (c *Config) onForeignPacket() func([]byte, net.Addr) {
+	if c == nil {
+		return nil
+	}
+	return c.OnForeignPacket
+}
+
+func (c *Config) onHandshakeFailure() func(HandshakeFailure, net.Addr) {
+	if c == nil {
+		return nil
+	}
+	return c.OnHandshakeFailure
+}
+
+func (c *Config) verifyPeer(key []byte, domain string, addr net.Addr) error {
+	if c == nil || c.VerifyPeer == nil {
+		return nil
+	}
+	var k [32]byte
+	copy(k[:], key)
+	return c.VerifyPeer(k, domain, addr)
+}
+
+func (c *Config) revoked(key []byte) bool {
+	if c == nil || c.Revoked == nil {
+		return false
+	}
+	var k [32]byte
+	copy(k[:], key)
+	return c.Revoked(k)
+}
+
+func (c *Config) revocationCheckInterval() time.Duration {
+	if c == nil || c.Revoked == nil {
+		return 0
+	}
+	return c.RevocationCheckInterval
+}
+
+// acceptsProtocol returns true if proto is an acceptable
+// application protocol.
+func (c *Config) acceptsProtocol(proto string) bool {
+	if c == nil || len(c.Protocols) == 0 {
+		return true
+	}
+	for _, p := range c.Protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) sharedKeyCacheSize() int {
+	if c == nil || c.SharedKeyCacheSize == 0 {
+		return defaultSharedKeyCacheSize
+	}
+	return c.SharedKeyCacheSize
+}
+
+// longTermNonce fills b, 16 bytes, with a nonce for a box under the
+// long-term key.
+func (c *Config) longTermNonce(b []byte) {
+	if c != nil && c.NonceSource != nil && c.NonceSource.Nonce(b) == nil {
+		return
+	}
+	randBytes(b)
+}
+
+func (c *Config) latencyAlarms() []LatencyAlarm {
+	if c == nil {
+		return nil
+	}
+	return c.LatencyAlarms
+}
+
+func (c *Config) insecureTap() Tap {
+	if c == nil {
+		return nil
+	}
+	return c.InsecureTap
+}
+
+func (c *Config) onPeerDead() func(net.Conn) {
+	if c == nil {
+		return nil
+	}
+	return c.OnPeerDead
+}
@@ -0,0 +1,37 @@
+package curvecp
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffTimeout(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tab := []struct {
+		b       Backoff
+		retries int
+		want    time.Duration
+	}{
+		{Backoff{}, 0, time.Second},
+		{Backoff{}, 5, time.Second},
+		{Backoff{Multiplier: 0.5}, 5, time.Second},
+		{Backoff{Multiplier: 2}, 0, time.Second},
+		{Backoff{Multiplier: 2}, 3, 8 * time.Second},
+		{Backoff{Multiplier: 2, Max: 5 * time.Second}, 3, 5 * time.Second},
+		{Backoff{Multiplier: 2, Max: 5 * time.Second}, 1000, 5 * time.Second},
+		{Backoff{Multiplier: 1.5}, 2, 2250 * time.Millisecond},
+	}
+	for _, tt := range tab {
+		if got := tt.b.timeout(time.Second, tt.retries, r); got != tt.want {
+			t.Errorf("%+v.timeout(1s, %d) = %s, want %s", tt.b, tt.retries, got, tt.want)
+		}
+	}
+
+	b := Backoff{Multiplier: 2, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		if got := b.timeout(time.Second, 1, r); got < 1500*time.Millisecond || got > 2500*time.Millisecond {
+			t.Fatalf("%+v.timeout(1s, 1) = %s, want within 25%% of 2s", b, got)
+		}
+	}
+}
@@ -5,6 +5,40 @@ import (
 	"time"
 )
 
+// A CongestionController decides how fast a connection sends data,
+// and how long it waits for an acknowledgment before retransmitting.
+// The connection reports what it observes, and asks for its decisions
+// before every transmission. Each connection has its own controller,
+// used only from the connection's goroutine.
+type CongestionController interface {
+	// OnRTT reports a round trip time, measured at now from an
+	// acknowledgment of data or of a keepalive.
+	OnRTT(now time.Time, rtt time.Duration)
+	// OnAck reports that n bytes of data were acknowledged at now.
+	OnAck(now time.Time, n int)
+	// OnLoss reports that a block of data went unacknowledged past
+	// the retransmission timeout, and is being sent again at now.
+	OnLoss(now time.Time)
+	// NextSendTime returns the earliest time the next block of data
+	// may be sent, given that the last one was sent at last.
+	NextSendTime(last time.Time) time.Time
+	// RTO returns the retransmission timeout.
+	RTO() time.Duration
+	// RTT returns the smoothed round trip time, or 0 before the
+	// first sample.
+	RTT() time.Duration
+	// RTTVar returns the mean deviation of the round trip time, or 0
+	// before the first sample.
+	RTTVar() time.Duration
+}
+
+// NewChicago returns a controller implementing Chicago, the
+// congestion control algorithm of the reference implementation, and
+// the default.
+func NewChicago() CongestionController {
+	return newScheduler()
+}
+
 // Scheduler keeps track of the congestion of the link and adjusts
 // various parameters, the most important two being the
 // inter-transmission delay and the retransmit timer.
@@ -31,6 +65,8 @@ type scheduler struct {
 	// observed RTT and RTT variance.
 	rttAverage time.Duration
 	rttMeanDev time.Duration
+	// The estimator's gains.
+	estimator RTTEstimator
 
 	// rttHigh and rttLow are simpler estimators of the highest and
 	// lowest RTTs seen in the lifetime of the connection. They
@@ -46,13 +82,18 @@ type scheduler struct {
 	// cycle. This keeps track of whether we just reached the
 	// top/bottom of the congestion cycle.
 	wasHigh, wasLow bool
-	// True if we're in the falling part of the congestion cycle, true
-	// if we're in the rising part.
+	// Whether any RTT sample since the last adjustment was a high or
+	// a low, becoming wasHigh and wasLow at the next adjustment.
+	seenHigh, seenLow bool
+	// True if we're in the falling part of the congestion cycle,
+	// false if we're in the rising part.
 	falling bool
 	// Last time we reversed direction in the congestion cycle.
 	lastEdge time.Time
 	// Last time we doubled the transmission rate.
 	lastDoubling time.Time
+	// Last time a retransmission halved the transmission rate.
+	lastPanic time.Time
 }
 
 func newScheduler() *scheduler {
@@ -63,36 +104,44 @@ func newScheduler() *scheduler {
 	}
 }
 
-func (s *scheduler) init(initRtt time.Duration) {
+const (
+	// Below this interval between transmissions, the rate no longer
+	// increases additively.
+	minAdditiveThrottle = 131072 * time.Nanosecond
+	// Below this interval, the rate is no longer doubled.
+	minDoublingThrottle = 65536 * time.Nanosecond
+)
+
+func (s *scheduler) init(now time.Time, initRtt time.Duration) {
 	s.txThrottle = initRtt
 	s.rttAverage = initRtt
 	s.rttMeanDev = initRtt / 2
 	s.rttHigh = initRtt
 	s.rttLow = initRtt
-	s.lastThrottleAdjustment = time.Now()
+	s.lastThrottleAdjustment = now
 }
 
 // Adjust adjusts the scheduler variables based on a new observation
-// of RTT.
-func (s *scheduler) Adjust(rtt time.Duration) {
+// of RTT, made at now.
+func (s *scheduler) Adjust(now time.Time, rtt time.Duration) {
 	// If this is the first RTT observation, initialize the
 	// scheduler.
 	if s.rttAverage == 0 {
-		s.init(rtt)
+		s.init(now, rtt)
 	}
 
 	// This is Jacobson/Karels's txTimeout calculation, straight from
-	// the paper, with a gain of .125 for the average and .25 for
-	// deviation. The paper goes into great detail about this
+	// the paper, with by default a gain of .125 for the average and
+	// .25 for deviation. The paper goes into great detail about this
 	// algorithm, refer to it for more.
 	averageDelta := rtt - s.rttAverage
-	s.rttAverage += averageDelta / 8
+	s.rttAverage += time.Duration(float64(averageDelta) * s.estimator.averageGain())
 	meanDevDelta := abs(averageDelta) - s.rttMeanDev
-	s.rttMeanDev += meanDevDelta / 4
+	s.rttMeanDev += time.Duration(float64(meanDevDelta) * s.estimator.deviationGain())
 	s.txTimeout = s.rttAverage + 4*s.rttMeanDev
 	// The reference implementation throws in more delay here to
-	// account for delayed acks. Not sure why.
-	s.txTimeout += 8 * s.txThrottle
+	// account for delayed acks, 8 intervals by default.
+	s.txTimeout += time.Duration(float64(s.txThrottle) * s.estimator.delayedAckFactor())
 
 	// Adjust the top and bottom of the congestion cycle.
 	s.rttHigh += (rtt - s.rttHigh) / 1024
@@ -103,8 +152,14 @@ func (s *scheduler) Adjust(rtt time.Duration) {
 	} else {
 		s.rttLow += lowDelta / 256
 	}
+	if s.rttAverage > s.rttHigh+5*time.Millisecond {
+		s.seenHigh = true
+	}
+	if s.rttAverage < s.rttLow {
+		s.seenLow = true
+	}
 
-	sinceAdjust := time.Since(s.lastThrottleAdjustment)
+	sinceAdjust := now.Sub(s.lastThrottleAdjustment)
 	// Reconsider txThrottle every 16 packet intervals.
 	if sinceAdjust >= 16*s.txThrottle {
 		if sinceAdjust > 10*time.Second {
@@ -112,21 +167,21 @@ func (s *scheduler) Adjust(rtt time.Duration) {
 			s.txThrottle = time.Duration(int64(time.Second) + s.rand.Int63n(int64(time.Second/8)))
 		}
 
-		s.lastThrottleAdjustment = time.Now()
+		s.lastThrottleAdjustment = now
 
 		// Additive increase to the transmission rate, if we're not
-		// already at ludicrous speed.
-		if s.txThrottle > 100*time.Microsecond {
-			// These maths taken straight from the implementation. I'm
-			// not sure I get why it adjusts the way it does, but I
-			// want to make progress.
-			const timeConstant = 2251799813685248 // 2^51
-			if s.txThrottle < 16*time.Millisecond {
-				// N = N - cN^3, avoids 1 division and is close to the next curve.
-				s.txThrottle -= s.txThrottle * s.txThrottle * s.txThrottle / timeConstant
+		// already at ludicrous speed. Adding c to the rate 1/N, with
+		// N in nanoseconds, makes N/(1 + cN^2), c = 2^-51, as in the
+		// reference implementation.
+		if s.txThrottle >= minAdditiveThrottle {
+			if s.txThrottle < 16777216 {
+				// Close to N - cN^3: with u = N/2^17, u^3 is
+				// N^3/2^51, as in the reference.
+				u := s.txThrottle / 131072
+				s.txThrottle -= u * u * u
 			} else {
-				// N = N/(1 + cN^2)
-				s.txThrottle = s.txThrottle / (1 + s.txThrottle*s.txThrottle/timeConstant)
+				d := float64(s.txThrottle)
+				s.txThrottle = time.Duration(d / (1 + d*d/2251799813685248))
 			}
 		}
 
@@ -139,35 +194,73 @@ func (s *scheduler) Adjust(rtt time.Duration) {
 		} else {
 			// We're past the high point of congestion, back off.
 			if s.wasHigh {
-				s.txThrottle += time.Duration(s.rand.Int63n(int64(s.txThrottle) / 4))
-				s.lastEdge = time.Now()
+				s.txThrottle += time.Duration(s.rand.Int63n(int64(s.txThrottle)/4 + 1))
+				s.lastEdge = now
 				s.falling = true
 			}
 		}
 
-		s.wasLow = s.rttAverage < s.rttLow
-		s.wasHigh = s.rttAverage > (s.rttHigh + 5*time.Millisecond)
+		s.wasLow, s.wasHigh = s.seenLow, s.seenHigh
+		s.seenLow, s.seenHigh = false, false
 
 		// Occasionally double our send rate, if not already at
 		// ludicrous speed.
-		if s.txThrottle > 100*time.Microsecond {
-			if time.Since(s.lastEdge) < 60*time.Second {
-				if time.Now().Before(s.lastDoubling.Add((4 * s.txThrottle) + (64 * s.txTimeout) + (5 * time.Second))) {
+		if s.txThrottle >= minDoublingThrottle {
+			if now.Sub(s.lastEdge) < 60*time.Second {
+				if now.Before(s.lastDoubling.Add((4 * s.txThrottle) + (64 * s.txTimeout) + (5 * time.Second))) {
 					return
 				}
 			} else {
-				if time.Now().Before(s.lastDoubling.Add((4 * s.txThrottle) + (2 * s.txTimeout))) {
+				if now.Before(s.lastDoubling.Add((4 * s.txThrottle) + (2 * s.txTimeout))) {
 					return
 				}
 			}
 
 			s.txThrottle /= 2
-			s.lastDoubling = time.Now()
-			s.lastEdge = time.Now()
+			s.lastDoubling = now
+			// Until the first edge, keep doubling at the fast
+			// pace above.
+			if !s.lastEdge.IsZero() {
+				s.lastEdge = now
+			}
 		}
 	}
 }
 
+func (s *scheduler) OnRTT(now time.Time, rtt time.Duration) {
+	s.Adjust(now, rtt)
+}
+
+// OnAck does nothing, acknowledgments count through their RTTs.
+func (s *scheduler) OnAck(now time.Time, n int) {}
+
+// OnLoss panics: it halves the transmission rate, at most once every
+// four retransmission timeouts, and marks an edge of the congestion
+// cycle.
+func (s *scheduler) OnLoss(now time.Time) {
+	if now.Sub(s.lastPanic) > 4*s.txTimeout {
+		s.txThrottle *= 2
+		s.lastPanic = now
+		s.lastEdge = now
+	}
+}
+
+func (s *scheduler) NextSendTime(last time.Time) time.Time {
+	return last.Add(s.txThrottle)
+}
+
+func (s *scheduler) RTO() time.Duration {
+	return s.txTimeout
+}
+
+func (s *scheduler) RTT() time.Duration {
+	return s.rttAverage
+}
+
+func (s *scheduler) RTTVar() time.Duration {
+	return s.rttMeanDev
+}
+
 func abs(d time.Duration) time.Duration {
 	if d < 0 {
 		return -d
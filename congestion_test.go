@@ -0,0 +1,231 @@
+package curvecp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerSteadyRTT(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	rtt := 20 * time.Millisecond
+	s.Adjust(now, rtt)
+
+	// On an uncongested path the rate only goes up, and never past
+	// the point where it stops being increased.
+	prev := s.txThrottle
+	for i := 0; i < 10000; i++ {
+		now = now.Add(16 * s.txThrottle)
+		s.Adjust(now, rtt)
+		if s.txThrottle > prev || s.txThrottle < minDoublingThrottle/2 {
+			t.Fatalf("after %d samples, throttle went from %s to %s", i, prev, s.txThrottle)
+		}
+		prev = s.txThrottle
+	}
+	if s.txThrottle >= rtt/100 {
+		t.Errorf("throttle still %s after 10000 samples", s.txThrottle)
+	}
+}
+
+func TestSchedulerAdditiveIncrease(t *testing.T) {
+	for _, throttle := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 5 * time.Second} {
+		s := newScheduler()
+		now := time.Now()
+		s.Adjust(now, throttle)
+		s.txThrottle = throttle
+		// Not time to double yet.
+		s.lastDoubling, s.lastEdge = now, now
+		s.Adjust(now.Add(16*throttle), throttle)
+		if s.txThrottle <= 0 || s.txThrottle > throttle {
+			t.Errorf("throttle %s adjusted to %s", throttle, s.txThrottle)
+		}
+	}
+}
+
+// TestSchedulerAdditiveStep checks a single additive increase against
+// the reference's N - (N/2^17)^3, and N/(1 + N^2/2^51) past 2^24ns.
+func TestSchedulerAdditiveStep(t *testing.T) {
+	for _, tt := range []struct {
+		throttle, want time.Duration
+	}{
+		{time.Millisecond, 1000000 - 7*7*7},
+		{10 * time.Millisecond, 10000000 - 76*76*76},
+		{16777215, 16777215 - 127*127*127},
+		// 2e7/(1 + 4e14/2^51), truncated.
+		{20 * time.Millisecond, 16983181},
+	} {
+		s := newScheduler()
+		now := time.Now()
+		s.Adjust(now, tt.throttle)
+		s.txThrottle = tt.throttle
+		s.lastDoubling, s.lastEdge = now, now
+		s.Adjust(now.Add(16*tt.throttle), tt.throttle)
+		if s.txThrottle != tt.want {
+			t.Errorf("throttle %d adjusted to %d, want %d", tt.throttle, s.txThrottle, tt.want)
+		}
+	}
+}
+
+func TestSchedulerDoubling(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	rtt := 10 * time.Millisecond
+	s.Adjust(now, rtt)
+
+	// nextDoubling adjusts on a steady RTT until the rate doubles, and
+	// returns how long that took.
+	nextDoubling := func() time.Duration {
+		start := now
+		for i := 0; i < 100000; i++ {
+			now = now.Add(16 * s.txThrottle)
+			s.Adjust(now, rtt)
+			if s.lastDoubling.Equal(now) {
+				return now.Sub(start)
+			}
+		}
+		t.Fatalf("no doubling after %s", now.Sub(start))
+		return 0
+	}
+
+	// Until the first edge, the rate doubles every 4N + 2 RTO, and
+	// doubling doesn't make an edge.
+	for i := 0; i < 3; i++ {
+		if d := nextDoubling(); d >= 5*time.Second {
+			t.Errorf("doubling %d before any edge after %s", i, d)
+		}
+		if !s.lastEdge.IsZero() {
+			t.Fatalf("doubling %d made an edge", i)
+		}
+	}
+
+	// After one, it waits for 4N + 64 RTO + 5s.
+	s.OnLoss(now)
+	if d := nextDoubling(); d < 5*time.Second+64*s.txTimeout {
+		t.Errorf("doubling %s after an edge", d)
+	}
+	if !s.lastEdge.Equal(now) {
+		t.Errorf("doubling after an edge didn't move it")
+	}
+}
+
+func TestSchedulerLoss(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	s.Adjust(now, 10*time.Millisecond)
+	throttle, rto := s.txThrottle, s.txTimeout
+
+	// Losses halve the rate, at most once every 4 RTO.
+	s.OnLoss(now)
+	if s.txThrottle != 2*throttle || !s.lastEdge.Equal(now) {
+		t.Errorf("after a loss, throttle %s and edge %s, want %s and %s", s.txThrottle, s.lastEdge, 2*throttle, now)
+	}
+	s.OnLoss(now.Add(4 * rto))
+	if s.txThrottle != 2*throttle {
+		t.Errorf("second loss within 4 RTO changed throttle to %s", s.txThrottle)
+	}
+	s.OnLoss(now.Add(4*rto + 1))
+	if s.txThrottle != 4*throttle {
+		t.Errorf("loss after 4 RTO: throttle %s, want %s", s.txThrottle, 4*throttle)
+	}
+}
+
+func TestSchedulerEstimator(t *testing.T) {
+	tests := []struct {
+		estimator     RTTEstimator
+		avg, dev, rto time.Duration
+	}{
+		{RTTEstimator{}, 112500 * time.Microsecond, 53125 * time.Microsecond, 1125 * time.Millisecond},
+		{RTTEstimator{AverageGain: 0.5, DeviationGain: 0.5, DelayedAckFactor: -1}, 150 * time.Millisecond, 62500 * time.Microsecond, 400 * time.Millisecond},
+	}
+	for _, test := range tests {
+		s := (&Config{RTTEstimator: test.estimator}).congestionController().(*scheduler)
+		// The first sample sets the average and deviation to
+		// 100ms and 50ms, then counts as a sample with no
+		// deviation.
+		now := time.Now()
+		s.Adjust(now, 100*time.Millisecond)
+		s.Adjust(now, 200*time.Millisecond)
+		if s.RTT() != test.avg || s.RTTVar() != test.dev || s.RTO() != test.rto {
+			t.Errorf("%+v: RTT %s, deviation %s, RTO %s, want %s, %s, %s", test.estimator, s.RTT(), s.RTTVar(), s.RTO(), test.avg, test.dev, test.rto)
+		}
+	}
+}
+
+// fixedRate is a CongestionController sending at a fixed pace, that
+// counts what it's told.
+type fixedRate struct {
+	interval    time.Duration
+	rtts, acked int
+	losses      int
+}
+
+func (f *fixedRate) OnRTT(now time.Time, rtt time.Duration) { f.rtts++ }
+func (f *fixedRate) OnAck(now time.Time, n int)             { f.acked += n }
+func (f *fixedRate) OnLoss(now time.Time)                   { f.losses++ }
+func (f *fixedRate) NextSendTime(last time.Time) time.Time  { return last.Add(f.interval) }
+func (f *fixedRate) RTO() time.Duration                     { return time.Second }
+func (f *fixedRate) RTT() time.Duration                     { return 10 * time.Millisecond }
+func (f *fixedRate) RTTVar() time.Duration                  { return time.Millisecond }
+
+func TestCongestionControl(t *testing.T) {
+	ccs := make(chan *fixedRate, 2)
+	server, client := newConnPair(t, &Config{CongestionControl: func() CongestionController {
+		f := &fixedRate{interval: 100 * time.Microsecond}
+		ccs <- f
+		return f
+	}})
+	startConnPair(server, client)
+
+	testTransfer(t, client, server, 50*1024)
+	var cc *fixedRate
+	for i := 0; i < 2; i++ {
+		if f := <-ccs; client.sched == CongestionController(f) {
+			cc = f
+		}
+	}
+	if cc == nil {
+		t.Fatal("client isn't using the configured controller")
+	}
+	// Once the client's pump exits, everything is acknowledged and
+	// the controller can be looked at.
+	go server.Close()
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-client.done
+	if cc.rtts == 0 || cc.acked != 50*1024 {
+		t.Errorf("controller saw %d RTTs and %d bytes acknowledged, want some and %d", cc.rtts, cc.acked, 50*1024)
+	}
+}
+
+func TestPacingBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		config   Config
+		min, max time.Duration
+	}{
+		// 20 blocks at 200 per second.
+		{"MaxPacketRate", 0, Config{MaxPacketRate: 200}, 95 * time.Millisecond, 5 * time.Second},
+		// Rather than 20 seconds.
+		{"MaxSendInterval", time.Second, Config{MaxSendInterval: time.Millisecond}, 0, 5 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.CongestionControl = func() CongestionController {
+				return &fixedRate{interval: test.interval}
+			}
+			server, client := newConnPair(t, &config)
+			startConnPair(server, client)
+			defer client.Close()
+			defer server.Close()
+
+			start := time.Now()
+			testTransfer(t, client, server, 20*1024)
+			if d := time.Since(start); d < test.min || d > test.max {
+				t.Errorf("transfer took %s, want between %s and %s", d, test.min, test.max)
+			}
+		})
+	}
+}
@@ -1,25 +1,83 @@
 package curvecp
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/binary"
 	"errors"
+	"io"
+	mrand "math/rand"
 	"net"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/johnwchadwick/curvecp/bufpool"
 	"github.com/johnwchadwick/curvecp/ringbuf"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
 const (
-	numSendBlocks  = 128       // *1024 = 128k of send buffer.
-	recvBufferSize = 64 * 1024 // 64k
+	initialSendBlocks = 16        // *1024 = 16k of send buffer, autotuned up from there.
+	recvBufferSize    = 64 * 1024 // 64k
+	// How many packets out of order an incoming packet may be and
+	// still be accepted, see acceptNonce.
+	replayWindow = 64
 )
 
 var (
-	// TODO: make it an appropriate net.Error
-	deadlineExceeded = errors.New("deadline exceeded")
+	// If no packet has been sent for this long, and no data is in
+	// flight, send a keepalive to get a fresh RTT sample. This keeps
+	// the scheduler's view of the link current through idle
+	// periods.
+	keepaliveInterval = 10 * time.Second
+
+	// However many retransmissions went unanswered, the peer isn't
+	// considered dead until nothing was heard from it for this long:
+	// on fast links, with retransmission timeouts of a millisecond, a
+	// pause of a few on either side would otherwise be enough.
+	deadPeerMinSilence = time.Second
+)
+
+var (
+	deadlineExceeded = os.ErrDeadlineExceeded
+
+	// ErrStreamTooLong is returned by Write when the data would
+	// take the stream past the protocol's 2^60 byte limit.
+	ErrStreamTooLong = errors.New("stream length limit exceeded")
+
+	// ErrUserTimeout is returned by Read and Write on a connection
+	// that gave up retransmitting data, per Config.UserTimeout and
+	// Config.MaxRetransmissions.
+	ErrUserTimeout net.Error = &timeoutError{"unacknowledged data timed out"}
+
+	// ErrPeerDead is returned by Read and Write on a connection
+	// whose peer stopped answering keepalives and retransmissions.
+	ErrPeerDead = errors.New("peer not responding")
+
+	// ErrSessionLost is returned by Read and Write on a client
+	// connection whose server is up but lost the session, typically
+	// by restarting, while data was in flight: it answered Hellos
+	// but not the session until the peer would have been considered
+	// dead, see Config.RehandshakeThreshold.
+	ErrSessionLost = errors.New("server lost the session")
+
+	// ErrStreamFailed is returned by Read, after the last of the
+	// data, when the peer ended its stream with the failure flag,
+	// meaning the data is incomplete.
+	ErrStreamFailed = errors.New("peer's stream ended with a failure")
 )
 
+// timeoutError is a net.Error for fatal timeouts.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return false }
+
 type opResult struct {
 	n   int
 	err error
@@ -30,155 +88,1081 @@ type block struct {
 	buf []byte
 	// Position of the first byte of buf in the overall stream.
 	pos int64
+	// Time of the first and last transmissions, zero if never sent.
+	firstSent, sent time.Time
+	// When to retransmit the block if it isn't acknowledged.
+	retransmitAt time.Time
+	// Number of times the block has been transmitted.
+	transmissions int
+	// ID of the message that last carried the block.
+	id uint32
+	// End of stream flag sent with the block's data, if it's the
+	// last block.
+	eof uint16
 
 	// The backing array for buf. Static so that we can preallocate
 	// all the memory associated with a connection at the beginning.
 	arr [1024]byte
 }
 
-// Implements net.Conn. Used by both client and server, with different
-// message/packet pumps.
-type conn struct {
+// A Conn is a CurveCP connection, client or server side. It
+// implements net.Conn, its other methods give access to what's
+// specific to CurveCP.
+type Conn struct {
 	// Peer's long-term public key, aka its identity.
 	peerIdentity [32]byte
+	// Short-term public keys of the current session.
+	localShortTermKey, peerShortTermKey [32]byte
+	// When the current session's handshake started, and when it
+	// completed, zero while a client waits for the server's first
+	// answer.
+	handshakeStart, handshakeEnd time.Time
 	// The shared key used to seal/open boxes to/from this client.
 	sharedKey [32]byte
-	// The domain requested during initiation.
-	domain string
+	// The domain requested during initiation, and the application
+	// protocol requested in it, if any.
+	domain, protocol string
+	config           *Config
+	// Config.Clock.
+	clock Clock
+
+	// The data the client sent along with its Initiate, see
+	// InitialData.
+	initialData []byte
+
+	// If not nil, the connection has failed, and all I/O returns
+	// this error.
+	err error
 
 	// from pump to conn, packets to process. Only Initiate and
 	// Message packets come through here.
 	packetIn chan packet
 	// The socket for sending. Don't read this, use packetIn for
 	// reading.
-	sock *net.UDPConn
+	sock net.PacketConn
+	// The buffers of outgoing packets, shared with whoever reads
+	// sock.
+	bufs *bufpool.Pool
+	// Where to send packets. Updated from every authenticated
+	// packet, since clients are allowed to roam. The pump writes it
+	// under addrMu, others read it under addrMu.
+	addr   net.Addr
+	addrMu sync.Mutex
 
-	// From user to pump, request to read/write some data.
+	// Prepended to every outgoing Message packet: magic,
+	// extensions, and for clients the short-term public key.
+	header []byte
+	// Nonce prefixes for outgoing and incoming Message boxes.
+	sendNoncePrefix, recvNoncePrefix []byte
+	// Offset of the compressed nonce in incoming Message packets,
+	// the box follows it.
+	recvNonceOffset int
+	// Last nonce used for an outgoing Message.
+	nonce uint64
+	// Highest nonce of an authenticated packet from the peer, and
+	// which of the replayWindow nonces before it were seen, bit i
+	// for recvNonce-1-i. Older nonces, and seen ones, are replays.
+	recvNonce  uint64
+	recvWindow uint64
+	// Authenticated packets dropped as replays.
+	replays int
+	// Packets dropped for breaking the format's length, padding or
+	// field constraints.
+	malformed int
+	// Client only: what it takes to handshake again.
+	client *clientState
+	// Client only: until the server answers, messages go out in
+	// Initiate packets, made of initiateHeader, a nonce, and a box
+	// of initiatePrefix followed by the message.
+	initiating                     bool
+	initiateHeader, initiatePrefix []byte
+	// Magic of incoming Message packets.
+	recvMagic []byte
+
+	// From user to pump, request to read/write some data. The pump
+	// copies what it can to/from its own buffers and answers
+	// immediately, it never holds on to the user's buffer.
 	readRequest  chan []byte
 	writeRequest chan []byte
-	// Deadlines for those ops
-	readDeadline  time.Time
-	writeDeadline time.Time
+	// Deadlines for those ops, set from any goroutine.
+	readDeadline, writeDeadline *deadline
 	// From pump to user, result of a read or write.
-	ioResult chan opResult
+	readResult  chan opResult
+	writeResult chan opResult
+	// From pump to user, signaled when there may be new data to
+	// read or buffer space to write into. Buffered, a stale signal
+	// just means a Read or Write retries for nothing.
+	readable, writable chan struct{}
+
+	// From user to pump, a kind of close, see Close, Abort,
+	// CloseWrite and CloseRead, and the answer.
+	closeRequest chan int
+	closeResult  chan error
+	// Closed by the pump once the stream it sends has ended: all of
+	// it acknowledged after Close, or failed with flushErr.
+	flushed  chan struct{}
+	flushErr error
+	// Closed when the pump exits.
+	done chan struct{}
+	// If not nil, called when the pump exits, to release what the
+	// conn's creator set up for it.
+	onClose func()
+	// The end of stream flag of our stream, 0 until the user closes
+	// the connection or its writing side.
+	sendEOF uint16
+	// The end of stream flag Close or Abort asked for, 0 while the
+	// connection is open.
+	closing uint16
+	// Whether the user closed the reading side. Data received after
+	// that is acknowledged and dropped.
+	readClosed bool
+	// Once flushed, when to stop waiting for the peer to end its
+	// own stream.
+	lingerUntil time.Time
+	// From user to pump, a new idle timeout, see SetIdleTimeout.
+	idleRequest chan time.Duration
+	// From the server's reaper to pump, to time the connection out.
+	expireRequest chan struct{}
+	// How long the connection survives without hearing from the
+	// peer, 0 for ever, and when it last heard from it.
+	idleTimeout time.Duration
+	lastRecv    time.Time
+	// Server only: when to check next whether the client's key was
+	// revoked, zero for never.
+	revokeCheck time.Time
+	// The end of stream flag of the peer's stream, 0 until it
+	// arrives, and the stream's length.
+	recvEOF    uint16
+	recvEOFPos int64
+
+	// Congestion state, drives pacing and retransmissions.
+	sched CongestionController
+	// Random source for jitter, not for cryptography.
+	rand *mrand.Rand
+	// Last message ID handed out.
+	lastID uint32
+	// Last time any packet was sent, and last time a data block was
+	// sent.
+	lastSend, lastBlock time.Time
+	// Moving average of the fraction of block transmissions that
+	// are retransmissions.
+	retransmitRate float64
+	// Data packets sent, and how many were retransmissions.
+	blocksSent, retransmissions int
+	// Every RTT sample.
+	rttHistogram RTTHistogram
+	// From user to pump, new alarms to watch.
+	alarmRequest chan LatencyAlarm
+	alarms       []alarmState
+	// From user to pump, request for Stats, and the answer.
+	statsRequest chan struct{}
+	statsResult  chan Stats
+	// The stats when the pump exited.
+	finalStats Stats
+	// From user to pump, request for ConnectionState, the answer,
+	// and the state when the pump exited.
+	stateRequest chan struct{}
+	stateResult  chan ConnectionState
+	finalState   ConnectionState
+	// Outstanding keepalive, if keepaliveID != 0, and when to resend
+	// it.
+	keepaliveID     uint32
+	keepaliveSent   time.Time
+	keepaliveResend time.Time
+	// Consecutive keepalives and retransmissions sent without
+	// hearing back from the peer.
+	unanswered int
+	// Authenticated packets dropped for coming from the wrong
+	// address, see Config.PinSourceAddress.
+	pinViolations int
 
 	// Blocks that needs to be sent.
 	toSend *list.List // of *block
-	// Freelist of blocks. All allocated on creation of the conn, we
-	// never allocate more.
+	// Freelist of blocks. Blocks are allocated up front, and more
+	// as the send buffer grows, but never released.
 	sendFree *list.List // of *block
+	// Total number of blocks, in toSend or sendFree.
+	sendBlocks int
+	// Stream position of the next byte written by the user.
+	sendPos int64
 
 	// Received data waiting for a reader.
 	received *ringbuf.Ringbuf
+	// From user to pump, requests for zero-copy access to received,
+	// see Peek.
+	peekRequest chan peekRequest
+	peekResult  chan peekResult
+	// Bytes at the start of received consumed by ReadSlice, but
+	// still in use by the caller.
+	held int
+	// Where views of received that wrap around are assembled.
+	peekBuf []byte
+	// Stream position of the next byte we expect from the peer. All
+	// bytes before it have been received.
+	recvPos int64
+	// Ranges of the stream after recvPos that arrived out of order,
+	// sorted and disjoint. Their data is already in place in the
+	// free space of received.
+	recvRanges []ackRange
+	// True if we owe the peer an acknowledgment, and the message ID
+	// to acknowledge (or 0).
+	ackNeeded bool
+	ackID     uint32
+
+	// Scratch space for message plaintexts.
+	sendMsg, recvMsg [maxMessageLen + box.Overhead]byte
 }
 
-func newConn(sock *net.UDPConn, peerIdentity, publicKey, privateKey []byte, domain string) *conn {
+// newConn creates a conn. The caller must start its pump. header is
+// prepended to all outgoing Message packets, client selects which
+// side of the Message packet formats this conn speaks.
+func newConn(sock net.PacketConn, addr net.Addr, header []byte, client bool, peerIdentity, publicKey, privateKey []byte, domain string, config *Config) *Conn {
 	if len(peerIdentity) != 32 || len(publicKey) != 32 || len(privateKey) != 32 {
 		panic("wrong key size")
 	}
-	c := &conn{
+	clock := config.clock()
+	now := clock.Now()
+	c := &Conn{
 		domain: domain,
+		config: config,
+		clock:  clock,
 
-		packetIn: make(chan packet),
+		packetIn: make(chan packet, connQuantum),
 		sock:     sock,
+		bufs:     bufpool.New(packetSize),
+		addr:     addr,
+
+		header: append([]byte(nil), header...),
+
+		readRequest:   make(chan []byte),
+		writeRequest:  make(chan []byte),
+		readResult:    make(chan opResult),
+		writeResult:   make(chan opResult),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		alarmRequest:  make(chan LatencyAlarm),
+		statsRequest:  make(chan struct{}),
+		statsResult:   make(chan Stats),
+		stateRequest:  make(chan struct{}),
+		stateResult:   make(chan ConnectionState),
+		peekRequest:   make(chan peekRequest),
+		peekResult:    make(chan peekResult),
+		closeRequest:  make(chan int),
+		closeResult:   make(chan error),
+		idleRequest:   make(chan time.Duration),
+		expireRequest: make(chan struct{}),
+		flushed:       make(chan struct{}),
+		done:          make(chan struct{}),
 
-		readRequest:  make(chan []byte),
-		writeRequest: make(chan []byte),
-		ioResult:     make(chan opResult),
+		idleTimeout: config.idleTimeout(),
+		lastRecv:    now,
+
+		handshakeStart: now,
+		handshakeEnd:   now,
+
+		sched: config.congestionController(),
+		rand:  mrand.New(mrand.NewSource(now.UnixNano())),
 
 		toSend:   list.New(),
 		sendFree: list.New(),
 
 		received: ringbuf.New(recvBufferSize),
 	}
+	if client {
+		c.sendNoncePrefix = clientMessageNoncePrefix
+		c.recvNoncePrefix = serverMessageNoncePrefix
+		c.recvNonceOffset = 40
+		c.recvMagic = serverMessageMagic
+	} else {
+		if d := config.revocationCheckInterval(); d > 0 {
+			c.revokeCheck = now.Add(d)
+		}
+		c.sendNoncePrefix = serverMessageNoncePrefix
+		c.recvNoncePrefix = clientMessageNoncePrefix
+		c.recvNonceOffset = 72
+		c.recvMagic = clientMessageMagic
+	}
+
+	_, c.protocol = SplitProtocolDomain(domain)
+	for _, a := range config.latencyAlarms() {
+		c.alarms = append(c.alarms, alarmState{LatencyAlarm: a})
+	}
+
 	// Key setup.
 	copy(c.peerIdentity[:], peerIdentity)
 	var pub, priv [32]byte
 	copy(pub[:], publicKey)
 	copy(priv[:], privateKey)
 	box.Precompute(&c.sharedKey, &pub, &priv)
+	c.peerShortTermKey = pub
+	curve25519.ScalarBaseMult(&c.localShortTermKey, &priv)
 
 	// Send blocks
-	for i := 0; i < numSendBlocks; i++ {
+	for ; c.sendBlocks < initialSendBlocks; c.sendBlocks++ {
 		c.sendFree.PushBack(new(block))
 	}
 
-	go c.pump()
 	return c
 }
 
-func (c *conn) Read(b []byte) (int, error) {
-	var deadline <-chan time.Time
-	if !c.readDeadline.IsZero() {
-		deadline = time.After(c.readDeadline.Sub(time.Now()))
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
 	}
-	select {
-	case c.readRequest <- b:
-	case <-deadline:
-		return 0, deadlineExceeded
+	deadline := c.readDeadline.wait()
+	for {
+		select {
+		case c.readRequest <- b:
+		case <-deadline:
+			return 0, deadlineExceeded
+		case <-c.done:
+			return 0, c.doneErr()
+		}
+		// The pump answers right away, no deadline needed.
+		res := <-c.readResult
+		if res.n > 0 || res.err != nil {
+			return res.n, res.err
+		}
+		select {
+		case <-c.readable:
+		case <-deadline:
+			return 0, deadlineExceeded
+		case <-c.done:
+			return 0, c.doneErr()
+		}
 	}
-	// Once readRequest has succeeded, this will return promptly, so
-	// don't reapply the deadline (plus, it would corrupt the stream
-	// to do so - pump is performing an operation on our behalf,
-	// ignoring that would cause a gap in the data).
-	res := <-c.ioResult
-	return res.n, res.err
 }
 
-func (c *conn) Write(b []byte) (int, error) {
-	var deadline <-chan time.Time
-	if !c.writeDeadline.IsZero() {
-		deadline = time.After(c.writeDeadline.Sub(time.Now()))
-	}
+func (c *Conn) Write(b []byte) (int, error) {
+	deadline := c.writeDeadline.wait()
 	written := 0
 	for len(b) > 0 {
 		select {
 		case c.writeRequest <- b:
 		case <-deadline:
 			return written, deadlineExceeded
+		case <-c.done:
+			return written, c.doneErr()
 		}
 		// See above, no deadline here.
-		res := <-c.ioResult
+		res := <-c.writeResult
 		written += res.n
 		b = b[res.n:]
 		if res.err != nil {
 			return written, res.err
 		}
+		if res.n == 0 {
+			select {
+			case <-c.writable:
+			case <-deadline:
+				return written, deadlineExceeded
+			case <-c.done:
+				return written, c.doneErr()
+			}
+		}
 	}
 	return written, nil
 }
 
-func (c *conn) Close() error {
-	return notImplemented
+// ConnectionState describes a CurveCP connection.
+type ConnectionState struct {
+	// The domain requested by the client, with the application
+	// protocol label removed.
+	Domain string
+	// The application protocol requested by the client, see
+	// ProtocolDomain.
+	Protocol string
+	// The peer's long-term public key: the client's on a server, the
+	// server's on a client.
+	PeerKey []byte
+	// Fingerprints, see Fingerprint, of the short-term public keys
+	// of the current session, ours and the peer's. A client that
+	// handshakes again gets new ones.
+	LocalShortTermKey, PeerShortTermKey string
+	// When the current session's handshake started and completed. A
+	// client's starts with its first Hello and completes when the
+	// server first answers, HandshakeEnd is zero until then. A server
+	// knows nothing of the client before its Initiate, both are when
+	// that arrived.
+	HandshakeStart, HandshakeEnd time.Time
+	// The smoothed round trip time, 0 before the first sample.
+	RTT time.Duration
+}
+
+// ConnectionState returns details about the connection. Once the
+// connection is closed, they stay as they were at the end.
+func (c *Conn) ConnectionState() ConnectionState {
+	select {
+	case c.stateRequest <- struct{}{}:
+		return <-c.stateResult
+	case <-c.done:
+		return c.finalState
+	}
+}
+
+// connectionState makes a ConnectionState, from the pump.
+func (c *Conn) connectionState() ConnectionState {
+	domain, _ := SplitProtocolDomain(c.domain)
+	return ConnectionState{
+		Domain:            domain,
+		Protocol:          c.protocol,
+		PeerKey:           append([]byte(nil), c.peerIdentity[:]...),
+		LocalShortTermKey: Fingerprint(c.localShortTermKey[:]),
+		PeerShortTermKey:  Fingerprint(c.peerShortTermKey[:]),
+		HandshakeStart:    c.handshakeStart,
+		HandshakeEnd:      c.handshakeEnd,
+		RTT:               c.sched.RTT(),
+	}
+}
+
+// PeerKey returns the peer's long-term public key, which identifies
+// it: the client's on a server, the server's on a client.
+func (c *Conn) PeerKey() []byte {
+	return append([]byte(nil), c.peerIdentity[:]...)
+}
+
+// Domain returns the domain requested by the client, with the
+// application protocol label removed, see ConnectionState.
+func (c *Conn) Domain() string {
+	domain, _ := SplitProtocolDomain(c.domain)
+	return domain
+}
+
+// Extensions returns the client and server extensions of the
+// connection's packets, see Dialer.ClientExtension and
+// ServerExtension.
+func (c *Conn) Extensions() (client, server [16]byte) {
+	if c.client != nil {
+		return c.client.ext, c.client.serverExt
+	}
+	copy(client[:], c.header[8:24])
+	copy(server[:], c.header[24:40])
+	return client, server
+}
+
+// InitialData returns the data the client sent in its Initiate
+// packet, i.e. the beginning of the client's stream, so that servers
+// can look at a client's first request without blocking in
+// Read. Returns nil if the Initiate carried no data.
+func (c *Conn) InitialData() []byte {
+	return c.initialData
 }
 
-func (c *conn) LocalAddr() net.Addr {
+func (c *Conn) LocalAddr() net.Addr {
 	return c.sock.LocalAddr()
 }
 
-func (c *conn) RemoteAddr() net.Addr {
-	return c.sock.RemoteAddr()
+// RemoteAddr returns the peer's address, as of its last
+// authenticated packet.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	return c.addr
 }
 
-func (c *conn) SetDeadline(t time.Time) error {
-	// Not thread-safe. TODO: figure out if it's supposed to be.
-	c.readDeadline = t
-	c.writeDeadline = t
+// SetDeadline sets both the read and write deadlines. Like all
+// deadlines, it may be set from any goroutine, and applies to I/O
+// already waiting.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
-func (c *conn) SetReadDeadline(t time.Time) error {
-	c.readDeadline = t
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
 	return nil
 }
 
-func (c *conn) SetWriteDeadline(t time.Time) error {
-	c.writeDeadline = t
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
 	return nil
 }
 
-func (c *conn) pump() {
+// pump is the connection's event loop, and the only goroutine that
+// touches its state. Each turn, it sends what the scheduler allows,
+// then waits for the earliest of: a packet to decrypt and process, a
+// request from the user, or the time of the next transmission,
+// retransmission or keepalive. It exits once the connection is
+// closed, see finished.
+func (c *Conn) pump() {
+	timer := c.clock.NewTimer(time.Hour)
+	defer timer.Stop()
+	defer c.teardown()
 	for {
-		select {}
+		now := c.clock.Now()
+		c.checkIdle(now)
+		c.checkRevoked(now)
+		wake := c.transmit(now)
+		if c.finished(now) {
+			return
+		}
+		if !c.lingerUntil.IsZero() && c.lingerUntil.Before(wake) {
+			wake = c.lingerUntil
+		}
+		if t := c.idleDeadline(); !t.IsZero() && t.Before(wake) {
+			wake = t
+		}
+		if !c.revokeCheck.IsZero() && c.revokeCheck.Before(wake) {
+			wake = c.revokeCheck
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		timer.Reset(wake.Sub(c.clock.Now()))
+
+		select {
+		case p := <-c.packetIn:
+			c.handlePacket(p)
+		case b := <-c.readRequest:
+			c.readResult <- c.read(b)
+		case b := <-c.writeRequest:
+			c.writeResult <- c.write(b)
+		case req := <-c.peekRequest:
+			c.peekResult <- c.handlePeek(req)
+		case a := <-c.alarmRequest:
+			c.alarms = append(c.alarms, alarmState{LatencyAlarm: a})
+			c.checkAlarms()
+		case <-c.statsRequest:
+			c.statsResult <- c.stats()
+		case <-c.stateRequest:
+			c.stateResult <- c.connectionState()
+		case kind := <-c.closeRequest:
+			c.closeResult <- c.handleClose(kind)
+		case c.idleTimeout = <-c.idleRequest:
+		case <-c.expireRequest:
+			c.fail(ErrIdleTimeout)
+		case <-timer.C():
+		}
+	}
+}
+
+// signal does a non-blocking send on ch, one of the readable and
+// writable channels.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fail marks the connection as failed with err. Pending and future
+// I/O return err.
+func (c *Conn) fail(err error) {
+	if c.err != nil {
+		return
 	}
+	c.err = err
+	if err == ErrPeerDead {
+		if f := c.config.onPeerDead(); f != nil {
+			go f(c)
+		}
+	}
+	signal(c.readable)
+	signal(c.writable)
+}
+
+// read copies received data into b.
+func (c *Conn) read(b []byte) opResult {
+	c.releaseHeld()
+	if c.readClosed {
+		return opResult{0, net.ErrClosed}
+	}
+	if c.err != nil {
+		return opResult{0, c.err}
+	}
+	n := c.received.Read(b)
+	if n == 0 {
+		return opResult{0, c.streamEnd()}
+	}
+	return opResult{n, nil}
+}
+
+// streamEnd returns the error reads get past the end of the peer's
+// stream, once all of it has arrived: io.EOF or ErrStreamFailed. nil
+// while there is more to come.
+func (c *Conn) streamEnd() error {
+	if c.recvEOF == 0 || c.recvPos != c.recvEOFPos {
+		return nil
+	}
+	if c.recvEOF == eofFailure {
+		return ErrStreamFailed
+	}
+	return io.EOF
+}
+
+// write copies as much of b as possible into send blocks.
+func (c *Conn) write(b []byte) opResult {
+	if c.sendEOF != 0 {
+		return opResult{0, net.ErrClosed}
+	}
+	if c.err != nil {
+		return opResult{0, c.err}
+	}
+	if left := maxStreamLen - c.sendPos; int64(len(b)) > left {
+		if left == 0 {
+			return opResult{0, ErrStreamTooLong}
+		}
+		b = b[:left]
+	}
+	n := 0
+	// Top up the last block if it hasn't been sent yet.
+	if e := c.toSend.Back(); e != nil {
+		if blk := e.Value.(*block); blk.transmissions == 0 && len(blk.buf) < c.maxBlockData() {
+			m := copy(blk.arr[len(blk.buf):c.maxBlockData()], b)
+			blk.buf = blk.arr[:len(blk.buf)+m]
+			n += m
+		}
+	}
+	for n < len(b) && c.sendFree.Len() > 0 {
+		blk := c.sendFree.Remove(c.sendFree.Front()).(*block)
+		m := copy(blk.arr[:c.maxBlockData()], b[n:])
+		blk.buf = blk.arr[:m]
+		blk.pos = c.sendPos + int64(n)
+		blk.firstSent, blk.sent = time.Time{}, time.Time{}
+		blk.transmissions = 0
+		blk.id = 0
+		blk.eof = 0
+		c.toSend.PushBack(blk)
+		n += m
+	}
+	c.sendPos += int64(n)
+	return opResult{n, nil}
+}
+
+// maxBlockData returns how much data a new block may hold. Clients
+// still initiating must fit their messages in Initiate packets.
+func (c *Conn) maxBlockData() int {
+	if c.initiating {
+		return maxInitiateMessageLen - messageHeaderLen
+	}
+	return maxMessageData
+}
+
+// transmit sends whatever is due at time now: acknowledgments, new or
+// retransmitted data, keepalives. Returns the next time transmit
+// should be called.
+func (c *Conn) transmit(now time.Time) (wake time.Time) {
+	wake = now.Add(time.Hour)
+	setWake := func(t time.Time) {
+		if t.Before(wake) {
+			wake = t
+		}
+	}
+	if c.err != nil {
+		return
+	}
+	if max := c.config.deadPeerThreshold(); max > 0 && c.unanswered >= max {
+		dead := c.lastRecv.Add(deadPeerMinSilence)
+		if !dead.After(now) {
+			if c.client != nil && c.client.answered {
+				c.fail(ErrSessionLost)
+			} else {
+				c.fail(ErrPeerDead)
+			}
+			return
+		}
+		setWake(dead)
+	}
+	if c.client != nil {
+		if t := c.probe(now); !t.IsZero() {
+			setWake(t)
+		}
+	}
+	if e := c.toSend.Front(); e != nil && c.config.userTimeout() > 0 {
+		if blk := e.Value.(*block); blk.transmissions > 0 {
+			// The front block is the oldest unacknowledged one.
+			giveUp := blk.firstSent.Add(c.config.userTimeout())
+			if !giveUp.After(now) {
+				c.fail(ErrUserTimeout)
+				return
+			}
+			setWake(giveUp)
+		}
+	}
+
+	// Pick a block to send: the most overdue retransmission, or
+	// failing that the first unsent block. RetransmitNewDataFirst
+	// reverses the priorities.
+	var next *block
+	var nextTime time.Time
+	for e := c.toSend.Front(); e != nil; e = e.Next() {
+		blk := e.Value.(*block)
+		if blk.transmissions == 0 {
+			if next == nil || nextTime.After(now) || c.config.retransmitOrder() == RetransmitNewDataFirst {
+				next, nextTime = blk, now
+			}
+			break
+		}
+		if next == nil || blk.retransmitAt.Before(nextTime) {
+			next, nextTime = blk, blk.retransmitAt
+		}
+	}
+	if next != nil {
+		if paced := c.nextSendTime(c.lastBlock); paced.After(nextTime) {
+			nextTime = paced
+		}
+		if nextTime.After(now) {
+			setWake(nextTime)
+		} else {
+			if next.transmissions > 0 {
+				if max := c.config.maxRetransmissions(); max > 0 && next.transmissions > max {
+					c.fail(ErrUserTimeout)
+					return
+				}
+				// Only the oldest block counts towards declaring the
+				// peer dead: after a burst of losses, many blocks come
+				// due at once, faster than the peer could answer.
+				if next == c.toSend.Front().Value.(*block) {
+					c.unanswered++
+				}
+				c.retransmitRate += (1 - c.retransmitRate) / 16
+				c.retransmissions++
+				c.sched.OnLoss(now)
+			} else {
+				next.firstSent = now
+				c.retransmitRate -= c.retransmitRate / 16
+			}
+			c.checkAlarms()
+			c.lastID++
+			next.id = c.lastID
+			next.sent = now
+			next.transmissions++
+			c.blocksSent++
+			next.retransmitAt = now.Add(c.config.dataBackoff().timeout(c.sched.RTO(), next.transmissions-1, c.rand))
+			c.lastBlock = now
+			c.sendMessage(now, &message{
+				id:   next.id,
+				pos:  next.pos,
+				data: next.buf,
+				eof:  next.eof,
+			})
+			setWake(now)
+		}
+	}
+
+	// Acknowledgments ride along with data when the pacer lets data
+	// out, and otherwise go out on their own immediately. They are
+	// never paced: holding them back behind our own congestion would
+	// stall the peer's stream as well.
+	if c.ackNeeded {
+		c.sendMessage(now, &message{})
+	}
+
+	if c.toSend.Len() == 0 {
+		// Send a keepalive after an idle period, and keep resending
+		// it on the retransmit timer until it's answered.
+		ka := c.lastSend.Add(keepaliveInterval)
+		if c.keepaliveID != 0 {
+			ka = c.keepaliveResend
+		}
+		if !ka.After(now) {
+			if c.keepaliveID != 0 {
+				c.unanswered++
+			}
+			c.lastID++
+			c.keepaliveID = c.lastID
+			c.keepaliveSent = now
+			c.keepaliveResend = now.Add(c.config.dataBackoff().timeout(c.sched.RTO(), c.unanswered, c.rand))
+			c.sendMessage(now, &message{id: c.keepaliveID})
+			setWake(c.keepaliveResend)
+		} else {
+			setWake(ka)
+		}
+	}
+	return wake
+}
+
+// sampleRTT takes note of an RTT measured at now.
+func (c *Conn) sampleRTT(now time.Time, rtt time.Duration) {
+	c.sched.OnRTT(now, rtt)
+	c.rttHistogram.Record(rtt)
+}
+
+// nextSendTime returns the earliest time the next block of data may
+// be sent after one sent at last: when the congestion controller
+// says, within the configured bounds.
+func (c *Conn) nextSendTime(last time.Time) time.Time {
+	t := c.sched.NextSendTime(last)
+	if min := c.config.minSendInterval(); min > 0 && t.Before(last.Add(min)) {
+		t = last.Add(min)
+	}
+	if max := c.config.maxSendInterval(); max > 0 && t.After(last.Add(max)) {
+		t = last.Add(max)
+	}
+	return t
+}
+
+// growSendBuffer allocates more send blocks if the bandwidth-delay
+// product measured by the scheduler needs them, up to the configured
+// maximum.
+func (c *Conn) growSendBuffer() {
+	interval := c.nextSendTime(time.Time{}).Sub(time.Time{})
+	if interval <= 0 {
+		return
+	}
+	// Blocks sent in one RTT at the current pace, doubled so that
+	// writers can stay ahead of the acknowledgments.
+	want := 2 * int(c.sched.RTT()/interval)
+	if max := c.config.maxSendBuffer() / len(block{}.arr); want > max {
+		want = max
+	}
+	if c.sendBlocks >= want {
+		return
+	}
+	for ; c.sendBlocks < want; c.sendBlocks++ {
+		c.sendFree.PushBack(new(block))
+	}
+	signal(c.writable)
+}
+
+// sendMessage fills in the acknowledgment fields of m, and sends it
+// to the peer.
+func (c *Conn) sendMessage(now time.Time, m *message) {
+	m.ackID = c.ackID
+	c.fillAcks(m)
+	c.ackNeeded, c.ackID = false, 0
+	c.tap(true, m)
+
+	c.nonce++
+	var nonce [24]byte
+	copy(nonce[:], c.sendNoncePrefix)
+	binary.LittleEndian.PutUint64(nonce[16:], c.nonce)
+
+	header, plaintext := c.header, c.sendMsg[:0]
+	if c.initiating {
+		copy(nonce[:], initiateNoncePrefix)
+		header = c.initiateHeader
+		plaintext = append(plaintext, c.initiatePrefix...)
+	}
+	plaintext = plaintext[:len(plaintext)+len(m.marshal(c.sendMsg[len(plaintext):]))]
+
+	pkt := c.bufs.Get()
+	n := copy(pkt, header)
+	copy(pkt[n:], nonce[16:])
+	pkt = box.SealAfterPrecomputation(pkt[:n+8], plaintext, &nonce, &c.sharedKey)
+	c.sock.WriteTo(pkt, c.addr)
+	c.bufs.Put(pkt)
+	c.lastSend = now
+}
+
+// handlePacket processes an incoming Message, or an Initiate that has
+// already been verified by the server pump.
+func (c *Conn) handlePacket(p packet) {
+	defer p.release()
+
+	if c.client != nil && bytes.Equal(p.buf[:8], cookieMagic) {
+		c.handleCookie(p.buf)
+		return
+	}
+	var plaintext []byte
+	var nonce uint64
+	if bytes.Equal(p.buf[:8], initiateMagic) {
+		// The server pump has replaced the box with its plaintext,
+		// the message is at the end.
+		plaintext = p.buf[528 : len(p.buf)-box.Overhead]
+		nonce = binary.LittleEndian.Uint64(p.buf[168:])
+	} else {
+		if !bytes.Equal(p.buf[:8], c.recvMagic) {
+			return
+		}
+		if !validMessagePacket(p.buf, c.recvNonceOffset+8+box.Overhead) {
+			c.malformed++
+			return
+		}
+		var fullNonce [24]byte
+		copy(fullNonce[:], c.recvNoncePrefix)
+		copy(fullNonce[16:], p.buf[c.recvNonceOffset:c.recvNonceOffset+8])
+		var ok bool
+		plaintext, ok = box.OpenAfterPrecomputation(c.recvMsg[:0], p.buf[c.recvNonceOffset+8:], &fullNonce, &c.sharedKey)
+		if !ok {
+			return
+		}
+		nonce = binary.LittleEndian.Uint64(fullNonce[16:])
+	}
+	// Nothing changes until the message is known to be sound.
+	var m message
+	if !m.unmarshal(plaintext) {
+		c.malformed++
+		return
+	}
+	// Before the nonce is taken, so that a copy from elsewhere can't
+	// burn it for the packet from the pinned address.
+	if c.config.pinSourceAddress() && p.Addr.String() != c.addr.String() {
+		c.pinViolations++
+		if f := c.config.onPinViolation(); f != nil {
+			go f(c, p.Addr)
+		}
+		return
+	}
+	if !c.acceptNonce(nonce) {
+		c.replays++
+		return
+	}
+	// Authenticated, the peer is at this address now, and still
+	// alive.
+	if p.Addr.String() != c.addr.String() {
+		c.addrMu.Lock()
+		c.addr = p.Addr
+		c.addrMu.Unlock()
+	}
+	c.unanswered = 0
+	c.lastRecv = c.clock.Now()
+	// The server has our Initiate, regular Messages from now on.
+	if c.initiating {
+		c.handshakeEnd = c.lastRecv
+	}
+	c.initiating = false
+
+	c.tap(false, &m)
+	now := c.clock.Now()
+
+	if m.ackID != 0 {
+		if m.ackID == c.keepaliveID {
+			c.sampleRTT(now, now.Sub(c.keepaliveSent))
+			c.growSendBuffer()
+			c.checkAlarms()
+			c.keepaliveID = 0
+		}
+		for e := c.toSend.Front(); e != nil; e = e.Next() {
+			if blk := e.Value.(*block); blk.id == m.ackID {
+				c.sampleRTT(now, now.Sub(blk.sent))
+				c.growSendBuffer()
+				c.checkAlarms()
+				break
+			}
+		}
+	}
+	for e := c.toSend.Front(); e != nil; {
+		blk, next := e.Value.(*block), e.Next()
+		// The end of the stream has no position to acknowledge, only
+		// the message carrying it.
+		if blk.transmissions > 0 && m.acked(blk.pos, blk.pos+int64(len(blk.buf))) && (blk.eof == 0 || blk.id == m.ackID) {
+			c.sched.OnAck(now, len(blk.buf))
+			c.sendFree.PushBack(c.toSend.Remove(e))
+			signal(c.writable)
+		}
+		e = next
+	}
+
+	// Messages without data, i.e. pure acknowledgments and
+	// keepalives, don't touch the stream: no position moves and
+	// readers aren't woken.
+	if len(m.data) > 0 {
+		c.receive(m.pos, m.data)
+	}
+	if m.eof != 0 && c.recvEOF == 0 {
+		c.recvEOF, c.recvEOFPos = m.eof, m.pos+int64(len(m.data))
+		signal(c.readable)
+	}
+	// Acknowledge anything that asks for it, with or without data.
+	if m.id != 0 {
+		c.ackNeeded, c.ackID = true, m.id
+	}
+}
+
+// acceptNonce returns true if an authenticated packet with the given
+// nonce is new, and records it. Packets reordered by the network by up
+// to replayWindow others are still accepted, once.
+func (c *Conn) acceptNonce(n uint64) bool {
+	switch {
+	case n > c.recvNonce:
+		shift := n - c.recvNonce
+		if shift > replayWindow {
+			c.recvWindow = 0
+		} else {
+			// The previous highest becomes bit shift-1.
+			c.recvWindow = c.recvWindow<<shift | 1<<(shift-1)
+		}
+		c.recvNonce = n
+		return true
+	case n == c.recvNonce || c.recvNonce-n > replayWindow:
+		return false
+	}
+	bit := uint64(1) << (c.recvNonce - n - 1)
+	if c.recvWindow&bit != 0 {
+		return false
+	}
+	c.recvWindow |= bit
+	return true
+}
+
+// receive stores stream data from the peer, starting at stream
+// position pos. Data past recvPos is kept aside until the gap before
+// it is filled.
+func (c *Conn) receive(pos int64, data []byte) {
+	end := pos + int64(len(data))
+	if end <= c.recvPos {
+		return
+	}
+	if pos < c.recvPos {
+		data = data[c.recvPos-pos:]
+		pos = c.recvPos
+	}
+	if pos > c.recvPos {
+		if pos-c.recvPos >= recvBufferSize {
+			return
+		}
+		if n := c.received.WriteAt(data, int(pos-c.recvPos)); n > 0 {
+			c.addRecvRange(ackRange{pos, pos + int64(n)})
+		}
+		return
+	}
+
+	n := c.received.Write(data)
+	if n == 0 {
+		return
+	}
+	c.recvPos += int64(n)
+	// The data may have filled the gap before ranges received out
+	// of order.
+	for len(c.recvRanges) > 0 && c.recvRanges[0].start <= c.recvPos {
+		if r := c.recvRanges[0]; r.end > c.recvPos {
+			c.recvPos += int64(c.received.Extend(int(r.end - c.recvPos)))
+		}
+		c.recvRanges = c.recvRanges[1:]
+	}
+	if c.readClosed {
+		c.received.Discard(c.received.Size())
+		return
+	}
+	signal(c.readable)
+}
+
+// addRecvRange adds r to recvRanges, merging it with the ranges it
+// overlaps or touches.
+func (c *Conn) addRecvRange(r ackRange) {
+	i := 0
+	for i < len(c.recvRanges) && c.recvRanges[i].end < r.start {
+		i++
+	}
+	j := i
+	for j < len(c.recvRanges) && c.recvRanges[j].start <= r.end {
+		if c.recvRanges[j].start < r.start {
+			r.start = c.recvRanges[j].start
+		}
+		if c.recvRanges[j].end > r.end {
+			r.end = c.recvRanges[j].end
+		}
+		j++
+	}
+	if i == j {
+		c.recvRanges = append(c.recvRanges, ackRange{})
+		copy(c.recvRanges[i+1:], c.recvRanges[i:])
+	} else {
+		c.recvRanges = append(c.recvRanges[:i+1], c.recvRanges[j:]...)
+	}
+	c.recvRanges[i] = r
+}
+
+// fillAcks sets the acknowledged ranges of m: everything up to
+// recvPos, then the first ranges received out of order.
+func (c *Conn) fillAcks(m *message) {
+	m.acks = [len(m.acks)]ackRange{{0, c.recvPos}}
+	copy(m.acks[1:], c.recvRanges)
 }
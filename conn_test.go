@@ -0,0 +1,786 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/impair"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// feed pumps packets from sock into c, as readLoop and the server
+// pump would.
+func feed(sock net.PacketConn, c *Conn) {
+	for {
+		pb := c.bufs.Get()
+		n, addr, err := sock.ReadFrom(pb)
+		if err != nil {
+			return
+		}
+		c.packetIn <- packet{addr, pb[:n], c.bufs}
+	}
+}
+
+// newConnPair returns a server and client conn that will talk to each
+// other over loopback once started, skipping the handshake. Both use
+// config.
+func newConnPair(t *testing.T, config *Config) (server, client *Conn) {
+	ssock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ssock.Close()
+		csock.Close()
+	})
+
+	cpk, csk, _ := box.GenerateKey(rand.Reader)
+	spk, ssk, _ := box.GenerateKey(rand.Reader)
+	var ext [32]byte
+
+	header := append(append([]byte(nil), serverMessageMagic...), ext[:]...)
+	server = newConn(ssock, csock.LocalAddr(), header, false, cpk[:], cpk[:], ssk[:], "example.com", config)
+
+	header = append(append(append([]byte(nil), clientMessageMagic...), ext[:]...), cpk[:]...)
+	client = newConn(csock, ssock.LocalAddr(), header, true, spk[:], spk[:], csk[:], "example.com", config)
+
+	return server, client
+}
+
+// startConnPair starts the pumps of conns returned by newConnPair.
+func startConnPair(server, client *Conn) {
+	go server.pump()
+	go client.pump()
+	go feed(server.sock, server)
+	go feed(client.sock, client)
+}
+
+func TestConnTransfer(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	testTransfer(t, client, server, 300*1024)
+	testTransfer(t, server, client, 300*1024)
+}
+
+func TestConnImpaired(t *testing.T) {
+	profile := impair.Profile{
+		Loss:      0.05,
+		Duplicate: 0.02,
+		Reorder:   0.05,
+		Latency:   5 * time.Millisecond,
+		Jitter:    2 * time.Millisecond,
+	}
+	socks := make([]*impair.Conn, 2)
+	for i := range socks {
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile.Seed = int64(i)
+		socks[i] = impair.New(sock, profile)
+		defer socks[i].Close()
+	}
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenPacketConn(socks[0], priv[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	c, err := DialPacketConn(socks[1], socks[0].LocalAddr(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 100*1024)
+	if stats := socks[1].Stats(); stats.Lost == 0 {
+		t.Errorf("no packets lost on the way: %+v", stats)
+	}
+}
+
+func TestConnPeerDead(t *testing.T) {
+	dead := make(chan net.Conn, 2)
+	server, client := newConnPair(t, &Config{
+		DeadPeerThreshold: 2,
+		OnPeerDead:        func(c net.Conn) { dead <- c },
+	})
+	startConnPair(server, client)
+	// Cut the client off, as if it had crashed.
+	client.sock.Close()
+
+	if _, err := server.Write([]byte("hello?")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	// The client hears nothing either, and may be declared dead in
+	// the same instant.
+	timeout := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case c := <-dead:
+			done = c == net.Conn(server)
+			if !done && c != net.Conn(client) {
+				t.Fatalf("OnPeerDead called with %v, want the server conn", c)
+			}
+		case <-timeout:
+			t.Fatal("OnPeerDead not called")
+		}
+	}
+	if _, err := server.Read(make([]byte, 10)); err != ErrPeerDead {
+		t.Errorf("Read on dead conn = %v, want ErrPeerDead", err)
+	}
+}
+
+func TestConnPeerDeadBurstLoss(t *testing.T) {
+	server, _ := newConnPair(t, &Config{DeadPeerThreshold: 3})
+	server.write(make([]byte, 5*1024))
+	// All 5 blocks were lost, and come due for retransmission at the
+	// same time. That's one unanswered attempt, not 5.
+	now := time.Now()
+	for e := server.toSend.Front(); e != nil; e = e.Next() {
+		blk := e.Value.(*block)
+		blk.firstSent, blk.sent, blk.retransmitAt = now.Add(-time.Second), now.Add(-time.Second), now
+		blk.transmissions = 1
+	}
+	chicago(server).txThrottle = 0
+	for i := 0; i < 5; i++ {
+		server.transmit(now)
+	}
+	if server.err != nil || server.unanswered != 1 {
+		t.Errorf("after a burst of retransmissions, unanswered = %d and err = %v, want 1 and nil", server.unanswered, server.err)
+	}
+}
+
+func TestConnSelectiveAck(t *testing.T) {
+	_, client := newConnPair(t, nil)
+	data := make([]byte, 5000)
+	rand.Read(data)
+
+	// Blocks 1 and 3 are lost.
+	client.receive(1000, data[1000:2000])
+	client.receive(3000, data[3000:5000])
+	var m message
+	client.fillAcks(&m)
+	want := [6]ackRange{{0, 0}, {1000, 2000}, {3000, 5000}}
+	if client.recvPos != 0 || m.acks != want {
+		t.Errorf("acks after losses = %v, recvPos %d, want %v, 0", m.acks, client.recvPos, want)
+	}
+
+	client.receive(2000, data[2000:3000])
+	client.receive(0, data[:1000])
+	client.fillAcks(&m)
+	if want = [6]ackRange{{0, 5000}}; client.recvPos != 5000 || m.acks != want {
+		t.Errorf("acks after retransmissions = %v, recvPos %d, want %v, 5000", m.acks, client.recvPos, want)
+	}
+	got := make([]byte, len(data))
+	if n := client.received.Read(got); n != len(data) || !bytes.Equal(got, data) {
+		t.Errorf("reassembled stream differs from sent data")
+	}
+}
+
+func TestConnSelectiveRetransmit(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	server.write(make([]byte, 4*1024))
+	now := time.Now()
+	for e := server.toSend.Front(); e != nil; e = e.Next() {
+		blk := e.Value.(*block)
+		blk.sent, blk.transmissions = now, 1
+	}
+	// Only the second block was lost.
+	client.recvPos = 1024
+	client.recvRanges = []ackRange{{2048, 4096}}
+	client.sendMessage(now, &message{})
+	deliver(t, server)
+
+	var left []int64
+	for e := server.toSend.Front(); e != nil; e = e.Next() {
+		left = append(left, e.Value.(*block).pos)
+	}
+	if len(left) != 1 || left[0] != 1024 {
+		t.Errorf("blocks left to retransmit at %v, want only the lost one, at 1024", left)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	data := make([]byte, 20*1024)
+	rand.Read(data)
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close() }()
+
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAll = %d bytes, %v, want the %d written and EOF", len(got), err, len(data))
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v, want net.ErrClosed", err)
+	}
+	if err := client.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close = %v, want net.ErrClosed", err)
+	}
+
+	// The client lingers until the server ends its stream too.
+	if err := server.Close(); err != nil {
+		t.Errorf("server Close = %v", err)
+	}
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("client pump still running after both sides closed")
+	}
+}
+
+func TestConnAbort(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	testTransfer(t, client, server, 1000)
+	if err := client.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 10)); err != ErrStreamFailed {
+		t.Errorf("Read after the peer aborted = %v, want ErrStreamFailed", err)
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	// A request ended by CloseWrite, answered after its end.
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after CloseWrite = %v, want net.ErrClosed", err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(server); string(got) != "request" || err != nil {
+		t.Fatalf("server ReadAll = %q, %v, want %q", got, err, "request")
+	}
+	if _, err := server.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(client); string(got) != "response" || err != nil {
+		t.Errorf("client ReadAll = %q, %v, want %q", got, err, "response")
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Close after CloseWrite = %v", err)
+	}
+}
+
+func TestConnCloseRead(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := server.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("pending Read = %v, want net.ErrClosed", err)
+	}
+
+	// More than the receive buffer holds still goes through, and
+	// the server can still write.
+	data := make([]byte, 2*recvBufferSize)
+	client.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, server, client, 1000)
+	if _, err := server.Read(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after CloseRead = %v, want net.ErrClosed", err)
+	}
+}
+
+func testTransfer(t *testing.T, w, r *Conn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		if _, err := w.Write(data); err != nil {
+			t.Errorf("Write: %s", err)
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received data differs from sent data")
+	}
+}
+
+func TestConnPast4GiB(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	// Pretend almost 4GiB have already gone through, so that the
+	// transfer crosses the 32-bit boundary.
+	const start = 1<<32 - 100*1024
+	server.sendPos, client.recvPos = start, start
+	startConnPair(server, client)
+
+	testTransfer(t, server, client, 200*1024)
+}
+
+func TestConnStreamLimit(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	server.sendPos, client.recvPos = maxStreamLen-10, maxStreamLen-10
+	startConnPair(server, client)
+
+	n, err := server.Write(make([]byte, 20))
+	if n != 10 || err != ErrStreamTooLong {
+		t.Errorf("Write past the stream limit = %d, %v, want 10, ErrStreamTooLong", n, err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 10)); err != nil {
+		t.Errorf("Read up to the stream limit: %s", err)
+	}
+}
+
+func TestConnUserTimeout(t *testing.T) {
+	for _, config := range []*Config{
+		{DeadPeerThreshold: -1, UserTimeout: 500 * time.Millisecond},
+		{DeadPeerThreshold: -1, MaxRetransmissions: 2},
+	} {
+		server, client := newConnPair(t, config)
+		startConnPair(server, client)
+		client.sock.Close()
+
+		if _, err := server.Write([]byte("hello?")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		_, err := server.Read(make([]byte, 10))
+		if err != ErrUserTimeout {
+			t.Errorf("Read with %+v = %v, want ErrUserTimeout", *config, err)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Read error %v is not a net.Error timeout", err)
+		}
+	}
+}
+
+// recordingTap records the stream data seen in each direction.
+type recordingTap struct {
+	sync.Mutex
+	in, out map[int64][]byte
+}
+
+func (r *recordingTap) Message(c net.Conn, m *TapMessage) {
+	r.Lock()
+	defer r.Unlock()
+	if len(m.Data) == 0 {
+		return
+	}
+	if m.Outgoing {
+		r.out[m.Pos] = append([]byte(nil), m.Data...)
+	} else {
+		r.in[m.Pos] = append([]byte(nil), m.Data...)
+	}
+}
+
+func (r *recordingTap) stream(blocks map[int64][]byte) []byte {
+	r.Lock()
+	defer r.Unlock()
+	var ret []byte
+	for b := blocks[0]; len(b) > 0; b = blocks[int64(len(ret))] {
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func TestConnTap(t *testing.T) {
+	tap := &recordingTap{in: map[int64][]byte{}, out: map[int64][]byte{}}
+	server, client := newConnPair(t, nil)
+	server.config = &Config{InsecureTap: tap}
+	startConnPair(server, client)
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tap.stream(tap.in); string(got) != "ping" {
+		t.Errorf("tapped incoming stream = %q, want %q", got, "ping")
+	}
+	if got := tap.stream(tap.out); string(got) != "pong" {
+		t.Errorf("tapped outgoing stream = %q, want %q", got, "pong")
+	}
+}
+
+func TestConnDeadlines(t *testing.T) {
+	server, client := newConnPair(t, &Config{DeadPeerThreshold: -1})
+	startConnPair(server, client)
+
+	// Nothing to read, the deadline has to interrupt the Read while
+	// it waits for data.
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err := server.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read past deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read returned %s after its deadline", d)
+	}
+
+	// Nobody is reading on the other end, so the send buffer fills
+	// and the Write has to be interrupted while it waits for space.
+	client.sock.Close()
+	server.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := server.Write(make([]byte, 2*initialSendBlocks*1024))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write past deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != initialSendBlocks*1024 {
+		t.Errorf("Write past deadline wrote %d bytes, want %d", n, initialSendBlocks*1024)
+	}
+}
+
+func TestConnDeadlinesConcurrent(t *testing.T) {
+	server, client := newConnPair(t, &Config{DeadPeerThreshold: -1})
+	startConnPair(server, client)
+
+	// A Read blocked without a deadline is interrupted by one set
+	// in the past.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read not interrupted by the deadline")
+	}
+
+	// Extending the deadline of a blocked Read keeps it waiting.
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		errc <- err
+	}()
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("Read returned after %s, before its extended deadline", d)
+	}
+
+	// Clearing it lets the next Read wait for data.
+	server.SetReadDeadline(time.Time{})
+	go client.Write([]byte("hi"))
+	if n, err := server.Read(make([]byte, 10)); n != 2 || err != nil {
+		t.Errorf("Read after clearing the deadline = %d, %v, want 2, nil", n, err)
+	}
+}
+
+func TestConnGrowSendBuffer(t *testing.T) {
+	server, _ := newConnPair(t, &Config{MaxSendBuffer: 100 * 1024})
+
+	// 10 blocks per RTT, want twice that.
+	chicago(server).rttAverage = 10 * time.Millisecond
+	chicago(server).txThrottle = time.Millisecond
+	server.growSendBuffer()
+	if server.sendFree.Len() != 20 {
+		t.Errorf("%d send blocks after growing, want 20", server.sendFree.Len())
+	}
+
+	// Never shrinks.
+	chicago(server).rttAverage = time.Millisecond
+	server.growSendBuffer()
+	if server.sendFree.Len() != 20 {
+		t.Errorf("%d send blocks after RTT drop, want 20", server.sendFree.Len())
+	}
+
+	// Capped by MaxSendBuffer.
+	chicago(server).rttAverage = time.Second
+	server.growSendBuffer()
+	if server.sendFree.Len() != 100 {
+		t.Errorf("%d send blocks after growing past the max, want 100", server.sendFree.Len())
+	}
+}
+
+func TestConnRetransmitOrder(t *testing.T) {
+	for _, tt := range []struct {
+		order RetransmitOrder
+		want  int64 // Position of the block sent first.
+	}{
+		{RetransmitOldestFirst, 0},
+		{RetransmitNewDataFirst, 1024},
+	} {
+		server, _ := newConnPair(t, &Config{RetransmitOrder: tt.order})
+
+		// One overdue block, and one new block.
+		server.write(make([]byte, 2048))
+		now := time.Now()
+		old := server.toSend.Front().Value.(*block)
+		old.transmissions = 1
+		old.firstSent = now.Add(-time.Second)
+		old.sent, old.retransmitAt = old.firstSent, old.firstSent
+
+		server.transmit(now)
+		for e := server.toSend.Front(); e != nil; e = e.Next() {
+			blk := e.Value.(*block)
+			if sent := blk.sent.Equal(now); sent != (blk.pos == tt.want) {
+				t.Errorf("with order %d, block at %d sent = %v", tt.order, blk.pos, sent)
+			}
+		}
+	}
+}
+
+func TestConnAckWhilePaced(t *testing.T) {
+	server, _ := newConnPair(t, nil)
+
+	// Data is waiting, but the pacer won't let it out for a while.
+	server.write(make([]byte, 2048))
+	now := time.Now()
+	chicago(server).txThrottle = time.Hour
+	server.lastBlock = now
+	server.ackNeeded, server.ackID = true, 42
+
+	wake := server.transmit(now)
+	if server.ackNeeded {
+		t.Errorf("acknowledgment held back by the pacer")
+	}
+	if blk := server.toSend.Front().Value.(*block); blk.transmissions != 0 {
+		t.Errorf("data sent despite the pacer")
+	}
+	if want := now.Add(time.Hour); !wake.Equal(want) {
+		t.Errorf("transmit wake = %s, want %s", wake, want)
+	}
+}
+
+// chicago returns c's congestion controller, the default one.
+func chicago(c *Conn) *scheduler {
+	return c.sched.(*scheduler)
+}
+
+// deliver reads one packet from to's socket and hands it to to's
+// handlePacket, for tests that don't run the pumps.
+func deliver(t *testing.T, to *Conn) {
+	pb := to.bufs.Get()
+	to.sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := to.sock.ReadFrom(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.handlePacket(packet{addr, pb[:n], to.bufs})
+}
+
+func TestConnZeroLengthMessages(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	for _, dir := range []struct {
+		name     string
+		from, to *Conn
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		from, to := dir.from, dir.to
+
+		// A keepalive: acknowledged, but no data.
+		from.sendMessage(time.Now(), &message{id: 7, pos: 1000})
+		deliver(t, to)
+		if !to.ackNeeded || to.ackID != 7 {
+			t.Errorf("%s: keepalive not acknowledged", dir.name)
+		}
+		to.ackNeeded, to.ackID = false, 0
+
+		// A pure acknowledgment: nothing to do.
+		from.sendMessage(time.Now(), &message{pos: 1000})
+		deliver(t, to)
+		if to.ackNeeded {
+			t.Errorf("%s: pure acknowledgment acknowledged", dir.name)
+		}
+
+		if to.recvPos != 0 || to.received.Size() != 0 {
+			t.Errorf("%s: recvPos = %d, %d bytes received after empty messages, want 0, 0", dir.name, to.recvPos, to.received.Size())
+		}
+		select {
+		case <-to.readable:
+			t.Errorf("%s: empty messages woke readers", dir.name)
+		default:
+		}
+	}
+}
+
+func TestConnPinSourceAddress(t *testing.T) {
+	violations := make(chan net.Addr, 1)
+	server, client := newConnPair(t, &Config{
+		PinSourceAddress: true,
+		OnPinViolation:   func(c net.Conn, from net.Addr) { violations <- from },
+	})
+	pinned := server.addr
+
+	// From the initiating address, all good.
+	client.sendMessage(time.Now(), &message{id: 1})
+	deliver(t, server)
+	if !server.ackNeeded || server.pinViolations != 0 {
+		t.Errorf("packet from the pinned address dropped")
+	}
+	server.ackNeeded = false
+
+	// The client moves.
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	client.sock = sock
+	client.sendMessage(time.Now(), &message{id: 2})
+	deliver(t, server)
+	if server.ackNeeded {
+		t.Errorf("packet from another address processed")
+	}
+	if server.addr.String() != pinned.String() {
+		t.Errorf("server sends to %s after a violation, want %s", server.addr, pinned)
+	}
+	if server.pinViolations != 1 {
+		t.Errorf("pinViolations = %d, want 1", server.pinViolations)
+	}
+	select {
+	case from := <-violations:
+		if from.String() != sock.LocalAddr().String() {
+			t.Errorf("violation reported from %s, want %s", from, sock.LocalAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("violation not reported")
+	}
+
+	// A copy from elsewhere doesn't burn the nonce of the packet from
+	// the pinned address.
+	client.sendMessage(time.Now(), &message{id: 3})
+	pb := server.bufs.Get()
+	server.sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.sock.ReadFrom(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := server.bufs.Get()
+	copy(dup, pb[:n])
+	server.handlePacket(packet{sock.LocalAddr(), dup[:n], server.bufs})
+	<-violations
+	server.handlePacket(packet{pinned, pb[:n], server.bufs})
+	if !server.ackNeeded || server.ackID != 3 || server.replays != 0 {
+		t.Errorf("packet from the pinned address dropped after a copy from elsewhere")
+	}
+}
+
+func TestConnReplay(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	now := time.Now()
+	client.sendMessage(now, &message{id: 1})
+	client.sendMessage(now, &message{id: 2})
+
+	var pkts [2][]byte
+	for i := range pkts {
+		pb := make([]byte, 1500)
+		server.sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := server.sock.ReadFrom(pb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts[i] = pb[:n]
+	}
+	handle := func(pkt []byte) uint32 {
+		pb := server.bufs.Get()
+		server.ackNeeded, server.ackID = false, 0
+		server.handlePacket(packet{client.sock.LocalAddr(), pb[:copy(pb, pkt)], server.bufs})
+		return server.ackID
+	}
+
+	// Reordered packets are accepted once, replays are ignored.
+	for i, tt := range []struct {
+		pkt  []byte
+		want uint32
+	}{
+		{pkts[1], 2},
+		{pkts[1], 0},
+		{pkts[0], 1},
+		{pkts[0], 0},
+	} {
+		if got := handle(tt.pkt); got != tt.want {
+			t.Errorf("packet %d acknowledged message %d, want %d", i, got, tt.want)
+		}
+	}
+	if server.replays != 2 {
+		t.Errorf("replays = %d, want 2", server.replays)
+	}
+}
+
+func TestConnReplayWindow(t *testing.T) {
+	var c Conn
+	for _, tt := range []struct {
+		nonce uint64
+		want  bool
+	}{
+		{1, true},
+		{100, true},
+		{100, false},
+		{50, true},
+		{36, true},
+		{35, false}, // Just out of the window.
+		{50, false},
+		{99, true},
+		{99, false},
+		{300, true},
+		{100, false},
+		{299, true},
+	} {
+		if got := c.acceptNonce(tt.nonce); got != tt.want {
+			t.Errorf("acceptNonce(%d) = %v, want %v", tt.nonce, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package curvecp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johnwchadwick/curvecp/bufpool"
+)
+
+// Packets queued for a Dispatcher's listener, more are dropped.
+const dispatchBacklog = 64
+
+var errExtensionInUse = errors.New("server extension already in use")
+
+// A Dispatcher runs several listeners on one UDP socket, each bound to
+// a server extension: clients pick the listener they talk to by
+// setting Dialer.ServerExtension, and packets for extensions without
+// a listener are dropped.
+type Dispatcher struct {
+	sock *net.UDPConn
+	// The buffers of the packets read from sock.
+	bufs *bufpool.Pool
+	mu   sync.Mutex
+	subs map[[16]byte]*extConn
+	// Closed when the socket fails or is closed, with the error in
+	// err.
+	done chan struct{}
+	err  error
+}
+
+// NewDispatcher returns a Dispatcher for the packets arriving on
+// sock, which it owns from then on.
+func NewDispatcher(sock *net.UDPConn) *Dispatcher {
+	sock.SetDeadline(time.Time{})
+	d := &Dispatcher{
+		sock: sock,
+		bufs: bufpool.New(packetSize),
+		subs: make(map[[16]byte]*extConn),
+		done: make(chan struct{}),
+	}
+	go d.readLoop()
+	return d
+}
+
+// Listen returns a listener for the packets carrying server extension
+// ext, like ListenWithConfig. Socket options in config don't apply,
+// the socket is the Dispatcher's. Closing the listener frees ext
+// once its connections have ended.
+func (d *Dispatcher) Listen(ext [16]byte, key []byte, config *Config) (Listener, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if isClosed(d.done) {
+		return nil, &net.OpError{Op: "listen", Net: "curvecp", Addr: d.sock.LocalAddr(), Err: d.err}
+	}
+	if _, ok := d.subs[ext]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "curvecp", Addr: d.sock.LocalAddr(), Err: errExtensionInUse}
+	}
+	c := &extConn{
+		d:            d,
+		ext:          ext,
+		in:           make(chan packet, dispatchBacklog),
+		closed:       make(chan struct{}),
+		readDeadline: newDeadline(),
+	}
+	d.subs[ext] = c
+	return newServer(c, true, key, config), nil
+}
+
+// Close closes the socket, and with it the listeners and their
+// connections.
+func (d *Dispatcher) Close() error {
+	return d.sock.Close()
+}
+
+// Addr returns the address of the socket.
+func (d *Dispatcher) Addr() net.Addr {
+	return d.sock.LocalAddr()
+}
+
+func (d *Dispatcher) readLoop() {
+	pb := d.bufs.Get()
+	for {
+		n, addr, err := d.sock.ReadFrom(pb)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			d.mu.Lock()
+			d.err = err
+			close(d.done)
+			d.mu.Unlock()
+			d.bufs.Put(pb)
+			return
+		}
+		if n < 64 {
+			continue
+		}
+		var ext [16]byte
+		copy(ext[:], pb[8:24])
+		d.mu.Lock()
+		c, ok := d.subs[ext]
+		if ok {
+			select {
+			case c.in <- packet{addr, pb[:n], d.bufs}:
+				pb = d.bufs.Get()
+			default:
+				// The listener isn't keeping up, drop it.
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// An extConn is the net.PacketConn of a Dispatcher's listener: the
+// Dispatcher's socket, reading only the packets for ext.
+type extConn struct {
+	d   *Dispatcher
+	ext [16]byte
+	// From the Dispatcher, packets for ext.
+	in           chan packet
+	closed       chan struct{}
+	readDeadline *deadline
+}
+
+func (c *extConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		n := copy(b, p.buf)
+		p.release()
+		return n, p.Addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.d.done:
+		return 0, nil, c.d.err
+	case <-c.readDeadline.wait():
+		return 0, nil, deadlineExceeded
+	}
+}
+
+func (c *extConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.d.sock.WriteTo(b, addr)
+}
+
+// Close unbinds ext, dropping the packets still queued.
+func (c *extConn) Close() error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if isClosed(c.closed) {
+		return nil
+	}
+	close(c.closed)
+	delete(c.d.subs, c.ext)
+	for {
+		select {
+		case p := <-c.in:
+			p.release()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *extConn) LocalAddr() net.Addr {
+	return c.d.sock.LocalAddr()
+}
+
+// SetDeadline sets the read deadline, writes don't wait.
+func (c *extConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *extConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *extConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestDispatcher(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(sock)
+	defer d.Close()
+	addr := d.Addr().String()
+
+	var exts [2][16]byte
+	var pubs [2]*[32]byte
+	for i := range exts {
+		exts[i][0] = byte(i + 1)
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		pubs[i] = pub
+		l, err := d.Listen(exts[i], priv[:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if !bytes.Equal(l.Addr().(*Addr).Key, pub[:]) {
+			t.Errorf("listener %d has the wrong key", i)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+	}
+	if _, err := d.Listen(exts[0], make([]byte, 32), nil); err == nil {
+		t.Errorf("two listeners for one extension")
+	}
+
+	for i := range exts {
+		dialer := Dialer{ServerExtension: exts[i]}
+		c, err := dialer.Dial(addr, pubs[i][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Abort()
+		testTransfer(t, c, c, 1000)
+	}
+
+	// Each listener only answers its own extension.
+	dialer := Dialer{ServerExtension: exts[0], Config: &Config{HandshakeTimeout: 300 * time.Millisecond}}
+	if c, err := dialer.Dial(addr, pubs[1][:]); err == nil {
+		c.Abort()
+		t.Errorf("Dial through another listener's extension succeeded")
+	}
+	dialer.ServerExtension = [16]byte{}
+	if c, err := dialer.Dial(addr, pubs[0][:]); err == nil {
+		c.Abort()
+		t.Errorf("Dial without a listener's extension succeeded")
+	}
+}
@@ -0,0 +1,296 @@
+package curvecp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/johnwchadwick/curvecp/handshake"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A PacketType is one of the five kinds of CurveCP packets. Messages
+// are told apart by the side that sends them.
+type PacketType int
+
+const (
+	HelloPacket PacketType = iota + 1
+	CookiePacket
+	InitiatePacket
+	ClientMessagePacket
+	ServerMessagePacket
+)
+
+var packetTypeNames = [...]string{
+	HelloPacket:         "Hello",
+	CookiePacket:        "Cookie",
+	InitiatePacket:      "Initiate",
+	ClientMessagePacket: "client Message",
+	ServerMessagePacket: "server Message",
+}
+
+func (t PacketType) String() string {
+	if t > 0 && int(t) < len(packetTypeNames) {
+		return packetTypeNames[t]
+	}
+	return "PacketType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// A DissectedPacket is a CurveCP packet decoded by a Dissector. Fields
+// the type of packet doesn't have are left zero, and so are those in
+// boxes the Dissector couldn't open.
+type DissectedPacket struct {
+	Type                             PacketType
+	ClientExtension, ServerExtension [16]byte
+	// The client's short-term public key, sent in the clear in Hello,
+	// Initiate and client Message packets.
+	ClientShortTermKey []byte
+	// The packet's nonce, without its constant prefix: 8 bytes of
+	// counter, or 16 random bytes in Cookies.
+	Nonce []byte
+	// Whether the packet's box was opened, and checked out in the
+	// case of Hellos, whose box holds zeros.
+	Opened bool
+
+	// From Cookies, the server's short-term public key.
+	ServerShortTermKey []byte
+
+	// From Initiates, the client's long-term public key, whether it
+	// vouches for the short-term key, which takes the server's
+	// long-term secret key to check, and the domain requested.
+	ClientLongTermKey []byte
+	Vouched           bool
+	Domain            string
+
+	// From Initiates and Messages, the message. Message.Outgoing is
+	// unused, the Type tells the direction. AckRanges has all the
+	// ranges of the stream flowing the other way that the message
+	// acknowledges, [start, end), of which Message.Acked is the
+	// first's end.
+	Message   *TapMessage
+	AckRanges [][2]int64
+}
+
+// A Dissector decodes captured CurveCP packets, and opens their boxes
+// with the keys it's given, to help debug interoperability problems.
+// It learns from the packets as it goes: the short-term keys exchanged
+// in handshakes let it open the boxes of later packets, so packets
+// should be given to it in the order they were captured.
+//
+// A server's long-term secret key opens Hellos and Cookies. Its minute
+// keys, see Config.MinuteKeys, open the Cookies echoed in Initiates,
+// which hold the server's short-term secret key, and with it the
+// Initiate and all Messages of the connection. Short-term secret keys
+// of either side do the same for their connection.
+type Dissector struct {
+	keys       []dissectorKey
+	minuteKeys [][32]byte
+	// Every public key known, of the keys and seen in packets.
+	publics map[[32]byte]bool
+}
+
+type dissectorKey struct {
+	secret, public [32]byte
+}
+
+// ErrNotCurveCP is returned by Dissector.Dissect for packets of
+// other protocols.
+var ErrNotCurveCP = errors.New("not a CurveCP packet")
+
+// NewDissector returns a Dissector with no keys.
+func NewDissector() *Dissector {
+	return &Dissector{publics: make(map[[32]byte]bool)}
+}
+
+// AddKey adds a secret key, 32 bytes, long-term or short-term, of a
+// server or a client.
+func (d *Dissector) AddKey(secret []byte) {
+	if len(secret) != 32 {
+		panic("Wrong key length")
+	}
+	var k dissectorKey
+	copy(k.secret[:], secret)
+	curve25519.ScalarBaseMult(&k.public, &k.secret)
+	for _, have := range d.keys {
+		if have == k {
+			return
+		}
+	}
+	d.keys = append(d.keys, k)
+	d.publics[k.public] = true
+}
+
+// AddMinuteKey adds a key a server seals Cookies under, 32 bytes.
+func (d *Dissector) AddMinuteKey(key []byte) {
+	if len(key) != 32 {
+		panic("Wrong key length")
+	}
+	var k [32]byte
+	copy(k[:], key)
+	d.minuteKeys = append(d.minuteKeys, k)
+}
+
+// Dissect decodes the packet pb, a UDP payload. It fails if pb isn't
+// a CurveCP packet. If a box opens to something malformed, Dissect
+// returns what it decoded along with the error.
+func (d *Dissector) Dissect(pb []byte) (*DissectedPacket, error) {
+	if len(pb) < 8 {
+		return nil, ErrNotCurveCP
+	}
+	p := &DissectedPacket{}
+	var valid bool
+	switch magic := pb[:8]; {
+	case bytes.Equal(magic, helloMagic):
+		p.Type, valid = HelloPacket, wellFormed(pb)
+	case bytes.Equal(magic, cookieMagic):
+		p.Type, valid = CookiePacket, len(pb) == 200
+	case bytes.Equal(magic, initiateMagic):
+		p.Type, valid = InitiatePacket, wellFormed(pb)
+	case bytes.Equal(magic, clientMessageMagic):
+		p.Type, valid = ClientMessagePacket, wellFormed(pb)
+	case bytes.Equal(magic, serverMessageMagic):
+		p.Type, valid = ServerMessagePacket, validMessagePacket(pb, 48+box.Overhead)
+	default:
+		return nil, ErrNotCurveCP
+	}
+	if !valid {
+		return nil, fmt.Errorf("malformed %s packet of %d bytes", p.Type, len(pb))
+	}
+
+	var nonce [24]byte
+	switch p.Type {
+	case HelloPacket:
+		copy(p.ServerExtension[:], pb[8:24])
+		copy(p.ClientExtension[:], pb[24:40])
+		p.ClientShortTermKey = d.learn(pb[40:72])
+		p.Nonce = clone(pb[136:144])
+		copy(nonce[:], handshake.HelloNoncePrefix)
+		copy(nonce[16:], p.Nonce)
+		zeros, ok := d.open(pb[144:], &nonce, pb[40:72])
+		p.Opened = ok && bytes.Equal(zeros, make([]byte, 64))
+
+	case CookiePacket:
+		copy(p.ClientExtension[:], pb[8:24])
+		copy(p.ServerExtension[:], pb[24:40])
+		p.Nonce = clone(pb[40:56])
+		copy(nonce[:], handshake.CookieNoncePrefix)
+		copy(nonce[8:], p.Nonce)
+		if plain, ok := d.open(pb[56:], &nonce, nil); ok {
+			p.Opened = true
+			p.ServerShortTermKey = d.learn(plain[:32])
+		}
+
+	case InitiatePacket:
+		copy(p.ServerExtension[:], pb[8:24])
+		copy(p.ClientExtension[:], pb[24:40])
+		p.ClientShortTermKey = d.learn(pb[40:72])
+		d.openCookie(pb[72:168], pb[40:72])
+		p.Nonce = clone(pb[168:176])
+		copy(nonce[:], initiateNoncePrefix)
+		copy(nonce[16:], p.Nonce)
+		plain, ok := d.open(pb[176:], &nonce, pb[40:72])
+		if !ok {
+			break
+		}
+		p.Opened = true
+		p.ClientLongTermKey = d.learn(plain[:32])
+		p.Domain = handshake.DecodeDomain(plain[96:352])
+		copy(nonce[:], handshake.VouchNoncePrefix)
+		copy(nonce[8:], plain[32:48])
+		vouch, ok := d.open(plain[48:96], &nonce, plain[:32])
+		p.Vouched = ok && bytes.Equal(vouch, pb[40:72])
+		if p.Domain == "" {
+			return p, errors.New("Initiate with an invalid domain")
+		}
+		return p, p.setMessage(plain[352:])
+
+	case ClientMessagePacket:
+		copy(p.ServerExtension[:], pb[8:24])
+		copy(p.ClientExtension[:], pb[24:40])
+		p.ClientShortTermKey = d.learn(pb[40:72])
+		p.Nonce = clone(pb[72:80])
+		copy(nonce[:], clientMessageNoncePrefix)
+		copy(nonce[16:], p.Nonce)
+		if plain, ok := d.open(pb[80:], &nonce, pb[40:72]); ok {
+			p.Opened = true
+			return p, p.setMessage(plain)
+		}
+
+	case ServerMessagePacket:
+		copy(p.ClientExtension[:], pb[8:24])
+		copy(p.ServerExtension[:], pb[24:40])
+		p.Nonce = clone(pb[40:48])
+		copy(nonce[:], serverMessageNoncePrefix)
+		copy(nonce[16:], p.Nonce)
+		if plain, ok := d.open(pb[48:], &nonce, nil); ok {
+			p.Opened = true
+			return p, p.setMessage(plain)
+		}
+	}
+	return p, nil
+}
+
+// learn records a public key seen in a packet, and returns a copy.
+func (d *Dissector) learn(key []byte) []byte {
+	var k [32]byte
+	copy(k[:], key)
+	d.publics[k] = true
+	return k[:]
+}
+
+// open opens the box b, between the owners of two keys, given either
+// of their public keys if the packet tells it, by trying the secret
+// keys it has against the public keys it knows.
+func (d *Dissector) open(b []byte, nonce *[24]byte, known []byte) ([]byte, bool) {
+	var peer [32]byte
+	copy(peer[:], known)
+	for _, k := range d.keys {
+		if known != nil && k.public != peer {
+			if plain, ok := box.Open(nil, b, nonce, &peer, &k.secret); ok {
+				return plain, true
+			}
+			continue
+		}
+		for pub := range d.publics {
+			if plain, ok := box.Open(nil, b, nonce, &pub, &k.secret); ok {
+				return plain, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// openCookie opens the Cookie echoed in an Initiate from the client
+// short-term key, with the minute keys, and adds the server
+// short-term secret key it holds.
+func (d *Dissector) openCookie(cookie, clientShortTermKey []byte) {
+	var c handshake.Cookie
+	copy(c[:], cookie)
+	for i := range d.minuteKeys {
+		if key, secret, ok := c.Open(&d.minuteKeys[i]); ok && bytes.Equal(key[:], clientShortTermKey) {
+			d.AddKey(secret[:])
+			return
+		}
+	}
+}
+
+// setMessage decodes the plaintext message b into p.
+func (p *DissectedPacket) setMessage(b []byte) error {
+	var m message
+	if !m.unmarshal(b) {
+		return fmt.Errorf("%s with a malformed message", p.Type)
+	}
+	p.Message = newTapMessage(false, &m)
+	for _, r := range m.acks {
+		if r.end > r.start {
+			p.AckRanges = append(p.AckRanges, [2]int64{r.start, r.end})
+		}
+	}
+	return nil
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
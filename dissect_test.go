@@ -0,0 +1,151 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// capturingSock is a memSock that keeps a copy of every packet read
+// from or written to it, in order.
+type capturingSock struct {
+	*memSock
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (s *capturingSock) capture(b []byte) {
+	s.mu.Lock()
+	s.packets = append(s.packets, append([]byte(nil), b...))
+	s.mu.Unlock()
+}
+
+func (s *capturingSock) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := s.memSock.ReadFrom(b)
+	if err == nil {
+		s.capture(b[:n])
+	}
+	return n, addr, err
+}
+
+func (s *capturingSock) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s.capture(b)
+	return s.memSock.WriteTo(b, addr)
+}
+
+// captureEcho runs a connection to an echo server over a memNet, with
+// the server's minute keys derived from minuteSecret, and returns the
+// server's secret key and the packets it saw.
+func captureEcho(t *testing.T, minuteSecret []byte, data string) ([]byte, [][]byte) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	mn := &memNet{socks: make(map[memAddr]*memSock)}
+	ssock := &capturingSock{memSock: mn.listen("server")}
+	config := &Config{MinuteKeys: NewSharedMinuteKeys(minuteSecret, time.Hour)}
+	l := newServer(ssock, true, priv[:], config)
+	defer l.Close()
+	go echoAll(l)
+
+	csock := mn.listen("client")
+	defer csock.Close()
+	d := Dialer{Domain: "example.com"}
+	c, err := d.DialPacketConn(csock, memAddr("server"), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(data))
+	c.CloseWrite()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if got, err := io.ReadAll(c); err != nil || string(got) != data {
+		t.Fatalf("read %q, %v, want %q", got, err, data)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ssock.mu.Lock()
+	defer ssock.mu.Unlock()
+	return priv[:], ssock.packets
+}
+
+func TestDissector(t *testing.T) {
+	minuteSecret := make([]byte, 32)
+	rand.Read(minuteSecret)
+	const data = "hello, dissector"
+	secret, packets := captureEcho(t, minuteSecret, data)
+
+	d := NewDissector()
+	d.AddKey(secret)
+	mk := NewSharedMinuteKeys(minuteSecret, time.Hour)
+	for _, k := range [][32]byte{mk.Current(), mk.Previous()} {
+		d.AddMinuteKey(k[:])
+	}
+	seen := make(map[PacketType]int)
+	streams := make(map[PacketType][]byte)
+	for i, pb := range packets {
+		p, err := d.Dissect(pb)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		seen[p.Type]++
+		if !p.Opened {
+			t.Errorf("packet %d, a %s, not opened", i, p.Type)
+			continue
+		}
+		switch p.Type {
+		case CookiePacket:
+			if len(p.ServerShortTermKey) != 32 {
+				t.Errorf("Cookie without the server's short-term key")
+			}
+		case InitiatePacket:
+			if !p.Vouched || p.Domain != "example.com" {
+				t.Errorf("Initiate vouched %v, for %q, want a vouch for example.com", p.Vouched, p.Domain)
+			}
+		}
+		if m := p.Message; m != nil && len(m.Data) > 0 {
+			dir := p.Type
+			if dir == InitiatePacket {
+				dir = ClientMessagePacket
+			}
+			if int(m.Pos) == len(streams[dir]) {
+				streams[dir] = append(streams[dir], m.Data...)
+			}
+		}
+	}
+	for _, typ := range []PacketType{HelloPacket, CookiePacket, InitiatePacket, ServerMessagePacket} {
+		if seen[typ] == 0 {
+			t.Errorf("no %s packets", typ)
+		}
+	}
+	for _, dir := range []PacketType{ClientMessagePacket, ServerMessagePacket} {
+		if string(streams[dir]) != data {
+			t.Errorf("%s stream %q, want %q", dir, streams[dir], data)
+		}
+	}
+}
+
+func TestDissectorWithoutKeys(t *testing.T) {
+	minuteSecret := make([]byte, 32)
+	_, packets := captureEcho(t, minuteSecret, "secret")
+
+	d := NewDissector()
+	for i, pb := range packets {
+		p, err := d.Dissect(pb)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if p.Opened || p.Message != nil {
+			t.Errorf("packet %d, a %s, opened without keys", i, p.Type)
+		}
+	}
+
+	for _, pb := range [][]byte{nil, []byte("not a CurveCP packet"), packets[0][:100]} {
+		if p, err := d.Dissect(pb); err == nil {
+			t.Errorf("Dissect(%q) = %v, want an error", pb, p)
+		}
+	}
+}
@@ -63,6 +63,13 @@ package curvecp
 // initiates. The absolute numbers for box elements are only valid
 // once the packet has been verified and the plaintext content copied
 // over the box.
+//
+// The message M is the client's first data, sent before it hears
+// from the server. The packet pump queues the Initiate that creates
+// a conn for it like any later packet, so M goes into the receive
+// buffer through the same path as Message packets, and the server's
+// first Read returns it. Retransmitted Initiates carry M again, and
+// are deduplicated by stream position.
 
 // SERVER MESSAGE format:
 //
@@ -86,3 +93,26 @@ package curvecp
 //               0 : M : message
 //
 // TOTAL: 96+M bytes
+
+// MESSAGE format (plaintext of the Message boxes, and of the
+// Initiate's M bytes):
+//
+// 0  : 4 : message ID, 0 if no acknowledgment is needed
+// 4  : 4 : ID of the message being acknowledged, or 0
+// 8  : 8 : size of the first acknowledged range, starting at 0
+// 16 : 4 : gap between ranges 1 and 2
+// 20 : 2 : size of range 2
+// 22 : 2 : gap between ranges 2 and 3
+// 24 : 2 : size of range 3
+// 26 : 2 : gap between ranges 3 and 4
+// 28 : 2 : size of range 4
+// 30 : 2 : gap between ranges 4 and 5
+// 32 : 2 : size of range 5
+// 34 : 2 : gap between ranges 5 and 6
+// 36 : 2 : size of range 6
+// 38 : 2 : D + SUCC (2048) / FAIL (4096) end of stream flags
+// 40 : 8 : stream position of the first data byte
+// 48 : P : zero padding, to make the total a multiple of 16
+// 48+P : D : data, at most 1024 bytes
+//
+// TOTAL: 48+P+D bytes, at most 1088.
@@ -0,0 +1,198 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// e2eNet is a network the end-to-end tests run over. start starts an
+// echo server on it, and returns a function dialing a new client to
+// it.
+type e2eNet struct {
+	name  string
+	start func(t *testing.T, config *Config) (dial func() (*Conn, error))
+}
+
+var e2eNets = []e2eNet{
+	{"loopback", func(t *testing.T, config *Config) func() (*Conn, error) {
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		l := serveEcho(t, "127.0.0.1:0", priv[:], config)
+		t.Cleanup(func() { l.Close() })
+		addr := l.Addr().(*Addr).UDP.String()
+		return func() (*Conn, error) {
+			d := Dialer{Config: config}
+			return d.Dial(addr, pub[:])
+		}
+	}},
+	{"memory", func(t *testing.T, config *Config) func() (*Conn, error) {
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		mn := &memNet{socks: make(map[memAddr]*memSock)}
+		l := newServer(mn.listen("server"), true, priv[:], config)
+		t.Cleanup(func() { l.Close() })
+		go echoAll(l)
+		var mu sync.Mutex
+		clients := 0
+		return func() (*Conn, error) {
+			mu.Lock()
+			clients++
+			sock := mn.listen(memAddr(fmt.Sprintf("client%d", clients)))
+			mu.Unlock()
+			t.Cleanup(func() { sock.Close() })
+			d := Dialer{Config: config}
+			return d.DialPacketConn(sock, memAddr("server"), pub[:])
+		}
+	}},
+}
+
+// e2eScenarios run against a fresh echo server each, on every e2eNet.
+var e2eScenarios = []struct {
+	name string
+	run  func(t *testing.T, dial func() (*Conn, error))
+}{
+	{"integrity", e2eIntegrity},
+	{"large transfer", e2eLargeTransfer},
+	{"concurrent connections", e2eConcurrent},
+}
+
+// TestEndToEnd runs the whole stack, handshake and pumps included,
+// through every scenario on every network.
+func TestEndToEnd(t *testing.T) {
+	for _, n := range e2eNets {
+		for _, sc := range e2eScenarios {
+			t.Run(n.name+"/"+sc.name, func(t *testing.T) {
+				sc.run(t, n.start(t, nil))
+			})
+		}
+	}
+}
+
+// echoAll echoes everything back on every connection l accepts, until
+// it's closed.
+func echoAll(l Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+// e2eEcho writes data to c in writes of chunk bytes, and checks that
+// it comes back.
+func e2eEcho(c *Conn, data []byte, chunk int) error {
+	c.SetDeadline(time.Now().Add(selfTestTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	werr := make(chan error, 1)
+	go func() {
+		for b := data; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := c.Write(b[:n]); err != nil {
+				werr <- err
+				return
+			}
+			b = b[n:]
+		}
+		werr <- nil
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if err := <-werr; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("data corrupted")
+	}
+	return nil
+}
+
+// e2eIntegrity sends data of sizes around the message and block
+// boundaries, in writes of all sizes, then ends the stream.
+func e2eIntegrity(t *testing.T, dial func() (*Conn, error)) {
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	for _, size := range []int{1, maxMessageData - 1, maxMessageData, maxMessageData + 1, 64*1024 + 1} {
+		for _, chunk := range []int{1, 7, maxMessageData, size} {
+			if chunk == 1 && size > maxMessageData {
+				continue
+			}
+			data := make([]byte, size)
+			rand.Read(data)
+			if err := e2eEcho(c, data, chunk); err != nil {
+				t.Fatalf("%d bytes in writes of %d: %v", size, chunk, err)
+			}
+		}
+	}
+
+	// The end of the stream goes around too.
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(selfTestTimeout))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read after CloseWrite = %d, %v, want io.EOF", n, err)
+	}
+}
+
+// e2eLargeTransfer echoes megabytes over one connection, enough for
+// the send buffer and congestion window to grow.
+func e2eLargeTransfer(t *testing.T, dial func() (*Conn, error)) {
+	size := 2 << 20
+	if testing.Short() {
+		size = 512 << 10
+	}
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	if err := selfTestEcho(c, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// e2eConcurrent echoes over many connections at once.
+func e2eConcurrent(t *testing.T, dial func() (*Conn, error)) {
+	const conns = 16
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func(i int) {
+			c, err := dial()
+			if err != nil {
+				errs <- fmt.Errorf("conn %d: %v", i, err)
+				return
+			}
+			defer c.Abort()
+			if err := selfTestEcho(c, 256*1024); err != nil {
+				errs <- fmt.Errorf("conn %d: %v", i, err)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < conns; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
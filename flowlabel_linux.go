@@ -0,0 +1,33 @@
+//go:build linux
+
+package curvecp
+
+import (
+	"net"
+	"syscall"
+)
+
+// From linux/in6.h, missing from package syscall.
+const ipv6AutoFlowLabel = 70
+
+// setAutoFlowLabel asks the kernel to derive an IPv6 flow label for
+// each destination sock sends to, from a hash of the flow's
+// addresses and ports. Each connection then keeps a stable label.
+func setAutoFlowLabel(sock *net.UDPConn) error {
+	if addr, ok := sock.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil && !addr.IP.IsUnspecified() {
+		// IPv4 only socket, no flow labels.
+		return nil
+	}
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AutoFlowLabel, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
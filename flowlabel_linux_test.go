@@ -0,0 +1,39 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestAutoFlowLabel(t *testing.T) {
+	_, key, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("[::1]:0", key[:], &Config{AutoFlowLabel: true})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	defer l.Close()
+
+	raw, err := l.(*server).sock.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AutoFlowLabel)
+	})
+	if err != nil || v != 1 {
+		t.Errorf("IPV6_AUTOFLOWLABEL = %d, %v, want 1", v, err)
+	}
+
+	// IPv4 listeners just ignore the option.
+	l4, err := ListenWithConfig("127.0.0.1:0", key[:], &Config{AutoFlowLabel: true})
+	if err != nil {
+		t.Errorf("ListenWithConfig on IPv4 with AutoFlowLabel: %s", err)
+	} else {
+		l4.Close()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package curvecp
+
+import (
+	"errors"
+	"net"
+)
+
+func setAutoFlowLabel(sock *net.UDPConn) error {
+	return errors.New("automatic IPv6 flow labels are only supported on Linux")
+}
@@ -0,0 +1,86 @@
+package curvecp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// The parsers below read packets straight off the network, from
+// anyone. Run them with e.g.
+//
+//	go test -fuzz FuzzInitiate
+//
+// The seeds are the regression packets, which fuzzServer accepts, so that
+// mutations start from packets that get all the way through.
+
+// fuzzServer returns a server that isn't running, with the keys of the
+// server of the regression packets.
+func fuzzServer(f *testing.F) *server {
+	useRegressionRand(f)
+	var secret [32]byte
+	copy(secret[:], regressionServerSecret)
+	s := &server{listen: true}
+	s.setKey(secret)
+	randBytes(s.minuteKey[:])
+	randBytes(s.prevMinuteKey[:])
+	return s
+}
+
+var fuzzAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+func FuzzHello(f *testing.F) {
+	s := fuzzServer(f)
+	f.Add(regressionPacket(f, regressionHello))
+	f.Add(make([]byte, 224))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if k := s.checkHello(packet{fuzzAddr, b, nil}); k != nil && !isHello(b) {
+			t.Errorf("accepted a %d byte Hello", len(b))
+		}
+	})
+}
+
+func FuzzInitiate(f *testing.F) {
+	s := fuzzServer(f)
+	f.Add(regressionPacket(f, regressionInitiate))
+	f.Add(regressionPacket(f, regressionInitiateData))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// A valid Initiate gets its box replaced with the plaintext.
+		pb := append([]byte(nil), b...)
+		key, domain, valid := s.checkInitiate(packet{fuzzAddr, pb, nil})
+		if !valid {
+			return
+		}
+		if len(key) != 32 || domain == "" {
+			t.Fatalf("valid Initiate with key %x, domain %q", key, domain)
+		}
+		initiateData(pb)
+	})
+}
+
+func FuzzMessage(f *testing.F) {
+	ka, _ := hex.DecodeString(kaMessageEncoded)
+	f.Add(ka)
+	f.Add(make([]byte, messageHeaderLen))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var m message
+		if !m.unmarshal(b) {
+			return
+		}
+		// Encoding may leave acknowledgments out, but mustn't make
+		// any up, or change anything else.
+		var m2 message
+		if !m2.unmarshal(m.marshal(make([]byte, maxMessageLen))) {
+			t.Fatalf("%+v doesn't survive encoding", m)
+		}
+		if m2.id != m.id || m2.ackID != m.ackID || m2.eof != m.eof || m2.pos != m.pos || !bytes.Equal(m2.data, m.data) || m2.acks[0] != m.acks[0] {
+			t.Fatalf("%+v encodes as %+v", m, m2)
+		}
+		for _, r := range m2.acks {
+			if r.start < r.end && !m.acked(r.start, r.end) {
+				t.Fatalf("%+v encodes as %+v, acknowledging %v", m, m2, r)
+			}
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A Client runs the client side of a handshake with a server: it makes
+// Hellos until it gets a Cookie, then Initiates, until the server's
+// first Message shows that the session is up.
+type Client struct {
+	// The extensions of the server and client, sent in every packet.
+	// They may be set until the first Hello.
+	ServerExtension, ClientExtension [16]byte
+
+	rand                          io.Reader
+	serverKey                     [32]byte
+	longTermKey, longTermSecret   [32]byte
+	shortTermKey, shortTermSecret [32]byte
+	domain                        []byte
+	nonce                         uint64
+
+	// Set by HandleCookie.
+	serverShortTermKey *[32]byte
+	sessionKey         [32]byte
+	header, prefix     []byte
+}
+
+// NewClient returns a Client connecting with the long-term key of
+// longTermSecret to the server with the long-term key serverKey, for
+// domain. Short-term keys and nonces are drawn from rand, or
+// crypto/rand if it's nil.
+func NewClient(serverKey, longTermSecret *[32]byte, domain string, rand io.Reader) (*Client, error) {
+	c := &Client{rand: rand, serverKey: *serverKey, longTermSecret: *longTermSecret}
+	if c.domain = EncodeDomain(domain); c.domain == nil {
+		return nil, errors.New("domain name can't be encoded in an Initiate")
+	}
+	curve25519.ScalarBaseMult(&c.longTermKey, &c.longTermSecret)
+	pub, priv, err := box.GenerateKey(c.reader())
+	if err != nil {
+		return nil, err
+	}
+	c.shortTermKey, c.shortTermSecret = *pub, *priv
+	return c, nil
+}
+
+func (c *Client) reader() io.Reader {
+	if c.rand == nil {
+		return rand.Reader
+	}
+	return c.rand
+}
+
+// Hello returns a new Hello packet, to send until a Cookie comes back.
+func (c *Client) Hello() []byte {
+	c.nonce++
+	return SealHello(nil, c.ServerExtension, c.ClientExtension, &c.serverKey, &c.shortTermKey, &c.shortTermSecret, c.nonce)
+}
+
+// HandleCookie processes the packet pkt, which should be the server's
+// Cookie. Once it succeeds, further Cookies are ignored and the client
+// goes on with Initiates.
+func (c *Client) HandleCookie(pkt []byte) error {
+	if c.serverShortTermKey != nil {
+		return nil
+	}
+	if len(pkt) < 24 || string(pkt[8:24]) != string(c.ClientExtension[:]) {
+		return ErrMalformed
+	}
+	serverShortTermKey, cookie, err := OpenCookie(pkt, &c.serverKey, &c.shortTermSecret)
+	if err != nil {
+		return err
+	}
+	var nonce [16]byte
+	if _, err := io.ReadFull(c.reader(), nonce[:]); err != nil {
+		return err
+	}
+	c.header = InitiateHeader(c.ServerExtension, c.ClientExtension, &c.shortTermKey, cookie)
+	c.prefix = InitiatePrefix(&c.serverKey, &c.longTermKey, &c.longTermSecret, &c.shortTermKey, &nonce, c.domain)
+	box.Precompute(&c.sessionKey, &serverShortTermKey, &c.shortTermSecret)
+	c.serverShortTermKey = &serverShortTermKey
+	return nil
+}
+
+// Initiate returns a new Initiate packet carrying message, to send
+// until the server answers with a Message. The message is a multiple
+// of 16 bytes, up to MaxInitiateMessageLen. It fails before a Cookie.
+func (c *Client) Initiate(message []byte) ([]byte, error) {
+	if c.serverShortTermKey == nil {
+		return nil, errors.New("Initiate before a Cookie")
+	}
+	if len(message) > MaxInitiateMessageLen || len(message)%16 != 0 {
+		return nil, ErrBadMessage
+	}
+	c.nonce++
+	return SealInitiate(nil, c.header, c.prefix, message, &c.sessionKey, c.nonce), nil
+}
+
+// Nonce returns the counter of the client's short-term nonces, that of
+// the last Hello or Initiate. The client's Messages go on from there.
+func (c *Client) Nonce() uint64 {
+	return c.nonce
+}
+
+// ShortTermKey returns the client's short-term public key.
+func (c *Client) ShortTermKey() *[32]byte {
+	return &c.shortTermKey
+}
+
+// ServerShortTermKey returns the server's short-term key, or nil
+// before a Cookie.
+func (c *Client) ServerShortTermKey() *[32]byte {
+	return c.serverShortTermKey
+}
+
+// SessionKey returns the key of the session, to box Messages with, or
+// nil before a Cookie.
+func (c *Client) SessionKey() *[32]byte {
+	if c.serverShortTermKey == nil {
+		return nil
+	}
+	return &c.sessionKey
+}
@@ -0,0 +1,389 @@
+// Package handshake implements the CurveCP handshake, the Hello,
+// Cookie and Initiate packets that set up a session, independently of
+// how the packets are carried. Packets go in as byte slices and
+// packets and session keys come out, so that CurveCP sessions can be
+// set up over other carriers than UDP, and so that the handshake can
+// be tested without a network.
+//
+// The functions seal and open single packets, with the nonces and
+// short-term keys given by the caller. Client and Server build on them
+// to run whole handshakes. Either way, Messages are up to the caller:
+// after the handshake, both sides box them with the session key, the
+// shared key of the two short-term keys, under the Message nonce
+// prefixes and the caller's nonce counter, which the client's Hellos
+// and Initiates share.
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Magic IDs at the beginning of packets.
+const (
+	HelloMagic         = "QvnQ5XlH"
+	CookieMagic        = "RL3aNMXK"
+	InitiateMagic      = "QvnQ5XlI"
+	ClientMessageMagic = "QvnQ5XlM"
+	ServerMessageMagic = "RL3aNMXM"
+)
+
+// The prefixes of the nonces of the various boxes. Those of 8 bytes are
+// followed by 16 random bytes, the others by an 8-byte counter.
+const (
+	HelloNoncePrefix         = "CurveCP-client-H"
+	CookieNoncePrefix        = "CurveCPK"
+	InitiateNoncePrefix      = "CurveCP-client-I"
+	VouchNoncePrefix         = "CurveCPV"
+	ServerMessageNoncePrefix = "CurveCP-server-M"
+	ClientMessageNoncePrefix = "CurveCP-client-M"
+	MinuteNoncePrefix        = "minute-k"
+)
+
+const (
+	// HelloLen and CookieLen are the lengths of Hello and Cookie
+	// packets.
+	HelloLen  = 224
+	CookieLen = 200
+	// InitiateLen is the length of an Initiate packet without a
+	// message. The message, if any, is a multiple of 16 bytes up to
+	// MaxInitiateMessageLen.
+	InitiateLen           = 544
+	MaxInitiateMessageLen = 640
+	// CookieSize is the size of a Cookie.
+	CookieSize = 96
+	// DomainSize is the size of an encoded domain, see EncodeDomain.
+	DomainSize = 256
+)
+
+var (
+	// ErrMalformed is returned for packets of the wrong type or
+	// length.
+	ErrMalformed = errors.New("malformed handshake packet")
+	// ErrBadHello is returned for Hellos not boxed to the server's
+	// long-term key.
+	ErrBadHello = errors.New("Hello doesn't open")
+	// ErrBadCookie is returned for Cookie packets that don't open,
+	// and Initiates echoing a Cookie that doesn't.
+	ErrBadCookie = errors.New("Cookie doesn't open")
+	// ErrBadInitiate is returned for Initiates whose box doesn't open.
+	ErrBadInitiate = errors.New("Initiate doesn't open")
+	// ErrBadDomain is returned for Initiates with a domain that
+	// doesn't decode.
+	ErrBadDomain = errors.New("Initiate with an invalid domain")
+	// ErrBadVouch is returned for Initiates whose client long-term key
+	// doesn't vouch for its short-term key.
+	ErrBadVouch = errors.New("Initiate with a bad vouch")
+	// ErrBadMessage is returned for Initiate messages of a length not
+	// allowed, see MaxInitiateMessageLen.
+	ErrBadMessage = errors.New("invalid Initiate message length")
+)
+
+var zeros [64]byte
+
+// SealHello appends to dst a Hello packet from the client short-term
+// key pair to the server's long-term key, with the counter n of the
+// client's short-term nonces.
+func SealHello(dst []byte, serverExt, clientExt [16]byte, serverKey, shortTermKey, shortTermSecret *[32]byte, n uint64) []byte {
+	ret, out := sliceForAppend(dst, HelloLen)
+	copy(out, HelloMagic)
+	copy(out[8:], serverExt[:])
+	copy(out[24:], clientExt[:])
+	copy(out[40:], shortTermKey[:])
+	copy(out[72:136], zeros[:])
+
+	var nonce [24]byte
+	copy(nonce[:], HelloNoncePrefix)
+	binary.LittleEndian.PutUint64(nonce[16:], n)
+	copy(out[136:], nonce[16:])
+	box.Seal(out[:144], zeros[:], &nonce, serverKey, shortTermSecret)
+	return ret
+}
+
+// OpenHello checks that hello is a Hello boxed to the server long-term
+// key of serverSecret, and returns the client's short-term key.
+func OpenHello(hello []byte, serverSecret *[32]byte) (clientShortTermKey [32]byte, err error) {
+	if len(hello) != HelloLen || string(hello[:8]) != HelloMagic || !allZero(hello[72:136]) {
+		return clientShortTermKey, ErrMalformed
+	}
+	copy(clientShortTermKey[:], hello[40:72])
+
+	var nonce [24]byte
+	copy(nonce[:], HelloNoncePrefix)
+	copy(nonce[16:], hello[136:144])
+	var out [64]byte
+	if _, ok := box.Open(out[:0], hello[144:], &nonce, &clientShortTermKey, serverSecret); !ok || !allZero(out[:]) {
+		return clientShortTermKey, ErrBadHello
+	}
+	return clientShortTermKey, nil
+}
+
+// A Cookie is what a server sends a client in its Cookie packet for the
+// client to echo in its Initiates: both short-term keys of the session,
+// sealed under a minute key only the server knows, so that the server
+// keeps no state for a client until its Initiate. It's a 16-byte nonce
+// and a secretbox.
+type Cookie [CookieSize]byte
+
+// NewCookie seals a Cookie of the client short-term key and server
+// short-term secret key under minuteKey, with the random nonce.
+func NewCookie(clientShortTermKey, serverShortTermSecret, minuteKey *[32]byte, nonce *[16]byte) *Cookie {
+	var plain [64]byte
+	copy(plain[:], clientShortTermKey[:])
+	copy(plain[32:], serverShortTermSecret[:])
+
+	var n [24]byte
+	copy(n[:], MinuteNoncePrefix)
+	copy(n[8:], nonce[:])
+	c := new(Cookie)
+	copy(c[:], nonce[:])
+	secretbox.Seal(c[:16], plain[:], &n, minuteKey)
+	return c
+}
+
+// Open returns the keys sealed in c, if minuteKey opens it.
+func (c *Cookie) Open(minuteKey *[32]byte) (clientShortTermKey, serverShortTermSecret [32]byte, ok bool) {
+	var n [24]byte
+	copy(n[:], MinuteNoncePrefix)
+	copy(n[8:], c[:16])
+	var plain [64]byte
+	if _, ok = secretbox.Open(plain[:0], c[16:], &n, minuteKey); !ok {
+		return
+	}
+	copy(clientShortTermKey[:], plain[:32])
+	copy(serverShortTermSecret[:], plain[32:])
+	return
+}
+
+// SealCookie appends to dst the Cookie packet answering hello, a Hello
+// opened with OpenHello, boxed from the server long-term key of
+// serverSecret with the nonce. The nonce must never repeat with the
+// server's long-term key.
+func SealCookie(dst, hello []byte, serverSecret, serverShortTermKey *[32]byte, cookie *Cookie, nonce *[16]byte) []byte {
+	ret, out := sliceForAppend(dst, CookieLen)
+	copy(out, CookieMagic)
+	// Extensions, swapped.
+	copy(out[8:], hello[24:40])
+	copy(out[24:], hello[8:24])
+	copy(out[40:], nonce[:])
+
+	var plain [32 + CookieSize]byte
+	copy(plain[:], serverShortTermKey[:])
+	copy(plain[32:], cookie[:])
+	var clientShortTermKey [32]byte
+	copy(clientShortTermKey[:], hello[40:72])
+	var n [24]byte
+	copy(n[:], CookieNoncePrefix)
+	copy(n[8:], nonce[:])
+	box.Seal(out[:56], plain[:], &n, &clientShortTermKey, serverSecret)
+	return ret
+}
+
+// OpenCookie opens the Cookie packet pkt, from the server long-term
+// key to the client's short-term secret key, and returns the server's
+// short-term key and the Cookie. Whether the packet's client extension
+// is that of the client is up to the caller.
+func OpenCookie(pkt []byte, serverKey, shortTermSecret *[32]byte) (serverShortTermKey [32]byte, cookie *Cookie, err error) {
+	if len(pkt) != CookieLen || string(pkt[:8]) != CookieMagic {
+		return serverShortTermKey, nil, ErrMalformed
+	}
+	var n [24]byte
+	copy(n[:], CookieNoncePrefix)
+	copy(n[8:], pkt[40:56])
+	var plain [32 + CookieSize]byte
+	if _, ok := box.Open(plain[:0], pkt[56:], &n, serverKey, shortTermSecret); !ok {
+		return serverShortTermKey, nil, ErrBadCookie
+	}
+	copy(serverShortTermKey[:], plain[:32])
+	cookie = new(Cookie)
+	copy(cookie[:], plain[32:])
+	return serverShortTermKey, cookie, nil
+}
+
+// InitiateHeader returns the start of the client's Initiate packets,
+// the 168 bytes up to the nonce, which are the same in all of them.
+func InitiateHeader(serverExt, clientExt [16]byte, shortTermKey *[32]byte, cookie *Cookie) []byte {
+	h := make([]byte, 168)
+	copy(h, InitiateMagic)
+	copy(h[8:], serverExt[:])
+	copy(h[24:], clientExt[:])
+	copy(h[40:], shortTermKey[:])
+	copy(h[72:], cookie[:])
+	return h
+}
+
+// InitiatePrefix returns the start of the plaintext of the client's
+// Initiates, which the message follows: its long-term key, the vouch
+// for its short-term key, boxed with the nonce, and the domain, encoded
+// by EncodeDomain. The nonce must never repeat with the client's
+// long-term key.
+func InitiatePrefix(serverKey, longTermKey, longTermSecret, shortTermKey *[32]byte, nonce *[16]byte, domain []byte) []byte {
+	p := make([]byte, 96, 96+DomainSize)
+	copy(p, longTermKey[:])
+	copy(p[32:], nonce[:])
+	var n [24]byte
+	copy(n[:], VouchNoncePrefix)
+	copy(n[8:], nonce[:])
+	box.Seal(p[:48], shortTermKey[:], &n, serverKey, longTermSecret)
+	return append(p, domain...)
+}
+
+// SealInitiate appends to dst an Initiate packet made of header and
+// prefix, from InitiateHeader and InitiatePrefix, and message, boxed
+// with the session key and the counter n of the client's short-term
+// nonces.
+func SealInitiate(dst, header, prefix, message []byte, sessionKey *[32]byte, n uint64) []byte {
+	var nonce [24]byte
+	copy(nonce[:], InitiateNoncePrefix)
+	binary.LittleEndian.PutUint64(nonce[16:], n)
+	dst = append(dst, header...)
+	dst = append(dst, nonce[16:]...)
+	plain := make([]byte, 0, len(prefix)+len(message))
+	plain = append(append(plain, prefix...), message...)
+	return box.SealAfterPrecomputation(dst, plain, &nonce, sessionKey)
+}
+
+// An Initiate is an Initiate packet opened by OpenInitiate.
+type Initiate struct {
+	ClientShortTermKey [32]byte
+	// The server's short-term secret key, from the Cookie.
+	ServerShortTermSecret [32]byte
+	ClientLongTermKey     [32]byte
+	Domain                string
+	// Message is the message the Initiate carries, within the packet.
+	Message []byte
+
+	vouch []byte
+}
+
+// OpenInitiate opens the Initiate packet pkt: the Cookie it echoes
+// with the first of minuteKeys that opens it, and then its box with
+// the short-term keys. The plaintext then replaces the box, at
+// pkt[176:len(pkt)-box.Overhead]; pkt is left alone if the box doesn't
+// open.
+//
+// The vouch isn't checked, it takes the server's long-term key, see
+// Vouched.
+func OpenInitiate(pkt []byte, minuteKeys ...*[32]byte) (*Initiate, error) {
+	if len(pkt) < InitiateLen || len(pkt) > InitiateLen+MaxInitiateMessageLen || len(pkt)%16 != 0 || string(pkt[:8]) != InitiateMagic {
+		return nil, ErrMalformed
+	}
+	ini := &Initiate{}
+	var cookie Cookie
+	copy(cookie[:], pkt[72:168])
+	var clientShortTermKey [32]byte
+	ok := false
+	for _, k := range minuteKeys {
+		if clientShortTermKey, ini.ServerShortTermSecret, ok = cookie.Open(k); ok {
+			break
+		}
+	}
+	// The Cookie must be the client's.
+	if !ok || !bytes.Equal(clientShortTermKey[:], pkt[40:72]) {
+		return nil, ErrBadCookie
+	}
+	ini.ClientShortTermKey = clientShortTermKey
+
+	var nonce [24]byte
+	copy(nonce[:], InitiateNoncePrefix)
+	copy(nonce[16:], pkt[168:176])
+	// Not in place, the plaintext doesn't start where the ciphertext
+	// does.
+	var scratch [96 + DomainSize + MaxInitiateMessageLen]byte
+	opened, ok := box.Open(scratch[:0], pkt[176:], &nonce, &ini.ClientShortTermKey, &ini.ServerShortTermSecret)
+	if !ok {
+		return nil, ErrBadInitiate
+	}
+	plain := pkt[176 : 176+copy(pkt[176:], opened)]
+	copy(ini.ClientLongTermKey[:], plain[:32])
+	ini.vouch = plain[32:96]
+	ini.Message = plain[96+DomainSize:]
+	if ini.Domain = DecodeDomain(plain[96 : 96+DomainSize]); ini.Domain == "" {
+		return nil, ErrBadDomain
+	}
+	return ini, nil
+}
+
+// Vouched reports whether the client's long-term key vouches for its
+// short-term key, given the key shared by the client's and the
+// server's long-term keys, from box.Precompute, which servers may
+// want to cache.
+func (ini *Initiate) Vouched(vouchKey *[32]byte) bool {
+	var nonce [24]byte
+	copy(nonce[:], VouchNoncePrefix)
+	copy(nonce[8:], ini.vouch[:16])
+	var vouch [32]byte
+	_, ok := box.OpenAfterPrecomputation(vouch[:0], ini.vouch[16:], &nonce, vouchKey)
+	return ok && vouch == ini.ClientShortTermKey
+}
+
+// SessionKey returns the key the server's Messages are boxed with, the
+// shared key of the short-term keys.
+func (ini *Initiate) SessionKey() *[32]byte {
+	k := new([32]byte)
+	box.Precompute(k, &ini.ClientShortTermKey, &ini.ServerShortTermSecret)
+	return k
+}
+
+// EncodeDomain encodes domain the way Initiate packets carry it, in
+// DomainSize bytes. Returns nil if it doesn't fit.
+func EncodeDomain(domain string) []byte {
+	d := make([]byte, DomainSize)
+	off := 0
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		// Leave room for the terminating empty label.
+		if len(label) == 0 || len(label) > 63 || off+1+len(label) >= len(d) {
+			return nil
+		}
+		d[off] = byte(len(label))
+		copy(d[off+1:], label)
+		off += 1 + len(label)
+	}
+	return d
+}
+
+// DecodeDomain decodes a domain encoded by EncodeDomain. Returns ""
+// if it isn't valid.
+func DecodeDomain(d []byte) string {
+	var ret []string
+	for len(d) > 0 {
+		l := int(d[0])
+		if l == 0 {
+			return strings.Join(ret, ".")
+		}
+		if l > 63 || l > len(d)-1 {
+			return ""
+		}
+
+		ret = append(ret, string(d[1:l+1]))
+		d = d[l+1:]
+	}
+	return strings.Join(ret, ".")
+}
+
+func allZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sliceForAppend extends in by n bytes, and returns the whole slice and
+// the new bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
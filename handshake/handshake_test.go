@@ -0,0 +1,236 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func newKey(t *testing.T) (pub, priv *[32]byte) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// handshake runs a handshake between c and s, and returns the
+// server's view of the Initiate carrying message.
+func handshake(t *testing.T, c *Client, s *Server, message []byte) *Initiate {
+	t.Helper()
+	hello := c.Hello()
+	if len(hello) != HelloLen {
+		t.Fatalf("Hello of %d bytes", len(hello))
+	}
+	cookie, err := s.HandleHello(hello)
+	if err != nil {
+		t.Fatalf("HandleHello: %v", err)
+	}
+	if err := c.HandleCookie(cookie); err != nil {
+		t.Fatalf("HandleCookie: %v", err)
+	}
+	initiate, err := c.Initiate(message)
+	if err != nil {
+		t.Fatalf("Initiate: %v", err)
+	}
+	if got, want := len(initiate), InitiateLen+len(message); got != want {
+		t.Fatalf("Initiate of %d bytes, want %d", got, want)
+	}
+	ini, err := s.HandleInitiate(initiate)
+	if err != nil {
+		t.Fatalf("HandleInitiate: %v", err)
+	}
+	return ini
+}
+
+func TestHandshake(t *testing.T) {
+	serverKey, serverSecret := newKey(t)
+	clientKey, clientSecret := newKey(t)
+	s, err := NewServer(serverSecret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(serverKey, clientSecret, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SessionKey() != nil {
+		t.Errorf("session key before the Cookie")
+	}
+	if _, err := c.Initiate(nil); err == nil {
+		t.Errorf("Initiate before the Cookie succeeded")
+	}
+
+	message := bytes.Repeat([]byte("0123456789abcdef"), 3)
+	ini := handshake(t, c, s, message)
+	if ini.ClientLongTermKey != *clientKey {
+		t.Errorf("client long-term key %x, want %x", ini.ClientLongTermKey, *clientKey)
+	}
+	if ini.ClientShortTermKey != *c.ShortTermKey() {
+		t.Errorf("client short-term key %x, want %x", ini.ClientShortTermKey, *c.ShortTermKey())
+	}
+	if ini.Domain != "example.com" {
+		t.Errorf("domain %q, want example.com", ini.Domain)
+	}
+	if !bytes.Equal(ini.Message, message) {
+		t.Errorf("message %q, want %q", ini.Message, message)
+	}
+	if *ini.SessionKey() != *c.SessionKey() {
+		t.Errorf("session keys differ")
+	}
+	if c.Nonce() != 2 {
+		t.Errorf("nonce %d after a Hello and an Initiate, want 2", c.Nonce())
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	serverKey, serverSecret := newKey(t)
+	_, clientSecret := newKey(t)
+	s, _ := NewServer(serverSecret, nil)
+
+	// A Hello to another server.
+	otherKey, _ := newKey(t)
+	c, _ := NewClient(otherKey, clientSecret, "example.com", nil)
+	if _, err := s.HandleHello(c.Hello()); err != ErrBadHello {
+		t.Errorf("Hello to another key: %v, want ErrBadHello", err)
+	}
+	if _, err := s.HandleHello(make([]byte, HelloLen)); err != ErrMalformed {
+		t.Errorf("zero Hello: %v, want ErrMalformed", err)
+	}
+
+	c, _ = NewClient(serverKey, clientSecret, "example.com", nil)
+	cookie, err := s.HandleHello(c.Hello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), cookie...)
+	tampered[100] ^= 1
+	if err := c.HandleCookie(tampered); err != ErrBadCookie {
+		t.Errorf("tampered Cookie: %v, want ErrBadCookie", err)
+	}
+	if err := c.HandleCookie(cookie); err != nil {
+		t.Fatal(err)
+	}
+	initiate, _ := c.Initiate(nil)
+
+	tampered = append([]byte(nil), initiate...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := s.HandleInitiate(tampered); err != ErrBadInitiate {
+		t.Errorf("tampered Initiate: %v, want ErrBadInitiate", err)
+	}
+	if !bytes.Equal(tampered[:len(tampered)-1], initiate[:len(initiate)-1]) {
+		t.Errorf("Initiate that doesn't open modified")
+	}
+
+	// Another client's short-term key with the Cookie.
+	tampered = append([]byte(nil), initiate...)
+	tampered[40] ^= 1
+	if _, err := s.HandleInitiate(tampered); err != ErrBadCookie {
+		t.Errorf("Initiate with another client's Cookie: %v, want ErrBadCookie", err)
+	}
+
+	// Cookies last two minute keys.
+	s.RotateMinuteKey()
+	if _, err := s.HandleInitiate(append([]byte(nil), initiate...)); err != nil {
+		t.Errorf("Initiate after a rotation: %v", err)
+	}
+	s.RotateMinuteKey()
+	if _, err := s.HandleInitiate(append([]byte(nil), initiate...)); err != ErrBadCookie {
+		t.Errorf("Initiate after two rotations: %v, want ErrBadCookie", err)
+	}
+}
+
+func TestOpenInitiate(t *testing.T) {
+	serverKey, serverSecret := newKey(t)
+	clientKey, clientSecret := newKey(t)
+	s, _ := NewServer(serverSecret, nil)
+	c, _ := NewClient(serverKey, clientSecret, "example.com", nil)
+	cookie, err := s.HandleHello(c.Hello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleCookie(cookie); err != nil {
+		t.Fatal(err)
+	}
+	message := bytes.Repeat([]byte("fedcba9876543210"), MaxInitiateMessageLen/16)
+	pkt, err := c.Initiate(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ini, err := OpenInitiate(pkt, &s.previousKey, &s.minuteKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The plaintext replaces the box, where servers read it.
+	if !bytes.Equal(pkt[176:208], clientKey[:]) {
+		t.Errorf("client long-term key at pkt[176:] %x, want %x", pkt[176:208], clientKey[:])
+	}
+	if DecodeDomain(pkt[272:528]) != "example.com" {
+		t.Errorf("domain at pkt[272:] %q, want example.com", DecodeDomain(pkt[272:528]))
+	}
+	if !bytes.Equal(pkt[528:len(pkt)-box.Overhead], message) {
+		t.Errorf("message at pkt[528:] %q, want %q", pkt[528:len(pkt)-box.Overhead], message)
+	}
+	if &ini.Message[0] != &pkt[528] {
+		t.Errorf("Initiate.Message isn't within the packet")
+	}
+}
+
+func TestVouch(t *testing.T) {
+	serverKey, serverSecret := newKey(t)
+	clientKey, clientSecret := newKey(t)
+	_, otherSecret := newKey(t)
+
+	// An Initiate whose vouch is for another short-term key.
+	var minuteKey [32]byte
+	shortTermKey, shortTermSecret := newKey(t)
+	serverShortTermKey, serverShortTermSecret := newKey(t)
+	var nonce [16]byte
+	cookie := NewCookie(shortTermKey, serverShortTermSecret, &minuteKey, &nonce)
+	header := InitiateHeader([16]byte{}, [16]byte{}, shortTermKey, cookie)
+	otherShortTermKey, _ := newKey(t)
+	prefix := InitiatePrefix(serverKey, clientKey, clientSecret, otherShortTermKey, &nonce, EncodeDomain("example.com"))
+	var sessionKey [32]byte
+	box.Precompute(&sessionKey, serverShortTermKey, shortTermSecret)
+	ini, err := OpenInitiate(SealInitiate(nil, header, prefix, nil, &sessionKey, 1), &minuteKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vouchKey [32]byte
+	box.Precompute(&vouchKey, clientKey, serverSecret)
+	if ini.Vouched(&vouchKey) {
+		t.Errorf("vouch for another short-term key accepted")
+	}
+
+	prefix = InitiatePrefix(serverKey, clientKey, clientSecret, shortTermKey, &nonce, EncodeDomain("example.com"))
+	if ini, err = OpenInitiate(SealInitiate(nil, header, prefix, nil, &sessionKey, 1), &minuteKey); err != nil {
+		t.Fatal(err)
+	}
+	if !ini.Vouched(&vouchKey) {
+		t.Errorf("good vouch rejected")
+	}
+	box.Precompute(&vouchKey, clientKey, otherSecret)
+	if ini.Vouched(&vouchKey) {
+		t.Errorf("vouch accepted by another server key")
+	}
+}
+
+func TestDomain(t *testing.T) {
+	long := strings.Repeat("x", 63)
+	for _, d := range []string{"example.com", "example.com.", "_echo.example.com", "127.0.0.1", "a", long + ".b"} {
+		if got := DecodeDomain(EncodeDomain(d)); got != d && got+"." != d {
+			t.Errorf("DecodeDomain(EncodeDomain(%q)) = %q", d, got)
+		}
+	}
+	for _, d := range []string{"", "a..b", long + "x.b", strings.Repeat(long+".", 4)} {
+		if EncodeDomain(d) != nil {
+			t.Errorf("EncodeDomain(%q) accepted an invalid domain", d)
+		}
+	}
+	if DecodeDomain(make([]byte, DomainSize)) != "" {
+		t.Errorf("empty domain accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A Server runs the server side of handshakes: it answers Hellos with
+// Cookies, and checks Initiates. It keeps no state per client, but two
+// minute keys: Cookies are sealed under the current one, and Initiates
+// accepted with either, so that rotating the keys, say every minute,
+// expires Cookies after a minute or two.
+//
+// An Initiate may be sent many times, and replayed by an attacker: the
+// caller must start a session only for the first Initiate from a
+// client short-term key, and hand the messages of later ones to it.
+// A Server is not safe for concurrent use.
+type Server struct {
+	rand                   io.Reader
+	secret                 [32]byte
+	minuteKey, previousKey [32]byte
+}
+
+// NewServer returns a Server with the long-term key of secret.
+// Short-term keys, minute keys and nonces are drawn from rand, or
+// crypto/rand if it's nil.
+func NewServer(secret *[32]byte, rand io.Reader) (*Server, error) {
+	s := &Server{rand: rand, secret: *secret}
+	// Twice, so that the previous key isn't all zeros, which anyone
+	// could seal Cookies under.
+	for i := 0; i < 2; i++ {
+		if err := s.RotateMinuteKey(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) reader() io.Reader {
+	if s.rand == nil {
+		return rand.Reader
+	}
+	return s.rand
+}
+
+// RotateMinuteKey makes a new minute key, and keeps the current one as
+// the previous one.
+func (s *Server) RotateMinuteKey() error {
+	s.previousKey = s.minuteKey
+	_, err := io.ReadFull(s.reader(), s.minuteKey[:])
+	return err
+}
+
+// HandleHello checks the Hello hello, and returns the Cookie packet
+// that answers it.
+func (s *Server) HandleHello(hello []byte) ([]byte, error) {
+	clientShortTermKey, err := OpenHello(hello, &s.secret)
+	if err != nil {
+		return nil, err
+	}
+	pub, priv, err := box.GenerateKey(s.reader())
+	if err != nil {
+		return nil, err
+	}
+	var minuteNonce, nonce [16]byte
+	if _, err := io.ReadFull(s.reader(), minuteNonce[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(s.reader(), nonce[:]); err != nil {
+		return nil, err
+	}
+	cookie := NewCookie(&clientShortTermKey, priv, &s.minuteKey, &minuteNonce)
+	return SealCookie(nil, hello, &s.secret, pub, cookie, &nonce), nil
+}
+
+// HandleInitiate checks the Initiate pkt, vouch included, and returns
+// its contents. As with OpenInitiate, the plaintext replaces the box.
+func (s *Server) HandleInitiate(pkt []byte) (*Initiate, error) {
+	ini, err := OpenInitiate(pkt, &s.minuteKey, &s.previousKey)
+	if err != nil {
+		return nil, err
+	}
+	var vouchKey [32]byte
+	box.Precompute(&vouchKey, &ini.ClientLongTermKey, &s.secret)
+	if !ini.Vouched(&vouchKey) {
+		return nil, ErrBadVouch
+	}
+	return ini, nil
+}
@@ -0,0 +1,104 @@
+package curvecp
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// Each power of two of microseconds is split into
+	// 1<<histogramSubBits buckets, for a relative error under 1/16.
+	histogramSubBits = 4
+	histogramSub     = 1 << histogramSubBits
+	// Samples are capped at 1<<histogramMaxBits microseconds, about
+	// 18 minutes.
+	histogramMaxBits = 30
+	histogramBuckets = (histogramMaxBits - histogramSubBits + 1) * histogramSub
+)
+
+// An RTTHistogram counts RTT samples in buckets of logarithmically
+// growing width, in the manner of HDR histograms: a bucket covers at
+// most 1/16th of its lower bound, from 1µs to about 18 minutes. The
+// zero value is an empty histogram.
+type RTTHistogram struct {
+	counts   [histogramBuckets]uint64
+	count    uint64
+	min, max time.Duration
+}
+
+// histogramBucket returns the bucket of a sample of v microseconds.
+func histogramBucket(v uint64) int {
+	if v < histogramSub {
+		return int(v)
+	}
+	if v >= 1<<histogramMaxBits {
+		v = 1<<histogramMaxBits - 1
+	}
+	shift := bits.Len64(v) - 1 - histogramSubBits
+	return (shift+1)*histogramSub + int(v>>shift) - histogramSub
+}
+
+// histogramHighest returns the highest sample, in microseconds, that
+// falls in bucket i.
+func histogramHighest(i int) uint64 {
+	if i < histogramSub {
+		return uint64(i)
+	}
+	shift := i/histogramSub - 1
+	low := uint64(i%histogramSub+histogramSub) << shift
+	return low + 1<<shift - 1
+}
+
+// Record adds a sample to the histogram.
+func (h *RTTHistogram) Record(rtt time.Duration) {
+	if rtt < 0 {
+		rtt = 0
+	}
+	h.counts[histogramBucket(uint64(rtt/time.Microsecond))]++
+	if h.count == 0 || rtt < h.min {
+		h.min = rtt
+	}
+	if rtt > h.max {
+		h.max = rtt
+	}
+	h.count++
+}
+
+// Count returns the number of samples.
+func (h *RTTHistogram) Count() uint64 {
+	return h.count
+}
+
+// Min and Max return the exact lowest and highest samples, or 0 if
+// there are none.
+func (h *RTTHistogram) Min() time.Duration { return h.min }
+func (h *RTTHistogram) Max() time.Duration { return h.max }
+
+// Quantile returns the sample below which the fraction q, between 0
+// and 1, of the samples fall: Quantile(0.99) is the 99th
+// percentile. The result is the highest value of its bucket, capped
+// by Max, so it never understates the tail. Returns 0 if there are no
+// samples.
+func (h *RTTHistogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	want := uint64(q*float64(h.count) + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		if seen += n; seen >= want {
+			d := time.Duration(histogramHighest(i)+1)*time.Microsecond - 1
+			if d > h.max {
+				d = h.max
+			}
+			if d < h.min {
+				d = h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,51 @@
+package curvecp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	prev := -1
+	for v := uint64(0); v < 1<<histogramMaxBits; v += v/64 + 1 {
+		i := histogramBucket(v)
+		if i < prev || i >= histogramBuckets {
+			t.Fatalf("%dµs in bucket %d, after %d", v, i, prev)
+		}
+		if hi := histogramHighest(i); v > hi || hi-v > v/histogramSub {
+			t.Fatalf("%dµs in bucket %d, whose highest value is %d", v, i, hi)
+		}
+		prev = i
+	}
+	if i := histogramBucket(1 << 40); i != histogramBuckets-1 {
+		t.Errorf("huge sample in bucket %d, want the last, %d", i, histogramBuckets-1)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h RTTHistogram
+	if h.Quantile(0.5) != 0 {
+		t.Errorf("empty histogram has a median")
+	}
+	// 1ms to 100ms.
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	if h.Count() != 100 || h.Min() != time.Millisecond || h.Max() != 100*time.Millisecond {
+		t.Errorf("count %d, min %s, max %s, want 100, 1ms, 100ms", h.Count(), h.Min(), h.Max())
+	}
+	for _, test := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, 50 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	} {
+		got := h.Quantile(test.q)
+		if got < test.want || got > test.want+test.want/histogramSub {
+			t.Errorf("Quantile(%v) = %s, want %s within 1/16", test.q, got, test.want)
+		}
+	}
+}
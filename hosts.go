@@ -0,0 +1,82 @@
+package curvecp
+
+import (
+	"net"
+)
+
+const (
+	defaultHostPrefixV4 = 32
+	defaultHostPrefixV6 = 64
+)
+
+// hostCount is what a server tracks per host, see Config.MaxConnsPerHost.
+type hostCount struct {
+	// Conns, and those of them whose client hasn't sent a Message
+	// yet.
+	conns, halfOpen int
+}
+
+// hostKey returns the host addr counts towards: its IP address,
+// truncated to Config.HostPrefixV4 or HostPrefixV6 bits.
+func (c *Config) hostKey(addr net.Addr) string {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip := udp.IP.To4(); ip != nil {
+		return ip.Mask(net.CIDRMask(c.hostPrefixV4(), 32)).String()
+	}
+	return udp.IP.Mask(net.CIDRMask(c.hostPrefixV6(), 128)).String()
+}
+
+// hostFull reports whether the host of addr has as many conns, or
+// half-open conns, as it may.
+func (s *server) hostFull(addr net.Addr) bool {
+	maxConns, maxHalfOpen := s.config.maxConnsPerHost(), s.config.maxHalfOpenPerHost()
+	if maxConns == 0 && maxHalfOpen == 0 {
+		return false
+	}
+	h, ok := s.hosts[s.config.hostKey(addr)]
+	if !ok {
+		return false
+	}
+	return maxConns > 0 && h.conns >= maxConns || maxHalfOpen > 0 && h.halfOpen >= maxHalfOpen
+}
+
+// addHost counts the new conn of q towards its host.
+func (s *server) addHost(q *connQueue, addr net.Addr) {
+	q.host = s.config.hostKey(addr)
+	h, ok := s.hosts[q.host]
+	if !ok {
+		h = &hostCount{}
+		s.hosts[q.host] = h
+	}
+	h.conns++
+	h.halfOpen++
+}
+
+// establish notes that the client of q has sent a Message.
+func (s *server) establish(q *connQueue) {
+	if q.established {
+		return
+	}
+	q.established = true
+	if h, ok := s.hosts[q.host]; ok {
+		h.halfOpen--
+	}
+}
+
+// removeHost stops counting the conn of q towards its host.
+func (s *server) removeHost(q *connQueue) {
+	h, ok := s.hosts[q.host]
+	if !ok {
+		return
+	}
+	h.conns--
+	if !q.established {
+		h.halfOpen--
+	}
+	if h.conns == 0 {
+		delete(s.hosts, q.host)
+	}
+}
@@ -0,0 +1,60 @@
+package curvecp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostKey(t *testing.T) {
+	for _, tc := range []struct {
+		config *Config
+		addr   string
+		want   string
+	}{
+		{nil, "192.0.2.1:1234", "192.0.2.1"},
+		{&Config{HostPrefixV4: 24}, "192.0.2.1:1234", "192.0.2.0"},
+		{nil, "[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::"},
+		{&Config{HostPrefixV6: 128}, "[2001:db8::1]:1234", "2001:db8::1"},
+	} {
+		addr, err := net.ResolveUDPAddr("udp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.config.hostKey(addr); got != tc.want {
+			t.Errorf("hostKey(%s) = %s, want %s", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestHostLimits(t *testing.T) {
+	s := &server{
+		config: &Config{MaxConnsPerHost: 2, MaxHalfOpenPerHost: 1},
+		hosts:  make(map[string]*hostCount),
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}
+
+	q1 := &connQueue{}
+	s.addHost(q1, addr)
+	if !s.hostFull(addr) {
+		t.Errorf("host with a half-open conn not full")
+	}
+	if s.hostFull(other) {
+		t.Errorf("other host full")
+	}
+	s.establish(q1)
+	if s.hostFull(addr) {
+		t.Errorf("host full with an established conn")
+	}
+	q2 := &connQueue{}
+	s.addHost(q2, addr)
+	s.establish(q2)
+	if !s.hostFull(addr) {
+		t.Errorf("host with two conns not full")
+	}
+	s.removeHost(q1)
+	s.removeHost(q2)
+	if len(s.hosts) != 0 {
+		t.Errorf("hosts without conns still tracked: %v", s.hosts)
+	}
+}
@@ -0,0 +1,57 @@
+package curvecp
+
+import (
+	"net"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Read and Write on a connection torn
+// down because nothing arrived from the peer for longer than its idle
+// timeout, see Config.IdleTimeout, or because the server reaped it,
+// see Config.HalfOpenTimeout and Config.SilentTimeout.
+var ErrIdleTimeout net.Error = &timeoutError{"connection idle timeout"}
+
+// SetIdleTimeout overrides Config.IdleTimeout for this connection,
+// counting from the last packet received. Zero disables the idle
+// timeout.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	select {
+	case c.idleRequest <- d:
+	case <-c.done:
+	}
+}
+
+// idleDeadline returns when the connection times out if nothing
+// arrives, or the zero time if it never does.
+func (c *Conn) idleDeadline() time.Time {
+	if c.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return c.lastRecv.Add(c.idleTimeout)
+}
+
+// checkIdle fails the connection with ErrIdleTimeout once its idle
+// deadline has passed. The pump then tears it down.
+func (c *Conn) checkIdle(now time.Time) {
+	if t := c.idleDeadline(); !t.IsZero() && !now.Before(t) {
+		c.fail(ErrIdleTimeout)
+	}
+}
+
+// doneErr returns the error for I/O on a connection whose pump has
+// exited.
+func (c *Conn) doneErr() error {
+	if c.closing == 0 && c.err != nil {
+		return c.err
+	}
+	return net.ErrClosed
+}
+
+// expire fails the connection with ErrIdleTimeout, for the server's
+// reaper.
+func (c *Conn) expire() {
+	select {
+	case c.expireRequest <- struct{}{}:
+	case <-c.done:
+	}
+}
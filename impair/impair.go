@@ -0,0 +1,157 @@
+// Package impair implements a net.PacketConn that makes the network
+// worse on purpose: it loses, duplicates, reorders and delays the
+// packets written to it, so that congestion control and loss recovery
+// can be exercised in tests and benchmarks. Wrap both ends of a
+// connection to impair both directions.
+//
+// The fate of each packet is drawn from a random source seeded by
+// Profile.Seed, so the same sequence of writes always meets the same
+// impairments. Delivery times follow the clock, and aren't as
+// reproducible.
+package impair
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Extra delay of reordered packets when Profile.ReorderDelay is zero.
+const defaultReorderDelay = 10 * time.Millisecond
+
+// A Profile describes the impairments of a Conn.
+type Profile struct {
+	// Loss is the probability of losing a packet, from 0 to 1.
+	Loss float64
+	// Duplicate is the probability of sending a packet twice.
+	Duplicate float64
+	// Reorder is the probability of holding a packet back by
+	// ReorderDelay more than the others, so that later ones
+	// overtake it.
+	Reorder float64
+	// ReorderDelay is how long reordered packets are held back.
+	// Zero means the default of 10ms.
+	ReorderDelay time.Duration
+	// Latency delays every packet, give or take up to Jitter,
+	// picked uniformly for each packet.
+	Latency, Jitter time.Duration
+	// Seed seeds the random source deciding the fate of packets.
+	Seed int64
+}
+
+// Stats counts what a Conn did to the packets written to it.
+type Stats struct {
+	Written, Lost, Duplicated, Reordered int
+}
+
+// A Conn is a net.PacketConn impairing the packets written to it.
+// Reads are left alone.
+type Conn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	profile Profile
+	rand    *rand.Rand
+	stats   Stats
+	closed  bool
+}
+
+// New returns a Conn writing to conn with the impairments of profile.
+func New(conn net.PacketConn, profile Profile) *Conn {
+	return &Conn{
+		PacketConn: conn,
+		profile:    profile,
+		rand:       rand.New(rand.NewSource(profile.Seed)),
+	}
+}
+
+// SetProfile changes the impairments of the packets written from now
+// on, keeping the random source going.
+func (c *Conn) SetProfile(profile Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = profile
+}
+
+// Stats returns the counts of what happened to packets so far.
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// WriteTo sends b to addr, or not, now or later, according to the
+// profile. Packets sent later have their errors ignored. Lost packets
+// count as written.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.stats.Written++
+	p := c.profile
+	if c.rand.Float64() < p.Loss {
+		c.stats.Lost++
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	copies := 1
+	if c.rand.Float64() < p.Duplicate {
+		c.stats.Duplicated++
+		copies = 2
+	}
+	var delays [2]time.Duration
+	for i := 0; i < copies; i++ {
+		delays[i] = c.delay(p)
+	}
+	c.mu.Unlock()
+
+	for _, d := range delays[:copies] {
+		if d <= 0 {
+			if _, err := c.PacketConn.WriteTo(b, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		pkt := append([]byte(nil), b...)
+		time.AfterFunc(d, func() {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if !closed {
+				c.PacketConn.WriteTo(pkt, addr)
+			}
+		})
+	}
+	return len(b), nil
+}
+
+// delay picks how long to hold a packet back, under c.mu.
+func (c *Conn) delay(p Profile) time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(2*p.Jitter)+1)) - p.Jitter
+	}
+	if c.rand.Float64() < p.Reorder {
+		c.stats.Reordered++
+		if p.ReorderDelay > 0 {
+			d += p.ReorderDelay
+		} else {
+			d += defaultReorderDelay
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Close closes the underlying conn. Packets still held back are lost.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,112 @@
+package impair
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sink is a net.PacketConn recording the packets written to it.
+type sink struct {
+	net.PacketConn
+	mu   sync.Mutex
+	pkts []byte
+}
+
+func (s *sink) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pkts = append(s.pkts, b[0])
+	return len(b), nil
+}
+
+func (s *sink) Close() error {
+	return nil
+}
+
+func (s *sink) received() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.pkts...)
+}
+
+// send writes n one-byte packets, numbered, through a Conn with
+// profile, and returns what arrived once the delays are over.
+func send(profile Profile, n int, wait time.Duration) ([]byte, Stats) {
+	s := &sink{}
+	c := New(s, profile)
+	for i := 0; i < n; i++ {
+		c.WriteTo([]byte{byte(i)}, nil)
+	}
+	time.Sleep(wait)
+	return s.received(), c.Stats()
+}
+
+func TestLoss(t *testing.T) {
+	got, stats := send(Profile{Loss: 0.3, Seed: 1}, 200, 0)
+	if stats.Written != 200 || stats.Lost+len(got) != 200 {
+		t.Fatalf("stats %+v with %d packets through", stats, len(got))
+	}
+	if stats.Lost < 30 || stats.Lost > 90 {
+		t.Errorf("lost %d packets of 200 at 30%%", stats.Lost)
+	}
+	again, _ := send(Profile{Loss: 0.3, Seed: 1}, 200, 0)
+	if string(again) != string(got) {
+		t.Errorf("same seed, different losses")
+	}
+	other, _ := send(Profile{Loss: 0.3, Seed: 2}, 200, 0)
+	if string(other) == string(got) {
+		t.Errorf("different seeds, same losses")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	got, stats := send(Profile{Duplicate: 1}, 10, 0)
+	if len(got) != 20 || stats.Duplicated != 10 {
+		t.Errorf("%d packets through, %d duplicated, want 20 and 10", len(got), stats.Duplicated)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := &sink{}
+	c := New(s, Profile{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	c.WriteTo([]byte{1}, nil)
+	if len(s.received()) != 0 {
+		t.Errorf("packet through before the latency")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(s.received()) != 1 {
+		t.Errorf("packet not through after the latency")
+	}
+}
+
+func TestReorder(t *testing.T) {
+	got, stats := send(Profile{Reorder: 0.2, ReorderDelay: 20 * time.Millisecond, Seed: 1}, 50, 100*time.Millisecond)
+	if len(got) != 50 || stats.Reordered == 0 {
+		t.Fatalf("%d packets through, %d reordered", len(got), stats.Reordered)
+	}
+	inOrder := true
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			inOrder = false
+		}
+	}
+	if inOrder {
+		t.Errorf("reordered packets arrived in order")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	s := &sink{}
+	c := New(s, Profile{Latency: 20 * time.Millisecond})
+	c.WriteTo([]byte{1}, nil)
+	c.Close()
+	if _, err := c.WriteTo([]byte{2}, nil); err == nil {
+		t.Errorf("write after Close succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(s.received()) != 0 {
+		t.Errorf("held back packet sent after Close")
+	}
+}
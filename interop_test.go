@@ -0,0 +1,129 @@
+package curvecp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The interop tests run this package against the reference
+// implementation's tools, curvecpserver, curvecpclient, curvecpmessage
+// and curvecpmakekey, when they are in the PATH. They are skipped
+// otherwise.
+
+// How long an interop test may take.
+const interopTimeout = 30 * time.Second
+
+// The server extension the interop tests use, arbitrary.
+var interopExt = [16]byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x58, 0x97, 0x93, 0x23, 0x84, 0x62, 0x64, 0x33, 0x83, 0x27, 0x95}
+
+// interopTools skips the test unless the reference tools are in the
+// PATH.
+func interopTools(t *testing.T) {
+	for _, tool := range []string{"curvecpserver", "curvecpclient", "curvecpmessage", "curvecpmakekey"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found, skipping interop test", tool)
+		}
+	}
+}
+
+// freeUDPPort returns a port on 127.0.0.1 nobody was listening on
+// just now.
+func freeUDPPort(t *testing.T) int {
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	return sock.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestInteropClient dials curvecpserver, running cat as an echo
+// server.
+func TestInteropClient(t *testing.T) {
+	interopTools(t)
+	ctx, cancel := context.WithTimeout(context.Background(), interopTimeout)
+	defer cancel()
+
+	keydir := filepath.Join(t.TempDir(), "server")
+	if out, err := exec.CommandContext(ctx, "curvecpmakekey", keydir).CombinedOutput(); err != nil {
+		t.Fatalf("curvecpmakekey: %v: %s", err, out)
+	}
+	key, err := os.ReadFile(filepath.Join(keydir, "publickey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(freeUDPPort(t))
+	server := exec.CommandContext(ctx, "curvecpserver", "example.com", keydir, "127.0.0.1", port,
+		hex.EncodeToString(interopExt[:]), "curvecpmessage", "cat")
+	server.Stderr = os.Stderr
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+
+	d := Dialer{Domain: "example.com", ServerExtension: interopExt}
+	c, err := d.DialContext(ctx, "127.0.0.1:"+port, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	if err := selfTestEcho(c, 256*1024); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	c.SetReadDeadline(time.Now().Add(interopTimeout))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after CloseWrite = %v, want io.EOF", err)
+	}
+}
+
+// TestInteropServer has curvecpclient send a file to an echo server,
+// and checks that it comes back.
+func TestInteropServer(t *testing.T) {
+	interopTools(t)
+	ctx, cancel := context.WithTimeout(context.Background(), interopTimeout)
+	defer cancel()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l := serveEcho(t, "127.0.0.1:0", priv[:], nil)
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*Addr).UDP.Port)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// curvecpmessage gives client programs the stream on file
+	// descriptors 6 and 7.
+	script := `cat "$1" >&7 && exec 7>&- && cat <&6 >"$2"`
+	client := exec.CommandContext(ctx, "curvecpclient", "example.com", hex.EncodeToString(pub[:]), "127.0.0.1", port,
+		hex.EncodeToString(interopExt[:]), "curvecpmessage", "-c", "sh", "-c", script, "sh", in, out)
+	if output, err := client.CombinedOutput(); err != nil {
+		t.Fatalf("curvecpclient: %v: %s", err, output)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes back, not the %d sent", len(got), len(data))
+	}
+}
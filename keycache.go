@@ -0,0 +1,56 @@
+package curvecp
+
+import (
+	"container/list"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// keyCache is a bounded LRU cache of box.Precompute results, keyed by
+// peer public key. All lookups must use the same secret key.
+type keyCache struct {
+	max int
+	// Most recently used first.
+	lru     *list.List // of *keyCacheEntry
+	entries map[[32]byte]*list.Element
+}
+
+type keyCacheEntry struct {
+	peer, shared [32]byte
+}
+
+// newKeyCache returns a cache of up to max keys. If max <= 0, nothing
+// is cached.
+func newKeyCache(max int) *keyCache {
+	return &keyCache{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+	}
+}
+
+// get returns the key shared by peer and secret, computing it if it
+// isn't cached.
+func (k *keyCache) get(peer, secret *[32]byte) (shared [32]byte) {
+	if e, ok := k.entries[*peer]; ok {
+		k.lru.MoveToFront(e)
+		return e.Value.(*keyCacheEntry).shared
+	}
+	box.Precompute(&shared, peer, secret)
+	if k.max <= 0 {
+		return shared
+	}
+	var entry *keyCacheEntry
+	if k.lru.Len() >= k.max {
+		// Recycle the least recently used entry.
+		e := k.lru.Back()
+		entry = e.Value.(*keyCacheEntry)
+		delete(k.entries, entry.peer)
+		k.lru.Remove(e)
+	} else {
+		entry = new(keyCacheEntry)
+	}
+	entry.peer, entry.shared = *peer, shared
+	k.entries[*peer] = k.lru.PushFront(entry)
+	return shared
+}
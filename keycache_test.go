@@ -0,0 +1,37 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestKeyCache(t *testing.T) {
+	_, secret, _ := box.GenerateKey(rand.Reader)
+	var peers [3][32]byte
+	for i := range peers {
+		pub, _, _ := box.GenerateKey(rand.Reader)
+		peers[i] = *pub
+	}
+	want := func(peer *[32]byte) (k [32]byte) {
+		box.Precompute(&k, peer, secret)
+		return
+	}
+
+	k := newKeyCache(2)
+	for _, i := range []int{0, 1, 0, 2} {
+		if got := k.get(&peers[i], secret); got != want(&peers[i]) {
+			t.Errorf("wrong shared key for peer %d", i)
+		}
+	}
+	// Peer 1 was the least recently used when peer 2 came in.
+	if _, ok := k.entries[peers[1]]; ok || k.lru.Len() != 2 {
+		t.Errorf("cache holds peer 1 and %d keys, want peers 0 and 2", k.lru.Len())
+	}
+
+	k = newKeyCache(-1)
+	if got := k.get(&peers[0], secret); got != want(&peers[0]) || k.lru.Len() != 0 {
+		t.Errorf("disabled cache computed the wrong key or cached it")
+	}
+}
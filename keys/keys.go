@@ -0,0 +1,194 @@
+// Package keys generates CurveCP long-term keypairs, and stores them
+// in the directory layout of DJB's curvecpmakekey, so that Go programs
+// and the reference tools can share keys:
+//
+//	<dir>/publickey                 the public key, 32 bytes
+//	<dir>/.expertsonly/secretkey    the secret key, 32 bytes
+//	<dir>/.expertsonly/lock         empty, locked while updating nonces
+//	<dir>/.expertsonly/noncekey     random 32 bytes, to encrypt nonces
+//	<dir>/.expertsonly/noncecounter 8 bytes, the long-term nonce counter
+//
+// Rotate adds one file of its own, which the reference tools ignore:
+//
+//	<dir>/.expertsonly/previoussecretkey  the secret key before the last rotation
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrKeyMismatch is returned by Read when the public key doesn't
+// belong with the secret key.
+var ErrKeyMismatch = errors.New("public key doesn't match secret key")
+
+// A KeyPair is a Curve25519 keypair.
+type KeyPair struct {
+	Public, Secret [32]byte
+}
+
+// Generate returns a new random keypair.
+func Generate() (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{*pub, *priv}, nil
+}
+
+// Write creates dir, which must not exist yet, and stores kp in it
+// like curvecpmakekey does, with fresh nonce state.
+func Write(dir string, kp *KeyPair) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	expert := filepath.Join(dir, ".expertsonly")
+	if err := os.Mkdir(expert, 0700); err != nil {
+		return err
+	}
+	var nonceKey [32]byte
+	if _, err := rand.Read(nonceKey[:]); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{filepath.Join(dir, "publickey"), kp.Public[:], 0644},
+		{filepath.Join(expert, "secretkey"), kp.Secret[:], 0600},
+		{filepath.Join(expert, "lock"), nil, 0600},
+		{filepath.Join(expert, "noncekey"), nonceKey[:], 0600},
+		{filepath.Join(expert, "noncecounter"), make([]byte, 8), 0600},
+	} {
+		if err := writeNew(f.name, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read loads the keypair stored in dir, and checks that its halves
+// match.
+func Read(dir string) (*KeyPair, error) {
+	pub, err := ReadPublic(dir)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{}
+	copy(kp.Public[:], pub)
+	if err := readKey(filepath.Join(dir, ".expertsonly", "secretkey"), kp.Secret[:]); err != nil {
+		return nil, err
+	}
+	var derived [32]byte
+	curve25519.ScalarBaseMult(&derived, &kp.Secret)
+	if !bytes.Equal(derived[:], kp.Public[:]) {
+		return nil, ErrKeyMismatch
+	}
+	return kp, nil
+}
+
+// ReadPublic loads only the public key stored in dir, which is all a
+// client needs to know about a server.
+func ReadPublic(dir string) ([]byte, error) {
+	pub := make([]byte, 32)
+	if err := readKey(filepath.Join(dir, "publickey"), pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// Rotate replaces the keypair in dir with a new one, and keeps the
+// old secret key, for servers to go on honoring while clients learn
+// the new public key, see ReadPrevious. The nonce state carries over.
+// Rotate returns the new keypair.
+func Rotate(dir string) (*KeyPair, error) {
+	expert := filepath.Join(dir, ".expertsonly")
+	lock, err := os.OpenFile(filepath.Join(expert, "lock"), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return nil, err
+	}
+
+	old, err := Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	// The public key goes last: until then, Read fails rather than
+	// return the old public key with the new secret.
+	if err := replace(filepath.Join(expert, "previoussecretkey"), old.Secret[:], 0600); err != nil {
+		return nil, err
+	}
+	if err := replace(filepath.Join(expert, "secretkey"), kp.Secret[:], 0600); err != nil {
+		return nil, err
+	}
+	if err := replace(filepath.Join(dir, "publickey"), kp.Public[:], 0644); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// ReadPrevious loads the keypair that was in dir before the last
+// Rotate. The error satisfies errors.Is(err, fs.ErrNotExist) if the
+// keys were never rotated.
+func ReadPrevious(dir string) (*KeyPair, error) {
+	kp := &KeyPair{}
+	if err := readKey(filepath.Join(dir, ".expertsonly", "previoussecretkey"), kp.Secret[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&kp.Public, &kp.Secret)
+	return kp, nil
+}
+
+// readKey reads a key file, which must be exactly len(key) bytes.
+func readKey(name string, key []byte) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(key) {
+		return &os.PathError{Op: "read", Path: name, Err: errors.New("wrong key length")}
+	}
+	copy(key, b)
+	return nil
+}
+
+// writeNew writes data to a new file, failing if it already exists.
+func writeNew(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replace writes data to name, replacing any file there in one step.
+func replace(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".new"
+	os.Remove(tmp)
+	if err := writeNew(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
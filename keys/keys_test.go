@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	kp, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "serverkey")
+	if err := Write(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *kp {
+		t.Errorf("Read returned a different keypair")
+	}
+
+	for name, size := range map[string]int64{
+		"publickey":                 32,
+		".expertsonly/secretkey":    32,
+		".expertsonly/lock":         0,
+		".expertsonly/noncekey":     32,
+		".expertsonly/noncecounter": 8,
+	} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if fi.Size() != size {
+			t.Errorf("%s is %d bytes, want %d", name, fi.Size(), size)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, ".expertsonly")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf(".expertsonly mode = %v, %v, want 0700", fi.Mode(), err)
+	}
+
+	if err := Write(dir, kp); err == nil {
+		t.Errorf("Write over an existing key succeeded")
+	}
+}
+
+func TestReadMismatch(t *testing.T) {
+	a, _ := Generate()
+	b, _ := Generate()
+	dir := filepath.Join(t.TempDir(), "key")
+	Write(dir, &KeyPair{a.Public, b.Secret})
+	if _, err := Read(dir); err != ErrKeyMismatch {
+		t.Errorf("Read of mismatched keys = %v, want ErrKeyMismatch", err)
+	}
+	if pub, err := ReadPublic(dir); err != nil || string(pub) != string(a.Public[:]) {
+		t.Errorf("ReadPublic = %x, %v, want %x", pub, err, a.Public)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	first, _ := Generate()
+	dir := filepath.Join(t.TempDir(), "key")
+	if err := Write(dir, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPrevious(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadPrevious before Rotate = %v, want fs.ErrNotExist", err)
+	}
+
+	prev := first
+	for i := 0; i < 2; i++ {
+		kp, err := Rotate(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *kp == *prev {
+			t.Fatal("Rotate kept the same keypair")
+		}
+		if got, err := Read(dir); err != nil || *got != *kp {
+			t.Errorf("Read after Rotate = %v, %v, want the new keypair", got, err)
+		}
+		if got, err := ReadPrevious(dir); err != nil || *got != *prev {
+			t.Errorf("ReadPrevious = %v, %v, want the old keypair", got, err)
+		}
+		prev = kp
+	}
+	if _, err := OpenNonceCounter(dir); err != nil {
+		t.Errorf("nonce state lost: %v", err)
+	}
+}
+
+func TestNonceCounter(t *testing.T) {
+	kp, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "serverkey")
+	if err := Write(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two users of the key, as if in different processes, never
+	// make the same nonce.
+	seen := make(map[[16]byte]bool)
+	for i := 0; i < 2; i++ {
+		n, err := OpenNonceCounter(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			var nonce [16]byte
+			if err := n.Nonce(nonce[:]); err != nil {
+				t.Fatal(err)
+			}
+			if seen[nonce] {
+				t.Fatalf("nonce %x repeated", nonce)
+			}
+			seen[nonce] = true
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, ".expertsonly", "noncecounter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint64(b); got != 2*nonceReservation {
+		t.Errorf("noncecounter = %d after two reservations, want %d", got, 2*nonceReservation)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package keys
+
+import "os"
+
+// lockFile does nothing: without a portable file lock, processes
+// sharing a key directory must not make nonces concurrently.
+func lockFile(f *os.File) error {
+	return nil
+}
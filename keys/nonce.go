@@ -0,0 +1,101 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// How many counter values a NonceCounter reserves in the key
+// directory at a time, as the reference implementation does.
+const nonceReservation = 1 << 20
+
+// A NonceCounter makes nonces for boxes under a long-term key from
+// the counter in its key directory, so that they never repeat, even
+// across restarts and between processes sharing the key. It reserves
+// a range of the counter at a time, under the directory's lock, and
+// hides the counter's value by encrypting it with the noncekey.
+//
+// A NonceCounter is safe for concurrent use. Its Nonce method makes
+// it a curvecp.NonceSource.
+type NonceCounter struct {
+	dir   string
+	block cipher.Block
+
+	mu          sync.Mutex
+	next, limit uint64
+}
+
+// OpenNonceCounter returns a NonceCounter for the key directory dir,
+// written by Write or curvecpmakekey.
+func OpenNonceCounter(dir string) (*NonceCounter, error) {
+	var key [32]byte
+	if err := readKey(filepath.Join(dir, ".expertsonly", "noncekey"), key[:]); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &NonceCounter{dir: dir, block: block}, nil
+}
+
+// Nonce fills b, 16 bytes, with the next nonce.
+func (n *NonceCounter) Nonce(b []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.next == n.limit {
+		if err := n.reserve(); err != nil {
+			return err
+		}
+	}
+	var plain [16]byte
+	binary.LittleEndian.PutUint64(plain[:], n.next)
+	n.next++
+	if _, err := rand.Read(plain[8:]); err != nil {
+		return err
+	}
+	n.block.Encrypt(b[:16], plain[:])
+	return nil
+}
+
+// reserve takes the next range of counter values from the
+// noncecounter file.
+func (n *NonceCounter) reserve() error {
+	expert := filepath.Join(n.dir, ".expertsonly")
+	lock, err := os.OpenFile(filepath.Join(expert, "lock"), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+
+	name := filepath.Join(expert, "noncecounter")
+	var counter [8]byte
+	if err := readKey(name, counter[:]); err != nil {
+		return err
+	}
+	next := binary.LittleEndian.Uint64(counter[:])
+	binary.LittleEndian.PutUint64(counter[:], next+nonceReservation)
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(counter[:]); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	n.next, n.limit = next, next+nonceReservation
+	return nil
+}
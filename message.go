@@ -0,0 +1,172 @@
+package curvecp
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// Size of the fixed message header, before padding and data.
+	messageHeaderLen = 48
+	// Maximum amount of stream data carried by one message.
+	maxMessageData = 1024
+	// Messages are always a multiple of 16 bytes, between 16 and
+	// 1088 bytes long.
+	minMessageLen = 16
+	maxMessageLen = 1088
+	// Messages carried by Initiate packets are shorter, to keep the
+	// packet within 1184 bytes.
+	maxInitiateMessageLen = 640
+
+	// End of stream flags, added to the data length field.
+	eofSuccess = 2048
+	eofFailure = 4096
+
+	// Streams are limited to 2^60 bytes.
+	maxStreamLen = 1 << 60
+)
+
+// ackRange is a range of acknowledged stream bytes, [start, end).
+type ackRange struct {
+	start, end int64
+}
+
+// message is the plaintext content of the box in a Message packet
+// (or the message part of an Initiate). See doc.go for the wire
+// format.
+type message struct {
+	// Sender-chosen message ID. Zero means the message does not need
+	// to be acknowledged.
+	id uint32
+	// If nonzero, the ID of a message being acknowledged.
+	ackID uint32
+	// Acknowledged ranges of the stream flowing the other way. The
+	// first range always starts at position 0.
+	acks [6]ackRange
+	// 0, eofSuccess or eofFailure.
+	eof uint16
+	// Stream position of the first byte of data.
+	pos int64
+	// The data. When unmarshalled, aliases the input buffer.
+	data []byte
+}
+
+// messageLen returns the size of a message carrying n bytes of data,
+// padding included.
+func messageLen(n int) int {
+	return (messageHeaderLen + n + 15) &^ 15
+}
+
+// validMessagePacket returns true if pb, a Message packet whose box
+// starts overhead bytes before its message, has a valid length: a
+// multiple of 16, with a message between minMessageLen and
+// maxMessageLen bytes.
+func validMessagePacket(pb []byte, overhead int) bool {
+	n := len(pb) - overhead
+	return n >= minMessageLen && n <= maxMessageLen && n%16 == 0
+}
+
+// marshal encodes m into b, which must have room for
+// messageLen(len(m.data)) bytes, and returns the encoded message.
+// Acknowledgment ranges past one that the format can't express are
+// left out, the peer learns of them later.
+func (m *message) marshal(b []byte) []byte {
+	if len(m.data) > maxMessageData || m.eof == eofSuccess|eofFailure {
+		panic("invalid message")
+	}
+	b = b[:messageLen(len(m.data))]
+	for i := range b {
+		b[i] = 0
+	}
+	binary.LittleEndian.PutUint32(b[0:], m.id)
+	binary.LittleEndian.PutUint32(b[4:], m.ackID)
+	binary.LittleEndian.PutUint64(b[8:], uint64(m.acks[0].end))
+	// Ranges 2..6 are a gap (4 bytes for the first, 2 for the others)
+	// followed by a 2 byte length, each relative to the end of the
+	// previous range.
+	prev := m.acks[0].end
+	off := 16
+	for i, r := range m.acks[1:] {
+		if r.end <= r.start || r.end-r.start > 0xffff {
+			break
+		}
+		if gap := r.start - prev; gap < 0 || (i == 0 && gap > 0xffffffff) || (i > 0 && gap > 0xffff) {
+			break
+		}
+		if i == 0 {
+			binary.LittleEndian.PutUint32(b[off:], uint32(r.start-prev))
+			off += 4
+		} else {
+			binary.LittleEndian.PutUint16(b[off:], uint16(r.start-prev))
+			off += 2
+		}
+		binary.LittleEndian.PutUint16(b[off:], uint16(r.end-r.start))
+		off += 2
+		prev = r.end
+	}
+	binary.LittleEndian.PutUint16(b[38:], uint16(len(m.data))+m.eof)
+	binary.LittleEndian.PutUint64(b[40:], uint64(m.pos))
+	copy(b[len(b)-len(m.data):], m.data)
+	return b
+}
+
+// unmarshal decodes b into m. Returns false if b is not a well-formed
+// message.
+func (m *message) unmarshal(b []byte) bool {
+	if len(b) < messageHeaderLen || len(b) > maxMessageLen || len(b)%16 != 0 {
+		return false
+	}
+	m.id = binary.LittleEndian.Uint32(b[0:])
+	m.ackID = binary.LittleEndian.Uint32(b[4:])
+
+	first := binary.LittleEndian.Uint64(b[8:])
+	if first > maxStreamLen {
+		return false
+	}
+	pos := int64(first)
+	m.acks[0] = ackRange{0, pos}
+	off := 16
+	for i := 1; i < len(m.acks); i++ {
+		if i == 1 {
+			pos += int64(binary.LittleEndian.Uint32(b[off:]))
+			off += 4
+		} else {
+			pos += int64(binary.LittleEndian.Uint16(b[off:]))
+			off += 2
+		}
+		start := pos
+		pos += int64(binary.LittleEndian.Uint16(b[off:]))
+		off += 2
+		m.acks[i] = ackRange{start, pos}
+	}
+
+	flags := binary.LittleEndian.Uint16(b[38:])
+	m.eof = flags & (eofSuccess | eofFailure)
+	n := int(flags &^ (eofSuccess | eofFailure))
+	if n > maxMessageData || n > len(b)-messageHeaderLen || m.eof == eofSuccess|eofFailure {
+		return false
+	}
+	pos = int64(binary.LittleEndian.Uint64(b[40:]))
+	if pos < 0 || pos+int64(n) > maxStreamLen || m.acks[len(m.acks)-1].end > maxStreamLen {
+		return false
+	}
+	// The padding between the header and the data must be zeros.
+	for _, x := range b[messageHeaderLen : len(b)-n] {
+		if x != 0 {
+			return false
+		}
+	}
+	m.pos = pos
+	m.data = b[len(b)-n:]
+	return true
+}
+
+// acked returns true if the stream range [start, end) is covered by
+// one of m's acknowledgment ranges.
+func (m *message) acked(start, end int64) bool {
+	for _, r := range m.acks {
+		if r.start <= start && end <= r.end {
+			return true
+		}
+	}
+	return false
+}
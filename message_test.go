@@ -0,0 +1,109 @@
+package curvecp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tab := []message{
+		{},
+		{id: 1, ackID: 2, acks: [6]ackRange{{0, 100}}},
+		{id: 3, pos: 42, data: []byte("hello")},
+		{id: 4, acks: [6]ackRange{{0, 10}, {20, 30}, {40, 50}}, pos: 1 << 40, data: make([]byte, maxMessageData)},
+		{id: 5, eof: eofSuccess, pos: 7},
+		{id: 6, eof: eofFailure, pos: 7, data: []byte("x")},
+	}
+
+	var buf [maxMessageLen]byte
+	for _, m := range tab {
+		b := m.marshal(buf[:])
+		if len(b)%16 != 0 || len(b) < minMessageLen || len(b) > maxMessageLen {
+			t.Errorf("len(marshal(%#v)) = %d, want multiple of 16 in [16, 1088]", m, len(b))
+		}
+		var got message
+		if !got.unmarshal(b) {
+			t.Errorf("unmarshal(marshal(%#v)) failed", m)
+			continue
+		}
+		if got.id != m.id || got.ackID != m.ackID || got.eof != m.eof || got.pos != m.pos || !bytes.Equal(got.data, m.data) {
+			t.Errorf("unmarshal(marshal(%#v)) = %#v", m, got)
+		}
+		for i, r := range m.acks {
+			if r.end > r.start && got.acks[i] != r {
+				t.Errorf("acks[%d] = %v, want %v", i, got.acks[i], r)
+			}
+		}
+	}
+}
+
+func TestMessageUnmarshalInvalid(t *testing.T) {
+	var m message
+	var buf [maxMessageLen]byte
+	b := (&message{data: []byte("hello")}).marshal(buf[:])
+
+	if m.unmarshal(b[:40]) {
+		t.Errorf("unmarshal accepted a short message")
+	}
+	if m.unmarshal(b[:len(b)-1]) {
+		t.Errorf("unmarshal accepted a message that isn't a multiple of 16")
+	}
+	b[len(b)-6] = 1
+	if m.unmarshal(b) {
+		t.Errorf("unmarshal accepted nonzero padding")
+	}
+	b[len(b)-6] = 0
+	b[38] = 0xff
+	if m.unmarshal(b) {
+		t.Errorf("unmarshal accepted a data length larger than the message")
+	}
+}
+
+func TestMessageMarshalAckLimits(t *testing.T) {
+	var buf [maxMessageLen]byte
+	var m message
+	// The second range is too long for its 16 bit size, it and the
+	// ranges after it are left out.
+	b := (&message{acks: [6]ackRange{{0, 10}, {20, 30}, {40, 40 + 1<<16}, {1 << 17, 1<<17 + 1}}}).marshal(buf[:])
+	if !m.unmarshal(b) {
+		t.Fatal("unmarshal failed")
+	}
+	want := [6]ackRange{{0, 10}, {20, 30}}
+	for i := 2; i < len(want); i++ {
+		want[i] = ackRange{30, 30}
+	}
+	if m.acks != want {
+		t.Errorf("acks = %v, want %v", m.acks, want)
+	}
+}
+
+func TestValidMessagePacket(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		want bool
+	}{
+		{96, false},
+		{96 + 16, true},
+		{96 + 17, false},
+		{96 + maxMessageLen, true},
+		{96 + maxMessageLen + 16, false},
+	} {
+		if got := validMessagePacket(make([]byte, tt.n), 96); got != tt.want {
+			t.Errorf("validMessagePacket(%d bytes) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMessageStreamLimit(t *testing.T) {
+	var buf [maxMessageLen]byte
+	var m message
+	if b := (&message{pos: maxStreamLen - 5, data: []byte("hello")}).marshal(buf[:]); !m.unmarshal(b) {
+		t.Errorf("unmarshal rejected data ending at the stream limit")
+	}
+	if b := (&message{pos: maxStreamLen - 4, data: []byte("hello")}).marshal(buf[:]); m.unmarshal(b) {
+		t.Errorf("unmarshal accepted data past the stream limit")
+	}
+	if b := (&message{acks: [6]ackRange{{0, maxStreamLen + 1}}}).marshal(buf[:]); m.unmarshal(b) {
+		t.Errorf("unmarshal accepted an acknowledgment past the stream limit")
+	}
+}
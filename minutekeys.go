@@ -0,0 +1,170 @@
+package curvecp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// MinuteKeys supplies the keys a server seals its Cookies under, in
+// place of the random ones it rotates itself, see
+// Config.MinuteKeys. Servers behind a UDP load balancer that share
+// their long-term key and their MinuteKeys accept each other's
+// Cookies, so a client's Initiate needn't reach the server that
+// answered its Hello.
+//
+// Methods are called from the server's packet loop, and must be
+// fast.
+type MinuteKeys interface {
+	// Current returns the key new Cookies are sealed under.
+	Current() [32]byte
+	// Previous returns the key Current replaced, which Cookies are
+	// still accepted under.
+	Previous() [32]byte
+}
+
+// SharedMinuteKeys derives minute keys from a secret and the time,
+// so that servers with the same secret and interval agree on them
+// without talking to each other, as long as their clocks do to well
+// within the interval.
+type SharedMinuteKeys struct {
+	secret   []byte
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewSharedMinuteKeys returns the minute keys for secret, which
+// should be 32 random bytes, rotated every interval.
+func NewSharedMinuteKeys(secret []byte, interval time.Duration) *SharedMinuteKeys {
+	return &SharedMinuteKeys{append([]byte(nil), secret...), interval, time.Now}
+}
+
+func (k *SharedMinuteKeys) Current() [32]byte {
+	return k.key(k.epoch())
+}
+
+func (k *SharedMinuteKeys) Previous() [32]byte {
+	return k.key(k.epoch() - 1)
+}
+
+func (k *SharedMinuteKeys) epoch() uint64 {
+	return uint64(k.now().UnixNano() / int64(k.interval))
+}
+
+func (k *SharedMinuteKeys) key(epoch uint64) [32]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], epoch)
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte("CurveCP minute key"))
+	mac.Write(b[:])
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// currentMinuteKey returns the key to seal new Cookies under.
+func (s *server) currentMinuteKey() *[32]byte {
+	if mk := s.config.minuteKeys(); mk != nil {
+		key := mk.Current()
+		return &key
+	}
+	return &s.minuteKey
+}
+
+// previousMinuteKey returns the key before currentMinuteKey.
+func (s *server) previousMinuteKey() *[32]byte {
+	if mk := s.config.minuteKeys(); mk != nil {
+		key := mk.Previous()
+		return &key
+	}
+	return &s.prevMinuteKey
+}
+
+// minuteKeyFileKey returns the key a server's MinuteKeyFile is sealed
+// under: Config.MinuteKeyFileKey, or one derived from the server's
+// long-term secret key.
+func (s *server) minuteKeyFileKey() *[32]byte {
+	var key [32]byte
+	if k := s.config.MinuteKeyFileKey; len(k) == 32 {
+		copy(key[:], k)
+		return &key
+	}
+	h := sha256.New()
+	h.Write([]byte("CurveCP minute key file"))
+	h.Write(s.keys[0].secret[:])
+	copy(key[:], h.Sum(nil))
+	return &key
+}
+
+// loadMinuteKeys restores the minute keys saved in
+// Config.MinuteKeyFile, if it's there and they're still good, so
+// that Cookies handed out before a restart keep working. Returns true
+// if the file is up to date.
+func (s *server) loadMinuteKeys(now time.Time) bool {
+	path := s.config.minuteKeyFile()
+	if path == "" {
+		return true
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) != 24+secretbox.Overhead+8+64 {
+		return false
+	}
+	var nonce [24]byte
+	copy(nonce[:], b)
+	var plain [8 + 64]byte
+	if _, ok := secretbox.Open(plain[:0], b[24:], &nonce, s.minuteKeyFileKey()); !ok {
+		return false
+	}
+	saved := time.Unix(0, int64(binary.BigEndian.Uint64(plain[:8])))
+	switch age, interval := now.Sub(saved), s.config.minuteKeyInterval(); {
+	case age < 0 || age >= 2*interval:
+		// Both keys have been retired since.
+	case age < interval:
+		copy(s.minuteKey[:], plain[8:])
+		copy(s.prevMinuteKey[:], plain[8+32:])
+		return true
+	default:
+		// The saved current key would have been rotated out
+		// meanwhile.
+		copy(s.prevMinuteKey[:], plain[8:])
+	}
+	return false
+}
+
+// saveMinuteKeys writes the minute keys to Config.MinuteKeyFile, if
+// set, sealed under minuteKeyFileKey. The file is replaced
+// atomically, and errors are ignored: losing it only costs in-flight
+// handshakes a retry after a restart.
+func (s *server) saveMinuteKeys(now time.Time) {
+	path := s.config.minuteKeyFile()
+	if path == "" {
+		return
+	}
+	var plain [8 + 64]byte
+	binary.BigEndian.PutUint64(plain[:8], uint64(now.UnixNano()))
+	copy(plain[8:], s.minuteKey[:])
+	copy(plain[8+32:], s.prevMinuteKey[:])
+	var nonce [24]byte
+	randBytes(nonce[:])
+	b := secretbox.Seal(nonce[:], plain[:], &nonce, s.minuteKeyFileKey())
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
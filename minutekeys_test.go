@@ -0,0 +1,160 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestSharedMinuteKeys(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	a := NewSharedMinuteKeys(secret, time.Minute)
+	b := NewSharedMinuteKeys(secret, time.Minute)
+	a.now, b.now = clock, clock
+
+	cur := a.Current()
+	if b.Current() != cur || b.Previous() != a.Previous() {
+		t.Errorf("minute keys from the same secret differ")
+	}
+	if a.Previous() == cur {
+		t.Errorf("previous minute key is the current one")
+	}
+	now = now.Add(time.Minute)
+	if a.Previous() != cur || a.Current() == cur {
+		t.Errorf("minute keys didn't rotate")
+	}
+	rand.Read(secret)
+	if c := NewSharedMinuteKeys(secret, time.Minute); c.Current() == a.Current() {
+		t.Errorf("minute keys from different secrets agree")
+	}
+}
+
+func TestSharedMinuteKeysAcrossServers(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	config := &Config{MinuteKeys: NewSharedMinuteKeys(secret, time.Minute)}
+	var servers [2]Listener
+	for i := range servers {
+		l, err := ListenWithConfig("127.0.0.1:0", priv[:], config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		servers[i] = l
+	}
+	go func() {
+		c, err := servers[1].Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	// A load balancer sending Hellos to one server, and everything
+	// else to the other.
+	lb, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	var backends [2]*net.UDPConn
+	for i := range backends {
+		if backends[i], err = net.DialUDP("udp", nil, servers[i].Addr().(*Addr).UDP); err != nil {
+			t.Fatal(err)
+		}
+		defer backends[i].Close()
+	}
+	var mu sync.Mutex
+	var client net.Addr
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := lb.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			client = addr
+			mu.Unlock()
+			if bytes.HasPrefix(b[:n], helloMagic) {
+				backends[0].Write(b[:n])
+			} else {
+				backends[1].Write(b[:n])
+			}
+		}
+	}()
+	for _, be := range backends {
+		go func(be *net.UDPConn) {
+			b := make([]byte, 2048)
+			for {
+				n, err := be.Read(b)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				to := client
+				mu.Unlock()
+				lb.WriteTo(b[:n], to)
+			}
+		}(be)
+	}
+
+	c, err := DialTimeout(lb.LocalAddr().String(), pub[:], 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 5000)
+}
+
+func TestMinuteKeyFile(t *testing.T) {
+	_, priv, _ := box.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "minutekeys")
+	config := &Config{MinuteKeyFile: path, MinuteKeyInterval: time.Minute}
+	fresh := func() *server {
+		s := &server{config: config}
+		s.setKey(*priv)
+		randBytes(s.minuteKey[:])
+		randBytes(s.prevMinuteKey[:])
+		return s
+	}
+
+	now := time.Now()
+	s := fresh()
+	s.saveMinuteKeys(now)
+
+	// A quick restart picks up both keys.
+	restarted := fresh()
+	if !restarted.loadMinuteKeys(now.Add(10*time.Second)) || restarted.minuteKey != s.minuteKey || restarted.prevMinuteKey != s.prevMinuteKey {
+		t.Errorf("minute keys not restored")
+	}
+	// A slower one only the current key, which is the previous one
+	// by now.
+	restarted = fresh()
+	if restarted.loadMinuteKeys(now.Add(90*time.Second)) || restarted.minuteKey == s.minuteKey || restarted.prevMinuteKey != s.minuteKey {
+		t.Errorf("minute keys not rotated on restore")
+	}
+	// Keys retired since aren't restored.
+	restarted = fresh()
+	if restarted.loadMinuteKeys(now.Add(3*time.Minute)) || restarted.minuteKey == s.minuteKey || restarted.prevMinuteKey == s.minuteKey {
+		t.Errorf("retired minute keys restored")
+	}
+
+	// Nor is a file sealed under another key.
+	config.MinuteKeyFileKey = make([]byte, 32)
+	restarted = fresh()
+	if restarted.loadMinuteKeys(now) || restarted.minuteKey == s.minuteKey {
+		t.Errorf("minute keys restored under the wrong key")
+	}
+}
@@ -0,0 +1,168 @@
+package curvecp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+)
+
+// Kinds of peekRequest.
+const (
+	peekN = iota
+	peekDelim
+	peekDiscard
+	peekRelease
+)
+
+// peekRequest asks the pump for a view of the receive buffer, or to
+// drop some of it.
+type peekRequest struct {
+	kind  int
+	n     int
+	delim byte
+}
+
+type peekResult struct {
+	b   []byte
+	n   int
+	err error
+	// False if the request can't be answered until more data
+	// arrives.
+	done bool
+}
+
+// Peek returns the next n bytes of the stream without consuming them,
+// waiting for them to arrive. The bytes are not copied: the slice
+// points into the connection's receive buffer, and is only valid until
+// the next Read, Peek, ReadSlice, Discard or Release. n can't exceed
+// the size of the receive buffer, 64KiB, or Peek fails with
+// bufio.ErrBufferFull.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	res := c.peek(peekRequest{kind: peekN, n: n})
+	return res.b, res.err
+}
+
+// ReadSlice reads until the first occurrence of delim, and returns a
+// slice of the receive buffer holding the data up to and including
+// delim. The data is consumed, but its space in the receive buffer is
+// held, and the slice valid, until the next Read, Peek, ReadSlice,
+// Discard or Release. If the receive buffer fills up before delim
+// arrives, ReadSlice returns the whole buffer and bufio.ErrBufferFull.
+func (c *Conn) ReadSlice(delim byte) ([]byte, error) {
+	res := c.peek(peekRequest{kind: peekDelim, delim: delim})
+	return res.b, res.err
+}
+
+// Discard consumes up to n bytes already in the receive buffer, e.g.
+// after looking at them with Peek, and returns the number of bytes
+// consumed. It doesn't wait for more data.
+func (c *Conn) Discard(n int) (int, error) {
+	res := c.peek(peekRequest{kind: peekDiscard, n: n})
+	return res.n, res.err
+}
+
+// Release gives back the receive buffer space held by the last
+// ReadSlice, for when no read will follow soon. The slice it returned
+// must not be used anymore.
+func (c *Conn) Release() {
+	c.peek(peekRequest{kind: peekRelease})
+}
+
+// peek sends req to the pump, and waits until it can be answered or
+// the read deadline passes.
+func (c *Conn) peek(req peekRequest) peekResult {
+	deadline := c.readDeadline.wait()
+	for {
+		select {
+		case c.peekRequest <- req:
+		case <-deadline:
+			return peekResult{err: deadlineExceeded}
+		case <-c.done:
+			return peekResult{err: c.doneErr()}
+		}
+		// Answered right away, as for Read.
+		res := <-c.peekResult
+		if res.done {
+			return res
+		}
+		select {
+		case <-c.readable:
+		case <-deadline:
+			return peekResult{err: deadlineExceeded}
+		case <-c.done:
+			return peekResult{err: c.doneErr()}
+		}
+	}
+}
+
+// handlePeek answers a peekRequest, from the pump.
+func (c *Conn) handlePeek(req peekRequest) peekResult {
+	c.releaseHeld()
+	if c.readClosed {
+		return peekResult{err: net.ErrClosed, done: true}
+	}
+	if c.err != nil {
+		return peekResult{err: c.err, done: true}
+	}
+	avail := c.received.Size()
+	eof := c.streamEnd()
+	switch req.kind {
+	case peekN:
+		if req.n > recvBufferSize {
+			return peekResult{err: bufio.ErrBufferFull, done: true}
+		}
+		if avail < req.n {
+			if eof != nil {
+				return peekResult{b: c.view(avail), err: eof, done: true}
+			}
+			return peekResult{}
+		}
+		return peekResult{b: c.view(req.n), done: true}
+
+	case peekDelim:
+		a, b := c.received.Bytes()
+		n := -1
+		if i := bytes.IndexByte(a, req.delim); i >= 0 {
+			n = i + 1
+		} else if i := bytes.IndexByte(b, req.delim); i >= 0 {
+			n = len(a) + i + 1
+		}
+		var err error
+		if n < 0 {
+			switch {
+			case eof != nil:
+				n, err = avail, eof
+			case avail < recvBufferSize:
+				return peekResult{}
+			default:
+				n, err = avail, bufio.ErrBufferFull
+			}
+		}
+		c.held = n
+		return peekResult{b: c.view(n), err: err, done: true}
+
+	case peekDiscard:
+		return peekResult{n: c.received.Discard(req.n), done: true}
+	}
+	return peekResult{done: true}
+}
+
+// releaseHeld frees the receive buffer space held by the last
+// ReadSlice.
+func (c *Conn) releaseHeld() {
+	c.received.Discard(c.held)
+	c.held = 0
+}
+
+// view returns the first n bytes of the receive buffer as one slice.
+// They are only copied if they wrap around the end of the ring.
+func (c *Conn) view(n int) []byte {
+	a, b := c.received.Bytes()
+	if n <= len(a) {
+		return a[:n]
+	}
+	if cap(c.peekBuf) < n {
+		c.peekBuf = make([]byte, 0, n)
+	}
+	return append(append(c.peekBuf[:0], a...), b[:n-len(a)]...)
+}
@@ -0,0 +1,50 @@
+package curvecp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestConnReadSlice(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	go server.Write([]byte("hello\nworld\n!"))
+
+	for _, want := range []string{"hello\n", "world\n"} {
+		if got, err := client.ReadSlice('\n'); string(got) != want || err != nil {
+			t.Errorf("ReadSlice = %q, %v, want %q, nil", got, err, want)
+		}
+	}
+	client.Release()
+	if got, err := client.Peek(1); string(got) != "!" || err != nil {
+		t.Errorf("Peek(1) = %q, %v, want \"!\", nil", got, err)
+	}
+	if _, err := client.Peek(recvBufferSize + 1); err != bufio.ErrBufferFull {
+		t.Errorf("Peek past the buffer size = %v, want bufio.ErrBufferFull", err)
+	}
+}
+
+func TestConnPeekWrap(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	// Move the ring's start near its end, so that the next data wraps
+	// around.
+	go server.Write(make([]byte, recvBufferSize-100))
+	if _, err := io.ReadFull(client, make([]byte, recvBufferSize-100)); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1000)
+	rand.Read(data)
+	go server.Write(data)
+	got, err := client.Peek(len(data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Peek across the end of the ring = %v, data differs: %v", err, !bytes.Equal(got, data))
+	}
+	if n, err := client.Discard(len(data)); n != len(data) || err != nil {
+		t.Errorf("Discard = %d, %v, want %d, nil", n, err, len(data))
+	}
+}
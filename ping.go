@@ -0,0 +1,63 @@
+package curvecp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Ping checks that a CurveCP server is reachable at raddr and holds the
+// secret key for serverKey, by exchanging a Hello and a Cookie packet
+// with it, and returns how long the exchange took: a round trip, unless
+// Hellos had to be retransmitted. No connection is made: the server
+// keeps no state for the Hello, and its application sees nothing.
+//
+// A server with another key can't open the Hello and ignores it, so a
+// wrong key looks like a server that is down: Ping fails with
+// ErrHandshakeTimeout once the Hellos run out, per the Dialer's Config,
+// or with ctx.Err() when ctx is done first.
+//
+// Ping uses the Dialer's extensions and Config, but not its Key, which
+// servers only learn from Initiate packets, nor its Domain.
+func (d *Dialer) Ping(ctx context.Context, raddr string, serverKey []byte) (time.Duration, error) {
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return 0, err
+	}
+	if serverKey == nil {
+		if serverKey, err = KeyFromHostname(host); err != nil {
+			return 0, &net.OpError{Op: "ping", Net: "curvecp", Err: err}
+		}
+	}
+	if len(serverKey) != 32 {
+		panic("Wrong key length")
+	}
+	addrs, err := resolveAll(ctx, raddr)
+	if err != nil {
+		return 0, err
+	}
+	mux, err := d.mux()
+	if err != nil {
+		return 0, err
+	}
+	defer d.release(mux)
+	if timeout := d.Config.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cs := &clientState{ext: d.ClientExtension, serverExt: d.ServerExtension}
+	copy(cs.serverKey[:], serverKey)
+	cs.shortTermKey, cs.shortTermSecretKey = generateKey()
+	clock := d.Config.clock()
+	start := clock.Now()
+	var cookie [128]byte
+	_, cookies, _, err := d.hello(ctx, mux, addrs, cs, cookie[:])
+	if err != nil {
+		return 0, &net.OpError{Op: "ping", Net: "curvecp", Addr: addrs[0], Err: err}
+	}
+	rtt := clock.Now().Sub(start)
+	abandonCookies(mux, cs.ext, cookies)
+	return rtt, nil
+}
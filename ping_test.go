@@ -0,0 +1,39 @@
+package curvecp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestPing(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().(*Addr).UDP.String()
+
+	var d Dialer
+	rtt, err := d.Ping(context.Background(), addr, pub[:])
+	if err != nil || rtt <= 0 {
+		t.Fatalf("Ping = %v, %v", rtt, err)
+	}
+	// The server's application never hears of it.
+	l.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if c, err := l.Accept(); err == nil {
+		c.Close()
+		t.Error("Ping made a connection")
+	}
+
+	// Under the wrong key, the server stays silent.
+	d.Config = &Config{HelloAttempts: 2, HandshakeBackoff: Backoff{Max: 10 * time.Millisecond}}
+	if _, err := d.Ping(context.Background(), addr, make([]byte, 32)); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("Ping with the wrong key = %v, want ErrHandshakeTimeout", err)
+	}
+}
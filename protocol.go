@@ -0,0 +1,37 @@
+package curvecp
+
+import (
+	"strings"
+)
+
+// CurveCP has no application protocol negotiation of its own. By
+// convention, a client asks for an application protocol by
+// prepending a label made of an underscore and the protocol name to
+// the domain it requests, the same way DNS SRV records name
+// services: "_h2.example.com" requests protocol "h2" on
+// "example.com". Servers that don't know the convention see an
+// unusual domain name, nothing more.
+
+// ProtocolDomain returns the domain a client should request to ask
+// for application protocol proto on domain.
+func ProtocolDomain(domain, proto string) string {
+	if proto == "" {
+		return domain
+	}
+	return "_" + proto + "." + domain
+}
+
+// SplitProtocolDomain splits a requested domain into the domain
+// itself and the application protocol requested, following the
+// convention of ProtocolDomain. proto is empty if no protocol was
+// requested.
+func SplitProtocolDomain(requested string) (domain, proto string) {
+	if !strings.HasPrefix(requested, "_") {
+		return requested, ""
+	}
+	i := strings.Index(requested, ".")
+	if i < 0 {
+		return requested, ""
+	}
+	return requested[i+1:], requested[1:i]
+}
@@ -0,0 +1,36 @@
+package curvecp
+
+import (
+	"testing"
+)
+
+func TestProtocolDomain(t *testing.T) {
+	tab := []struct {
+		requested, domain, proto string
+	}{
+		{"example.com", "example.com", ""},
+		{"_h2.example.com", "example.com", "h2"},
+		{"_smtp._tcp.example.com", "_tcp.example.com", "smtp"},
+		{"_h2", "_h2", ""},
+	}
+	for _, tt := range tab {
+		domain, proto := SplitProtocolDomain(tt.requested)
+		if domain != tt.domain || proto != tt.proto {
+			t.Errorf("SplitProtocolDomain(%q) = %q, %q, want %q, %q", tt.requested, domain, proto, tt.domain, tt.proto)
+		}
+		if tt.proto == "" {
+			continue
+		}
+		if got := ProtocolDomain(tt.domain, tt.proto); got != tt.requested {
+			t.Errorf("ProtocolDomain(%q, %q) = %q, want %q", tt.domain, tt.proto, got, tt.requested)
+		}
+	}
+}
+
+func TestConnectionStateProtocol(t *testing.T) {
+	server, _ := newConnPair(t, nil)
+	server = newConn(server.sock, server.addr, server.header, false, server.peerIdentity[:], server.peerIdentity[:], server.peerIdentity[:], "_h2.example.com", nil)
+	if st := server.connectionState(); st.Domain != "example.com" || st.Protocol != "h2" {
+		t.Errorf("ConnectionState() = %+v, want domain example.com, protocol h2", st)
+	}
+}
@@ -0,0 +1,51 @@
+package curvecp
+
+import (
+	"io"
+	"net"
+)
+
+// Proxy copies the stream of c to backend, and the data read from
+// backend back to c, until both directions have ended, so that a
+// plain TCP service, say, can be reached over CurveCP, or the other
+// way around. The end of each direction is passed on: c's with
+// CloseWrite, and backend's with its CloseWrite method, if it has one
+// like net.TCPConn.
+//
+// If either direction fails, both are torn down, c by aborting it.
+// Proxy closes c and backend before returning the first error, if
+// any.
+func Proxy(c *Conn, backend net.Conn) error {
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, c)
+		if err == nil {
+			if cw, ok := backend.(interface{ CloseWrite() error }); ok {
+				err = cw.CloseWrite()
+			}
+		}
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, backend)
+		if err == nil {
+			err = c.CloseWrite()
+		}
+		errc <- err
+	}()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+			// Unblock the other direction.
+			c.Abort()
+			backend.Close()
+		}
+	}
+	backend.Close()
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
@@ -0,0 +1,82 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// tcpEcho returns a connection to a TCP server echoing back what it
+// reads, and ending its output after its input.
+func tcpEcho(t *testing.T) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestProxy(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	defer client.Abort()
+
+	done := make(chan error, 1)
+	go func() { done <- Proxy(server, tcpEcho(t)) }()
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, %v, want the %d written", len(got), err, len(data))
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Proxy: %v", err)
+	}
+}
+
+func TestProxyBackendFailure(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+	defer client.Abort()
+
+	backend, peer := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- Proxy(server, backend) }()
+	peer.Close()
+
+	// Writing to the closed backend fails, and Proxy must say so
+	// without leaving the client hanging.
+	client.Write([]byte("hello"))
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadAll(client); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("stream didn't end")
+	}
+	if err := <-done; err == nil {
+		t.Error("Proxy succeeded")
+	}
+}
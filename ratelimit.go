@@ -0,0 +1,101 @@
+package curvecp
+
+import (
+	"net"
+	"time"
+)
+
+// Most hosts a server keeps Cookie rate limits for. Beyond that, new
+// hosts are only subject to the global limit: a flood from that many
+// hosts is likely spoofed, and per-host limits can't tell spoofed
+// sources apart anyway.
+const maxCookieHosts = 4096
+
+// A tokenBucket allows events at a steady rate, with bursts.
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// allow reports whether an event may happen at now, and takes a token
+// for it if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled completely, i.e. it
+// would behave just like a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// allowCookie reports whether the server may answer a Hello from
+// addr with a Cookie, under Config.CookieRatePerHost and CookieRate.
+// It's cheap, and comes before any cryptography.
+func (s *server) allowCookie(addr net.Addr, now time.Time) bool {
+	if !s.allowHostCookie(addr, now) {
+		return false
+	}
+	rate := s.config.cookieRate()
+	if rate <= 0 {
+		return true
+	}
+	if s.cookieBucket == nil {
+		s.cookieBucket = newTokenBucket(rate, s.config.CookieBurst, now)
+	}
+	return s.cookieBucket.allow(now)
+}
+
+func (s *server) allowHostCookie(addr net.Addr, now time.Time) bool {
+	rate := s.config.cookieRatePerHost()
+	if rate <= 0 {
+		return true
+	}
+	if s.hostBuckets == nil {
+		s.hostBuckets = make(map[string]*tokenBucket)
+	}
+	host := s.config.hostKey(addr)
+	b, ok := s.hostBuckets[host]
+	if !ok {
+		if len(s.hostBuckets) >= maxCookieHosts && now.Sub(s.hostBucketsSwept) >= time.Second {
+			// Make room by forgetting the hosts whose bucket has
+			// refilled, which are as good as new.
+			s.hostBucketsSwept = now
+			for h, b := range s.hostBuckets {
+				if b.full(now) {
+					delete(s.hostBuckets, h)
+				}
+			}
+		}
+		if len(s.hostBuckets) >= maxCookieHosts {
+			return true
+		}
+		b = newTokenBucket(rate, s.config.CookieBurstPerHost, now)
+		s.hostBuckets[host] = b
+	}
+	return b.allow(now)
+}
@@ -0,0 +1,55 @@
+package curvecp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("burst event %d denied", i)
+		}
+	}
+	if b.allow(now) {
+		t.Errorf("event beyond the burst allowed")
+	}
+	if !b.allow(now.Add(100 * time.Millisecond)) {
+		t.Errorf("event after a token's worth of time denied")
+	}
+	if b.full(now.Add(200 * time.Millisecond)) {
+		t.Errorf("bucket full too early")
+	}
+	if !b.full(now.Add(time.Second)) {
+		t.Errorf("bucket not full after refilling")
+	}
+}
+
+func TestAllowCookie(t *testing.T) {
+	s := &server{config: &Config{CookieRatePerHost: 1, CookieBurstPerHost: 2, CookieRate: 1, CookieBurst: 3}}
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}
+	for i, tc := range []struct {
+		addr net.Addr
+		want bool
+	}{
+		{a, true},
+		{a, true},
+		// a's burst is used up, b's isn't.
+		{a, false},
+		{b, true},
+		// The global burst is used up.
+		{b, false},
+	} {
+		if got := s.allowCookie(tc.addr, now); got != tc.want {
+			t.Errorf("Hello %d from %s: allowed = %v, want %v", i, tc.addr, got, tc.want)
+		}
+	}
+	if !s.allowCookie(b, now.Add(time.Second)) {
+		t.Errorf("Hello denied after the limits refilled")
+	}
+}
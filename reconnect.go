@@ -0,0 +1,278 @@
+package curvecp
+
+import (
+	"context"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrReconnectBufferFull is returned by ReconnectingConn.Write when
+// the connection is down and the data doesn't fit in what remains of
+// the buffer.
+var ErrReconnectBufferFull = errors.New("reconnect buffer full")
+
+// A ReconnectingConn is a client connection that dials the server
+// again, with the same client identity, whenever the underlying
+// connection fails. While it is down, writes are buffered up to a
+// limit and sent once it is back up.
+//
+// Each reconnection starts a new stream, so ReconnectingConn suits
+// protocols made of self-contained messages, like telemetry or
+// control channels. Data written shortly before a failure may be lost
+// with the connection that carried it.
+type ReconnectingConn struct {
+	dialer    *Dialer
+	raddr     string
+	serverKey []byte
+	// The client long-term secret key, fixed for all connections.
+	clientKey []byte
+	// The most data to buffer while disconnected.
+	maxBuffer int
+
+	mu sync.Mutex
+	// Signaled when conn changes or the ReconnectingConn is closed.
+	cond *sync.Cond
+	// The current connection, nil while reconnecting.
+	conn *Conn
+	// Data written while disconnected.
+	pending []byte
+	// Deadlines, applied to every connection.
+	readDeadline, writeDeadline time.Time
+	closed                      bool
+	// Closed by Close, to cut short the wait between dials.
+	closing chan struct{}
+}
+
+// DialReconnecting is like Dial, but returns a ReconnectingConn that
+// buffers up to maxBuffer bytes of writes while reconnecting. If the
+// Dialer has no Key, a random one is picked and used for all the
+// connections.
+func (d *Dialer) DialReconnecting(raddr string, serverKey []byte, maxBuffer int) (*ReconnectingConn, error) {
+	clientKey := d.Key
+	if clientKey == nil {
+		clientKey = make([]byte, 32)
+		randBytes(clientKey)
+	}
+	c, err := d.dial(context.Background(), raddr, "", serverKey, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReconnectingConn{
+		dialer:    d,
+		raddr:     raddr,
+		serverKey: append([]byte(nil), serverKey...),
+		clientKey: clientKey,
+		maxBuffer: maxBuffer,
+		conn:      c,
+		closing:   make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r, nil
+}
+
+// current waits for a connection to be up, and returns it.
+func (r *ReconnectingConn) current() (*Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.conn == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	return r.conn, nil
+}
+
+// failed takes note that c returned err, and starts reconnecting if
+// the error is fatal to c. Returns true if it was. The end of the
+// server's stream isn't, nor is the connection being closed: those go
+// to the caller.
+func (r *ReconnectingConn) failed(c *Conn, err error) bool {
+	if err == nil || err == deadlineExceeded || err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == c && !r.closed {
+		r.conn = nil
+		// Close waits for c to flush, not while holding mu.
+		go c.Close()
+		go r.reconnect()
+	}
+	return true
+}
+
+// reconnect dials until it succeeds or the ReconnectingConn is
+// closed, then flushes the buffered writes and puts the new
+// connection in use.
+func (r *ReconnectingConn) reconnect() {
+	clock := r.dialer.Config.clock()
+	backoff := r.dialer.Config.handshakeBackoff()
+	rng := mrand.New(mrand.NewSource(clock.Now().UnixNano()))
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			timer := clock.NewTimer(backoff.timeout(helloTimeout, attempt-1, rng))
+			select {
+			case <-timer.C():
+			case <-r.closing:
+				timer.Stop()
+				return
+			}
+		}
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		c, err := r.dialer.dial(context.Background(), r.raddr, "", r.serverKey, r.clientKey)
+		if err != nil {
+			continue
+		}
+		for {
+			r.mu.Lock()
+			if r.closed {
+				r.mu.Unlock()
+				c.Close()
+				return
+			}
+			if len(r.pending) == 0 {
+				c.SetReadDeadline(r.readDeadline)
+				c.SetWriteDeadline(r.writeDeadline)
+				r.conn = c
+				r.cond.Broadcast()
+				r.mu.Unlock()
+				return
+			}
+			pending := r.pending
+			r.pending = nil
+			r.mu.Unlock()
+			if n, err := c.Write(pending); err != nil {
+				// Keep what didn't make it for the next
+				// connection.
+				r.mu.Lock()
+				r.pending = append(pending[n:], r.pending...)
+				r.mu.Unlock()
+				c.Close()
+				break
+			}
+		}
+	}
+}
+
+// Read reads from the current connection, waiting for a new one if it
+// fails. The read deadline doesn't interrupt that wait.
+func (r *ReconnectingConn) Read(b []byte) (int, error) {
+	for {
+		c, err := r.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := c.Read(b)
+		if n > 0 || !r.failed(c, err) {
+			return n, err
+		}
+	}
+}
+
+// Write writes to the current connection, or buffers the data if
+// there is none. What remains of a write interrupted by a failure is
+// buffered too.
+func (r *ReconnectingConn) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c := r.conn
+	if c == nil {
+		defer r.mu.Unlock()
+		if room := r.maxBuffer - len(r.pending); room < len(b) {
+			r.pending = append(r.pending, b[:room]...)
+			return room, ErrReconnectBufferFull
+		}
+		r.pending = append(r.pending, b...)
+		return len(b), nil
+	}
+	r.mu.Unlock()
+
+	n, err := c.Write(b)
+	if !r.failed(c, err) {
+		return n, err
+	}
+	m, err := r.Write(b[n:])
+	return n + m, err
+}
+
+// Close closes the current connection and stops reconnecting.
+func (r *ReconnectingConn) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return net.ErrClosed
+	}
+	r.closed = true
+	close(r.closing)
+	r.cond.Broadcast()
+	c := r.conn
+	r.mu.Unlock()
+	// Close waits for c to flush, not while holding mu.
+	if c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the current connection, or
+// nil while reconnecting.
+func (r *ReconnectingConn) LocalAddr() net.Addr {
+	if c := r.peek(); c != nil {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote address of the current connection, or
+// nil while reconnecting.
+func (r *ReconnectingConn) RemoteAddr() net.Addr {
+	if c := r.peek(); c != nil {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+// peek returns the current connection without waiting.
+func (r *ReconnectingConn) peek() *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+func (r *ReconnectingConn) SetDeadline(t time.Time) error {
+	r.SetReadDeadline(t)
+	return r.SetWriteDeadline(t)
+}
+
+func (r *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readDeadline = t
+	if r.conn != nil {
+		return r.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (r *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeDeadline = t
+	if r.conn != nil {
+		return r.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
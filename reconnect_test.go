@@ -0,0 +1,180 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestReconnectingConn(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	d := &Dialer{Config: &Config{DeadPeerThreshold: 1}}
+	r, err := d.DialReconnecting(addr, key, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(s string) {
+		t.Helper()
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		got := make([]byte, len(s))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		if string(got) != s {
+			t.Errorf("echoed %q, want %q", got, s)
+		}
+	}
+	echo("before")
+
+	// Cut the connection off. Unanswered retransmissions of the
+	// next write get it declared dead, and a Read notices and
+	// reconnects.
+	old := r.peek()
+	old.sock.Close()
+	r.Write([]byte("lost"))
+	for start := time.Now(); r.peek() == old; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("no reconnection")
+		}
+		r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		r.Read(make([]byte, 1))
+	}
+	r.SetReadDeadline(time.Time{})
+	echo("after")
+}
+
+func TestReconnectingConnBuffer(t *testing.T) {
+	r := &ReconnectingConn{maxBuffer: 8}
+	if n, err := r.Write([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("buffered Write = %d, %v, want 5, nil", n, err)
+	}
+	if n, err := r.Write([]byte("world")); n != 3 || err != ErrReconnectBufferFull {
+		t.Errorf("Write past the buffer = %d, %v, want 3, ErrReconnectBufferFull", n, err)
+	}
+	if string(r.pending) != "hellowor" {
+		t.Errorf("buffered %q, want %q", r.pending, "hellowor")
+	}
+}
+
+func TestReconnectingConnEOF(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("bye"))
+		c.Close()
+	}()
+	var d Dialer
+	r, err := d.DialReconnecting(l.Addr().(*Addr).UDP.String(), pub[:], 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The end of the server's stream goes to the reader, without a
+	// reconnection.
+	old := r.peek()
+	r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if b, err := io.ReadAll(r); err != nil || string(b) != "bye" {
+		t.Errorf("ReadAll = %q, %v, want %q, nil", b, err, "bye")
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after the end = %v, want io.EOF", err)
+	}
+	if r.peek() != old {
+		t.Errorf("reconnected after the end of the server's stream")
+	}
+}
+
+func TestReconnectingConnClose(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	var d Dialer
+	r, err := d.DialReconnecting(addr, key, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data that can't be acknowledged keeps Close flushing, without
+	// holding up the rest.
+	r.peek().sock.Close()
+	r.Write([]byte("unacknowledged"))
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	got := make(chan net.Addr)
+	go func() { got <- r.LocalAddr() }()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Errorf("LocalAddr blocked while Close flushes")
+	}
+	select {
+	case <-closed:
+		t.Errorf("Close didn't wait for the flush")
+	default:
+	}
+}
+
+func TestReconnectingConnBackoff(t *testing.T) {
+	// A server that never answers, counting Hellos.
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	hellos := make(chan struct{}, 16)
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			if _, _, err := sink.ReadFrom(b); err != nil {
+				return
+			}
+			hellos <- struct{}{}
+		}
+	}()
+
+	// One Hello per dial, and 1s then 1000s between dials, on a
+	// clock that only moves when told to.
+	clock := newFakeClock()
+	d := &Dialer{Config: &Config{Clock: clock, HelloAttempts: 1, HandshakeBackoff: Backoff{Multiplier: 1000}}}
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	r := &ReconnectingConn{dialer: d, raddr: sink.LocalAddr().String(), serverKey: pub[:], closing: make(chan struct{})}
+	r.clientKey = make([]byte, 32)
+	r.cond = sync.NewCond(&r.mu)
+	go r.reconnect()
+	defer r.Close()
+
+	start := clock.Now()
+	deadline := time.After(10 * time.Second)
+	for n := 0; n < 3; {
+		select {
+		case <-hellos:
+			n++
+		case <-deadline:
+			t.Fatalf("%d dials after %s on the clock", n, clock.Now().Sub(start))
+		case <-time.After(time.Millisecond):
+			if next, ok := clock.next(); ok {
+				clock.Advance(next.Sub(clock.Now()))
+			}
+		}
+	}
+	if elapsed := clock.Now().Sub(start); elapsed < 1000*time.Second {
+		t.Errorf("three dials after %s on the clock, want at least 1000s", elapsed)
+	}
+}
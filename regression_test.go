@@ -0,0 +1,200 @@
+package curvecp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Regression packets of a connection between a client with
+// long-term secret key regressionClientSecret and a server with
+// regressionServerSecret, both taking their randomness from
+// regressionRand, on clocks that stand still so that no timer goes
+// off. The client asks for domain "example.com" and writes "hello"
+// once the handshake is done, and the server answers "world".
+//
+// They come from this implementation, with fixed randomness, and pin
+// down its own output: a change to any of them is a change to the
+// wire format. That the format is the reference's is for the interop
+// tests to show.
+var (
+	regressionServerSecret = bytes.Repeat([]byte{0x5e}, 32)
+	regressionClientSecret = bytes.Repeat([]byte{0xc1}, 32)
+
+	regressionHello           = "51766e5135586c48000000000000000000000000000000000000000000000000000000000000000064ffccce5bedf41c0d1fda2ab6e2f464ff0e5b57e804159f13c47a9d2accfe79000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000100000000000000047f60b00520cf3fb2528fcccef8e626975ebbd6d3c64f3395955ade66c56c46f49ea01a43ec0579c9afb3559d21d7b225e909ff5e860304c50b536173da765554760d335bc46525a89db51bddf88ce9"
+	regressionCookie          = "524c33614e4d584b0000000000000000000000000000000000000000000000000000000000000000680b4e7c8b763a1b1d49d4955c84862134e2fc098a3667fbe8a1b04ab113bea818ff6f8394f75b51769c3850f6807ef4b3c0247ded3018832580b74ef1899ca29a551f0096f50535775a19ca185b767716c825139b8949978a3acb7dfc93512d4eb2d90e2435572b9138522b1d18c03da076fafbbe89eaad3a0d489a246fdbca88515986065035abcd46359626a947fc367ed37cc867c397dcd910e8abb5ce48"
+	regressionInitiate        = "51766e5135586c49000000000000000000000000000000000000000000000000000000000000000064ffccce5bedf41c0d1fda2ab6e2f464ff0e5b57e804159f13c47a9d2accfe795fb90badb37c5821b6d95526a41a9504adde57f4701b8343c6b10d0f749452a5835092ba59077dfd3c2d501c5de66d1221c7f3993330e92790f738ee47f95a8cc0121e4d50133512fca4e5d8bf94158fb3c2637c656a04f1b87a90412e44ca2102000000000000006a75b246053b06701330505452c143cda081c4c4c41051e1e0f5ba1783cfb27140e33f1b59fed0c36ff5301687f964d149532e0f2bd00009498aa9e63e87593ae2e15d96a80cbac5f5c3c8ce81020c3bf9692ab1a6405e963a13565923cd9a083c7c2a0f5a8510b2ade53b4a9a33092c984a5ceb014a90ac14dbfbaefa3ca236d2cad102208a921872e17e19c7df4dab1c60ba7c24787fe3bbd3dc6bd6a7cdcf83739c0f1f3dab33eb8321fba39f7f370a39105ddcf24ff9266486c575b0499a88fd42ef2300da3f15c18a3a4e9a5f8663287bb3de124f03eb481142f6f8292fafc72ffcfb816dc44d912fdd90cd6756dfd34c6c4b6a77f9604cf2cc71aeddd9887ecb1990bc1c88624f54921335b8e54deb8b01fb5490300f32caae9348d039bf192d1ab283827812a9c52b1246897c4e367ee8403c468323bf847a9fe1b3389659b67f95c25612237676425e8f2135a8bea3fc7038b66f3025c66b0688c40189532acb2f31de6ee243d0a1d0f942ea2f609f688a6d9b7fc72b20f34f5f76cf87233a127006e94ccf58c5dc5d9d13c9b35a5fd9f4cc483f6dfd79e6a10cc283"
+	regressionInitiateData    = "51766e5135586c49000000000000000000000000000000000000000000000000000000000000000064ffccce5bedf41c0d1fda2ab6e2f464ff0e5b57e804159f13c47a9d2accfe795fb90badb37c5821b6d95526a41a9504adde57f4701b8343c6b10d0f749452a5835092ba59077dfd3c2d501c5de66d1221c7f3993330e92790f738ee47f95a8cc0121e4d50133512fca4e5d8bf94158fb3c2637c656a04f1b87a90412e44ca21030000000000000056424762d14fc1969fc90bd28a321a468e4d9afad8e58f410b4a83774e5152758479f868f9b03972cc8c492fd0346183ff6b9602bb55a9ea4c6466f83816a078bec1d6a38a9f4658ae9fb67aa47f64e800674e0634bda236d19aafd429d138698f3b6e7fb236eb21143436ef056c1ec2beed72a7750915e1199fc58b7f83e39573271e0c54a29093f032a8a04335c88827f1764c4c0bac632070ac19d15e9a6b9818272e5f9fa24627f1879b3ab1f8dd9ab5e26a631caba91616961b4a88bdef78cce366741839fb5a78ac97c043c5df33ba685dabd9fa97c1628059ef564664f9bdde7b98f056dd8a5d2d0e931446d687494c935a65847d52e43dd13ff54872b337e65854b460e48e4926812f50ab99ff06f2780297034d5006a506140817254cb997c211a5cb8e3e3afe3be7d21f42d2a32dc6ffff14a481bb02e378b04796839d973a7c20bbc5168ef0b1cb673185c19b3606e2dc7870cd720c3c36e036842913324801a44a767d3e24f68eecb23d9278628e45ab04daae1173b2ec85913a33e2993e5cd54385ab82868eb8cda3a0fa4d3921e8d6611c7823e3237cba7c423f1b5bc8b65130853bb3ea3ea52de203"
+	regressionServerKeepalive = "524c33614e4d584d000000000000000000000000000000000000000000000000000000000000000001000000000000004a5cc0a293aadc834dc21857dda4ee0d1286e39de327bfe2650ac93bcbf97e6c6783e6e59188e9dfa7868f51634f815abe9bd4e48a8b69bdbb6d24c72ee83bd8"
+	regressionServerAck       = "524c33614e4d584d00000000000000000000000000000000000000000000000000000000000000000200000000000000458583d984d7c54cdd2d8b5692365ca2f3352d607307bd11c123aa5bca380b8579a3aa41332d997cd54b8e42ff1e8b2badf26a9288d43d8411158700a4e82584"
+	regressionServerDataAck   = "524c33614e4d584d0000000000000000000000000000000000000000000000000000000000000000030000000000000083a0079c7a9302d59fea7af7d105db56e5eab532ee0405a5660e120172a68b3b27921011e6341f6bc8440b2d7c90fe66f268c814a4726ca7506ec4e1a44a2869"
+	regressionServerData      = "524c33614e4d584d00000000000000000000000000000000000000000000000000000000000000000400000000000000114a43574466a2f970a5a2afef253ee412338422b94e8247d2d9c43fca127bfb91a436e24f01a6ef79e0a467afa5317c37040fe1d26a5dd65f237b965340ceb8adc4ca613fe261d3e292d640baafaed8"
+)
+
+// regressionRand is a reproducible randReader.
+type regressionRand struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+func (r *regressionRand) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(b)
+}
+
+// useRegressionRand makes randReader reproducible for the rest of the
+// test.
+func useRegressionRand(t testing.TB) {
+	saved := randReader
+	randReader = &regressionRand{r: mrand.New(mrand.NewSource(1))}
+	t.Cleanup(func() { randReader = saved })
+}
+
+func regressionPublicKey(secret []byte) []byte {
+	var pub, priv [32]byte
+	copy(priv[:], secret)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return pub[:]
+}
+
+func regressionPacket(t testing.TB, h string) []byte {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// expectPacket reads the next packet arriving on sock, and compares it
+// with the regression packet want.
+func expectPacket(t *testing.T, sock *memSock, name, want string) {
+	t.Helper()
+	b := make([]byte, 2048)
+	done := make(chan int)
+	go func() {
+		n, _, _ := sock.ReadFrom(b)
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if got := hex.EncodeToString(b[:n]); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: no packet", name)
+	}
+}
+
+// TestRegressionClient checks that a client sends the regression packets, and
+// understands those of the server.
+func TestRegressionClient(t *testing.T) {
+	useRegressionRand(t)
+	mn := &memNet{socks: make(map[memAddr]*memSock)}
+	ssock := mn.listen("server")
+	defer ssock.Close()
+	csock := mn.listen("client")
+	defer csock.Close()
+
+	d := Dialer{Key: regressionClientSecret, Domain: "example.com", Config: &Config{Clock: newFakeClock()}}
+	dialed := make(chan *Conn, 1)
+	go func() {
+		c, err := d.DialPacketConn(csock, ssock.LocalAddr(), regressionPublicKey(regressionServerSecret))
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- c
+	}()
+	expectPacket(t, ssock, "Hello", regressionHello)
+	ssock.WriteTo(regressionPacket(t, regressionCookie), csock.LocalAddr())
+	var c *Conn
+	select {
+	case c = <-dialed:
+		if c == nil {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial didn't accept the Cookie")
+	}
+	defer c.Abort()
+	expectPacket(t, ssock, "Initiate", regressionInitiate)
+	c.Write([]byte("hello"))
+	expectPacket(t, ssock, "Initiate with data", regressionInitiateData)
+
+	ssock.WriteTo(regressionPacket(t, regressionServerData), csock.LocalAddr())
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "world" {
+		t.Errorf("Read = %q, %v, want %q", b, err, "world")
+	}
+}
+
+// TestRegressionServer checks that a server sends the regression packets, and
+// understands those of the client.
+func TestRegressionServer(t *testing.T) {
+	useRegressionRand(t)
+	mn := &memNet{socks: make(map[memAddr]*memSock)}
+	ssock := mn.listen("server")
+	defer ssock.Close()
+	csock := mn.listen("client")
+	defer csock.Close()
+
+	l := newServer(ssock, false, regressionServerSecret, &Config{Clock: newFakeClock()})
+	defer l.Close()
+	csock.WriteTo(regressionPacket(t, regressionHello), ssock.LocalAddr())
+	expectPacket(t, csock, "Cookie", regressionCookie)
+	csock.WriteTo(regressionPacket(t, regressionInitiate), ssock.LocalAddr())
+	expectPacket(t, csock, "Keepalive", regressionServerKeepalive)
+	expectPacket(t, csock, "Message acknowledging Initiate", regressionServerAck)
+	csock.WriteTo(regressionPacket(t, regressionInitiateData), ssock.LocalAddr())
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*Conn)
+	defer c.Abort()
+	if !bytes.Equal(c.PeerKey(), regressionPublicKey(regressionClientSecret)) {
+		t.Errorf("PeerKey = %x", c.PeerKey())
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("Read = %q, %v, want %q", b, err, "hello")
+	}
+	expectPacket(t, csock, "Message acknowledging data", regressionServerDataAck)
+	c.Write([]byte("world"))
+	expectPacket(t, csock, "Message with data", regressionServerData)
+}
+
+// TestRegressionVectors checks the boxes of the regression Hello and
+// Cookie, those under the server's long-term key, with box alone: the
+// Hello's opens to zeros, and the Cookie's to the server's short-term
+// key and a cookie.
+func TestRegressionVectors(t *testing.T) {
+	var serverSecret, clientShortTermKey [32]byte
+	copy(serverSecret[:], regressionServerSecret)
+	hello := regressionPacket(t, regressionHello)
+	copy(clientShortTermKey[:], hello[40:72])
+
+	var nonce [24]byte
+	copy(nonce[:], "CurveCP-client-H")
+	copy(nonce[16:], hello[136:144])
+	if zeros, ok := box.Open(nil, hello[144:], &nonce, &clientShortTermKey, &serverSecret); !ok || !bytes.Equal(zeros, make([]byte, 64)) {
+		t.Errorf("regression Hello doesn't open to zeros with the server's key")
+	}
+
+	cookie := regressionPacket(t, regressionCookie)
+	copy(nonce[:], "CurveCPK")
+	copy(nonce[8:], cookie[40:56])
+	if plain, ok := box.Open(nil, cookie[56:], &nonce, &clientShortTermKey, &serverSecret); !ok || len(plain) != 32+96 {
+		t.Errorf("regression Cookie doesn't open with the server's key")
+	}
+}
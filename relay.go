@@ -0,0 +1,106 @@
+package curvecp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/johnwchadwick/curvecp/bufpool"
+)
+
+// Address types of the relay header.
+const (
+	relayIPv4 = 1
+	relayIPv6 = 4
+)
+
+var errRelayAddr = errors.New("relay destination must be a UDP address")
+
+// relayConn is a net.PacketConn that sends all its packets through a
+// relay, for clients that can't reach servers directly.
+//
+// Every packet to and from the relay starts with the header of a
+// SOCKS5 UDP request (RFC 1928, section 7) giving the address of the
+// real destination, or source. The relay strips the header and
+// forwards the rest, and wraps the answers the same way. Unlike
+// SOCKS5, there is no association step: the relay is expected to
+// forward anything from clients it is willing to serve.
+type relayConn struct {
+	*net.UDPConn
+	relay *net.UDPAddr
+	// The buffers of wrapped packets.
+	bufs *bufpool.Pool
+}
+
+func (r *relayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errRelayAddr
+	}
+	pkt := r.bufs.Get()
+	defer r.bufs.Put(pkt)
+	pkt = appendRelayHeader(pkt[:0], ua)
+	n := len(pkt)
+	pkt = append(pkt, b...)
+	if _, err := r.UDPConn.WriteTo(pkt, r.relay); err != nil {
+		return 0, err
+	}
+	return len(pkt) - n, nil
+}
+
+// ReadFrom reads the next packet forwarded by the relay, dropping
+// anything else, and returns it with its original source address.
+func (r *relayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := r.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(r.relay.IP) || from.Port != r.relay.Port {
+			continue
+		}
+		addr, hlen := parseRelayHeader(b[:n])
+		if addr == nil {
+			continue
+		}
+		return copy(b, b[hlen:n]), addr, nil
+	}
+}
+
+func appendRelayHeader(b []byte, addr *net.UDPAddr) []byte {
+	// Reserved, and fragment number 0 (not fragmented).
+	b = append(b, 0, 0, 0)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(append(b, relayIPv4), ip4...)
+	} else {
+		b = append(append(b, relayIPv6), addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// parseRelayHeader returns the address in the relay header at the
+// start of b, and the header's length. The address is nil if b
+// doesn't start with a header we support.
+func parseRelayHeader(b []byte) (*net.UDPAddr, int) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 || b[2] != 0 {
+		return nil, 0
+	}
+	var iplen int
+	switch b[3] {
+	case relayIPv4:
+		iplen = net.IPv4len
+	case relayIPv6:
+		iplen = net.IPv6len
+	default:
+		return nil, 0
+	}
+	hlen := 4 + iplen + 2
+	if len(b) < hlen {
+		return nil, 0
+	}
+	addr := &net.UDPAddr{
+		IP:   append(net.IP(nil), b[4:4+iplen]...),
+		Port: int(binary.BigEndian.Uint16(b[4+iplen:])),
+	}
+	return addr, hlen
+}
@@ -0,0 +1,87 @@
+package curvecp
+
+import (
+	"net"
+	"testing"
+)
+
+// runRelay forwards packets between a single client and any servers,
+// as the relays relayConn talks to do.
+func runRelay(t *testing.T) *net.UDPConn {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+
+	client := make(chan *net.UDPAddr, 1)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := front.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			select {
+			case client <- from:
+			default:
+			}
+			if to, hlen := parseRelayHeader(b[:n]); to != nil {
+				back.WriteTo(b[hlen:n], to)
+			}
+		}
+	}()
+	go func() {
+		from := <-client
+		b := make([]byte, 1500)
+		for {
+			n, server, err := back.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			front.WriteTo(append(appendRelayHeader(nil, server), b[:n]...), from)
+		}
+	}()
+	return front
+}
+
+func TestRelayHeader(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+	} {
+		b := appendRelayHeader(nil, addr)
+		got, n := parseRelayHeader(append(b, "payload"...))
+		if got == nil || got.String() != addr.String() || n != len(b) {
+			t.Errorf("relay header for %s parsed as %v, %d bytes", addr, got, n)
+		}
+	}
+	for _, b := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 1, relayIPv4, 1, 2, 3, 4, 0, 1},
+		{0, 0, 0, 3, 1, 'a', 0, 1},
+		{0, 0, 0, relayIPv6, 1, 2, 3, 4, 0, 1},
+	} {
+		if addr, _ := parseRelayHeader(b); addr != nil {
+			t.Errorf("parseRelayHeader(%v) accepted a bad header", b)
+		}
+	}
+}
+
+func TestDialRelay(t *testing.T) {
+	addr, key := listenEcho(t, nil)
+	relay := runRelay(t)
+	d := Dialer{Relay: relay.LocalAddr().String()}
+	c, err := d.Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, c, c, 20*1024)
+}
@@ -0,0 +1,132 @@
+package curvecp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRevoked is returned by Read and Write on a server connection
+// torn down because its client's key was revoked, see
+// Config.Revoked.
+var ErrRevoked = errors.New("client key revoked")
+
+// How often a RevocationFile reads the file again to look for changes.
+const revocationFileCheck = time.Second
+
+// A RevocationFile is a list of revoked client keys kept in a file,
+// in the manner of a certificate revocation list: one key per line in
+// hexadecimal, blank lines and lines starting with # ignored. Its
+// Revoked method is meant for Config.Revoked. A goroutine watches the
+// file for changes until Close, so keys can be revoked without
+// restarting the server.
+type RevocationFile struct {
+	path string
+	// The list last loaded, replaced whole on reloads, so that
+	// Revoked never waits on the file.
+	keys atomic.Pointer[map[[32]byte]bool]
+	// The hash of the contents last loaded. Only the watcher touches
+	// it after OpenRevocationFile.
+	sum [sha256.Size]byte
+
+	// Closed by Close, and by the watcher on its way out.
+	stop, done chan struct{}
+	closeOnce  sync.Once
+}
+
+// OpenRevocationFile loads the revocation list at path, and starts
+// watching it.
+func OpenRevocationFile(path string) (*RevocationFile, error) {
+	f := &RevocationFile{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(b); err != nil {
+		return nil, err
+	}
+	go f.watch()
+	return f, nil
+}
+
+// load parses b, the contents of the file, and makes it the list in
+// effect.
+func (f *RevocationFile) load(b []byte) error {
+	keys := make(map[[32]byte]bool)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		k, err := hex.DecodeString(string(line))
+		if err != nil || len(k) != 32 {
+			return &os.PathError{Op: "read", Path: f.path, Err: fmt.Errorf("line %d: not a public key", n)}
+		}
+		var key [32]byte
+		copy(key[:], k)
+		keys[key] = true
+	}
+	f.keys.Store(&keys)
+	f.sum = sha256.Sum256(b)
+	return nil
+}
+
+// watch reloads the file when it changes, looking at it once a second,
+// until Close.
+func (f *RevocationFile) watch() {
+	defer close(f.done)
+	t := time.NewTicker(revocationFileCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f.reload()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// reload loads the file again if its contents changed. Modification
+// times are too coarse to go by: an edit within the same tick that
+// keeps the size would go unnoticed. If the file can't be read or
+// parsed, the last list loaded stays in effect.
+func (f *RevocationFile) reload() {
+	if b, err := os.ReadFile(f.path); err == nil && sha256.Sum256(b) != f.sum {
+		f.load(b)
+	}
+}
+
+// Revoked returns true if key is in the list last loaded.
+func (f *RevocationFile) Revoked(key [32]byte) bool {
+	return (*f.keys.Load())[key]
+}
+
+// Close stops watching the file, and returns once the watcher is
+// done with it. The last list loaded stays in effect.
+func (f *RevocationFile) Close() error {
+	f.closeOnce.Do(func() { close(f.stop) })
+	<-f.done
+	return nil
+}
+
+// checkRevoked fails a server connection with ErrRevoked if its
+// client's key was revoked since, when it's time to check again. The
+// pump then tears it down.
+func (c *Conn) checkRevoked(now time.Time) {
+	if c.revokeCheck.IsZero() || now.Before(c.revokeCheck) {
+		return
+	}
+	c.revokeCheck = now.Add(c.config.revocationCheckInterval())
+	if c.config.revoked(c.peerIdentity[:]) {
+		c.fail(ErrRevoked)
+	}
+}
@@ -0,0 +1,120 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestRevocationFile(t *testing.T) {
+	a, b, c := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	path := filepath.Join(t.TempDir(), "revoked")
+	os.WriteFile(path, []byte("# revoked keys\n\n"+hex.EncodeToString(a[:])+"\n"), 0644)
+	f, err := OpenRevocationFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.Revoked(a) || f.Revoked(b) {
+		t.Errorf("only a should be revoked")
+	}
+
+	// The watcher picks up changes.
+	os.WriteFile(path, []byte(hex.EncodeToString(a[:])+"\n"+hex.EncodeToString(b[:])+"\n"), 0644)
+	deadline := time.Now().Add(5 * revocationFileCheck)
+	for !f.Revoked(b) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !f.Revoked(b) {
+		t.Errorf("b not revoked after the file changed")
+	}
+
+	// So does an edit that keeps the size and modification time.
+	f.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte(hex.EncodeToString(a[:])+"\n"+hex.EncodeToString(c[:])+"\n"), 0644)
+	os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	f.reload()
+	if !f.Revoked(c) || f.Revoked(b) {
+		t.Errorf("c not revoked instead of b after a same-size edit")
+	}
+
+	// A broken file leaves the last list in effect.
+	os.WriteFile(path, []byte("garbage\n"), 0644)
+	f.reload()
+	if !f.Revoked(a) || !f.Revoked(c) {
+		t.Errorf("keys no longer revoked after the file broke")
+	}
+	if _, err := OpenRevocationFile(path); err == nil {
+		t.Errorf("OpenRevocationFile of a broken file succeeded")
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	spub, spriv, _ := box.GenerateKey(rand.Reader)
+	cpub, cpriv, _ := box.GenerateKey(rand.Reader)
+	revoked := NewKeySet()
+	l, err := ListenWithConfig("127.0.0.1:0", spriv[:], &Config{
+		Revoked:                 revoked.Contains,
+		RevocationCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, _ := l.AcceptCurveCP()
+		accepted <- c
+	}()
+
+	d := Dialer{Key: cpriv[:]}
+	addr := l.Addr().(*Addr).UDP.String()
+	c, err := d.Dial(addr, spub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	c.Write([]byte("hi"))
+	s := <-accepted
+	if s == nil {
+		t.Fatal("Accept failed")
+	}
+	defer s.Close()
+	if _, err := s.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoking the key tears down the established connection.
+	revoked.Add(*cpub)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := s.Read(make([]byte, 2)); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Read after revocation = %v, want ErrRevoked", err)
+	}
+
+	// And keeps the client out.
+	go func() {
+		c, _ := l.AcceptCurveCP()
+		accepted <- c
+	}()
+	c, err = d.Dial(addr, spub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	c.Write([]byte("hi"))
+	select {
+	case <-accepted:
+		t.Errorf("revoked client accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
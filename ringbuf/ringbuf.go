@@ -34,6 +34,38 @@ func (r *Ringbuf) Write(b []byte) int {
 	return written
 }
 
+// WriteAt writes b off bytes past the end of the ring buffer's
+// contents, in its free space, without adding it to the
+// contents. Returns the number of bytes written, which may be less
+// than len(b), or 0, if they don't all fit in the free space.
+func (r *Ringbuf) WriteAt(b []byte, off int) int {
+	free := len(r.buf) - r.size
+	if off < 0 || off >= free {
+		return 0
+	}
+	if len(b) > free-off {
+		b = b[:free-off]
+	}
+	start := (r.start + r.size + off) % len(r.buf)
+	n := copy(r.buf[start:], b)
+	copy(r.buf, b[n:])
+	return len(b)
+}
+
+// Extend adds up to n bytes of the free space following the contents
+// to the contents, as if they had been written with Write, typically
+// after filling them with WriteAt. Returns the number of bytes added.
+func (r *Ringbuf) Extend(n int) int {
+	if free := len(r.buf) - r.size; n > free {
+		n = free
+	}
+	if n <= 0 {
+		return 0
+	}
+	r.size += n
+	return n
+}
+
 // Read reads as many bytes as possible from the ring buffer into
 // b. Returns the number of bytes removed from the ring buffer, which
 // may be zero if the buffer is empty.
@@ -56,3 +88,30 @@ func (r *Ringbuf) Read(b []byte) int {
 func (r *Ringbuf) Size() int {
 	return r.size
 }
+
+// Bytes returns the contents of the ring buffer, without removing
+// them. The contents may wrap around the end of the underlying
+// buffer, in which case they are split in two slices, a then b.
+// The slices alias the ring buffer, and are only valid until the next
+// Write.
+func (r *Ringbuf) Bytes() (a, b []byte) {
+	end := r.start + r.size
+	if end <= len(r.buf) {
+		return r.buf[r.start:end], nil
+	}
+	return r.buf[r.start:], r.buf[:end-len(r.buf)]
+}
+
+// Discard removes up to n bytes from the ring buffer without copying
+// them anywhere. Returns the number of bytes removed.
+func (r *Ringbuf) Discard(n int) int {
+	if n > r.size {
+		n = r.size
+	}
+	if n <= 0 {
+		return 0
+	}
+	r.start = (r.start + n) % len(r.buf)
+	r.size -= n
+	return n
+}
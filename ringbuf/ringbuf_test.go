@@ -71,3 +71,45 @@ func TestRingbuf(t *testing.T) {
 		t.Logf("%#v", r)
 	}
 }
+
+func TestRingbufBytes(t *testing.T) {
+	r := New(5)
+	r.Write([]byte("abcd"))
+	if a, b := r.Bytes(); string(a) != "abcd" || b != nil {
+		t.Errorf("r.Bytes() = %q, %q, want \"abcd\", nil", a, b)
+	}
+	if n := r.Discard(3); n != 3 || r.Size() != 1 {
+		t.Errorf("r.Discard(3) = %d, size %d, want 3, 1", n, r.Size())
+	}
+	r.Write([]byte("efg"))
+	if a, b := r.Bytes(); string(a) != "de" || string(b) != "fg" {
+		t.Errorf("wrapped r.Bytes() = %q, %q, want \"de\", \"fg\"", a, b)
+	}
+	if n := r.Discard(10); n != 4 || r.Size() != 0 {
+		t.Errorf("r.Discard(10) = %d, size %d, want 4, 0", n, r.Size())
+	}
+}
+
+func TestRingbufWriteAt(t *testing.T) {
+	r := New(6)
+	r.Write([]byte("ab"))
+	r.Read(make([]byte, 2))
+	// Past the end of the underlying buffer, wrapping around.
+	if n := r.WriteAt([]byte("efgh"), 2); n != 4 {
+		t.Errorf("r.WriteAt(\"efgh\", 2) = %d, want 4", n)
+	}
+	if n := r.WriteAt([]byte("xyz"), 6); n != 0 {
+		t.Errorf("r.WriteAt past the free space = %d, want 0", n)
+	}
+	if r.Size() != 0 {
+		t.Errorf("r.Size() = %d after WriteAt, want 0", r.Size())
+	}
+	r.Write([]byte("cd"))
+	if n := r.Extend(10); n != 4 {
+		t.Errorf("r.Extend(10) = %d, want 4", n)
+	}
+	b := make([]byte, 10)
+	if n := r.Read(b); string(b[:n]) != "cdefgh" {
+		t.Errorf("r.Read() = %q, want \"cdefgh\"", b[:n])
+	}
+}
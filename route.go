@@ -0,0 +1,127 @@
+package curvecp
+
+import (
+	"net"
+	"strings"
+)
+
+// A domainListener is the net.Listener returned by Listener.Handle,
+// accepting the server's new conns for one domain.
+type domainListener struct {
+	s      *server
+	domain string
+	// From pump, the conns for domain, at most Config.AcceptBacklog
+	// of them. Closed, under the server's routeMu, by whoever removes
+	// the listener from the server's routes.
+	ch chan *Conn
+}
+
+// Handle returns a listener for the connections whose clients request
+// domain, see Listener.
+func (s *server) Handle(domain string) net.Listener {
+	l := &domainListener{
+		s:      s,
+		domain: routeKey(domain),
+		ch:     make(chan *Conn, s.config.acceptBacklog()),
+	}
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	if s.routesClosed {
+		close(l.ch)
+		return l
+	}
+	if s.routes == nil {
+		s.routes = make(map[string]*domainListener)
+	}
+	if _, ok := s.routes[l.domain]; ok {
+		panic("Domain already handled")
+	}
+	s.routes[l.domain] = l
+	return l
+}
+
+// routeKey returns the key in the server's routes for a requested
+// domain: its host part, in lower case.
+func routeKey(domain string) string {
+	domain, _ = SplitProtocolDomain(domain)
+	return strings.ToLower(domain)
+}
+
+// handler returns the Handle listener for domain, or nil.
+func (s *server) handler(domain string) *domainListener {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	return s.routes[routeKey(domain)]
+}
+
+// routeFull reports whether the queue new conns for domain go to is
+// full: that of its Handle listener, or else acceptQueue.
+func (s *server) routeFull(domain string) bool {
+	if l := s.handler(domain); l != nil {
+		return len(l.ch) >= cap(l.ch)
+	}
+	return len(s.acceptQueue) >= s.config.acceptBacklog()
+}
+
+// route queues a new conn for whoever accepts the connections for
+// domain.
+func (s *server) route(c *Conn, domain string) {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	l, ok := s.routes[routeKey(domain)]
+	if !ok {
+		s.acceptQueue = append(s.acceptQueue, c)
+		return
+	}
+	select {
+	case l.ch <- c:
+	default:
+		// The listener's backlog filled up since routeFull.
+		s.overflowed++
+		go c.Abort()
+	}
+}
+
+// closeRoutes closes the Handle listeners, once the server stops
+// listening.
+func (s *server) closeRoutes() {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	s.routesClosed = true
+	for domain, l := range s.routes {
+		delete(s.routes, domain)
+		l.close()
+	}
+}
+
+// close closes l.ch, and aborts the conns nobody will accept anymore.
+func (l *domainListener) close() {
+	close(l.ch)
+	for c := range l.ch {
+		go c.Abort()
+	}
+}
+
+func (l *domainListener) Accept() (net.Conn, error) {
+	c, ok := <-l.ch
+	if !ok {
+		return nil, &net.OpError{Op: "accept", Net: "curvecp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+	return c, nil
+}
+
+// Close stops routing connections to l. Later ones for its domain go
+// to the server's Accept again.
+func (l *domainListener) Close() error {
+	l.s.routeMu.Lock()
+	defer l.s.routeMu.Unlock()
+	if l.s.routes[l.domain] == l {
+		delete(l.s.routes, l.domain)
+		l.close()
+	}
+	return nil
+}
+
+func (l *domainListener) Addr() net.Addr {
+	return l.s.Addr()
+}
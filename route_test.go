@@ -0,0 +1,81 @@
+package curvecp
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestHandle(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().(*Addr).UDP.String()
+	a := l.Handle("a.example")
+	b := l.Handle("B.example")
+
+	accepted := func(l net.Listener) <-chan string {
+		ch := make(chan string, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- c.(*Conn).Domain()
+			io.Copy(c, c)
+			c.Close()
+		}()
+		return ch
+	}
+	for _, tc := range []struct {
+		l            net.Listener
+		domain, want string
+	}{
+		{a, "a.example", "a.example"},
+		{b, ProtocolDomain("b.example", "echo"), "b.example"},
+		{l, "other.example", "other.example"},
+	} {
+		ch := accepted(tc.l)
+		d := Dialer{Domain: tc.domain}
+		c, err := d.Dial(addr, pub[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Abort()
+		testTransfer(t, c, c, 1000)
+		if got := <-ch; got != tc.want {
+			t.Errorf("Dial %s: accepted a conn for %q, want %q", tc.domain, got, tc.want)
+		}
+	}
+
+	// Closing a domain's listener hands it back to Accept.
+	a.Close()
+	if _, err := a.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept on a closed domain listener: %v", err)
+	}
+	ch := accepted(l)
+	d := Dialer{Domain: "a.example"}
+	c, err := d.Dial(addr, pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 1000)
+	if got := <-ch; got != "a.example" {
+		t.Errorf("Accept got a conn for %q, want a.example", got)
+	}
+
+	// And closing the server closes the rest.
+	l.Close()
+	if _, err := b.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept on a domain listener of a closed server: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package curvecp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// How long each self-test phase may take.
+const selfTestTimeout = 30 * time.Second
+
+// Known-answer vectors checked by RunSelfTest.
+var (
+	// X25519, from RFC 7748 section 6.1.
+	kaAliceSecret = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	kaAlicePublic = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+	kaBobPublic   = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	kaShared      = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+
+	// A message with a gap in its acknowledgments, the end of the
+	// stream and 3 bytes of data, see doc.go.
+	kaMessage = message{
+		id:    1,
+		ackID: 2,
+		acks:  [6]ackRange{{0, 1000}, {1100, 1200}},
+		eof:   eofSuccess,
+		pos:   4096,
+		data:  []byte("abc"),
+	}
+	kaMessageEncoded = "01000000" + "02000000" + "e803000000000000" +
+		"64000000" + "6400" + strings.Repeat("00", 16) + "0308" +
+		"0010000000000000" + strings.Repeat("00", 13) + "616263"
+)
+
+// RunSelfTest checks that this build of the package works: the
+// cryptography and message encoding against known answers, then a
+// client and server talking over an in-memory network, through a
+// handshake, packet loss, the client changing address, and closing the
+// connection. It returns
+// an error describing every failure, or nil.
+//
+// It normally takes well under a second, and is meant as a health
+// check when a program starts.
+func RunSelfTest() error {
+	var failures []string
+	for _, phase := range []struct {
+		name string
+		run  func() error
+	}{
+		{"known answers", selfTestVectors},
+		{"connection", selfTestConn},
+	} {
+		if err := phase.run(); err != nil {
+			failures = append(failures, phase.name+": "+err.Error())
+		}
+	}
+	if failures != nil {
+		return fmt.Errorf("curvecp self-test failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func selfTestVectors() error {
+	secret, _ := hex.DecodeString(kaAliceSecret)
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil || hex.EncodeToString(public) != kaAlicePublic {
+		return errors.New("wrong X25519 public key")
+	}
+	bob, _ := hex.DecodeString(kaBobPublic)
+	shared, err := curve25519.X25519(secret, bob)
+	if err != nil || hex.EncodeToString(shared) != kaShared {
+		return errors.New("wrong X25519 shared secret")
+	}
+
+	// Boxes must open with the peer's keys, and not once tampered
+	// with.
+	var nonce [24]byte
+	randBytes(nonce[:])
+	pa, sa, _ := box.GenerateKey(rand.Reader)
+	pb, sb, _ := box.GenerateKey(rand.Reader)
+	sealed := box.Seal(nil, []byte("self-test"), &nonce, pb, sa)
+	if opened, ok := box.Open(nil, sealed, &nonce, pa, sb); !ok || string(opened) != "self-test" {
+		return errors.New("box doesn't open")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, ok := box.Open(nil, sealed, &nonce, pa, sb); ok {
+		return errors.New("tampered box opens")
+	}
+
+	b := kaMessage.marshal(make([]byte, maxMessageLen))
+	if hex.EncodeToString(b) != kaMessageEncoded {
+		return errors.New("wrong message encoding")
+	}
+	var m message
+	if !m.unmarshal(b) || m.ackID != kaMessage.ackID || m.acks[0] != kaMessage.acks[0] || m.acks[1] != kaMessage.acks[1] || m.eof != kaMessage.eof || m.pos != kaMessage.pos || string(m.data) != "abc" {
+		return errors.New("wrong message decoding")
+	}
+	return nil
+}
+
+// selfTestConn dials a server over a memNet, and checks that data
+// echoes back correctly as the network changes.
+func selfTestConn() error {
+	mn := &memNet{socks: make(map[memAddr]*memSock)}
+	ssock := mn.listen("server")
+	defer ssock.Close()
+	csock := mn.listen("client")
+	defer csock.Close()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l := newServer(ssock, false, priv[:], nil)
+	defer l.Close()
+	// Errors the echo servers stopped on, nil at the end of the
+	// stream.
+	ends := make(chan error, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, err := io.Copy(c, c)
+				ends <- err
+				c.Close()
+			}()
+		}
+	}()
+
+	var d Dialer
+	c, err := d.dialMux(context.Background(), newClientMux(csock), []net.Addr{ssock.LocalAddr()}, pub[:], nil, "selftest.invalid")
+	if err != nil {
+		return err
+	}
+	if err := selfTestEcho(c, 16*1024); err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+
+	// Lose one packet in 8, both ways.
+	var lost int
+	mn.setDrop(func() bool {
+		lost++
+		return lost%8 == 0
+	})
+	if err := selfTestEcho(c, 64*1024); err != nil {
+		return fmt.Errorf("loss recovery: %v", err)
+	}
+	mn.setDrop(nil)
+
+	// The server must follow the client to its new address.
+	mn.rebind(csock, "client-roamed")
+	if err := selfTestEcho(c, 16*1024); err != nil {
+		return fmt.Errorf("roaming: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		return fmt.Errorf("close: %v", err)
+	}
+	select {
+	case err := <-ends:
+		if err != nil {
+			return fmt.Errorf("close: server read %v, not the end of the stream", err)
+		}
+	case <-time.After(selfTestTimeout):
+		return errors.New("close: server didn't see the end of the stream")
+	}
+	return nil
+}
+
+// selfTestEcho writes size random bytes to c, and checks that they
+// come back.
+func selfTestEcho(c *Conn, size int) error {
+	data := make([]byte, size)
+	randBytes(data)
+	c.SetDeadline(time.Now().Add(selfTestTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	werr := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		werr <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if err := <-werr; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("data corrupted")
+	}
+	return nil
+}
+
+// memNet is an in-memory packet network, which loses packets only on
+// request, or when a socket's queue is full.
+type memNet struct {
+	mu    sync.Mutex
+	socks map[memAddr]*memSock
+	// If not nil, packets for which it returns true are lost.
+	drop func() bool
+	// Packets written so far.
+	sent int
+}
+
+// memAddr is the address of a memSock.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memPacket is a packet in flight on a memNet.
+type memPacket struct {
+	from memAddr
+	b    []byte
+}
+
+// memSock is a net.PacketConn on a memNet. It ignores deadlines.
+type memSock struct {
+	net  *memNet
+	addr memAddr // Guarded by net.mu.
+	in   chan memPacket
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// listen returns a new socket at addr.
+func (n *memNet) listen(addr memAddr) *memSock {
+	s := &memSock{
+		net:    n,
+		addr:   addr,
+		in:     make(chan memPacket, 256),
+		closed: make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.socks[addr] = s
+	n.mu.Unlock()
+	return s
+}
+
+// rebind moves s to addr, as if a NAT had picked a new port.
+func (n *memNet) rebind(s *memSock, addr memAddr) {
+	n.mu.Lock()
+	delete(n.socks, s.addr)
+	s.addr = addr
+	n.socks[addr] = s
+	n.mu.Unlock()
+}
+
+// activity returns how many packets have been written so far, and
+// whether some are waiting to be read.
+func (n *memNet) activity() (sent int, queued bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, s := range n.socks {
+		if len(s.in) > 0 {
+			queued = true
+		}
+	}
+	return n.sent, queued
+}
+
+func (n *memNet) setDrop(drop func() bool) {
+	n.mu.Lock()
+	n.drop = drop
+	n.mu.Unlock()
+}
+
+func (s *memSock) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-s.in:
+		return copy(b, p.b), p.from, nil
+	case <-s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (s *memSock) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.net.mu.Lock()
+	defer s.net.mu.Unlock()
+	to, ok := addr.(memAddr)
+	if !ok {
+		return 0, errors.New("not a memNet address")
+	}
+	s.net.sent++
+	if s.net.drop != nil && s.net.drop() {
+		return len(b), nil
+	}
+	if dst := s.net.socks[to]; dst != nil {
+		select {
+		case dst.in <- memPacket{s.addr, append([]byte(nil), b...)}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (s *memSock) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *memSock) LocalAddr() net.Addr {
+	s.net.mu.Lock()
+	defer s.net.mu.Unlock()
+	return s.addr
+}
+
+func (s *memSock) SetDeadline(t time.Time) error      { return nil }
+func (s *memSock) SetReadDeadline(t time.Time) error  { return nil }
+func (s *memSock) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,9 @@
+package curvecp
+
+import "testing"
+
+func TestRunSelfTest(t *testing.T) {
+	if err := RunSelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,40 +2,70 @@ package curvecp
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"crypto/rand"
-	"errors"
 	"io"
 	"net"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/johnwchadwick/curvecp/freelist"
+	"github.com/johnwchadwick/curvecp/bufpool"
+	"github.com/johnwchadwick/curvecp/handshake"
 	"golang.org/x/crypto/nacl/box"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 var (
-	notImplemented = errors.New("not implemented")
-
 	// Magic IDs at the beginning of packets.
-	helloMagic    = []byte("QvnQ5XlH")
-	cookieMagic   = []byte("RL3aNMXK")
-	initiateMagic = []byte("QvnQ5XlI")
-	messageMagic  = []byte("RL3aNMXM")
+	helloMagic         = []byte(handshake.HelloMagic)
+	cookieMagic        = []byte(handshake.CookieMagic)
+	initiateMagic      = []byte(handshake.InitiateMagic)
+	clientMessageMagic = []byte(handshake.ClientMessageMagic)
+	serverMessageMagic = []byte(handshake.ServerMessageMagic)
 
 	// The prefixes for various nonces
-	helloNoncePrefix         = []byte("CurveCP-client-H")
-	cookieNoncePrefix        = []byte("CurveCPK")
-	initiateNoncePrefix      = []byte("CurveCP-client-I")
-	vouchNoncePrefix         = []byte("CurveCPV")
-	serverMessageNoncePrefix = []byte("CurveCP-server-M")
-	clientMessageNoncePrefix = []byte("CurveCP-client-M")
-	minuteNoncePrefix        = []byte("minute-k")
+	initiateNoncePrefix      = []byte(handshake.InitiateNoncePrefix)
+	serverMessageNoncePrefix = []byte(handshake.ServerMessageNoncePrefix)
+	clientMessageNoncePrefix = []byte(handshake.ClientMessageNoncePrefix)
+)
+
+const (
+	// Packets handed to a conn per round-robin turn, and the size of
+	// conns' packetIn buffers.
+	connQuantum = 8
+	// Most packets queued for a conn that isn't keeping up, more are
+	// dropped.
+	maxConnBacklog = 256
+	// How long to wait before retrying conns that were too busy to
+	// take their packets.
+	serviceRetry = time.Millisecond
 )
 
+// packetSize is the size of packet buffers. CurveCP datagrams are
+// specified to always fit in the smallest IPv6 datagram, 1280 bytes.
+const packetSize = 1280
+
+// A packet is a datagram, and where it came from or goes to. Its
+// buffer belongs to whoever holds the packet, who must release it
+// once done with it, or hand it on with the packet.
 type packet struct {
 	net.Addr
 	buf []byte
+	// The pool buf goes back to, or nil if it goes to the garbage
+	// collector.
+	pool *bufpool.Pool
+}
+
+// release hands p's buffer back to its pool. The server pump opens
+// Initiates in place, those are cleared first.
+func (p packet) release() {
+	switch {
+	case p.pool == nil:
+	case len(p.buf) >= 8 && bytes.Equal(p.buf[:8], initiateMagic):
+		p.pool.PutZeroed(p.buf)
+	default:
+		p.pool.Put(p.buf)
+	}
 }
 
 // Implements net.Listener.
@@ -46,52 +76,186 @@ type server struct {
 	// To pump, telling it to stop processing new
 	// connections. Existing connections still get processed.
 	stopListen chan struct{}
+	// To pump, from Shutdown: abort the remaining connections.
+	abortConns chan struct{}
+	// Closed by pump once it has stopped listening and the last
+	// connection has ended, telling readLoop to stop.
+	closing chan struct{}
+	// Closed by pump when it exits, after readLoop.
+	released chan struct{}
 	// From pump to Accept() callers, to distribute new conns.
-	newConn chan *conn
-	//  From connStates to pump, telling it that a connection has been
-	//  closed.
+	newConn chan *Conn
+	// New conns waiting for Accept, at most Config.AcceptBacklog.
+	acceptQueue []*Conn
+	// Initiates from new clients held while acceptQueue is full,
+	// under BacklogDefer.
+	deferred []deferredInitiate
+	// The listeners from Handle, by routeKey, taking new conns in
+	// place of acceptQueue. Guarded by routeMu, as Handle and the
+	// listeners' Close change them.
+	routeMu      sync.Mutex
+	routes       map[string]*domainListener
+	routesClosed bool
+	// To Accept() callers, transient errors worth reporting. Errors
+	// arriving while one is already pending are dropped.
+	acceptErr chan error
+	// Accept's deadline.
+	acceptDeadline *deadline
+	// Closed when readLoop exits, because of the error in readErr.
+	readDone chan struct{}
+	readErr  error
+	// From conns to pump, the short-term keys of connections whose
+	// pump exited.
 	endConn chan string
 
-	// The underlying UDP socket.
-	sock *net.UDPConn
-	// The long-term secret key, used to authenticate Cookie packets.
-	longTermSecretKey [32]byte
+	// The underlying UDP socket, and whether the server created it,
+	// and closes it when done.
+	sock    net.PacketConn
+	ownSock bool
+	config  *Config
+	// The buffers of the packets read from sock, and of those the
+	// server sends.
+	bufs *bufpool.Pool
+	// The long-term keys, the current one first, then those rotated
+	// away from, still good for Initiates for a while, and those of
+	// Config.KeyRing.
+	keys []*longTermKey
+	// The current long-term public key, for other goroutines.
+	keyMu     sync.Mutex
+	publicKey [32]byte
 	// True if new connections should be accepted.
 	listen bool
 	// Minute keys to construct/verify cookies.
 	minuteKey, prevMinuteKey [32]byte
 
-	// Initiated clients. Pump forwards packets to them for
-	// processing.
-	conns map[string]chan packet
+	// Packets dropped by Config.PacketFilter.
+	filtered int
+	// Packets rejected by handshakeFailed, by reason.
+	handshakeFailures [numHandshakeFailures]int
+	// Initiates from new clients rejected by Config.Revoked or
+	// Config.VerifyPeer.
+	rejected int
+	// Initiates from new clients dropped because the accept backlog
+	// was full.
+	overflowed int
+	// Conns timed out by reap.
+	reaped int
+	// Initiates from new clients dropped because of per-host limits.
+	hostLimited int
+	// Hellos left unanswered because of Cookie rate limits.
+	cookiesLimited int
+	// Initiates from new clients reusing a Cookie, see
+	// Config.SingleUseCookies.
+	cookieReplays int
+	// Under SingleUseCookies, the nonces of Cookies that started
+	// conns, and when they're no longer good anyway.
+	usedCookies map[[16]byte]time.Time
+
+	// Cookie rate limits, global and by host, and when hostBuckets
+	// was last swept for hosts to forget.
+	cookieBucket     *tokenBucket
+	hostBuckets      map[string]*tokenBucket
+	hostBucketsSwept time.Time
+
+	// Initiated clients, by short-term key. Pump forwards packets
+	// to them for processing.
+	conns map[string]*connQueue
+	// Conn counts by host, for hosts with conns.
+	hosts map[string]*hostCount
+	// Queues with packets waiting for their conn, serviced
+	// round-robin.
+	ready *list.List // of *connQueue
+}
+
+// deferredInitiate is a verified Initiate from a new client, waiting
+// for room in the accept backlog.
+type deferredInitiate struct {
+	packet
+	serverShortTermKey []byte
+	domain             string
+}
+
+// connQueue holds the packets for a conn that the server pump hasn't
+// handed over yet.
+type connQueue struct {
+	conn *Conn
+	// When the conn was created and last got a packet, whether the
+	// client has sent a Message yet, and whether reap expired it.
+	created, lastSeen time.Time
+	established       bool
+	expired           bool
+	// The host the conn counts towards, see hostKey.
+	host string
+	// The conn's packetIn.
+	ch      chan packet
+	pending []packet
+	// The queue's element in server.ready, or nil.
+	elem *list.Element
 }
 
-func newServer(sock *net.UDPConn, key []byte) *server {
-	if len(key) != 32 {
+func newServer(sock net.PacketConn, ownSock bool, key []byte, config *Config) *server {
+	var secret [32]byte
+	if kp := config.keyProvider(); kp != nil {
+		secret = kp.SecretKey()
+	} else if len(key) != 32 {
 		panic("Wrong key length")
+	} else {
+		copy(secret[:], key)
 	}
 	s := &server{
-		packetIn:   make(chan packet),
-		stopListen: make(chan struct{}),
-		newConn:    make(chan *conn),
-		endConn:    make(chan string),
-
-		sock:   sock,
-		listen: true,
-
-		conns: make(map[string]chan packet),
+		packetIn:       make(chan packet),
+		stopListen:     make(chan struct{}),
+		abortConns:     make(chan struct{}),
+		closing:        make(chan struct{}),
+		released:       make(chan struct{}),
+		newConn:        make(chan *Conn),
+		acceptErr:      make(chan error, 1),
+		acceptDeadline: newDeadline(),
+		readDone:       make(chan struct{}),
+		endConn:        make(chan string),
+
+		sock:    sock,
+		ownSock: ownSock,
+		config:  config,
+		bufs:    bufpool.New(packetSize),
+		listen:  true,
+
+		conns: make(map[string]*connQueue),
+		hosts: make(map[string]*hostCount),
+		ready: list.New(),
 	}
-	copy(s.longTermSecretKey[:], key)
+	s.setKey(secret)
+	s.addRingKeys()
+	s.addVirtualHosts()
 	randBytes(s.minuteKey[:])
 	randBytes(s.prevMinuteKey[:])
-	go readLoop(s.sock, s.packetIn)
+	if !s.loadMinuteKeys(s.config.clock().Now()) {
+		s.saveMinuteKeys(s.config.clock().Now())
+	}
+	go func() {
+		s.readErr = readLoop(s.sock, s.bufs, s.packetIn, s.acceptErr, s.closing, config.onForeignPacket())
+		if isClosed(s.closing) {
+			s.readErr = &net.OpError{Op: "accept", Net: "curvecp", Addr: s.Addr(), Err: net.ErrClosed}
+			if !ownSock {
+				// Hand the socket back as we found it.
+				s.sock.SetReadDeadline(time.Time{})
+			}
+		}
+		close(s.readDone)
+	}()
 	go s.pump()
 	return s
 }
 
 // Listen announces on the CurveCP address laddr and returns a CurveCP
 // listener.
-func Listen(laddr string, key []byte) (net.Listener, error) {
+func Listen(laddr string, key []byte) (Listener, error) {
+	return ListenWithConfig(laddr, key, nil)
+}
+
+// ListenWithConfig is like Listen, but the returned listener's
+// connections use the given configuration. config may be nil.
+func ListenWithConfig(laddr string, key []byte, config *Config) (Listener, error) {
 	addr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, err
@@ -100,7 +264,11 @@ func Listen(laddr string, key []byte) (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newServer(sock, key), nil
+	if err = config.setupSocket(sock); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return newServer(sock, true, key, config), nil
 }
 
 // ListenUDPConn is similar to Listen, but takes an already existing
@@ -110,38 +278,140 @@ func Listen(laddr string, key []byte) (net.Listener, error) {
 // The main use of ListenUDPConn is to first execute a NAT-busting
 // protocol on the UDPConn, and then use CurveCP to communicate with
 // the peer.
-func ListenUDPConn(sock *net.UDPConn, key []byte) (net.Listener, error) {
+func ListenUDPConn(sock *net.UDPConn, key []byte) (Listener, error) {
+	return ListenUDPConnWithConfig(sock, key, nil)
+}
+
+// ListenUDPConnWithConfig is like ListenUDPConn, but the returned
+// listener's connections use the given configuration. config may be
+// nil.
+func ListenUDPConnWithConfig(sock *net.UDPConn, key []byte, config *Config) (Listener, error) {
+	return ListenPacketConn(sock, key, config)
+}
+
+// ListenPacketConn is like ListenUDPConnWithConfig, but over any
+// net.PacketConn, for transports other than UDP: tunnels, test
+// harnesses, and the like. Socket options in config only apply to a
+// *net.UDPConn, and on other transports the listener's Addr has a nil
+// UDP address. Closing the listener stops its reads from sock with a
+// read deadline in the past, which sock must honor.
+func ListenPacketConn(sock net.PacketConn, key []byte, config *Config) (Listener, error) {
 	sock.SetDeadline(time.Time{})
-	return newServer(sock, key), nil
+	if udp, ok := sock.(*net.UDPConn); ok {
+		if err := config.setupSocket(udp); err != nil {
+			return nil, err
+		}
+	}
+	return newServer(sock, false, key, config), nil
 }
 
-// Accept waits for and returns the next connection to the listener.
+// Accept waits for and returns the next connection to the
+// listener, a *Conn. Errors are net.Errors, and Temporary() reports
+// whether it's worth calling Accept again.
 func (s *server) Accept() (net.Conn, error) {
-	conn, ok := <-s.newConn
-	if !ok {
-		return nil, errors.New("Listener closed")
+	c, err := s.AcceptCurveCP()
+	if err != nil {
+		return nil, err
 	}
-	return conn, nil
+	return c, nil
 }
 
+// AcceptCurveCP is like Accept, but returns a *Conn.
+func (s *server) AcceptCurveCP() (*Conn, error) {
+	select {
+	case conn, ok := <-s.newConn:
+		if !ok {
+			return nil, &net.OpError{Op: "accept", Net: "curvecp", Addr: s.Addr(), Err: net.ErrClosed}
+		}
+		return conn, nil
+	case err := <-s.acceptErr:
+		return nil, err
+	case <-s.acceptDeadline.wait():
+		return nil, &net.OpError{Op: "accept", Net: "curvecp", Addr: s.Addr(), Err: deadlineExceeded}
+	case <-s.readDone:
+		return nil, s.readErr
+	}
+}
+
+func (s *server) SetDeadline(t time.Time) error {
+	s.acceptDeadline.set(t)
+	return nil
+}
+
+// Close stops accepting new connections. Established connections
+// carry on, and the socket is released once the last of them ends:
+// closed if Listen created it, otherwise left for its owner.
 func (s *server) Close() error {
-	s.stopListen <- struct{}{}
+	select {
+	case s.stopListen <- struct{}{}:
+	case <-s.released:
+	}
 	return nil
 }
 
+// Shutdown closes the listener gracefully, see Listener.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.Close()
+	select {
+	case <-s.released:
+		return nil
+	case <-ctx.Done():
+	}
+	select {
+	case s.abortConns <- struct{}{}:
+	case <-s.released:
+	}
+	// Aborting doesn't wait for the peers.
+	<-s.released
+	return ctx.Err()
+}
+
+// Addr returns the listener's address, including its public key. It
+// is an *Addr.
 func (s *server) Addr() net.Addr {
-	return s.sock.LocalAddr()
+	udp, _ := s.sock.LocalAddr().(*net.UDPAddr)
+	return &Addr{udp, s.PublicKey()}
 }
 
-func readLoop(sock *net.UDPConn, packetIn chan<- packet) {
-	pb := freelist.Packets.Get()
+// PublicKey returns the current long-term public key, see
+// Config.KeyProvider.
+func (s *server) PublicKey() []byte {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	return append([]byte(nil), s.publicKey[:]...)
+}
+
+func (s *server) Fingerprint() string {
+	return Fingerprint(s.PublicKey())
+}
+
+// readLoop reads packets from sock into buffers from bufs and sends
+// them to packetIn, until a non-temporary error occurs, which it
+// returns. Temporary errors are reported to temporaryErr without
+// blocking. If foreign isn't nil, it gets the packets that aren't from
+// CurveCP clients, which it must not keep.
+func readLoop(sock net.PacketConn, bufs *bufpool.Pool, packetIn chan<- packet, temporaryErr chan<- error, stop <-chan struct{}, foreign func([]byte, net.Addr)) error {
+	pb := bufs.Get()
 	for {
-		// CurveCP datagrams are specified to always fit in the
-		// smallest IPv6 datagram, 1280 bytes.
 		n, addr, err := sock.ReadFrom(pb)
 		if err != nil {
-			// TODO: possibly be more discerning about when to return.
-			return
+			select {
+			case <-stop:
+				return net.ErrClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case temporaryErr <- err:
+				default:
+				}
+				continue
+			}
+			return err
+		}
+		if foreign != nil && !hasClientMagic(pb[:n]) {
+			foreign(pb[:n], addr)
+			continue
 		}
 		if n < 64 {
 			// Packet too small to be any CurveCP packet, discard.
@@ -149,224 +419,557 @@ func readLoop(sock *net.UDPConn, packetIn chan<- packet) {
 		}
 
 		pb = pb[:n]
-		// messageMagic first, since it's the most common.
-		packetIn <- packet{addr, pb}
-		pb = freelist.Packets.Get()
+		packetIn <- packet{addr, pb, bufs}
+		pb = bufs.Get()
 	}
 }
 
 func (s *server) pump() {
-	rotateMinuteKey := time.NewTicker(30 * time.Second)
+	rotateMinuteKey := s.config.clock().NewTicker(s.config.minuteKeyInterval())
+	// Runs while some conns are too busy to take their packets.
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	readDone := s.readDone
+	var reapTick <-chan time.Time
+	if every := s.reapInterval(); every > 0 {
+		reap := s.config.clock().NewTicker(every)
+		defer reap.Stop()
+		reapTick = reap.C()
+	}
 
 	for {
+		// Offer the oldest queued conn to Accept.
+		var accept chan *Conn
+		var next *Conn
+		if len(s.acceptQueue) > 0 {
+			accept, next = s.newConn, s.acceptQueue[0]
+		}
+
 		select {
 		case packet := <-s.packetIn:
-			if s.checkHello(packet.buf) {
-				resp := freelist.Packets.Get()
-				resp, scratch := resp[:200], resp[200:]
-
-				pkey, skey, err := box.GenerateKey(rand.Reader)
-				if err != nil {
-					panic("Ran out of randomness")
+			if !s.config.filterPacket(packet.Addr, packet.buf) {
+				s.filtered++
+				packet.release()
+				break
+			}
+			if !isClientMessage(packet.buf) {
+				s.rotateKeys(s.config.clock().Now())
+			}
+			if !wellFormed(packet.buf) {
+				s.handshakeFailed(HandshakeMalformed, packet.Addr)
+				packet.release()
+			} else if isClientMessage(packet.buf) {
+				// Messages first, they're the most common.
+				if q, ok := s.conns[string(packet.buf[40:40+32])]; ok {
+					// The conn does the decryption.
+					s.establish(q)
+					s.enqueue(q, packet)
+				} else {
+					packet.release()
 				}
-
-				// Client short-term public key
-				copy(scratch, packet.buf[40:40+32])
-				// Server short-term secret key
-				copy(scratch[32:], skey[:])
-
-				// minute-key secretbox nonce
-				var nonce [24]byte
-				copy(nonce[:], minuteNoncePrefix)
-				randBytes(nonce[len(minuteNoncePrefix):])
-
-				secretbox.Seal(scratch[:64], scratch[:64], &nonce, &s.minuteKey)
-
-				// Compressed cookie nonce
-				copy(scratch[48:64], nonce[len(minuteNoncePrefix):])
-				// Server short-term public key
-				copy(scratch[16:48], pkey[:])
-
+			} else if isHello(packet.buf) && !s.allowCookie(packet.Addr, s.config.clock().Now()) {
+				s.cookiesLimited++
+				packet.release()
+			} else if key := s.checkHello(packet); key != nil {
+				pkey, skey := generateKey()
 				var clientKey [32]byte
 				copy(clientKey[:], packet.buf[40:40+32])
+				var minuteNonce, nonce [16]byte
+				randBytes(minuteNonce[:])
+				cookie := handshake.NewCookie(&clientKey, &skey, s.currentMinuteKey(), &minuteNonce)
+				s.config.longTermNonce(nonce[:])
 
-				// Cookie box nonce
-				copy(nonce[:], cookieNoncePrefix)
-				randBytes(nonce[len(cookieNoncePrefix):])
+				resp := handshake.SealCookie(s.bufs.Get()[:0], packet.buf, &key.secret, &pkey, cookie, &nonce)
+				s.reply(resp, packet)
+				s.bufs.Put(resp)
 
-				box.Seal(resp[:56], scratch[16:16+128], &nonce, &clientKey, &s.longTermSecretKey)
-
-				// Packet header, with extensions swapped.
-				copy(resp, cookieMagic)
-				copy(resp[8:], packet.buf[24:24+16])
-				copy(resp[24:], packet.buf[8:8+16])
-				copy(resp[40:], nonce[8:])
-
-				s.sock.WriteTo(resp, packet.Addr)
-				freelist.Packets.Put(resp)
-
-			} else if serverShortTermKey, domain, valid := s.checkInitiate(packet.buf); valid {
+			} else if serverShortTermKey, domain, valid := s.checkInitiate(packet); valid {
 				clientShortTermKey := packet.buf[40 : 40+32]
 				clientLongTermKey := packet.buf[176 : 176+32]
-				if ch, ok := s.conns[string(clientShortTermKey)]; ok {
+				if q, ok := s.conns[string(clientShortTermKey)]; ok {
 					// Forward the Initiate to the conn. Because
 					// checkInitiate replaces the box in the Initiate
 					// packet with its plaintext, and because pump has
 					// done all the crypto verification, conn can
 					// ignore anything not relevant to maintaining
 					// correct stream state.
-					ch <- packet
+					s.enqueue(q, packet)
+				} else if s.listen && (s.config.revoked(clientLongTermKey) || s.config.verifyPeer(clientLongTermKey, domain, packet.Addr) != nil) {
+					s.rejected++
+					packet.release()
+				} else if s.listen && s.cookieUsed(packet.buf) {
+					s.cookieReplays++
+					packet.release()
+				} else if s.listen && s.atCapacity() {
+					packet.release()
+				} else if s.listen && s.hostFull(packet.Addr) {
+					s.hostLimited++
+					packet.release()
+				} else if s.listen && s.routeFull(domain) {
+					s.overflow(deferredInitiate{packet, serverShortTermKey, domain})
 				} else if s.listen {
-					// This is a new client initiating. Construct a
-					// conn and wait for someone to Accept() it.
-					c := newConn(s.sock, clientLongTermKey, clientShortTermKey, serverShortTermKey, domain)
-					// TODO: accept timeout or something.
-					s.newConn <- c
-					s.conns[string(clientShortTermKey)] = c.packetIn
+					s.newClient(packet, serverShortTermKey, domain)
+				} else {
+					packet.release()
 				}
 			}
 
+		case accept <- next:
+			s.acceptQueue[0] = nil
+			s.acceptQueue = s.acceptQueue[1:]
+			s.undefer()
+
+		case key := <-s.endConn:
+			s.forget(key)
+			s.release()
+
 		case <-s.stopListen:
-			s.listen = false
-			close(s.newConn)
+			s.stopListening()
+			s.release()
 			// We hang onto the long term secret key and minute keys
 			// for one full minute key rotation, so that we can still
 			// decode retransmitted Initiate packets for a while. The
 			// rotateMinuteKey case below will take care of final
 			// cleanup.
 
-		case <-rotateMinuteKey.C:
+		case now := <-reapTick:
+			s.reap(now)
+
+		case <-s.abortConns:
+			for _, q := range s.conns {
+				go q.conn.Abort()
+			}
+
+		case <-readDone:
+			readDone = nil
+			if isClosed(s.closing) {
+				s.clearKeys()
+				rotateMinuteKey.Stop()
+				close(s.released)
+				return
+			}
+
+		case <-rotateMinuteKey.C():
 			if !s.listen && bytes.Equal(s.minuteKey[:], s.prevMinuteKey[:]) {
-				// At least 30 seconds have passed since we stopped
+				// At least one rotation has passed since we stopped
 				// listening, we can clear the key material and stop
 				// refreshing minute keys.
-				for i := 0; i < len(s.longTermSecretKey); i++ {
-					s.minuteKey[i] = 0
-					s.prevMinuteKey[i] = 0
-					s.longTermSecretKey[i] = 0
-				}
+				s.clearKeys()
 				rotateMinuteKey.Stop()
 			} else {
+				s.forgetCookies(s.config.clock().Now())
 				copy(s.prevMinuteKey[:], s.minuteKey[:])
 				if s.listen {
 					randBytes(s.minuteKey[:])
+					s.saveMinuteKeys(s.config.clock().Now())
 				}
 			}
+
+		case <-retry.C:
+		}
+
+		if s.service() {
+			retry.Reset(serviceRetry)
 		}
 	}
 }
 
-func (s *server) checkHello(pb []byte) bool {
-	if !s.listen || len(pb) != 224 || !bytes.Equal(pb[:8], helloMagic) {
-		return false
+// newClient starts a conn for the client whose Initiate is p, and
+// queues it for Accept.
+func (s *server) newClient(p packet, serverShortTermKey []byte, domain string) {
+	clientShortTermKey := p.buf[40 : 40+32]
+	clientLongTermKey := p.buf[176 : 176+32]
+	header := make([]byte, 40)
+	copy(header, serverMessageMagic)
+	copy(header[8:], p.buf[24:24+16])
+	copy(header[24:], p.buf[8:8+16])
+	c := newConn(s.sock, p.Addr, header, false, clientLongTermKey, clientShortTermKey, serverShortTermKey, domain, s.config)
+	c.bufs = s.bufs
+	c.initialData = initiateData(p.buf)
+	key := string(clientShortTermKey)
+	c.onClose = func() {
+		// Don't hold up the conn's teardown on the pump.
+		go func() { s.endConn <- key }()
 	}
+	go c.pump()
+	q := &connQueue{conn: c, ch: c.packetIn, created: s.config.clock().Now()}
+	s.conns[key] = q
+	s.addHost(q, p.Addr)
+	s.useCookie(p.buf)
+	// The Initiate's message is the start of the stream, the conn
+	// must see it like any other.
+	s.enqueue(q, p)
+	s.route(c, domain)
+}
 
-	var clientKey [32]byte
-	copy(clientKey[:], pb[40:40+32])
+// overflow handles the Initiate of a new client arriving while the
+// accept backlog is full, according to Config.BacklogPolicy. Only
+// Accept's backlog defers Initiates, those of Handle listeners drop
+// them.
+func (s *server) overflow(d deferredInitiate) {
+	if s.config.backlogPolicy() == BacklogDefer && len(s.deferred) < s.config.acceptBacklog() && s.handler(d.domain) == nil {
+		key := d.buf[40 : 40+32]
+		for _, held := range s.deferred {
+			if bytes.Equal(held.buf[40:40+32], key) {
+				// A retransmission, the first one will do.
+				d.release()
+				return
+			}
+		}
+		s.deferred = append(s.deferred, d)
+		return
+	}
+	s.overflowed++
+	d.release()
+}
 
-	var nonce [24]byte
-	copy(nonce[:], helloNoncePrefix)
-	copy(nonce[len(helloNoncePrefix):], pb[136:136+8])
+// undefer starts the connections of deferred Initiates, as far as
+// the accept backlog has room for them.
+func (s *server) undefer() {
+	for len(s.deferred) > 0 && len(s.acceptQueue) < s.config.acceptBacklog() {
+		d := s.deferred[0]
+		s.deferred[0] = deferredInitiate{}
+		s.deferred = s.deferred[1:]
+		if _, ok := s.conns[string(d.buf[40:40+32])]; ok || s.atCapacity() || s.hostFull(d.Addr) {
+			d.release()
+			continue
+		}
+		s.newClient(d.packet, d.serverShortTermKey, d.domain)
+	}
+}
 
-	var out [64]byte
-	_, ok := box.Open(out[:0], pb[144:], &nonce, &clientKey, &s.longTermSecretKey)
-	return ok
+// release stops readLoop once the server has stopped listening and
+// its last connection has ended, closing the socket if it's the
+// server's own.
+func (s *server) release() {
+	if s.listen || len(s.conns) > 0 || isClosed(s.closing) {
+		return
+	}
+	close(s.closing)
+	if s.ownSock {
+		s.sock.Close()
+	} else {
+		s.sock.SetReadDeadline(time.Unix(1, 0))
+	}
 }
 
-// If valid == true, pb[176:] is replaced by the plaintext contents of
-// the Initiate C'->S' box.
-func (s *server) checkInitiate(pb []byte) (serverShortTermKey []byte, domain string, valid bool) {
-	valid = false
-	if len(pb) < 544 || !bytes.Equal(pb[:8], initiateMagic) {
+// clearKeys wipes the server's key material.
+func (s *server) clearKeys() {
+	for i := range s.minuteKey {
+		s.minuteKey[i] = 0
+		s.prevMinuteKey[i] = 0
+	}
+	for _, k := range s.keys {
+		for i := range k.secret {
+			k.secret[i] = 0
+		}
+		k.vouchKeys = newKeyCache(0)
+	}
+}
+
+// stopListening stops accepting new connections, and drops the ones
+// waiting for Accept.
+func (s *server) stopListening() {
+	if !s.listen {
 		return
 	}
+	s.listen = false
+	close(s.newConn)
+	// Nobody will accept the queued conns.
+	for _, c := range s.acceptQueue {
+		go c.Abort()
+	}
+	s.acceptQueue = nil
+	for _, d := range s.deferred {
+		d.release()
+	}
+	s.deferred = nil
+	s.closeRoutes()
+}
 
-	// Try to open the cookie.
-	var nonce [24]byte
-	copy(nonce[:], minuteNoncePrefix)
-	copy(nonce[len(minuteNoncePrefix):], pb[72:72+16])
+// reapInterval returns how often reap should run, or 0 for never.
+func (s *server) reapInterval() time.Duration {
+	every := s.config.halfOpenTimeout()
+	if silent := s.config.silentTimeout(); every == 0 || silent > 0 && silent < every {
+		every = silent
+	}
+	return every / 4
+}
 
-	var cookie [64]byte
-	if _, ok := secretbox.Open(cookie[:0], pb[88:168], &nonce, &s.minuteKey); !ok {
-		if _, ok = secretbox.Open(cookie[:0], pb[88:168], &nonce, &s.prevMinuteKey); !ok {
-			return
+// reap times out the conns whose client never got past the Initiate
+// within Config.HalfOpenTimeout, and those that have been silent for
+// longer than Config.SilentTimeout, so that clients that vanish, or
+// a flood of Initiates, can't pile up conns.
+func (s *server) reap(now time.Time) {
+	halfOpen, silent := s.config.halfOpenTimeout(), s.config.silentTimeout()
+	for _, q := range s.conns {
+		if q.expired {
+			continue
+		}
+		if !q.established && halfOpen > 0 && now.Sub(q.created) > halfOpen ||
+			q.established && silent > 0 && now.Sub(q.lastSeen) > silent {
+			q.expired = true
+			s.reaped++
+			go q.conn.expire()
 		}
 	}
+}
+
+// cookieUsed reports whether the Cookie in the Initiate pb already
+// started a conn, under Config.SingleUseCookies.
+func (s *server) cookieUsed(pb []byte) bool {
+	var nonce [16]byte
+	copy(nonce[:], pb[72:72+16])
+	_, ok := s.usedCookies[nonce]
+	return ok
+}
 
-	// Check that the cookie and client match
-	if !bytes.Equal(cookie[:32], pb[40:40+32]) {
+// useCookie remembers the Cookie in the Initiate pb, under
+// Config.SingleUseCookies. A Cookie is good until the minute key after
+// the one that sealed it replaces it, two rotations at most.
+func (s *server) useCookie(pb []byte) {
+	if !s.config.singleUseCookies() {
 		return
 	}
+	if s.usedCookies == nil {
+		s.usedCookies = make(map[[16]byte]time.Time)
+	}
+	var nonce [16]byte
+	copy(nonce[:], pb[72:72+16])
+	s.usedCookies[nonce] = s.config.clock().Now().Add(2 * s.config.minuteKeyInterval())
+}
 
-	// Extract server short-term secret key
-	var serverKey [32]byte
-	serverShortTermKey = serverKey[:]
-	copy(serverShortTermKey, cookie[32:])
-
-	// Open the Initiate box using both short-term secret keys.
-	copy(nonce[:], initiateNoncePrefix)
-	copy(nonce[len(initiateNoncePrefix):], pb[168:168+8])
+// forgetCookies forgets the used Cookies that are no longer good.
+func (s *server) forgetCookies(now time.Time) {
+	for nonce, expiry := range s.usedCookies {
+		if now.After(expiry) {
+			delete(s.usedCookies, nonce)
+		}
+	}
+}
 
-	var clientShortTermKey [32]byte
-	copy(clientShortTermKey[:], pb[40:40+32])
+// atCapacity reports whether the server handles as many connections
+// as it may.
+func (s *server) atCapacity() bool {
+	max := s.config.maxConns()
+	return max > 0 && len(s.conns) >= max
+}
 
-	initiate := make([]byte, len(pb[176:])-box.Overhead)
-	if _, ok := box.Open(initiate[:0], pb[176:], &nonce, &clientShortTermKey, &serverKey); !ok {
+// enqueue queues p for the conn of q, dropping it if the conn is too
+// far behind.
+func (s *server) enqueue(q *connQueue, p packet) {
+	q.lastSeen = s.config.clock().Now()
+	if len(q.pending) >= maxConnBacklog {
+		p.release()
 		return
 	}
+	q.pending = append(q.pending, p)
+	if q.elem == nil {
+		q.elem = s.ready.PushBack(q)
+	}
+}
 
-	if domain = domainToString(initiate[96 : 96+256]); domain == "" {
+// forget drops the conn with the given short-term key, and the
+// packets still queued for it.
+func (s *server) forget(key string) {
+	q, ok := s.conns[key]
+	if !ok {
 		return
 	}
+	delete(s.conns, key)
+	s.removeHost(q)
+	if q.elem != nil {
+		s.ready.Remove(q.elem)
+	}
+	for _, p := range q.pending {
+		p.release()
+	}
+	// The conn drained its channel when it ended, but may have been
+	// handed more since.
+	for {
+		select {
+		case p := <-q.ch:
+			p.release()
+		default:
+			return
+		}
+	}
+}
 
-	// Extract client long-term public key and check the vouch
-	// subpacket.
-	var clientLongTermKey [32]byte
-	copy(clientLongTermKey[:], initiate[:32])
+// service hands queued packets over to their conns, round-robin, up to
+// connQuantum packets per conn, so that a conn busy with a bulk
+// transfer can't hold up the others. Conns too busy to take a packet
+// are skipped until the next turn. Returns true if packets are still
+// waiting.
+func (s *server) service() bool {
+	for n := s.ready.Len(); n > 0; n-- {
+		q := s.ready.Front().Value.(*connQueue)
+		sent := 0
+	quantum:
+		for sent < connQuantum && sent < len(q.pending) {
+			select {
+			case q.ch <- q.pending[sent]:
+				sent++
+			default:
+				break quantum
+			}
+		}
+		q.pending = q.pending[:copy(q.pending, q.pending[sent:])]
+		if len(q.pending) == 0 {
+			s.ready.Remove(q.elem)
+			q.elem = nil
+		} else {
+			s.ready.MoveToBack(q.elem)
+		}
+	}
+	return s.ready.Len() > 0
+}
 
-	copy(nonce[:], vouchNoncePrefix)
-	copy(nonce[len(vouchNoncePrefix):], initiate[32:32+16])
+func isClientMessage(pb []byte) bool {
+	return bytes.Equal(pb[:8], clientMessageMagic)
+}
 
-	var vouch [32]byte
-	if _, ok := box.Open(vouch[:0], initiate[48:48+48], &nonce, &clientLongTermKey, &s.longTermSecretKey); !ok {
-		return
+// wellFormed returns true if pb, a packet from a client, has the
+// length its magic calls for, and Hellos their zero padding. Packets
+// of unknown type are not well formed either.
+func wellFormed(pb []byte) bool {
+	switch {
+	case bytes.Equal(pb[:8], helloMagic):
+		return len(pb) == 224 && allZero(pb[72:136])
+	case bytes.Equal(pb[:8], initiateMagic):
+		// 544 bytes and the message, at most
+		// maxInitiateMessageLen.
+		return len(pb) >= 544 && len(pb) <= 544+maxInitiateMessageLen && len(pb)%16 == 0
+	case bytes.Equal(pb[:8], clientMessageMagic):
+		return validMessagePacket(pb, 96)
 	}
+	return false
+}
 
-	if !bytes.Equal(vouch[:], pb[40:40+32]) {
+// reply sends resp to the source of req, which the server can't yet
+// tell isn't spoofed. resp is never larger than req, so that the
+// server is no use for amplifying a flood of packets to someone
+// else.
+func (s *server) reply(resp []byte, req packet) {
+	if len(resp) > len(req.buf) {
 		return
 	}
+	s.sock.WriteTo(resp, req.Addr)
+}
 
-	// The Initiate packet is valid, replace the encrypted box with
-	// the plaintext and return.
-	copy(pb[176:], initiate)
-	for i := len(pb) - box.Overhead; i < len(pb); i++ {
-		pb[i] = 0
+// hasClientMagic reports whether pb starts with the magic of a packet
+// from a client.
+func hasClientMagic(pb []byte) bool {
+	if len(pb) < 8 {
+		return false
 	}
-	valid = true
+	magic := pb[:8]
+	return bytes.Equal(magic, helloMagic) || bytes.Equal(magic, initiateMagic) || bytes.Equal(magic, clientMessageMagic)
+}
 
-	return
+// isHello reports whether pb looks like a Hello, without checking
+// anything cryptographic.
+func isHello(pb []byte) bool {
+	return len(pb) == 224 && bytes.Equal(pb[:8], helloMagic)
 }
 
-// Returns empty string if the domain isn't valid.
-func domainToString(d []byte) string {
-	var ret []string
-	for len(d) > 0 {
-		l := int(d[0])
-		if l == 0 {
-			return strings.Join(ret, ".")
+// checkHello returns the long-term key the Hello p is boxed to, or
+// nil if it's not a valid Hello.
+func (s *server) checkHello(p packet) *longTermKey {
+	pb := p.buf
+	if !s.listen || !isHello(pb) {
+		return nil
+	}
+
+	for _, k := range s.keys {
+		if k.initiatesOnly {
+			continue
 		}
-		if l > 63 || l > len(d)-1 {
-			return ""
+		if _, err := handshake.OpenHello(pb, &k.secret); err == nil {
+			return k
 		}
+	}
+	s.handshakeFailed(HandshakeBadHello, p.Addr)
+	return nil
+}
+
+func allZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInitiate reports whether p is a valid Initiate. If it is,
+// pb[176:] is replaced by the plaintext contents of the Initiate
+// C'->S' box.
+func (s *server) checkInitiate(p packet) (serverShortTermKey []byte, domain string, valid bool) {
+	pb := p.buf
+	ini, err := handshake.OpenInitiate(pb, s.currentMinuteKey(), s.previousMinuteKey())
+	switch err {
+	case nil:
+	case handshake.ErrMalformed:
+		return nil, "", false
+	case handshake.ErrBadCookie:
+		s.handshakeFailed(HandshakeBadCookie, p.Addr)
+		return nil, "", false
+	case handshake.ErrBadDomain:
+		s.handshakeFailed(HandshakeBadDomain, p.Addr)
+		return nil, "", false
+	default:
+		s.handshakeFailed(HandshakeBadInitiate, p.Addr)
+		return nil, "", false
+	}
+	if _, proto := SplitProtocolDomain(ini.Domain); !s.config.acceptsProtocol(proto) {
+		s.handshakeFailed(HandshakeBadDomain, p.Addr)
+		return nil, "", false
+	}
+
+	// Any of the long-term keys will do, the client may have got its
+	// Cookie before the last rotation.
+	var vouchedUnder *longTermKey
+	for _, k := range s.keys {
+		vouchKey := k.vouchKeys.get(&ini.ClientLongTermKey, &k.secret)
+		if ini.Vouched(&vouchKey) {
+			vouchedUnder = k
+			break
+		}
+	}
+	if vouchedUnder == nil {
+		s.handshakeFailed(HandshakeBadVouch, p.Addr)
+		return nil, "", false
+	}
+	if !s.servesDomain(vouchedUnder, ini.Domain) {
+		s.handshakeFailed(HandshakeBadDomain, p.Addr)
+		return nil, "", false
+	}
+
+	// The Initiate packet is valid, its plaintext replaced the box,
+	// clear what's left of it.
+	for i := len(pb) - box.Overhead; i < len(pb); i++ {
+		pb[i] = 0
+	}
+	return ini.ServerShortTermSecret[:], ini.Domain, true
+}
 
-		ret = append(ret, string(d[1:l+1]))
-		d = d[l+1:]
+// initiateData returns a copy of the stream data carried by a
+// verified Initiate packet, if it starts the stream.
+func initiateData(pb []byte) []byte {
+	var m message
+	if !m.unmarshal(pb[528:len(pb)-box.Overhead]) || m.pos != 0 || len(m.data) == 0 {
+		return nil
 	}
-	return strings.Join(ret, ".")
+	return append([]byte(nil), m.data...)
 }
 
+// randReader is where keys and nonces come from. Tests replace it to
+// make packets reproducible.
+var randReader io.Reader = rand.Reader
+
 func randBytes(b []byte) {
-	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+	if _, err := io.ReadFull(randReader, b); err != nil {
 		panic("Ran out of randomness")
 	}
 }
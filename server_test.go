@@ -0,0 +1,693 @@
+package curvecp
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestAcceptErrors(t *testing.T) {
+	_, key, _ := box.GenerateKey(rand.Reader)
+
+	// Closing the listener is fatal, and says so.
+	l, err := Listen("127.0.0.1:0", key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, err = l.Accept()
+	if ne, ok := err.(net.Error); !ok || ne.Temporary() || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept on closed listener = %v, want a non-temporary net.ErrClosed", err)
+	}
+
+	// So is losing the socket.
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = ListenUDPConn(sock, key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock.Close()
+	_, err = l.Accept()
+	if ne, ok := err.(net.Error); !ok || ne.Temporary() {
+		t.Errorf("Accept on closed socket = %v, want a non-temporary net.Error", err)
+	}
+}
+
+func TestAcceptDeadline(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	_, err = l.Accept()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Accept past deadline = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Accept deadline took %s", d)
+	}
+
+	// Clearing the deadline lets Accept wait again.
+	l.SetDeadline(time.Time{})
+	go func() {
+		c, err := Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+		if err == nil {
+			c.Write([]byte("hi"))
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept without deadline = %v", err)
+	}
+	io.ReadFull(c, make([]byte, 2))
+	c.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		l, err := Listen("127.0.0.1:0", priv[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Abort()
+		c.Write([]byte("hi"))
+		sc, err := l.AcceptCurveCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		timeout := 10 * time.Second
+		if force {
+			timeout = 200 * time.Millisecond
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shutdown := make(chan error)
+		go func() { shutdown <- l.Shutdown(ctx) }()
+
+		if !force {
+			// Shutdown waits for the established connection.
+			select {
+			case err := <-shutdown:
+				t.Fatalf("Shutdown = %v with a connection open", err)
+			case <-time.After(200 * time.Millisecond):
+			}
+			sc.Abort()
+		}
+		select {
+		case err = <-shutdown:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown didn't return")
+		}
+		if force && err != context.DeadlineExceeded {
+			t.Errorf("Shutdown past its deadline = %v, want context.DeadlineExceeded", err)
+		} else if !force && err != nil {
+			t.Errorf("Shutdown = %v", err)
+		}
+		select {
+		case <-sc.done:
+		default:
+			t.Errorf("connection still open after Shutdown")
+		}
+		if _, err := l.Accept(); err == nil {
+			t.Errorf("Accept after Shutdown succeeded")
+		}
+		if _, err := l.(*server).sock.WriteTo([]byte("x"), l.Addr().(*Addr).UDP); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("socket still open after Shutdown, WriteTo = %v", err)
+		}
+		l.Close()
+	}
+}
+
+func TestCloseReleasesSocket(t *testing.T) {
+	_, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	<-l.(*server).released
+	laddr := l.Addr().(*Addr).UDP
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("port still bound after Close: %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+
+	// A socket the listener was given goes back to its owner, open.
+	l, err = ListenUDPConn(sock, priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	<-l.(*server).released
+	sock.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := sock.ReadFrom(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom on released socket = %v, want a timeout", err)
+	}
+	sock.Close()
+}
+
+func TestInitiateData(t *testing.T) {
+	// Verified Initiates carry their plaintext in place of the box,
+	// the message starting at 528.
+	var buf [1280]byte
+	m := (&message{id: 1, data: []byte("GET /")}).marshal(buf[528:])
+	pb := buf[:528+len(m)+box.Overhead]
+	if got := initiateData(pb); string(got) != "GET /" {
+		t.Errorf("initiateData = %q, want %q", got, "GET /")
+	}
+
+	// Data not at the start of the stream doesn't count.
+	m = (&message{id: 1, pos: 10, data: []byte("GET /")}).marshal(buf[528:])
+	pb = buf[:528+len(m)+box.Overhead]
+	if got := initiateData(pb); got != nil {
+		t.Errorf("initiateData with pos 10 = %q, want nil", got)
+	}
+
+	// No message at all.
+	if got := initiateData(buf[:544]); got != nil {
+		t.Errorf("initiateData without message = %q, want nil", got)
+	}
+}
+
+func TestServiceRoundRobin(t *testing.T) {
+	s := &server{ready: list.New()}
+	bulk := &connQueue{ch: make(chan packet, connQuantum)}
+	interactive := &connQueue{ch: make(chan packet, connQuantum)}
+	for i := 0; i < 3*connQuantum; i++ {
+		s.enqueue(bulk, packet{buf: []byte{1}})
+	}
+	s.enqueue(interactive, packet{buf: []byte{2}})
+
+	// The bulk conn only gets a quantum, and its pump isn't keeping
+	// up, but the interactive conn gets its packet anyway.
+	if !s.service() {
+		t.Error("service() = false with packets still queued")
+	}
+	if len(bulk.ch) != connQuantum || len(interactive.ch) != 1 {
+		t.Errorf("handed over %d and %d packets, want %d and 1", len(bulk.ch), len(interactive.ch), connQuantum)
+	}
+	if s.service(); len(bulk.pending) != 2*connQuantum {
+		t.Errorf("%d packets went to a full conn", 2*connQuantum-len(bulk.pending))
+	}
+	for len(bulk.ch) > 0 {
+		<-bulk.ch
+	}
+	s.service()
+	for len(bulk.ch) > 0 {
+		<-bulk.ch
+	}
+	if s.service() || len(bulk.ch) != connQuantum || s.ready.Len() != 0 {
+		t.Errorf("queues not drained after three turns")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{IdleTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s := (<-accepted).(*Conn)
+
+	// The client vanishes, without closing the connection.
+	c.sock.Close()
+	start := time.Now()
+	var rerr error
+	for rerr == nil {
+		_, rerr = s.Read(make([]byte, 10))
+	}
+	if rerr != ErrIdleTimeout {
+		t.Errorf("Read = %v, want ErrIdleTimeout", rerr)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle timeout took %s", d)
+	}
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Errorf("idle connection not torn down")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{
+		MaxConns:      1,
+		AcceptBacklog: 1,
+		ReadBuffer:    256 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *Conn, 2)
+	go func() {
+		for {
+			c, err := l.(*server).AcceptCurveCP()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	addr := l.Addr().(*Addr).UDP.String()
+
+	c1, err := Dial(addr, pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Abort()
+	c1.Write([]byte("one"))
+	s1 := <-accepted
+
+	// The server is full, and ignores the second client's Initiates
+	// until the first connection is gone.
+	c2, err := Dial(addr, pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Abort()
+	c2.Write([]byte("two"))
+	select {
+	case <-accepted:
+		t.Fatal("server accepted a connection past MaxConns")
+	case <-time.After(300 * time.Millisecond):
+	}
+	s1.Abort()
+	select {
+	case s2 := <-accepted:
+		s2.Abort()
+	case <-time.After(5 * time.Second):
+		t.Error("server didn't accept a connection once it had room")
+	}
+}
+
+func TestPacketFilter(t *testing.T) {
+	var mu sync.Mutex
+	banned := true
+	config := &Config{PacketFilter: func(addr net.Addr, magic []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(magic) != 8 {
+			t.Errorf("filter got %d bytes of magic", len(magic))
+		}
+		return !banned || !bytes.Equal(magic, helloMagic)
+	}}
+	addr, key := listenEcho(t, config)
+
+	if c, err := DialTimeout(addr, key, 300*time.Millisecond); err == nil {
+		c.Abort()
+		t.Fatal("Dial got through the filter")
+	}
+	mu.Lock()
+	banned = false
+	mu.Unlock()
+	c, err := Dial(addr, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 1000)
+}
+
+func TestForeignPackets(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	foreign := make(chan string, 10)
+	l, err := ListenUDPConnWithConfig(sock, priv[:], &Config{
+		OnForeignPacket: func(b []byte, addr net.Addr) {
+			foreign <- string(b)
+			// Answer on the shared socket.
+			sock.WriteTo([]byte("pong"), addr)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	peer, err := net.DialUDP("udp", nil, sock.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Write([]byte("ping"))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 10)
+	if n, err := peer.Read(b); err != nil || string(b[:n]) != "pong" {
+		t.Errorf("foreign protocol answer %q, %v", b[:n], err)
+	}
+	if got := <-foreign; got != "ping" {
+		t.Errorf("foreign packet %q, want ping", got)
+	}
+
+	// CurveCP carries on alongside.
+	c, err := Dial(sock.LocalAddr().String(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 1000)
+	if len(foreign) > 0 {
+		t.Errorf("CurveCP packet %q handed over as foreign", <-foreign)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	for _, policy := range []BacklogPolicy{BacklogDrop, BacklogDefer} {
+		pub, priv, _ := box.GenerateKey(rand.Reader)
+		l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{AcceptBacklog: 1, BacklogPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		addr := l.Addr().(*Addr).UDP.String()
+
+		c1, err := Dial(addr, pub[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c1.Abort()
+		c1.Write([]byte("one"))
+		s1, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(s1, s1)
+		io.ReadFull(c1, make([]byte, 3))
+
+		// Overflow the backlog, and don't accept anything: the
+		// established connection must keep going.
+		for i := 0; i < 3; i++ {
+			c, err := Dial(addr, pub[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Abort()
+			c.Write([]byte("more"))
+		}
+		testTransfer(t, c1, c1, 5000)
+
+		accepted := make(chan net.Conn)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- c
+			}
+		}()
+		for i := 0; i < 3; i++ {
+			select {
+			case c := <-accepted:
+				c.(*Conn).Abort()
+			case <-time.After(5 * time.Second):
+				t.Fatalf("policy %d: queued connection %d never accepted", policy, i)
+			}
+		}
+	}
+}
+
+func TestReap(t *testing.T) {
+	s := &server{
+		config: &Config{HalfOpenTimeout: time.Second, SilentTimeout: 2 * time.Second},
+		conns:  make(map[string]*connQueue),
+	}
+	now := time.Now()
+	for _, tc := range []struct {
+		name              string
+		created, lastSeen time.Duration
+		established       bool
+		expire            bool
+	}{
+		{"fresh half-open", -500 * time.Millisecond, 0, false, false},
+		{"stale half-open", -1500 * time.Millisecond, 0, false, true},
+		{"established", -time.Hour, -time.Second, true, false},
+		{"silent", -time.Hour, -3 * time.Second, true, true},
+	} {
+		c := &Conn{expireRequest: make(chan struct{}, 1)}
+		q := &connQueue{
+			conn:        c,
+			created:     now.Add(tc.created),
+			lastSeen:    now.Add(tc.lastSeen),
+			established: tc.established,
+		}
+		s.conns = map[string]*connQueue{"key": q}
+		s.reap(now)
+		if q.expired != tc.expire {
+			t.Errorf("%s conn: expired = %v, want %v", tc.name, q.expired, tc.expire)
+		}
+	}
+}
+
+func TestReapSilent(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{SilentTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hi"))
+	s, err := l.AcceptCurveCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.CopyN(s, s, 2)
+	io.ReadFull(c, make([]byte, 2))
+
+	// The client vanishes.
+	c.sock.Close()
+	var rerr error
+	for rerr == nil {
+		_, rerr = s.Read(make([]byte, 10))
+	}
+	if rerr != ErrIdleTimeout {
+		t.Errorf("Read on reaped conn = %v, want ErrIdleTimeout", rerr)
+	}
+}
+
+func TestSingleUseCookies(t *testing.T) {
+	s := &server{config: &Config{SingleUseCookies: true, MinuteKeyInterval: time.Minute}}
+	initiate := make([]byte, 544)
+	copy(initiate, initiateMagic)
+	rand.Read(initiate[72 : 72+16])
+	other := append([]byte(nil), initiate...)
+	other[72]++
+
+	if s.cookieUsed(initiate) {
+		t.Errorf("fresh Cookie used")
+	}
+	s.useCookie(initiate)
+	if !s.cookieUsed(initiate) {
+		t.Errorf("Cookie that started a conn not used")
+	}
+	if s.cookieUsed(other) {
+		t.Errorf("other Cookie used")
+	}
+	s.forgetCookies(time.Now().Add(time.Minute))
+	if !s.cookieUsed(initiate) {
+		t.Errorf("Cookie forgotten while still good")
+	}
+	s.forgetCookies(time.Now().Add(3 * time.Minute))
+	if s.cookieUsed(initiate) {
+		t.Errorf("Cookie remembered after it expired")
+	}
+
+	// Without SingleUseCookies, nothing is remembered.
+	s = &server{}
+	s.useCookie(initiate)
+	if s.cookieUsed(initiate) {
+		t.Errorf("Cookie used without SingleUseCookies")
+	}
+}
+
+func TestServerForget(t *testing.T) {
+	s := &server{conns: make(map[string]*connQueue), ready: list.New()}
+	q := &connQueue{ch: make(chan packet, 1)}
+	s.conns["key"] = q
+	q.ch <- packet{buf: make([]byte, packetSize)}
+	s.enqueue(q, packet{buf: make([]byte, packetSize)})
+	s.forget("key")
+	if len(s.conns) != 0 || s.ready.Len() != 0 {
+		t.Errorf("forgotten conn still has %d entries and %d queues", len(s.conns), s.ready.Len())
+	}
+	if len(q.ch) != 0 {
+		t.Errorf("forgotten conn still has %d packets in its channel", len(q.ch))
+	}
+}
+
+func TestEndedConnsForgotten(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(l.Addr().(*Addr).UDP.String(), pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Abort()
+	c.Write([]byte("hi"))
+	sc, err := l.AcceptCurveCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The closed listener lets go of its socket once it has
+	// forgotten the last conn.
+	l.Close()
+	sc.Abort()
+	select {
+	case <-l.(*server).released:
+	case <-time.After(2 * time.Second):
+		t.Error("ended conn not forgotten")
+	}
+}
+
+func TestWellFormed(t *testing.T) {
+	for _, tt := range []struct {
+		magic []byte
+		n     int
+		want  bool
+	}{
+		{helloMagic, 224, true},
+		{helloMagic, 240, false},
+		{initiateMagic, 544 + 48, true},
+		{initiateMagic, 544 + 50, false},
+		{initiateMagic, 544 + maxInitiateMessageLen + 16, false},
+		{clientMessageMagic, 96 + 48, true},
+		{clientMessageMagic, 96 + 8, false},
+		{cookieMagic, 200, false},
+	} {
+		pb := make([]byte, tt.n)
+		copy(pb, tt.magic)
+		if got := wellFormed(pb); got != tt.want {
+			t.Errorf("wellFormed(%s, %d bytes) = %v, want %v", tt.magic, tt.n, got, tt.want)
+		}
+	}
+
+	hello := make([]byte, 224)
+	copy(hello, helloMagic)
+	hello[100] = 1
+	if wellFormed(hello) {
+		t.Errorf("wellFormed accepts a Hello without its zero padding")
+	}
+}
+
+func TestReplyNoAmplification(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	s := &server{sock: sock}
+	s.reply(make([]byte, 200), packet{sock.LocalAddr(), make([]byte, 100), nil})
+	s.reply(make([]byte, 200), packet{sock.LocalAddr(), make([]byte, 224), nil})
+	sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := sock.ReadFrom(make([]byte, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 200 {
+		t.Errorf("got a %d byte reply", n)
+	}
+	sock.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := sock.ReadFrom(make([]byte, 300)); err == nil {
+		t.Errorf("reply larger than its request sent")
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	l, err := Listen("127.0.0.1:0", priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	saddr := l.Addr().(*Addr).UDP.String()
+	c, err := Dial(saddr, pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-accepted
+	if s == nil {
+		return
+	}
+	defer s.Close()
+
+	// The server's socket isn't connected, the conn knows where its
+	// client is. The client's socket is bound to the wildcard
+	// address, only the port tells.
+	got, _ := s.RemoteAddr().(*net.UDPAddr)
+	if want := c.LocalAddr().(*net.UDPAddr); got == nil || !got.IP.IsLoopback() || got.Port != want.Port {
+		t.Errorf("server side RemoteAddr() = %v, want port %d on loopback", s.RemoteAddr(), want.Port)
+	}
+	if got := c.RemoteAddr(); got == nil || got.String() != saddr {
+		t.Errorf("client side RemoteAddr() = %v, want %v", got, saddr)
+	}
+}
@@ -0,0 +1,159 @@
+package curvecp
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// A KeyProvider supplies a server's long-term secret key, and lets it
+// change while the server runs, see Config.KeyProvider.
+type KeyProvider interface {
+	// SecretKey returns the current long-term secret key. It's
+	// called from the server's packet loop for every handshake
+	// packet, and must be fast.
+	SecretKey() [32]byte
+}
+
+// A SwappableKey is a KeyProvider whose key can be replaced at any
+// time with Set.
+type SwappableKey struct {
+	mu  sync.Mutex
+	key [32]byte
+}
+
+// NewSwappableKey returns a SwappableKey holding key.
+func NewSwappableKey(key []byte) *SwappableKey {
+	k := &SwappableKey{}
+	k.Set(key)
+	return k
+}
+
+// Set replaces the key.
+func (k *SwappableKey) Set(key []byte) {
+	if len(key) != 32 {
+		panic("Wrong key length")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	copy(k.key[:], key)
+}
+
+func (k *SwappableKey) SecretKey() [32]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.key
+}
+
+// A RingKey is a long-term key a server honors besides its own, see
+// Config.KeyRing.
+type RingKey struct {
+	// SecretKey is the long-term secret key.
+	SecretKey []byte
+	// Until, if not zero, is when the server stops honoring the key.
+	Until time.Time
+}
+
+// A longTermKey is one of a server's long-term keys.
+type longTermKey struct {
+	secret, public [32]byte
+	// Keys shared with recently seen clients' long-term keys, to
+	// verify vouches.
+	vouchKeys *keyCache
+	// If not zero, when the server stops honoring the key.
+	retired time.Time
+	// For a key the server rotated away from: Hellos are no longer
+	// answered, only Initiates of handshakes already under way.
+	initiatesOnly bool
+	// For a virtual host's key, the one domain clients may request
+	// under it.
+	domain string
+}
+
+func newLongTermKey(secret [32]byte, cacheSize int) *longTermKey {
+	k := &longTermKey{secret: secret, vouchKeys: newKeyCache(cacheSize)}
+	curve25519.ScalarBaseMult(&k.public, &k.secret)
+	return k
+}
+
+// setKey makes secret the server's current long-term key.
+func (s *server) setKey(secret [32]byte) {
+	k := newLongTermKey(secret, s.config.sharedKeyCacheSize())
+	s.keys = append([]*longTermKey{k}, s.keys...)
+	s.keyMu.Lock()
+	s.publicKey = k.public
+	s.keyMu.Unlock()
+}
+
+// addRingKeys adds the keys of Config.KeyRing after the current one.
+func (s *server) addRingKeys() {
+	for _, rk := range s.config.keyRing() {
+		if len(rk.SecretKey) != 32 {
+			panic("Wrong key length")
+		}
+		var secret [32]byte
+		copy(secret[:], rk.SecretKey)
+		k := newLongTermKey(secret, s.config.sharedKeyCacheSize())
+		k.retired = rk.Until
+		s.keys = append(s.keys, k)
+	}
+}
+
+// addVirtualHosts adds the keys of Config.VirtualHosts.
+func (s *server) addVirtualHosts() {
+	for domain, key := range s.config.virtualHosts() {
+		if len(key) != 32 {
+			panic("Wrong key length")
+		}
+		var secret [32]byte
+		copy(secret[:], key)
+		k := newLongTermKey(secret, s.config.sharedKeyCacheSize())
+		k.domain = domain
+		s.keys = append(s.keys, k)
+	}
+}
+
+// servesDomain reports whether clients that vouched under k may
+// request domain: a virtual host's key only serves its own domain,
+// and the server's other keys every domain but those.
+func (s *server) servesDomain(k *longTermKey, domain string) bool {
+	domain, _ = SplitProtocolDomain(domain)
+	if k.domain != "" {
+		return strings.EqualFold(k.domain, domain)
+	}
+	for _, other := range s.keys {
+		if other.domain != "" && strings.EqualFold(other.domain, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// rotateKeys drops the keys past their time, and picks up a new key
+// from Config.KeyProvider. Clients that got a Cookie just before may
+// still send Initiates vouched under the old key, which is accepted
+// for as long as Cookies are good, two minute key rotations.
+func (s *server) rotateKeys(now time.Time) {
+	live := s.keys[:0]
+	for i, k := range s.keys {
+		if i == 0 || k.retired.IsZero() || now.Before(k.retired) {
+			live = append(live, k)
+		}
+	}
+	for i := len(live); i < len(s.keys); i++ {
+		s.keys[i] = nil
+	}
+	s.keys = live
+
+	kp := s.config.keyProvider()
+	if kp == nil {
+		return
+	}
+	if secret := kp.SecretKey(); secret != s.keys[0].secret {
+		s.keys[0].retired = now.Add(2 * s.config.minuteKeyInterval())
+		s.keys[0].initiatesOnly = true
+		s.setKey(secret)
+	}
+}
@@ -0,0 +1,208 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestKeyProvider(t *testing.T) {
+	pub1, priv1, _ := box.GenerateKey(rand.Reader)
+	pub2, priv2, _ := box.GenerateKey(rand.Reader)
+	key := NewSwappableKey(priv1[:])
+	l, err := ListenWithConfig("127.0.0.1:0", nil, &Config{KeyProvider: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr := l.Addr().(*Addr).UDP.String()
+
+	old, err := Dial(addr, pub1[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Abort()
+	testTransfer(t, old, old, 1000)
+
+	key.Set(priv2[:])
+	c, err := Dial(addr, pub2[:])
+	if err != nil {
+		t.Fatalf("Dial with the new key: %v", err)
+	}
+	defer c.Abort()
+	testTransfer(t, c, c, 1000)
+	if !bytes.Equal(l.PublicKey(), pub2[:]) {
+		t.Errorf("listener's public key not rotated")
+	}
+	if _, err := DialTimeout(addr, pub1[:], 300*time.Millisecond); err == nil {
+		t.Errorf("Dial with the old key succeeded")
+	}
+
+	// The connection established under the old key carries on.
+	testTransfer(t, old, old, 1000)
+}
+
+func TestRotateKeysRetires(t *testing.T) {
+	_, priv1, _ := box.GenerateKey(rand.Reader)
+	_, priv2, _ := box.GenerateKey(rand.Reader)
+	key := NewSwappableKey(priv1[:])
+	s := &server{config: &Config{KeyProvider: key, MinuteKeyInterval: time.Minute}}
+	s.setKey(*priv1)
+	now := time.Now()
+
+	s.rotateKeys(now)
+	if len(s.keys) != 1 {
+		t.Fatalf("%d keys without a rotation", len(s.keys))
+	}
+	key.Set(priv2[:])
+	s.rotateKeys(now)
+	if len(s.keys) != 2 || s.keys[0].secret != *priv2 || s.keys[1].secret != *priv1 {
+		t.Fatalf("keys not rotated")
+	}
+	s.rotateKeys(now.Add(time.Minute))
+	if len(s.keys) != 2 {
+		t.Errorf("old key retired while Cookies are still good")
+	}
+	s.rotateKeys(now.Add(3 * time.Minute))
+	if len(s.keys) != 1 || s.keys[0].secret != *priv2 {
+		t.Errorf("old key not retired")
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	oldPub, oldPriv, _ := box.GenerateKey(rand.Reader)
+	expiredPub, expiredPriv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{KeyRing: []RingKey{
+		{SecretKey: oldPriv[:]},
+		{SecretKey: expiredPriv[:], Until: time.Now().Add(-time.Second)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr := l.Addr().(*Addr).UDP.String()
+	if !bytes.Equal(l.PublicKey(), pub[:]) {
+		t.Errorf("listener advertises another key than its own")
+	}
+
+	for _, key := range [][]byte{pub[:], oldPub[:]} {
+		c, err := Dial(addr, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Abort()
+		testTransfer(t, c, c, 1000)
+		if state := c.ConnectionState(); !bytes.Equal(state.PeerKey, key) {
+			t.Errorf("connected to %x, want %x", state.PeerKey, key)
+		}
+	}
+	if _, err := DialTimeout(addr, expiredPub[:], 300*time.Millisecond); err == nil {
+		t.Errorf("Dial with an expired key succeeded")
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	aPub, aPriv, _ := box.GenerateKey(rand.Reader)
+	bPub, bPriv, _ := box.GenerateKey(rand.Reader)
+	l, err := ListenWithConfig("127.0.0.1:0", priv[:], &Config{VirtualHosts: map[string][]byte{
+		"a.example": aPriv[:],
+		"b.example": bPriv[:],
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	domains := make(chan string, 3)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			domains <- c.(*Conn).Domain()
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	addr := l.Addr().(*Addr).UDP.String()
+
+	for _, tc := range []struct {
+		domain string
+		key    []byte
+	}{
+		{"a.example", aPub[:]},
+		{"B.example", bPub[:]},
+		{"other.example", pub[:]},
+	} {
+		d := Dialer{Domain: tc.domain}
+		c, err := d.Dial(addr, tc.key)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", tc.domain, err)
+		}
+		defer c.Abort()
+		testTransfer(t, c, c, 1000)
+		if got := <-domains; got != tc.domain {
+			t.Errorf("accepted a connection for %q, want %q", got, tc.domain)
+		}
+	}
+
+	for _, tc := range []struct {
+		domain string
+		key    []byte
+	}{
+		{"a.example", bPub[:]},
+		{"b.example", pub[:]},
+		{"other.example", aPub[:]},
+	} {
+		// The Cookie comes back, as Hellos don't carry the domain,
+		// but the Initiate is dropped.
+		d := Dialer{Domain: tc.domain}
+		c, err := d.Dial(addr, tc.key)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", tc.domain, err)
+		}
+		defer c.Abort()
+		c.SetDeadline(time.Now().Add(300 * time.Millisecond))
+		c.Write([]byte("x"))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s answered under another host's key", tc.domain)
+		}
+	}
+	select {
+	case domain := <-domains:
+		t.Errorf("accepted a connection for %q under another host's key", domain)
+	default:
+	}
+}
@@ -0,0 +1,280 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// How long the network must be quiet, no packets sent or waiting
+	// to be read, before a simulation moves the clock on.
+	simSettle = 200 * time.Microsecond
+	// How far a simulation moves the clock when no timer is set.
+	simMaxStep = time.Second
+	// How long packets take to cross a simulated network.
+	simLatency = 20 * time.Millisecond
+)
+
+// simulation runs a server and its clients over a memNet on a fake
+// clock, jumping from one timer to the next instead of waiting for
+// them, so that hours of traffic take seconds. Packets take
+// simLatency to arrive, and their loss is drawn from a seeded source.
+type simulation struct {
+	t      *testing.T
+	clock  *fakeClock
+	net    *memNet
+	config *Config
+	server Listener
+	key    []byte
+	secret []byte
+	// The server's socket.
+	ssock *memSock
+	socks int
+	// While set, the server's Message packets are lost, but it still
+	// answers Hellos: its conns look stalled.
+	stalled atomic.Bool
+}
+
+// simSock is a memSock whose packets take simLatency to arrive, minus
+// those drop, if not nil, returns true for.
+type simSock struct {
+	*memSock
+	clock *fakeClock
+	drop  func(b []byte) bool
+}
+
+func (s simSock) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if s.drop != nil && s.drop(b) {
+		return len(b), nil
+	}
+	pkt := append([]byte(nil), b...)
+	s.clock.afterFunc(simLatency, func() { s.memSock.WriteTo(pkt, addr) })
+	return len(b), nil
+}
+
+// newSimulation starts an echo server on a new simulated network,
+// with config's clock replaced by the simulation's.
+func newSimulation(t *testing.T, config Config, loss float64, seed int64) *simulation {
+	sim := &simulation{
+		t:     t,
+		clock: newFakeClock(),
+		net:   &memNet{socks: make(map[memAddr]*memSock)},
+	}
+	config.Clock = sim.clock
+	sim.config = &config
+	rng := mrand.New(mrand.NewSource(seed))
+	sim.net.setDrop(func() bool { return rng.Float64() < loss })
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	sim.key, sim.secret = pub[:], priv[:]
+	sim.startServer()
+	return sim
+}
+
+// startServer starts the echo server, with a socket of its own at the
+// server's address.
+func (sim *simulation) startServer() {
+	ssock := sim.net.listen("server")
+	stalled := func(b []byte) bool {
+		return sim.stalled.Load() && bytes.Equal(b[:8], serverMessageMagic)
+	}
+	server := newServer(simSock{ssock, sim.clock, stalled}, false, sim.secret, sim.config)
+	sim.ssock, sim.server = ssock, server
+	sim.t.Cleanup(func() {
+		ssock.Close()
+		server.Close()
+	})
+	go echoAll(server)
+}
+
+// dial connects a new client to the server, over a socket of its own.
+func (sim *simulation) dial() (*Conn, error) {
+	sim.socks++
+	csock := sim.net.listen(memAddr("client" + string(rune('0'+sim.socks))))
+	sim.t.Cleanup(func() { csock.Close() })
+	d := Dialer{Config: sim.config}
+	return d.DialPacketConn(simSock{csock, sim.clock, nil}, sim.ssock.LocalAddr(), sim.key)
+}
+
+// run runs f against the simulation, moving the clock on until f
+// returns, and fails the test if that takes longer than limit on the
+// clock. It returns how long f took on the clock.
+func (sim *simulation) run(limit time.Duration, f func()) time.Duration {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	start := sim.clock.Now()
+	lastSent := -1
+	for {
+		select {
+		case <-done:
+			return sim.clock.Now().Sub(start)
+		case <-time.After(simSettle):
+		}
+		sent, queued := sim.net.activity()
+		if sent != lastSent || queued {
+			// Let the goroutines finish what they're doing.
+			lastSent = sent
+			continue
+		}
+		now := sim.clock.Now()
+		if now.Sub(start) > limit {
+			sim.t.Fatalf("simulation still running after %s", limit)
+		}
+		next, ok := sim.clock.next()
+		if !ok || next.Sub(now) > simMaxStep {
+			next = now.Add(simMaxStep)
+		}
+		sim.clock.Advance(next.Sub(now))
+	}
+}
+
+func TestSimLossyTransfer(t *testing.T) {
+	sim := newSimulation(t, Config{}, 0.1, 1)
+	elapsed := sim.run(10*time.Minute, func() {
+		c, err := sim.dial()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Abort()
+		testTransfer(t, c, c, 256*1024)
+	})
+	t.Logf("transfer took %s of simulated time", elapsed)
+}
+
+func TestSimIdleHour(t *testing.T) {
+	sim := newSimulation(t, Config{IdleTimeout: 2 * time.Minute}, 0.02, 2)
+	var c *Conn
+	sim.run(time.Minute, func() {
+		var err error
+		if c, err = sim.dial(); err != nil {
+			t.Error(err)
+			return
+		}
+		testTransfer(t, c, c, 1000)
+	})
+	if c == nil {
+		return
+	}
+	defer c.Abort()
+
+	// Keepalives hold the connection open through an hour of
+	// silence, despite the idle timeout and lost packets.
+	sim.run(2*time.Hour, func() {
+		for start := sim.clock.Now(); sim.clock.Now().Sub(start) < time.Hour; {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	sim.run(time.Minute, func() {
+		testTransfer(t, c, c, 1000)
+	})
+}
+
+func TestSimRehandshake(t *testing.T) {
+	sim := newSimulation(t, Config{}, 0, 3)
+	var c *Conn
+	sim.run(time.Minute, func() {
+		var err error
+		if c, err = sim.dial(); err != nil {
+			t.Error(err)
+			return
+		}
+		testTransfer(t, c, c, 1000)
+	})
+	if c == nil {
+		return
+	}
+	defer c.Abort()
+	key := c.ConnectionState().LocalShortTermKey
+
+	// The server restarts while the connection is idle. Its
+	// keepalives go unanswered, until it handshakes again.
+	sim.ssock.Close()
+	sim.startServer()
+	sim.run(5*time.Minute, func() {
+		for start := sim.clock.Now(); sim.clock.Now().Sub(start) < 2*time.Minute; {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	sim.run(time.Minute, func() {
+		testTransfer(t, c, c, 1000)
+	})
+	if c.ConnectionState().LocalShortTermKey == key {
+		t.Errorf("no new session after the server restarted")
+	}
+}
+
+func TestSimStalledServer(t *testing.T) {
+	sim := newSimulation(t, Config{}, 0, 5)
+	var c *Conn
+	sim.run(time.Minute, func() {
+		var err error
+		if c, err = sim.dial(); err != nil {
+			t.Error(err)
+			return
+		}
+		testTransfer(t, c, c, 1000)
+	})
+	if c == nil {
+		return
+	}
+	defer c.Abort()
+
+	// The server stops answering for a while with data in flight,
+	// long enough for the client to probe it, but still answers
+	// Hellos. The connection carries on once it's back.
+	sim.stalled.Store(true)
+	sim.run(time.Minute, func() {
+		c.Write([]byte("hello"))
+		for start := sim.clock.Now(); sim.clock.Now().Sub(start) < 800*time.Millisecond; {
+			time.Sleep(time.Millisecond)
+		}
+		sim.stalled.Store(false)
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+			t.Errorf("Read after the server stalled = %q, %v, want %q", b, err, "hello")
+		}
+	})
+}
+
+func TestSimPeerDead(t *testing.T) {
+	sim := newSimulation(t, Config{DeadPeerThreshold: 2, RehandshakeThreshold: -1}, 0, 4)
+	var c *Conn
+	sim.run(time.Minute, func() {
+		var err error
+		if c, err = sim.dial(); err != nil {
+			t.Error(err)
+			return
+		}
+		testTransfer(t, c, c, 1000)
+	})
+	if c == nil {
+		return
+	}
+	defer c.Abort()
+
+	// The network goes down. Retransmission timeouts are a fraction
+	// of a second, but the server isn't given up on before a second
+	// of silence, give or take the last packet still on its way.
+	sim.net.setDrop(func() bool { return true })
+	elapsed := sim.run(time.Minute, func() {
+		c.Write([]byte("hello"))
+		if _, err := c.Read(make([]byte, 5)); err != ErrPeerDead {
+			t.Errorf("Read with the network down = %v, want ErrPeerDead", err)
+		}
+	})
+	if elapsed < deadPeerMinSilence-simLatency {
+		t.Errorf("peer considered dead after %s of silence, want at least %s", elapsed, deadPeerMinSilence)
+	}
+}
@@ -0,0 +1,70 @@
+package curvecp
+
+import "time"
+
+// Stats is a snapshot of a connection's measurements and counters,
+// see Stats.
+type Stats struct {
+	// Smoothed round trip time and its mean deviation, 0 before the
+	// first sample.
+	RTT, RTTVar time.Duration
+	// Current time between data packets, as paced by the congestion
+	// controller within the configured bounds.
+	PacingInterval time.Duration
+	// Current retransmission timeout, before backoff.
+	RTO time.Duration
+	// Every RTT sample over the life of the connection, for tail
+	// latencies.
+	RTTHistogram RTTHistogram
+
+	// Data packets sent, including retransmissions, and how many of
+	// them were retransmissions.
+	BlocksSent, Retransmissions int
+	// Moving average of the fraction of data transmissions that are
+	// retransmissions, as watched by latency alarms.
+	RetransmitRate float64
+	// Bytes sent and not yet acknowledged, and bytes written but
+	// not yet sent.
+	BytesInFlight, BytesQueued int
+
+	// Authenticated packets dropped as replays, packets dropped as
+	// malformed, and packets dropped for coming from the wrong
+	// address, see Config.PinSourceAddress.
+	Replays, Malformed, PinViolations int
+}
+
+// Stats returns the connection's current statistics. Once the
+// connection is closed, they stay as they were at the end.
+func (c *Conn) Stats() Stats {
+	select {
+	case c.statsRequest <- struct{}{}:
+		return <-c.statsResult
+	case <-c.done:
+		return c.finalStats
+	}
+}
+
+// stats makes a Stats, from the pump.
+func (c *Conn) stats() Stats {
+	st := Stats{
+		RTT:             c.sched.RTT(),
+		RTTVar:          c.sched.RTTVar(),
+		PacingInterval:  c.nextSendTime(time.Time{}).Sub(time.Time{}),
+		RTO:             c.sched.RTO(),
+		RTTHistogram:    c.rttHistogram,
+		BlocksSent:      c.blocksSent,
+		Retransmissions: c.retransmissions,
+		RetransmitRate:  c.retransmitRate,
+		Replays:         c.replays,
+		Malformed:       c.malformed,
+		PinViolations:   c.pinViolations,
+	}
+	for e := c.toSend.Front(); e != nil; e = e.Next() {
+		if blk := e.Value.(*block); blk.transmissions > 0 {
+			st.BytesInFlight += len(blk.buf)
+		} else {
+			st.BytesQueued += len(blk.buf)
+		}
+	}
+	return st
+}
@@ -0,0 +1,48 @@
+package curvecp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsBytes(t *testing.T) {
+	server, _ := newConnPair(t, nil)
+	server.write(make([]byte, 3*1024))
+	for e := server.toSend.Front(); e != nil; e = e.Next() {
+		e.Value.(*block).transmissions = 1
+	}
+	server.write(make([]byte, 1500))
+	if st := server.stats(); st.BytesInFlight != 3*1024 || st.BytesQueued != 1500 {
+		t.Errorf("%d bytes in flight and %d queued, want %d and 1500", st.BytesInFlight, st.BytesQueued, 3*1024)
+	}
+}
+
+func TestStats(t *testing.T) {
+	server, client := newConnPair(t, nil)
+	startConnPair(server, client)
+
+	testTransfer(t, client, server, 20*1024)
+	st := client.Stats()
+	if st.RTT <= 0 || st.RTO <= 0 || st.PacingInterval <= 0 {
+		t.Errorf("RTT %s, RTO %s, pacing interval %s, want all positive", st.RTT, st.RTO, st.PacingInterval)
+	}
+	if h := &st.RTTHistogram; h.Count() == 0 || h.Quantile(0.5) < h.Min() || h.Quantile(0.5) > h.Max() {
+		t.Errorf("RTT histogram has %d samples, median %s, min %s, max %s", h.Count(), h.Quantile(0.5), h.Min(), h.Max())
+	}
+	if st.BlocksSent < 20 || st.BlocksSent < st.Retransmissions {
+		t.Errorf("%d blocks sent, %d retransmissions, want at least 20 and fewer", st.BlocksSent, st.Retransmissions)
+	}
+
+	go server.Close()
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't exit")
+	}
+	if st := client.Stats(); st.BytesInFlight != 0 || st.BytesQueued != 0 || st.BlocksSent < 20 {
+		t.Errorf("after Close, stats are %+v, want nothing in flight or queued", st)
+	}
+}
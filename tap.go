@@ -0,0 +1,57 @@
+package curvecp
+
+import (
+	"net"
+)
+
+// TapMessage describes one message, as seen by a Tap.
+type TapMessage struct {
+	// True if the message was sent by this end of the connection,
+	// false if it was received.
+	Outgoing bool
+	// The message's ID, and the ID of the message it acknowledges
+	// (0 if none).
+	ID, AckID uint32
+	// Number of bytes of the opposite stream acknowledged, starting
+	// from the beginning of the stream.
+	Acked int64
+	// Stream position and plaintext of the carried data. Data is
+	// only valid for the duration of the Tap call.
+	Pos  int64
+	Data []byte
+	// True if the message ends the stream, and if so whether it
+	// ends it in failure.
+	EOF, Failed bool
+}
+
+// Tap receives copies of the decrypted traffic of connections, to
+// help debug application protocols running over CurveCP. See
+// Config.InsecureTap.
+type Tap interface {
+	// Message is called for every message sent or received on
+	// c. It's called synchronously from the connection's internals,
+	// so it must return quickly and must not call back into c.
+	Message(c net.Conn, m *TapMessage)
+}
+
+// tap reports m to the configured Tap, if any.
+func (c *Conn) tap(outgoing bool, m *message) {
+	t := c.config.insecureTap()
+	if t == nil {
+		return
+	}
+	t.Message(c, newTapMessage(outgoing, m))
+}
+
+func newTapMessage(outgoing bool, m *message) *TapMessage {
+	return &TapMessage{
+		Outgoing: outgoing,
+		ID:       m.id,
+		AckID:    m.ackID,
+		Acked:    m.acks[0].end,
+		Pos:      m.pos,
+		Data:     m.data,
+		EOF:      m.eof != 0,
+		Failed:   m.eof == eofFailure,
+	}
+}
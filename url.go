@@ -0,0 +1,78 @@
+package curvecp
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/johnwchadwick/curvecp/handshake"
+)
+
+// A URL names a CurveCP server and the domain to request from it, in
+// the form curvecp://<key>@<host>:<port>/<domain>, with the key in
+// DJB's base32 as in Addr.String. The key may be left out if the host
+// name embeds it, see KeyFromHostname, and the domain defaults to the
+// host.
+type URL struct {
+	Key []byte
+	// Host is a host name or IP address, and a port.
+	Host string
+	// Domain is the domain name to request, or empty.
+	Domain string
+}
+
+var errBadURL = errors.New("not a curvecp:// URL")
+
+// ParseURL parses a curvecp:// URL.
+func ParseURL(rawurl string) (*URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "curvecp" || u.Opaque != "" || u.Port() == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, &url.Error{Op: "parse", URL: rawurl, Err: errBadURL}
+	}
+	ret := &URL{
+		Host:   u.Host,
+		Domain: strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return nil, &url.Error{Op: "parse", URL: rawurl, Err: errBadURL}
+		}
+		if ret.Key = decodeKey(strings.ToLower(u.User.Username())); ret.Key == nil {
+			return nil, &url.Error{Op: "parse", URL: rawurl, Err: errors.New("invalid server key")}
+		}
+	} else if ret.Key, err = KeyFromHostname(u.Hostname()); err != nil {
+		return nil, &url.Error{Op: "parse", URL: rawurl, Err: err}
+	}
+	if ret.Domain != "" && handshake.EncodeDomain(ret.Domain) == nil {
+		return nil, &url.Error{Op: "parse", URL: rawurl, Err: errInvalidDomain}
+	}
+	return ret, nil
+}
+
+func (u *URL) String() string {
+	s := "curvecp://" + encodeKey(u.Key) + "@" + u.Host
+	if u.Domain != "" {
+		s += "/" + u.Domain
+	}
+	return s
+}
+
+// DialURL connects to the server named by a curvecp:// URL.
+func DialURL(rawurl string) (*Conn, error) {
+	var d Dialer
+	return d.DialURL(rawurl)
+}
+
+// DialURL connects to the server named by a curvecp:// URL. The URL's
+// domain, if any, takes precedence over the Dialer's.
+func (d *Dialer) DialURL(rawurl string) (*Conn, error) {
+	u, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return d.dial(context.Background(), u.Host, u.Domain, u.Key, d.Key)
+}
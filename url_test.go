@@ -0,0 +1,66 @@
+package curvecp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestParseURL(t *testing.T) {
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	pub[31] &= 0x7f
+	enc := encodeKey(pub[:])
+	for _, tc := range []struct {
+		in           string
+		host, domain string
+	}{
+		{"curvecp://" + enc + "@example.com:1234/_echo.example.com", "example.com:1234", "_echo.example.com"},
+		{"curvecp://" + enc + "@192.0.2.1:1234", "192.0.2.1:1234", ""},
+		{"curvecp://" + enc + "@[2001:db8::1]:1234/", "[2001:db8::1]:1234", ""},
+		{"curvecp://uz5" + enc + ".example.com:1234/example.com", "uz5" + enc + ".example.com:1234", "example.com"},
+	} {
+		u, err := ParseURL(tc.in)
+		if err != nil {
+			t.Errorf("ParseURL(%q): %s", tc.in, err)
+			continue
+		}
+		if !bytes.Equal(u.Key, pub[:]) || u.Host != tc.host || u.Domain != tc.domain {
+			t.Errorf("ParseURL(%q) = %x %q %q, want %x %q %q", tc.in, u.Key, u.Host, u.Domain, pub[:], tc.host, tc.domain)
+		}
+		if u2, err := ParseURL(u.String()); err != nil || u2.String() != u.String() {
+			t.Errorf("URL %q doesn't round-trip: %v", u, err)
+		}
+	}
+	for _, in := range []string{
+		"http://" + enc + "@example.com:1234",
+		"curvecp://" + enc + "@example.com",
+		"curvecp://" + enc[1:] + "@example.com:1234",
+		"curvecp://" + enc + ":secret@example.com:1234",
+		"curvecp://example.com:1234",
+		"curvecp://" + enc + "@example.com:1234/a..b",
+		"curvecp://" + enc + "@example.com:1234/?q",
+	} {
+		if _, err := ParseURL(in); err == nil {
+			t.Errorf("ParseURL(%q) accepted an invalid URL", in)
+		}
+	}
+}
+
+func TestDialURL(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	if pub[31]&0x80 != 0 {
+		t.Skip("public key too large for a URL")
+	}
+	l := serveEcho(t, "127.0.0.1:0", priv[:], nil)
+	u := &URL{Key: pub[:], Host: l.Addr().(*Addr).UDP.String(), Domain: "_echo.example.com"}
+	c, err := DialURL(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransfer(t, c, c, 5000)
+	if got := c.domain; got != "_echo.example.com" {
+		t.Errorf("connection requested domain %q, want the URL's", got)
+	}
+}